@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sessionCookieName = "sfu_session"
+	sessionLifetime   = 7 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,32}$`)
+
+// Optional account database, publishing and admin pages are open when nil
+var accountsDB *sql.DB
+
+var accountLog = newLogger("accounts")
+
+const accountsSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	username      TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	admin         INTEGER NOT NULL DEFAULT 0,
+	created       INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	token   TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS streams (
+	name     TEXT PRIMARY KEY,
+	owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id               TEXT PRIMARY KEY,
+	user_id          INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name             TEXT NOT NULL,
+	hash             TEXT NOT NULL UNIQUE,
+	scopes           TEXT NOT NULL,
+	created          INTEGER NOT NULL,
+	last_used        INTEGER,
+	expires          INTEGER,
+	previous_hash    TEXT,
+	previous_expires INTEGER
+);
+CREATE INDEX IF NOT EXISTS api_tokens_previous_hash ON api_tokens (previous_hash);
+CREATE TABLE IF NOT EXISTS oidc_identities (
+	issuer  TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created INTEGER NOT NULL,
+	PRIMARY KEY (issuer, subject)
+);
+`
+
+// Registered user
+type account struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"`
+
+	// Scopes of the API token the request came with, nil for a session
+	scopes []string
+}
+
+func openAccounts(path string) {
+	if path == "" {
+		return
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		fatalf("Failed to open accounts database: %v", err)
+	}
+	if _, err := db.Exec(accountsSchema); err != nil {
+		fatalf("Failed to create accounts schema: %v", err)
+	}
+	accountsDB = db
+	accountLog.infof("Accounts database loaded: %s", path)
+}
+
+// Create a user, the first one registered becomes an admin
+func registerAccount(username, password string) (*account, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, newSignalingError(http.StatusBadRequest, "Invalid username")
+	}
+	if len(password) < minPasswordLength {
+		return nil, newSignalingError(http.StatusBadRequest, "Password too short")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	// Counted in the same statement, so of two users registering at once
+	// only one becomes admin
+	a := &account{Username: username}
+	err = accountsDB.QueryRow(`INSERT INTO users (username, password_hash, admin, created)
+		SELECT ?, ?, (SELECT COUNT(*) FROM users) = 0, ? RETURNING id, admin`,
+		username, string(hash), time.Now().Unix()).Scan(&a.ID, &a.Admin)
+	if err != nil {
+		return nil, newSignalingError(http.StatusConflict, "Username already taken")
+	}
+	return a, nil
+}
+
+func authenticate(username, password string) (*account, error) {
+	a := &account{}
+	var hash string
+	err := accountsDB.QueryRow(`SELECT id, username, admin, password_hash FROM users WHERE username = ?`, username).
+		Scan(&a.ID, &a.Username, &a.Admin, &hash)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	if err != nil {
+		return nil, newSignalingError(http.StatusUnauthorized, "Invalid username or password")
+	}
+	return a, nil
+}
+
+// Start a session for the user and set its cookie
+func startSession(w http.ResponseWriter, r *http.Request, a *account) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(sessionLifetime)
+
+	if _, err := accountsDB.Exec(`INSERT INTO sessions (token, user_id, expires) VALUES (?, ?, ?)`, token, a.ID, expires.Unix()); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		accountsDB.Exec(`DELETE FROM sessions WHERE token = ?`, c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+}
+
+// User of the request's API token or session cookie, nil when not logged in
+func currentAccount(r *http.Request) *account {
+	if accountsDB == nil {
+		return nil
+	}
+	// Other bearer tokens are publish JWTs, see publishToken
+	if token, ok := bearerToken(r); ok && strings.HasPrefix(token, apiTokenPrefix) {
+		return tokenAccount(token)
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	a := &account{}
+	err = accountsDB.QueryRow(`SELECT u.id, u.username, u.admin FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token = ? AND s.expires > ?`, c.Value, time.Now().Unix()).Scan(&a.ID, &a.Username, &a.Admin)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// Whether the user has admin rights, everybody has while accounts are disabled
+func isAdmin(a *account) bool {
+	return accountsDB == nil || a != nil && a.Admin
+}
+
+// Wrap a handler so it requires a logged in user, or an admin. Everything is
+// allowed while accounts are disabled.
+func requireAccount(admin bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if accountsDB != nil {
+			a := currentAccount(r)
+			if a == nil {
+				http.Error(w, "Login required", http.StatusUnauthorized)
+				return
+			}
+			if admin && !a.Admin {
+				http.Error(w, "Admin access required", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// Handler for registration, login, logout and the current user
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	if accountsDB == nil {
+		http.Error(w, "Accounts are disabled", http.StatusNotFound)
+		return
+	}
+
+	var a *account
+	switch r.URL.Path {
+	case "/api/account":
+		if a = currentAccount(r); a == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+	case "/api/account/register", "/api/account/login":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if r.URL.Path == "/api/account/register" {
+			a, err = registerAccount(req.Username, req.Password)
+		} else {
+			a, err = authenticate(req.Username, req.Password)
+		}
+		if err == nil {
+			err = startSession(w, r, a)
+		}
+		if err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		accountLog.infof("User %s logged in.", a.Username)
+
+	case "/api/account/logout":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		endSession(w, r)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Viewer joins admitted per second and stream, 0 admits everyone at once
+var viewerJoinRate = 50.0
+
+// Joins admitted at once before the rate applies
+var viewerJoinBurst = 50
+
+// Longest a viewer waits for admission, and most viewers waiting per stream
+const (
+	maxAdmissionWait  = 10 * time.Second
+	maxAdmissionQueue = 1000
+)
+
+var admissionLog = newLogger("admission")
+
+var (
+	admissionBuckets   = make(map[string]*admissionBucket)
+	admissionBucketsMu sync.Mutex
+
+	admissionsRejected atomic.Uint64
+)
+
+// Token bucket of a stream's viewer joins. Tokens go negative while viewers
+// wait, each one reserving the next free slot, so the queue is served in
+// order.
+type admissionBucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+func getAdmissionBucket(stream string) *admissionBucket {
+	admissionBucketsMu.Lock()
+	defer admissionBucketsMu.Unlock()
+
+	b, ok := admissionBuckets[stream]
+	if !ok {
+		// Forget streams whose buckets refilled, they admit right away anyway
+		for name, idle := range admissionBuckets {
+			if idle.idle() {
+				delete(admissionBuckets, name)
+			}
+		}
+		b = &admissionBucket{tokens: float64(viewerJoinBurst), last: time.Now()}
+		admissionBuckets[stream] = b
+	}
+	return b
+}
+
+// Must be called with the bucket's mutex held
+func (b *admissionBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * viewerJoinRate
+	if b.tokens > float64(viewerJoinBurst) {
+		b.tokens = float64(viewerJoinBurst)
+	}
+	b.last = now
+}
+
+func (b *admissionBucket) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.waiting == 0 && b.tokens >= float64(viewerJoinBurst)
+}
+
+// Wait until a viewer of the stream may join. Joins beyond the rate are
+// queued so a stream going live does not get all its viewers, and their
+// keyframe requests, at once.
+func admitViewer(ctx context.Context, stream string) error {
+	if viewerJoinRate <= 0 {
+		return nil
+	}
+
+	b := getAdmissionBucket(stream)
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	wait := time.Duration(-b.tokens / viewerJoinRate * float64(time.Second))
+	if wait > maxAdmissionWait || b.waiting >= maxAdmissionQueue {
+		b.tokens++
+		b.mu.Unlock()
+		admissionsRejected.Add(1)
+		admissionLog.withStream(stream).warnf("Viewer rejected, %d already waiting.", b.waiting)
+		return newSignalingError(http.StatusServiceUnavailable, "Too many viewers joining, try again later")
+	}
+	b.waiting++
+	b.mu.Unlock()
+	admissionLog.withStream(stream).debugf("Viewer queued for %v.", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	b.waiting--
+	if err != nil {
+		// Hand the reserved slot back to the viewers behind
+		b.tokens++
+	}
+	b.mu.Unlock()
+	return err
+}
+
+// Viewers currently waiting for admission on all streams
+func queuedViewers() int {
+	admissionBucketsMu.Lock()
+	defer admissionBucketsMu.Unlock()
+
+	queued := 0
+	for _, b := range admissionBuckets {
+		b.mu.Lock()
+		queued += b.waiting
+		b.mu.Unlock()
+	}
+	return queued
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers used by RTMP commands
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// An AMF0 object or ECMA array, encoded with its keys sorted
+type amfMap map[string]interface{}
+
+// Decode all AMF0 values of an RTMP command or data message. Numbers become
+// float64, objects and ECMA arrays amfMap, null and undefined nil.
+func amfDecode(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := amfDecodeValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func amfDecodeValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amfNumber:
+		var n float64
+		err := binary.Read(r, binary.BigEndian, &n)
+		return n, err
+	case amfBoolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amfString:
+		return amfDecodeString(r, 2)
+	case amfLongString:
+		return amfDecodeString(r, 4)
+	case amfObject:
+		return amfDecodeObject(r)
+	case amfECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return amfDecodeObject(r)
+	case amfStrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0, min(n, 1024))
+		for range n {
+			v, err := amfDecodeValue(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case amfDate:
+		var ms float64
+		if err := binary.Read(r, binary.BigEndian, &ms); err != nil {
+			return nil, err
+		}
+		_, err := r.Seek(2, io.SeekCurrent)
+		return ms, err
+	case amfNull, amfUndefined:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported AMF0 type 0x%02x", marker)
+}
+
+func amfDecodeString(r *bytes.Reader, lengthSize int) (string, error) {
+	var n uint32
+	if lengthSize == 2 {
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return "", err
+		}
+		n = uint32(n16)
+	} else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+func amfDecodeObject(r *bytes.Reader) (amfMap, error) {
+	obj := amfMap{}
+	for {
+		key, err := amfDecodeString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker != amfObjectEnd {
+				return nil, errors.New("AMF0 object with an empty key")
+			}
+			return obj, nil
+		}
+		v, err := amfDecodeValue(r)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+}
+
+// Encode values as AMF0: float64 and int, bool, string, amfMap and nil
+func amfEncode(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		amfEncodeValue(&b, v)
+	}
+	return b.Bytes()
+}
+
+func amfEncodeValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(amfNumber)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		amfEncodeValue(b, float64(v))
+	case bool:
+		b.WriteByte(amfBoolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		b.WriteByte(amfString)
+		amfEncodeKey(b, v)
+	case amfMap:
+		b.WriteByte(amfObject)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			amfEncodeKey(b, k)
+			amfEncodeValue(b, v[k])
+		}
+		b.Write([]byte{0, 0, amfObjectEnd})
+	default:
+		b.WriteByte(amfNull)
+	}
+}
+
+func amfEncodeKey(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
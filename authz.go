@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// What a user wants to do with a stream
+type streamAction int
+
+const (
+	// Publish media, claims unowned streams
+	actionPublish streamAction = iota
+	// Change metadata, tokens, recordings and restream targets
+	actionManage
+	// Watch a private stream
+	actionView
+)
+
+// API token scope needed for an action
+func (a streamAction) scope() string {
+	if a == actionView {
+		return scopeView
+	}
+	return scopePublish
+}
+
+var errStreamOwned = errors.New("stream is owned by another user")
+
+// Central authorization check for stream operations: only the owner of a
+// stream, or an admin, may publish to or manage it. Everything is allowed
+// while accounts are disabled.
+func authorizeStream(a *account, stream string, action streamAction) error {
+	if accountsDB == nil {
+		return nil
+	}
+	if a == nil {
+		return newSignalingError(http.StatusUnauthorized, "Login required")
+	}
+	if !a.hasScope(action.scope()) {
+		return newSignalingError(http.StatusForbidden, "Token lacks the "+action.scope()+" scope")
+	}
+
+	var err error
+	if action == actionPublish {
+		err = claimStream(stream, a)
+	} else {
+		err = checkStreamOwner(stream, a)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errStreamOwned):
+		return newSignalingError(http.StatusForbidden, "Stream is owned by another user")
+	case errors.Is(err, sql.ErrNoRows):
+		return newSignalingError(http.StatusNotFound, "Stream has no owner yet")
+	}
+	accountLog.errorf("Error checking owner of stream %q: %v", stream, err)
+	return newSignalingError(http.StatusInternalServerError, "Could not check stream owner")
+}
+
+// Check that the user may publish to the stream and claim the stream for
+// them on first use
+func authorizePublish(a *account, stream string) error {
+	return authorizeStream(a, stream, actionPublish)
+}
+
+// Check a publisher of the stream at every gate: its publish token, the
+// stream's keys and the user's claim on the stream. a is the logged in user,
+// if any, a valid key stands in for its creator otherwise. Returns the key
+// used, nil without one, and the account publishing.
+func authorizePublisher(token, key, stream string, a *account) (*streamKey, *account, error) {
+	if err := authorizePublishToken(token, stream); err != nil {
+		return nil, nil, err
+	}
+	k, owner, err := authorizeStreamKey(key, stream, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, owner, authorizePublish(owner, stream)
+}
+
+// Record the user as owner of an unclaimed stream
+func claimStream(stream string, a *account) error {
+	if _, err := accountsDB.Exec(`INSERT OR IGNORE INTO streams (name, owner_id, created) VALUES (?, ?, ?)`, stream, a.ID, time.Now().Unix()); err != nil {
+		return err
+	}
+	return checkStreamOwner(stream, a)
+}
+
+// Admins may act on any stream, everybody else only on their own
+func checkStreamOwner(stream string, a *account) error {
+	if a.Admin {
+		return nil
+	}
+	var owner int64
+	if err := accountsDB.QueryRow(`SELECT owner_id FROM streams WHERE name = ?`, stream).Scan(&owner); err != nil {
+		return err
+	}
+	if owner != a.ID {
+		return errStreamOwned
+	}
+	return nil
+}
+
+// Username of the owner of a stream, empty when unowned or accounts are disabled
+func streamOwner(stream string) string {
+	if accountsDB == nil {
+		return ""
+	}
+	var username string
+	accountsDB.QueryRow(`SELECT u.username FROM streams s JOIN users u ON u.id = s.owner_id WHERE s.name = ?`, stream).Scan(&username)
+	return username
+}
+
+// Wrap a management handler of the stream named in the {stream} path
+// segment so only its owner or an admin reaches it
+func requireStreamOwner(h func(w http.ResponseWriter, r *http.Request, stream string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := r.PathValue("stream")
+		if !streamNamePattern.MatchString(stream) {
+			http.Error(w, "Invalid stream name", http.StatusBadRequest)
+			return
+		}
+		if err := authorizeStream(currentAccount(r), stream, actionManage); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		h(w, r, stream)
+	}
+}
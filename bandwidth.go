@@ -0,0 +1,282 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How long a publisher's test media is measured by default and at most
+	defaultBandwidthTest = 5 * time.Second
+	maxBandwidthTest     = 15 * time.Second
+	// Test connections that don't deliver media for this long are closed
+	bandwidthTestTimeout = 30 * time.Second
+	// Share of the measured bitrate a recommendation leaves as headroom
+	bandwidthHeadroom = 0.8
+)
+
+var bandwidthLog = newLogger("bandwidth")
+
+// Encoding recommended to a publisher, highest first. MaxBitrate covers
+// video and audio.
+type bandwidthRecommendation struct {
+	Width      int `json:"width"`
+	Height     int `json:"height"`
+	Framerate  int `json:"framerate"`
+	MaxBitrate int `json:"maxBitrate"`
+}
+
+var bandwidthLadder = []bandwidthRecommendation{
+	{Width: 1920, Height: 1080, Framerate: 30, MaxBitrate: 4_500_000},
+	{Width: 1280, Height: 720, Framerate: 30, MaxBitrate: 2_500_000},
+	{Width: 960, Height: 540, Framerate: 30, MaxBitrate: 1_200_000},
+	{Width: 640, Height: 360, Framerate: 30, MaxBitrate: 700_000},
+	{Width: 426, Height: 240, Framerate: 15, MaxBitrate: 300_000},
+}
+
+// Outcome of a bandwidth test, sent to the publisher as
+// {"type":"bandwidth-result","result":{...}}
+type bandwidthResult struct {
+	// Seconds of media measured, from the first packet
+	Duration float64 `json:"duration"`
+	// Bits per second over the whole test, over its second half once the
+	// sender's bandwidth estimate ramped up, and in the best second
+	Bitrate          int `json:"bitrate"`
+	SustainedBitrate int `json:"sustainedBitrate"`
+	PeakBitrate      int `json:"peakBitrate"`
+	// Share of the packets lost, after retransmissions
+	Loss float64 `json:"loss"`
+
+	Recommendation bandwidthRecommendation `json:"recommendation"`
+	// Why the test measured nothing, the recommendation is then the lowest
+	Error string `json:"error,omitempty"`
+}
+
+// Length of the bandwidth test from the ?duration= of the request, e.g.
+// duration=5s
+func parseBandwidthTestDuration(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("duration")
+	if value == "" {
+		return defaultBandwidthTest, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 || d > maxBandwidthTest {
+		return 0, newSignalingError(http.StatusBadRequest, "duration must be a duration up to "+maxBandwidthTest.String())
+	}
+	return d, nil
+}
+
+// Packets received from one SSRC of a test, with the first and highest
+// sequence number extended past wraparounds
+type bandwidthStream struct {
+	received       int
+	first, highest uint32
+}
+
+func (s *bandwidthStream) observe(seq uint16) {
+	if s.received == 0 {
+		s.first, s.highest = uint32(seq), uint32(seq)
+	} else if delta := int16(seq - uint16(s.highest)); delta > 0 {
+		s.highest += uint32(delta)
+	}
+	s.received++
+}
+
+// Media received by a bandwidth test, in bytes per second of the test
+type bandwidthMeter struct {
+	mu      sync.Mutex
+	started time.Time
+	seconds []int
+	streams map[uint32]*bandwidthStream
+	done    bool
+}
+
+func (m *bandwidthMeter) observe(packet *rtp.Packet, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return
+	}
+	now := time.Now()
+	if m.started.IsZero() {
+		m.started = now
+	}
+	second := int(now.Sub(m.started) / time.Second)
+	for len(m.seconds) <= second {
+		m.seconds = append(m.seconds, 0)
+	}
+	m.seconds[second] += size
+
+	s, ok := m.streams[packet.SSRC]
+	if !ok {
+		s = &bandwidthStream{}
+		m.streams[packet.SSRC] = s
+	}
+	s.observe(packet.SequenceNumber)
+}
+
+// Stop measuring and sum up what arrived by the end of the test
+func (m *bandwidthMeter) result(end time.Time) bandwidthResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done = true
+
+	res := bandwidthResult{Recommendation: bandwidthLadder[len(bandwidthLadder)-1]}
+	elapsed := end.Sub(m.started)
+	if m.started.IsZero() || elapsed < time.Second {
+		res.Error = "No media received"
+		return res
+	}
+	res.Duration = elapsed.Seconds()
+
+	// The last second is partial
+	whole := m.seconds
+	if len(whole) > 1 {
+		whole = whole[:len(whole)-1]
+	}
+	total := 0
+	for _, bytes := range m.seconds {
+		total += bytes
+	}
+	res.Bitrate = int(float64(total*8) / elapsed.Seconds())
+	sustained := 0
+	for i, bytes := range whole {
+		res.PeakBitrate = max(res.PeakBitrate, bytes*8)
+		if i >= len(whole)/2 {
+			sustained += bytes
+		}
+	}
+	res.SustainedBitrate = sustained * 8 / (len(whole) - len(whole)/2)
+
+	expected, received := 0, 0
+	for _, s := range m.streams {
+		expected += int(s.highest-s.first) + 1
+		received += s.received
+	}
+	if expected > received {
+		res.Loss = float64(expected-received) / float64(expected)
+	}
+	res.Recommendation = recommendEncoding(res.SustainedBitrate, res.Loss)
+	return res
+}
+
+// Highest rung of the ladder the bitrate carries with headroom, one lower
+// for every 5% of packets lost
+func recommendEncoding(bitrate int, loss float64) bandwidthRecommendation {
+	rung := len(bandwidthLadder) - 1
+	for i, r := range bandwidthLadder {
+		if float64(r.MaxBitrate) <= float64(bitrate)*bandwidthHeadroom {
+			rung = i
+			break
+		}
+	}
+	rung = min(rung+int(loss/0.05), len(bandwidthLadder)-1)
+	return bandwidthLadder[rung]
+}
+
+// Set up a throwaway PeerConnection a publisher sends test media to before
+// going live. Its media is measured for duration from the first packet and
+// dropped; onResult then gets the result and the connection is closed.
+// request is the correlation ID the test is logged with.
+func negotiateBandwidthTest(request, stream string, offer webrtc.SessionDescription, duration time.Duration, onCandidate func(*webrtc.ICECandidate), onResult func(bandwidthResult)) (*peer, *webrtc.SessionDescription, error) {
+	if services.isStopping() {
+		return nil, nil, errShuttingDown
+	}
+	blog := bandwidthLog.withStream(stream).withRequest(request)
+
+	config, settingEngine, err := peerConnectionSettings("publisher")
+	if err != nil {
+		blog.errorf("Error configuring PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
+	}
+	// Same codecs and interceptors as publishers, the transport-wide
+	// congestion control feedback lets the sender ramp up its bitrate
+	feedback := newRTCPFeedback(publisherRTCP)
+	pc, err := publisherAPI(settingEngine, publisherRTCP, feedback).NewPeerConnection(config)
+	if err != nil {
+		blog.errorf("Error creating PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
+	}
+
+	test := newPeer("bandwidth-test", stream, request, pc)
+	test.feedback.Store(feedback)
+	blog = test.log(bandwidthLog)
+	meter := &bandwidthMeter{streams: make(map[uint32]*bandwidthStream)}
+
+	var finishOnce sync.Once
+	finish := func() {
+		finishOnce.Do(func() {
+			res := meter.result(time.Now())
+			if res.Error == "" {
+				blog.infof("[bandwidth-test %s] %d kbit/s sustained, %.1f%% loss, recommending %dp.", test.id, res.SustainedBitrate/1000, res.Loss*100, res.Recommendation.Height)
+			} else {
+				blog.warnf("[bandwidth-test %s] %s.", test.id, res.Error)
+			}
+			onResult(res)
+			test.close(func() {})
+		})
+	}
+	timeout := time.AfterFunc(bandwidthTestTimeout, finish)
+	var startOnce sync.Once
+	// Negotiation failed, the error is the result
+	closeTest := func() {
+		finishOnce.Do(func() {})
+		timeout.Stop()
+		test.close(func() {})
+	}
+
+	pc.OnICECandidate(onCandidate)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		blog.debugf("[bandwidth-test %s] Peer Connection State has changed: %s", test.id, s.String())
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			timeout.Stop()
+			finish()
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		blog.debugf("[bandwidth-test %s] Measuring %s track %s.", test.id, track.Kind(), track.ID())
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := track.Read(buf)
+				if err != nil {
+					return
+				}
+				var packet rtp.Packet
+				if packet.Unmarshal(buf[:n]) != nil {
+					continue
+				}
+				startOnce.Do(func() {
+					timeout.Stop()
+					time.AfterFunc(duration, finish)
+				})
+				meter.observe(&packet, n)
+			}
+		}()
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		blog.errorf("Error setting remote description: %v", err)
+		closeTest()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set remote description")
+	}
+	test.flushPendingCandidates()
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		blog.errorf("Error creating answer: %v", err)
+		closeTest()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		blog.errorf("Error setting local description: %v", err)
+		closeTest()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
+	}
+	blog.infof("[bandwidth-test %s] Measuring the publisher's bandwidth for %v.", test.id, duration)
+	return test, &answer, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import "slices"
+
+// Notified as the tracks of a stream are published and unpublished. The
+// stream's tracks are those of its current publisher: when another one
+// takes over, the old publisher's tracks are removed and the new one's
+// added. Components following a stream subscribe instead of looking at its
+// publisher, so they can't miss a track published while they attach.
+type trackSubscriber interface {
+	// A track was published, also called for each current track when
+	// subscribing
+	trackAdded(p *Publisher, t *trackFanout)
+	// A track ended, or its publisher was replaced or left
+	trackRemoved(p *Publisher, t *trackFanout)
+}
+
+// Subscribe to the room's tracks, getting the current ones right away.
+// Notifications are delivered in order with the subscribers' lock held, so
+// subscribers must not block or subscribe from them.
+func (r *Room) subscribeTracks(s trackSubscriber) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	r.subscribers = append(r.subscribers, s)
+	if p := r.getPublisher(); p != nil {
+		for _, t := range p.fanouts() {
+			s.trackAdded(p, t)
+		}
+	}
+}
+
+func (r *Room) unsubscribeTracks(s trackSubscriber) {
+	r.subscribersMu.Lock()
+	if i := slices.Index(r.subscribers, s); i >= 0 {
+		r.subscribers = slices.Delete(r.subscribers, i, i+1)
+	}
+	r.subscribersMu.Unlock()
+}
+
+// Announce a new track of p, if p is the room's publisher. Tracks of a
+// publisher that hasn't taken over yet are announced when it does.
+func (r *Room) publishTrack(p *Publisher, t *trackFanout) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	if r.getPublisher() != p {
+		return
+	}
+	for _, s := range r.subscribers {
+		s.trackAdded(p, t)
+	}
+}
+
+// Forget a track of p once it ended and announce it to the subscribers
+func (r *Room) unpublishTrack(p *Publisher, t *trackFanout) {
+	p.removeTrack(t)
+
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	if r.getPublisher() != p {
+		return
+	}
+	for _, s := range r.subscribers {
+		s.trackRemoved(p, t)
+	}
+}
+
+// Hand the room's tracks from one publisher to another, either may be nil.
+// Must be called with the subscribers' lock held.
+func (r *Room) switchTracks(old, p *Publisher) {
+	if old == p {
+		return
+	}
+	if old != nil {
+		for _, t := range old.fanouts() {
+			for _, s := range r.subscribers {
+				s.trackRemoved(old, t)
+			}
+		}
+	}
+	if p != nil {
+		for _, t := range p.fanouts() {
+			for _, s := range r.subscribers {
+				s.trackAdded(p, t)
+			}
+		}
+	}
+}
+
+// All fanouts of the publisher, the highest simulcast layer of each track
+// first
+func (p *Publisher) fanouts() []*trackFanout {
+	var list []*trackFanout
+	for _, t := range p.getTracks() {
+		list = append(list, p.layers(t.ID())...)
+	}
+	return list
+}
+
+// Move a viewer track still fed by a previous publisher onto a new track,
+// so the viewer keeps playing across a publisher takeover. Tracks of
+// co-hosts stay with them. A track none can move to is added to the
+// viewer's connection, which is renegotiated.
+func (v *Viewer) trackAdded(p *Publisher, t *trackFanout) {
+	room := getRoom(v.stream)
+	for _, vt := range v.getTracks() {
+		current := vt.currentFanout()
+		if current == t || !current.compatible(t) || p.hasTrack(current) {
+			continue
+		}
+		if room != nil && room.trackOwner(current) != room.getPublisher() {
+			continue
+		}
+		vt.switchTo(t)
+		v.log(roomLog).debugf("[viewer %s] Now watching track %s of publisher %s.", v.id, t.key(), p.id)
+		p.requestKeyframe(t.key())
+		return
+	}
+	// Viewers of transcoded video keep following the stream through it,
+	// those shown the offline slate instead get it again
+	for _, vt := range v.getTracks() {
+		f := vt.currentFanout()
+		if !f.transcoded || f.Kind() != t.Kind() {
+			continue
+		}
+		if !f.slate {
+			return
+		}
+		if codecVariantsEnabled && room != nil {
+			go v.resumeVariant(room, vt, f.Codec())
+			return
+		}
+	}
+	if room != nil {
+		go v.addLateTrack(room, p, t)
+	}
+}
+
+// Viewers of an ended simulcast layer are moved by the publisher, the
+// others wait for a new publisher
+func (v *Viewer) trackRemoved(*Publisher, *trackFanout) {}
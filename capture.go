@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// How much of each stream is kept in memory for captures, from
+// -capture-buffer. 0 disables capturing.
+var captureBuffer = 30 * time.Second
+
+var captureLog = newLogger("capture")
+
+// The last captureBuffer of the packets the host of a room published, that
+// a capture writes out after the fact
+type captureRing struct {
+	mu      sync.Mutex
+	packets []capturedPacket
+}
+
+type capturedPacket struct {
+	at        time.Time
+	publisher *Publisher
+	track     *trackFanout
+	packet    *rtp.Packet
+}
+
+// Keep a packet of one of the host's tracks, dropping those that fell out
+// of the buffer
+func (c *captureRing) add(p *Publisher, t *trackFanout, packet *rtp.Packet) {
+	if captureBuffer <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := now.Add(-captureBuffer)
+	i := 0
+	for i < len(c.packets) && c.packets[i].at.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		c.packets = append(c.packets[:0], c.packets[i:]...)
+	}
+	c.packets = append(c.packets, capturedPacket{at: now, publisher: p, track: t, packet: packet})
+}
+
+// Copy of the buffered packets, oldest first
+func (c *captureRing) freeze() []capturedPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]capturedPacket(nil), c.packets...)
+}
+
+// Write the packets to a recording starting at the first of them, each
+// video track from its first keyframe so the files start decodable
+func writeCapture(stream string, packets []capturedPacket) *recording {
+	var at time.Time
+	rec := &recording{stream: stream, started: packets[0].at, writers: make(map[string]rtpFileWriter), feeds: make(map[string]*recordingFeed), skipped: make(map[string]bool)}
+	rec.clock = func() time.Time { return at }
+
+	rec.mu.Lock()
+	at = rec.started
+	rec.writeEvent(recordingEvent{Type: "start"})
+	rec.mu.Unlock()
+
+	decodable := make(map[*trackFanout]bool)
+	for _, c := range packets {
+		t := c.track
+		if t.Kind() == webrtc.RTPCodecTypeVideo && !decodable[t] && canMonitorKeyframes(t.Codec().MimeType) {
+			if !isKeyframe(t.Codec().MimeType, c.packet.Payload) {
+				continue
+			}
+			decodable[t] = true
+		}
+		at = c.at
+		rec.write(c.publisher, t, c.packet)
+	}
+	rec.stop()
+	return rec
+}
+
+// Handler for POST /api/streams/{stream}/capture, allowed to the stream's
+// owner. Writes the last -capture-buffer of the stream to a recording when
+// someone notices a glitch, without it being recorded all along, and
+// returns it as the recordings API does. The stream needn't be live
+// anymore while its room is around, so the moments before a publisher
+// dropped can be captured too.
+func captureHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	if captureBuffer <= 0 {
+		http.Error(w, "Capturing is disabled", http.StatusNotFound)
+		return
+	}
+	var packets []capturedPacket
+	if room := getRoom(stream); room != nil {
+		packets = room.capture.freeze()
+	}
+	if len(packets) == 0 {
+		http.Error(w, "Nothing of the stream to capture", http.StatusNotFound)
+		return
+	}
+
+	rec := writeCapture(stream, packets)
+	info := rec.info()
+	captureLog.withStream(stream).infof("Captured %s of the stream to %s, %d files.", packets[len(packets)-1].at.Sub(packets[0].at).Round(time.Millisecond), info.ID, len(info.Files))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
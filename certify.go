@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Pause between the checks of a certification, for the client to settle
+	certificationSettle = 2 * time.Second
+	// How long the client gets to recover from each disruption
+	certificationTimeout = 5 * time.Second
+	// How long certification reports stay available
+	certificationRetention = time.Hour
+	// Retransmissions asked of a publisher
+	certificationNACKs = 16
+)
+
+var certifyLog = newLogger("certify")
+
+var errNoSignaling = newSignalingError(http.StatusConflict, "Peer has no signaling socket or event stream to send an offer on")
+
+var (
+	certificationsMu sync.Mutex
+	certifications   = make(map[string]*certification)
+)
+
+// Battery of disruptions run against a connected publisher or viewer, each
+// checking that the client recovers the way a conforming WebRTC client does:
+//
+//   - "keyframe-on-pli": a publisher sends a keyframe when asked with a PLI
+//   - "retransmit-on-nack": a publisher resends the packets NACKed
+//   - "nack-on-loss": a viewer NACKs the packets it misses
+//   - "keyframe-request-on-loss": a viewer asks for a keyframe when video
+//     it can't repair is lost
+//   - "renegotiate": the client answers an offer of the server
+//   - "ice-restart": the client answers an ICE restart and reconnects
+//
+// Offers go out on the peer's signaling socket or /events stream, clients
+// following neither skip those checks.
+type certification struct {
+	mu     sync.Mutex
+	report certificationReport
+	ended  time.Time
+	// Ends the certification early, on shutdown or reset
+	cancel context.CancelFunc
+}
+
+type certificationReport struct {
+	ID      string    `json:"id"`
+	Peer    string    `json:"peer"`
+	Role    string    `json:"role"`
+	Stream  string    `json:"stream"`
+	Started time.Time `json:"started"`
+	Running bool      `json:"running,omitempty"`
+	// Whether no check failed, set once all ran
+	Passed bool                 `json:"passed"`
+	Checks []certificationCheck `json:"checks"`
+}
+
+type certificationCheck struct {
+	Name string `json:"name"`
+	// "pass", "fail" or "skipped"
+	Result string `json:"result"`
+	// Seconds from the disruption until the client recovered
+	Recovery float64 `json:"recoverySeconds,omitempty"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+// Outcome of one check, nil error for a pass
+type checkFunc func() (time.Duration, error)
+
+// Check skipped because the client can't take part in it
+type skippedCheck string
+
+func (s skippedCheck) Error() string { return string(s) }
+
+// Start certifying the client of a publisher or viewer in the background,
+// until the checks are done or stopCertifications is called
+func startCertification(p *peer) *certification {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &certification{cancel: cancel, report: certificationReport{
+		ID: newID(), Peer: p.id, Role: p.role, Stream: p.stream, Started: time.Now(), Running: true, Checks: []certificationCheck{},
+	}}
+	certificationsMu.Lock()
+	expireCertifications()
+	certifications[c.report.ID] = c
+	certificationsMu.Unlock()
+
+	go c.run(ctx, p)
+	return c
+}
+
+// End the running certifications, on shutdown or reset
+func stopCertifications() {
+	certificationsMu.Lock()
+	list := make([]*certification, 0, len(certifications))
+	for _, c := range certifications {
+		list = append(list, c)
+	}
+	certificationsMu.Unlock()
+	for _, c := range list {
+		c.cancel()
+	}
+}
+
+func (c *certification) run(ctx context.Context, p *peer) {
+	defer c.cancel()
+	plog := p.log(certifyLog)
+	plog.infof("[%s %s] Certification %s started.", p.role, p.id, c.report.ID)
+
+	var checks []struct {
+		name string
+		run  checkFunc
+	}
+	add := func(name string, run checkFunc) {
+		checks = append(checks, struct {
+			name string
+			run  checkFunc
+		}{name, run})
+	}
+	if _, publisher := findPublisher(p.id); publisher != nil && p.role == "publisher" {
+		add("keyframe-on-pli", func() (time.Duration, error) { return certifyKeyframeOnPLI(ctx, publisher) })
+		add("retransmit-on-nack", func() (time.Duration, error) { return certifyRetransmitOnNACK(ctx, publisher) })
+	}
+	if room := getRoom(p.stream); room != nil && p.role == "viewer" {
+		if viewer := room.getViewer(p.id); viewer != nil {
+			add("nack-on-loss", func() (time.Duration, error) { return certifyNACKOnLoss(ctx, viewer) })
+			add("keyframe-request-on-loss", func() (time.Duration, error) { return certifyKeyframeRequest(ctx, viewer) })
+		}
+	}
+	add("renegotiate", func() (time.Duration, error) { return certifyOffer(ctx, p, false) })
+	add("ice-restart", func() (time.Duration, error) { return certifyOffer(ctx, p, true) })
+
+	passed := true
+	for i, check := range checks {
+		if i > 0 {
+			select {
+			case <-time.After(certificationSettle):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			passed = false
+			plog.infof("[%s %s] Certification %s stopped.", p.role, p.id, c.report.ID)
+			break
+		}
+		result := certificationCheck{Name: check.name, Result: "pass"}
+		var skipped skippedCheck
+		switch took, err := check.run(); {
+		case ctx.Err() != nil:
+			result.Result, result.Detail = "skipped", "Certification stopped"
+		case p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed:
+			result.Result, result.Detail = "fail", "Connection closed"
+		case errors.As(err, &skipped):
+			result.Result, result.Detail = "skipped", err.Error()
+		case err != nil:
+			result.Result, result.Detail = "fail", err.Error()
+		default:
+			result.Recovery = took.Seconds()
+		}
+		passed = passed && result.Result != "fail"
+		plog.infof("[%s %s] Certification check %s: %s %s", p.role, p.id, check.name, result.Result, result.Detail)
+
+		c.mu.Lock()
+		c.report.Checks = append(c.report.Checks, result)
+		c.mu.Unlock()
+		if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.report.Running, c.report.Passed = false, passed
+	c.ended = time.Now()
+	c.mu.Unlock()
+	plog.infof("[%s %s] Certification %s done, passed: %v.", p.role, p.id, c.report.ID, passed)
+}
+
+func (c *certification) snapshot() certificationReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := c.report
+	report.Checks = append([]certificationCheck(nil), c.report.Checks...)
+	return report
+}
+
+// Drop reports older than certificationRetention, with certificationsMu held
+func expireCertifications() {
+	for id, c := range certifications {
+		c.mu.Lock()
+		expired := !c.report.Running && time.Since(c.ended) > certificationRetention
+		c.mu.Unlock()
+		if expired {
+			delete(certifications, id)
+		}
+	}
+}
+
+// Poll cond until it holds, returning how long that took, or false once
+// timeout is up or ctx is done
+func waitFor(ctx context.Context, timeout time.Duration, cond func() bool) (time.Duration, bool) {
+	start := time.Now()
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if cond() {
+			return time.Since(start), true
+		}
+		if time.Since(start) > timeout {
+			return 0, false
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, false
+		}
+	}
+}
+
+// Video SSRCs of the publisher with the fanout of each
+func (p *Publisher) videoFanouts() map[webrtc.SSRC]*trackFanout {
+	fanouts := make(map[webrtc.SSRC]*trackFanout)
+	for _, f := range p.fanouts() {
+		p.trackMutex.Lock()
+		ssrc, ok := p.videoSSRCs[f.key()]
+		p.trackMutex.Unlock()
+		if ok {
+			fanouts[ssrc] = f
+		}
+	}
+	return fanouts
+}
+
+// Keyframes the monitor of an ingest SSRC has seen
+func keyframesSeen(ssrc webrtc.SSRC) (int, bool) {
+	keyframeMonitorsMu.Lock()
+	m := keyframeMonitors[ssrc]
+	keyframeMonitorsMu.Unlock()
+	if m == nil {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keyframes, true
+}
+
+// Ask every video track for a keyframe, bypassing the PLI coalescing, and
+// wait for each to send one
+func certifyKeyframeOnPLI(ctx context.Context, p *Publisher) (time.Duration, error) {
+	before := make(map[webrtc.SSRC]int)
+	for ssrc := range p.videoFanouts() {
+		if n, ok := keyframesSeen(ssrc); ok {
+			before[ssrc] = n
+		}
+	}
+	if len(before) == 0 {
+		return 0, skippedCheck("No VP8 or H264 video to ask keyframes of")
+	}
+	ssrcs := make([]webrtc.SSRC, 0, len(before))
+	for ssrc := range before {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	p.writePLIs(ssrcs)
+
+	took, ok := waitFor(ctx, certificationTimeout, func() bool {
+		for ssrc, n := range before {
+			if now, _ := keyframesSeen(ssrc); now <= n {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		return 0, fmt.Errorf("No keyframe within %v of a PLI", certificationTimeout)
+	}
+	return took, nil
+}
+
+// NACK recent packets of the first video track sent with RTX and wait for
+// them to be resent. Resent on the track's own SSRC, packets already
+// received are dropped by SRTP replay protection, so publishers without RTX
+// skip the check.
+func certifyRetransmitOnNACK(ctx context.Context, p *Publisher) (time.Duration, error) {
+	for ssrc, f := range p.videoFanouts() {
+		highest, before, ok := f.sequence()
+		if !ok || !p.sendsRTX(ssrc) {
+			continue
+		}
+		seqs := make([]uint16, 0, certificationNACKs)
+		for i := certificationNACKs; i > 0; i-- {
+			seqs = append(seqs, highest-uint16(i))
+		}
+		nack := &rtcp.TransportLayerNack{MediaSSRC: uint32(ssrc), Nacks: rtcp.NackPairsFromSequenceNumbers(seqs)}
+		if err := p.pc.WriteRTCP([]rtcp.Packet{nack}); err != nil {
+			return 0, fmt.Errorf("Error sending NACK: %v", err)
+		}
+		took, ok := waitFor(ctx, certificationTimeout, func() bool {
+			_, late, _ := f.sequence()
+			return late > before
+		})
+		if !ok {
+			return 0, fmt.Errorf("None of %d NACKed packets resent within %v", certificationNACKs, certificationTimeout)
+		}
+		return took, nil
+	}
+	return 0, skippedCheck("No video sent with RTX to NACK")
+}
+
+// Whether the publisher's track with the SSRC has an RTX stream
+func (p *Publisher) sendsRTX(ssrc webrtc.SSRC) bool {
+	for _, receiver := range p.pc.GetReceivers() {
+		for _, t := range receiver.Tracks() {
+			if t.SSRC() == ssrc && t.HasRTX() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Drop every tenth video packet to the viewer for a second and wait for
+// its NACKs
+func certifyNACKOnLoss(ctx context.Context, v *Viewer) (time.Duration, error) {
+	f := v.feedback.Load()
+	tracks := v.videoTracks()
+	if f == nil || len(tracks) == 0 {
+		return 0, skippedCheck("No video to drop packets of")
+	}
+	before := f.nacksReceived.Load()
+	for _, t := range tracks {
+		t.injectLoss(10, time.Second)
+	}
+	took, ok := waitFor(ctx, certificationTimeout, func() bool { return f.nacksReceived.Load() > before })
+	if !ok {
+		return 0, fmt.Errorf("No NACK within %v of packet loss", certificationTimeout)
+	}
+	return took, nil
+}
+
+// Drop all of the viewer's video for a second, which the packets NACKed
+// can't repair as they never were sent, and wait for a keyframe request
+func certifyKeyframeRequest(ctx context.Context, v *Viewer) (time.Duration, error) {
+	f := v.feedback.Load()
+	tracks := v.videoTracks()
+	if f == nil || len(tracks) == 0 {
+		return 0, skippedCheck("No video to drop packets of")
+	}
+	before := f.keyframeRequestsReceived.Load()
+	for _, t := range tracks {
+		t.injectLoss(1, time.Second)
+	}
+	took, ok := waitFor(ctx, time.Second+certificationTimeout, func() bool { return f.keyframeRequestsReceived.Load() > before })
+	if !ok {
+		return 0, fmt.Errorf("No PLI or FIR within %v of losing video", certificationTimeout)
+	}
+	return took, nil
+}
+
+// Send the client an offer, restarting ICE when asked, and wait for its
+// answer and for RTCP to flow on the connection again
+func certifyOffer(ctx context.Context, p *peer, iceRestart bool) (time.Duration, error) {
+	start := time.Now()
+	if err := p.sendServerOffer(iceRestart); errors.Is(err, errNoSignaling) {
+		return 0, skippedCheck(err.Error())
+	} else if err != nil {
+		return 0, err
+	}
+	if _, ok := waitFor(ctx, certificationTimeout, func() bool { return p.pc.SignalingState() == webrtc.SignalingStateStable }); !ok {
+		return 0, fmt.Errorf("Offer not answered within %v", certificationTimeout)
+	}
+	f := p.feedback.Load()
+	var before uint64
+	if f != nil {
+		before = f.packetsReceived.Load()
+	}
+	if _, ok := waitFor(ctx, 3*certificationTimeout, func() bool {
+		return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected && (f == nil || f.packetsReceived.Load() > before)
+	}); !ok {
+		return 0, fmt.Errorf("Connection not back to %s with RTCP flowing within %v", webrtc.PeerConnectionStateConnected, 3*certificationTimeout)
+	}
+	return time.Since(start), nil
+}
+
+// Send the client an offer of its current tracks over its signaling socket
+// or /events stream
+func (p *peer) sendServerOffer(iceRestart bool) error {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		return newSignalingError(http.StatusConflict, "Renegotiation already in progress")
+	}
+	if len(socketsOf(p)) == 0 && !p.followed() {
+		return errNoSignaling
+	}
+
+	offer, err := p.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: iceRestart})
+	if err != nil {
+		return fmt.Errorf("Error creating offer: %v", err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("Error setting local description: %v", err)
+	}
+	notifySockets(signalMessage{Type: "offer", ID: p.id, Stream: p.stream, SDP: &offer}, p)
+	p.publishEvent(peerEvent{Type: "offer", SDP: &offer})
+	return nil
+}
+
+// Video tracks the viewer receives
+func (v *Viewer) videoTracks() []*viewerTrack {
+	var tracks []*viewerTrack
+	for _, t := range v.getTracks() {
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// Handler for POST /api/admin/certifications {"peer":"<peer ID>"} starting
+// the certification of a connected publisher's or viewer's client. The
+// report is updated at /api/admin/certifications/{id} as checks complete.
+func startCertificationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Peer string `json:"peer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if services.isStopping() {
+		writeSignalingError(w, errShuttingDown)
+		return
+	}
+	p := lookupPeer(req.Peer)
+	if p == nil || p.pc == nil || (p.role != "publisher" && p.role != "viewer") {
+		http.Error(w, "No such peer", http.StatusNotFound)
+		return
+	}
+	if p.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		http.Error(w, "Peer is not connected", http.StatusConflict)
+		return
+	}
+	c := startCertification(p)
+	adminLog.forRequest(r).infof("Certification %s of %s %s started.", c.report.ID, p.role, p.id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(c.snapshot())
+}
+
+// Handler for GET /api/admin/certifications/{id}
+func certificationHandler(w http.ResponseWriter, r *http.Request) {
+	certificationsMu.Lock()
+	c, ok := certifications[r.PathValue("id")]
+	certificationsMu.Unlock()
+	if !ok {
+		http.Error(w, "No such certification", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.snapshot())
+}
+
+// Drop one packet in every of the track's for d, the viewer seeing them
+// lost as they leave a gap in the sequence numbers
+func (t *viewerTrack) injectLoss(every int, d time.Duration) {
+	t.mu.Lock()
+	t.lossEvery, t.lossUntil, t.lossCount = every, time.Now().Add(d), 0
+	t.mu.Unlock()
+}
+
+// Whether injected loss drops the next packet, with the track's mutex held
+func (t *viewerTrack) loseNext() bool {
+	if t.lossEvery == 0 {
+		return false
+	}
+	if time.Now().After(t.lossUntil) {
+		t.lossEvery = 0
+		return false
+	}
+	t.lossCount++
+	return t.lossCount%t.lossEvery == 0
+}
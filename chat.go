@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Label of the data channel the server opens on every publisher and
+	// viewer connection for the stream's chat
+	chatChannelLabel = "chat"
+	// Messages a participant may send per second, and at once
+	chatRate  = 1
+	chatBurst = 5
+	// Longest message in bytes
+	maxChatLength = 500
+	// Messages new participants get to catch up
+	chatHistory = 20
+)
+
+var chatLog = newLogger("chat")
+
+// Message of a participant on the chat channel: {"text": "hello"}
+type chatInput struct {
+	Text string `json:"text"`
+}
+
+// Sent to everyone on the chat channel of a stream: the messages of its
+// participants as {"type": "chat"}, and to the sender alone
+// {"type": "chat-error"} when a message is refused
+type chatMessage struct {
+	Type  string      `json:"type"`
+	Seq   uint64      `json:"seq,omitempty"`
+	From  *chatSender `json:"from,omitempty"`
+	Text  string      `json:"text,omitempty"`
+	Time  *time.Time  `json:"time,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Who sent a chat message: the peer's display ID, its role and the user it
+// is logged in as, if any
+type chatSender struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+	User string `json:"user,omitempty"`
+}
+
+// Chat hub of a room: the last messages and each sender's allowance
+type roomChat struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []chatMessage
+	buckets map[string]*rateBucket
+}
+
+// Open the chat channel on a publisher's or viewer's connection, once its
+// offer is set. Offers without a data channel section get no chat, as do
+// data-only streams, whose channels all belong to the application.
+func openChat(room *Room, p *peer, sender chatSender, channels *dataChannels) {
+	if desc := p.pc.RemoteDescription(); desc == nil || !strings.Contains(desc.SDP, "m=application") {
+		return
+	}
+	dc, err := p.pc.CreateDataChannel(chatChannelLabel, nil)
+	if err != nil {
+		p.log(chatLog).warnf("[%s %s] Error opening chat channel: %v", p.role, p.id, err)
+		return
+	}
+	dc.OnOpen(func() {
+		room.chat.join(dc, channels)
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var in chatInput
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			sendChat(dc, chatMessage{Type: "chat-error", Error: "Invalid chat message"})
+			return
+		}
+		if refused := room.chat.post(room, sender, in.Text, time.Now()); refused != "" {
+			sendChat(dc, chatMessage{Type: "chat-error", Error: refused})
+		}
+	})
+}
+
+// Catch a participant's channel up on the last messages and relay the
+// next ones to it too, none missed or out of order in between
+func (c *roomChat) join(dc *webrtc.DataChannel, channels *dataChannels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.history {
+		sendChat(dc, m)
+	}
+	channels.add(dc)
+}
+
+// Add a message to the history and relay it, or return the reason it is
+// refused
+func (c *roomChat) post(room *Room, from chatSender, text string, now time.Time) string {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return "Empty message"
+	case len(text) > maxChatLength || !utf8.ValidString(text):
+		return "Message too long, at most " + strconv.Itoa(maxChatLength) + " bytes"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buckets == nil {
+		c.buckets = make(map[string]*rateBucket)
+	}
+	if !allowMessage(c.buckets, from.ID, chatRate, chatBurst, now) {
+		return "Slow down, too many messages"
+	}
+	c.seq++
+	m := chatMessage{Type: "chat", Seq: c.seq, From: &from, Text: text, Time: &now}
+	c.history = append(c.history, m)
+	if len(c.history) > chatHistory {
+		c.history = c.history[len(c.history)-chatHistory:]
+	}
+	relayChat(room, m)
+	return ""
+}
+
+// Forget the allowance of a participant that left
+func (c *roomChat) left(id string) {
+	c.mu.Lock()
+	delete(c.buckets, id)
+	c.mu.Unlock()
+}
+
+// Send a message to every publisher and viewer of the room, and record it
+// with the stream. Called with the chat's lock held, so everyone gets the
+// messages in order.
+func relayChat(room *Room, m chatMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	msg := webrtc.DataChannelMessage{IsString: true, Data: data}
+	recordMessage(room, m.From.Role+" "+m.From.ID, chatChannelLabel, msg)
+	for _, p := range append(room.getCohosts(), room.getPublisher()) {
+		if p == nil {
+			continue
+		}
+		if err := p.channels.send(chatChannelLabel, msg); err != nil {
+			p.log(chatLog).warnf("[publisher %s] Error sending chat: %v", p.id, err)
+		}
+	}
+	for _, v := range room.getViewers() {
+		v.sendData(chatChannelLabel, msg)
+	}
+	chatLog.withStream(room.name).debugf("Chat message %d from %s %s relayed.", m.Seq, m.From.Role, m.From.ID)
+}
+
+func sendChat(dc *webrtc.DataChannel, m chatMessage) {
+	if data, err := json.Marshal(m); err == nil {
+		dc.SendText(string(data))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Codecs viewers can ask for with ?codec=, e.g. ?codec=h264 or
+// ?codec=vp8,opus
+var codecNames = map[string]string{
+	"h264": webrtc.MimeTypeH264,
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"av1":  webrtc.MimeTypeAV1,
+	"opus": webrtc.MimeTypeOpus,
+	"g722": webrtc.MimeTypeG722,
+	"pcmu": webrtc.MimeTypePCMU,
+	"pcma": webrtc.MimeTypePCMA,
+}
+
+// Mime types of the codecs publishers are asked to send, from -codecs
+var publisherCodecs []string
+
+// Mime types of the codecs named by a ?codec= parameter, in order of
+// preference, nil when it is empty
+func parseCodecPreference(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var mimeTypes []string
+	for _, name := range strings.Split(s, ",") {
+		mimeType, ok := codecNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, newSignalingError(http.StatusBadRequest, fmt.Sprintf("Unknown codec %q", name))
+		}
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	return mimeTypes, nil
+}
+
+// Restrict the codecs the viewer's transceiver of a track answers with to
+// the preferred ones of the track's kind, in order of preference. Tracks
+// are forwarded as published, so the publisher's codec has to be one of
+// them; kinds without a preference keep all codecs.
+func preferCodecs(transceiver *webrtc.RTPTransceiver, track *trackFanout, prefer []string) error {
+	var wanted []string
+	for _, mimeType := range prefer {
+		if strings.HasPrefix(mimeType, track.Kind().String()+"/") {
+			wanted = append(wanted, mimeType)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	published := track.Codec().MimeType
+	if !containsFold(wanted, published) {
+		return newSignalingError(http.StatusNotAcceptable,
+			fmt.Sprintf("Stream's %s is %s and is not transcoded", track.Kind(), strings.TrimPrefix(published, track.Kind().String()+"/")))
+	}
+
+	available := transceiver.Sender().GetParameters().Codecs
+	var codecs []webrtc.RTPCodecParameters
+	for _, mimeType := range wanted {
+		for _, c := range available {
+			if !strings.EqualFold(c.MimeType, mimeType) {
+				continue
+			}
+			codecs = append(codecs, c)
+			// Keep the retransmission format of the codec
+			for _, rtx := range available {
+				if strings.EqualFold(rtx.MimeType, "video/rtx") && rtx.SDPFmtpLine == fmt.Sprintf("apt=%d", c.PayloadType) {
+					codecs = append(codecs, rtx)
+				}
+			}
+		}
+	}
+	return transceiver.SetCodecPreferences(codecs)
+}
+
+// Put the preferred codecs first among those a publisher's transceiver
+// answers with, the publisher then sends the first of them it offered
+func orderPublisherCodecs(transceiver *webrtc.RTPTransceiver, prefer []string) error {
+	if len(prefer) == 0 || transceiver.Receiver() == nil {
+		return nil
+	}
+	codecs := transceiver.Receiver().GetParameters().Codecs
+	rank := func(c webrtc.RTPCodecParameters) int {
+		for i, mimeType := range prefer {
+			if strings.EqualFold(c.MimeType, mimeType) {
+				return i
+			}
+		}
+		return len(prefer)
+	}
+	sort.SliceStable(codecs, func(i, j int) bool { return rank(codecs[i]) < rank(codecs[j]) })
+	return transceiver.SetCodecPreferences(codecs)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
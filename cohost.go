@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Most co-hosts a stream has besides its host
+const maxCohosts = 3
+
+// Whether a publisher joins the live stream as a co-host with ?cohost=true,
+// e.g. the guest of an interview, instead of taking it over. It needs the
+// same authorization as the host, and viewers get its tracks next to the
+// host's under the stream ID "cohost-<id>", one stream per co-host. Outputs
+// and recordings carry the host's tracks only. Viewers connected before a
+// co-host joined get {"type":"cohost-joined"} and reconnect to receive its
+// tracks, and {"type":"cohost-left"} once it leaves.
+func parseCohost(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("cohost") {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	}
+	return false, newSignalingError(http.StatusBadRequest, "cohost must be true or false")
+}
+
+// Join p to the room's host as a co-host
+func (r *Room) addCohost(p *Publisher) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.publisher == nil {
+		return newSignalingError(http.StatusConflict, "Stream has no host to co-host with")
+	}
+	if len(r.cohosts) >= maxCohosts {
+		return newSignalingError(http.StatusConflict, "Stream has the most co-hosts already")
+	}
+	r.cohosts = append(r.cohosts, p)
+	return nil
+}
+
+func (r *Room) removeCohost(p *Publisher) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.Index(r.cohosts, p)
+	if i < 0 {
+		return false
+	}
+	r.cohosts = slices.Delete(r.cohosts, i, i+1)
+	return true
+}
+
+// Co-hosts of the room, in the order they joined
+func (r *Room) getCohosts() []*Publisher {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.cohosts)
+}
+
+func (r *Room) getCohost(id string) *Publisher {
+	for _, p := range r.getCohosts() {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// Tracks of the co-hosts viewers subscribe to besides the host's
+func (r *Room) cohostTracks() []*trackFanout {
+	var list []*trackFanout
+	for _, p := range r.getCohosts() {
+		list = append(list, p.getTracks()...)
+	}
+	return list
+}
+
+// Publisher of the room whose track t is, the host unless a co-host has it
+func (r *Room) trackOwner(t *trackFanout) *Publisher {
+	for _, p := range r.getCohosts() {
+		if p.hasTrack(t) {
+			return p
+		}
+	}
+	return r.getPublisher()
+}
+
+func notifyViewers(room *Room, msg signalMessage) {
+	viewers := room.getViewers()
+	peers := make([]*peer, len(viewers))
+	for i, v := range viewers {
+		peers[i] = v.peer
+	}
+	notifySockets(msg, peers...)
+}
+
+// Whether the publisher's tracks of the kind are muted, dropped before they
+// reach viewers or outputs
+func (p *Publisher) isMuted(kind webrtc.RTPCodecType) bool {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return p.mutedAudio.Load()
+	case webrtc.RTPCodecTypeVideo:
+		return p.mutedVideo.Load()
+	}
+	return false
+}
+
+// Mute or unmute the publisher's tracks of the kind, returning whether that
+// changed anything
+func (p *Publisher) setMuted(kind webrtc.RTPCodecType, muted bool) bool {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return p.mutedAudio.Swap(muted) != muted
+	case webrtc.RTPCodecTypeVideo:
+		if p.mutedVideo.Swap(muted) == muted {
+			return false
+		}
+		// Viewers need a keyframe to decode the video again
+		if !muted {
+			p.requestKeyframe()
+		}
+		return true
+	}
+	return false
+}
+
+// Host or co-host of this instance by peer ID
+func findPublisher(id string) (*Room, *Publisher) {
+	for _, room := range listRooms() {
+		if p := room.getPublisher(); p != nil && p.id == id {
+			return room, p
+		}
+		if p := room.getCohost(id); p != nil {
+			return room, p
+		}
+	}
+	return nil, nil
+}
+
+// Handler for POST and DELETE /api/admin/publishers/{id}/mute, muting and
+// unmuting the audio or video of a host or co-host with ?kind=, both when
+// omitted. The publisher keeps sending; its packets are dropped until it is
+// unmuted, and its signaling socket gets {"type":"muted"} or
+// {"type":"unmuted"} with the kind.
+func muteHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	switch kind := r.URL.Query().Get("kind"); kind {
+	case "":
+	case "audio", "video":
+		kinds = []webrtc.RTPCodecType{webrtc.NewRTPCodecType(kind)}
+	default:
+		http.Error(w, "kind must be audio or video", http.StatusBadRequest)
+		return
+	}
+	room, p := findPublisher(id)
+	if p == nil {
+		unknownPeer(w, id, "publisher")
+		return
+	}
+
+	muted := r.Method == http.MethodPost
+	typ := "unmuted"
+	if muted {
+		typ = "muted"
+	}
+	for _, kind := range kinds {
+		if !p.setMuted(kind, muted) {
+			continue
+		}
+		notifySockets(signalMessage{Type: typ, Stream: room.name, ID: p.id, Kind: kind.String()}, p.peer)
+		p.log(moderationLog).infof("[publisher %s] %s %s by an admin.", p.id, kind, typ)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Audio bool `json:"audioMuted"`
+		Video bool `json:"videoMuted"`
+	}{p.isMuted(webrtc.RTPCodecTypeAudio), p.isMuted(webrtc.RTPCodecTypeVideo)})
+}
@@ -0,0 +1,339 @@
+// Package config loads the server's settings from flags, SFU_* environment
+// variables and a YAML file, in that order of precedence.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables overriding the config file, e.g.
+// SFU_LOG_LEVEL for -log-level
+const envPrefix = "SFU_"
+
+// Settings of the server that used to be hardcoded
+type Config struct {
+	// Address the HTTP server listens on
+	Listen string
+
+	// Certificate and key files to serve HTTPS with, reloaded when they
+	// change, or domains to obtain certificates for from Let's Encrypt,
+	// cached in ACMECacheDir
+	TLSCert, TLSKey string
+	ACMEDomains     []string
+	ACMEEmail       string
+	ACMECacheDir    string
+
+	// Address redirecting plain HTTP to HTTPS and answering ACME http-01
+	// challenges, empty for none
+	HTTPRedirect string
+
+	// STUN and TURN URLs handed to both ends of every PeerConnection, or of
+	// publisher ones when viewers have their own
+	ICEServers       []string
+	ViewerICEServers []string
+
+	// Static credentials of the TURN URLs, or a secret shared with the TURN
+	// server to derive credentials valid for TURNTTL from
+	TURNUsername, TURNCredential string
+	TURNSecret                   string
+	TURNTTL                      time.Duration
+
+	// UDP ports ICE gathers host candidates on, 0 for any
+	ICEPortMin, ICEPortMax uint16
+
+	// Key publish JWTs are signed with: a shared HMAC secret, or a PEM file
+	// with the RSA public key. Publishing needs a token once either is set.
+	PublishJWTSecret string
+	PublishJWTKey    string
+
+	// HMAC secret stream URLs are signed with, so they open the stream until
+	// they expire. Signed URLs are rejected when empty.
+	URLSigningSecret string
+
+	// Whether anybody may watch streams that aren't private, "open", or
+	// only viewers with a view token signed with ViewTokenSecret, "token"
+	Viewing         string
+	ViewTokenSecret string
+
+	// Whether publish and view tokens without an audience are rejected.
+	// Tokens issued before audiences were checked have none and are
+	// accepted with a warning until this becomes the default.
+	RequireTokenAudience bool
+
+	// OpenID Connect provider users log in with, e.g. Google or Keycloak,
+	// and the client registered with it. The redirect URL defaults to
+	// /api/account/oidc/callback on the host users reach the server at.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	// Whether the main page and signaling need a logged in user
+	RequireLogin bool
+
+	// How the embedded pages signal: over the /ws socket, "websocket", or
+	// with POST /publish and /view and the peer's /events stream, "http"
+	Signaling string
+
+	// Codec names publishers are asked to send, in order of preference,
+	// e.g. h264,opus; empty leaves the choice to the publisher
+	Codecs []string
+
+	// Lowest level logged, and whether log lines are text or JSON
+	LogLevel  string
+	LogFormat string
+
+	// Where peer records and stream metadata are kept: empty for memory,
+	// or a redis:// URL to keep them across restarts and share them
+	// between instances
+	SessionStore string
+	// Name of this instance in the session store, the hostname by default
+	InstanceID string
+}
+
+// Settings used when nothing else is configured
+func Default() *Config {
+	return &Config{
+		Listen:       ":8080",
+		ACMECacheDir: "acme-cache",
+		ICEServers:   []string{"stun:stun.l.google.com:19302"},
+		TURNTTL:      24 * time.Hour,
+		LogLevel:     "info",
+		LogFormat:    "text",
+		Viewing:      "open",
+		Signaling:    "websocket",
+		InstanceID:   hostname(),
+	}
+}
+
+// Register the settings as flags of fs, parse args and apply the config file
+// named by -config and the environment to every flag not given in args. This
+// covers the flags registered on fs by the caller as well: a file can set
+// any of them by name, like
+//
+//	listen: ":8443"
+//	ice-servers: [stun:stun.example.com, turn:turn.example.com]
+//	rtmp: ""
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML file with flag values, e.g. \"listen: :8443\"")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the HTTP server listens on")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "PEM certificate file to serve HTTPS with, browsers only allow getUserMedia over HTTPS or on localhost")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "PEM private key file of -tls-cert")
+	fs.Var((*listValue)(&c.ACMEDomains), "acme-domains", "comma-separated domains to serve HTTPS for with certificates from Let's Encrypt, instead of -tls-cert")
+	fs.StringVar(&c.ACMEEmail, "acme-email", "", "contact address of the Let's Encrypt account, for expiry notices")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache", c.ACMECacheDir, "directory Let's Encrypt certificates are kept in across restarts")
+	fs.StringVar(&c.HTTPRedirect, "http-redirect", "", "address redirecting plain HTTP to HTTPS, e.g. :80, which Let's Encrypt's http-01 challenge needs unless -listen is :443")
+	fs.Var((*listValue)(&c.ICEServers), "ice-servers", "comma-separated STUN and TURN URLs for publishers and viewers")
+	fs.Var((*listValue)(&c.ViewerICEServers), "viewer-ice-servers", "comma-separated STUN and TURN URLs for viewers instead of -ice-servers, e.g. a TURN server near the audience")
+	fs.StringVar(&c.TURNUsername, "turn-username", "", "username for the TURN URLs of -ice-servers")
+	fs.StringVar(&c.TURNCredential, "turn-credential", "", "password for the TURN URLs of -ice-servers")
+	fs.StringVar(&c.TURNSecret, "turn-secret", "", "secret shared with the TURN server, e.g. coturn's static-auth-secret, to issue time-limited credentials instead")
+	fs.DurationVar(&c.TURNTTL, "turn-ttl", c.TURNTTL, "how long credentials issued with -turn-secret are valid")
+	fs.Var((*portRangeValue)(c), "ice-port-range", "UDP port range for ICE, e.g. 50000-50100, empty for any port")
+	fs.StringVar(&c.PublishJWTSecret, "publish-jwt-secret", "", "HMAC secret publish JWTs are signed with (HS256/384/512), publishing needs a token for the \"publish\" audience naming the stream once set")
+	fs.StringVar(&c.PublishJWTKey, "publish-jwt-key", "", "PEM file with the RSA public key publish JWTs are signed with (RS256/384/512), instead of -publish-jwt-secret")
+	fs.StringVar(&c.URLSigningSecret, "url-signing-secret", "", "HMAC secret of signed stream URLs, ?expires=...&signature=..., which open private streams until they expire")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL users log in with, e.g. https://accounts.google.com, needs -accounts-db")
+	fs.StringVar(&c.OIDCClientID, "oidc-client-id", "", "client ID registered with the -oidc-issuer")
+	fs.StringVar(&c.OIDCClientSecret, "oidc-client-secret", "", "client secret registered with the -oidc-issuer")
+	fs.StringVar(&c.OIDCRedirectURL, "oidc-redirect-url", "", "callback URL registered with the -oidc-issuer, /api/account/oidc/callback on the request's host by default")
+	fs.BoolVar(&c.RequireLogin, "require-login", false, "require a logged in user for the main page, publishing, viewing and the signaling socket, needs -accounts-db")
+	fs.StringVar(&c.Signaling, "signaling", c.Signaling, "how the main page publishes and views: websocket, or http for POST /publish and /view with candidates over /events, e.g. behind proxies without WebSocket support")
+	fs.StringVar(&c.Viewing, "viewing", c.Viewing, "who may watch streams that aren't private: open, or token for viewers with a -view-token-secret token only")
+	fs.StringVar(&c.ViewTokenSecret, "view-token-secret", "", "HMAC secret view JWTs are signed with (HS256/384/512), they carry the \"view\" audience and open the stream they name until they expire")
+	fs.BoolVar(&c.RequireTokenAudience, "require-token-audience", false, "reject publish and view tokens without an audience, which are accepted with a warning for now and will be rejected by default in a future release")
+	fs.Var((*listValue)(&c.Codecs), "codecs", "codecs publishers are asked to send in order of preference, e.g. h264,opus")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log line format: text (key=value) or json")
+	fs.StringVar(&c.SessionStore, "session-store", "", "redis:// URL to keep sessions and stream metadata in, e.g. redis://localhost:6379/0, instead of memory")
+	fs.StringVar(&c.InstanceID, "instance-id", c.InstanceID, "name of this server among the instances sharing -session-store")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	file := map[string]interface{}{}
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("%s: unknown setting %q", *path, name)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		source := envName(f.Name)
+		if !ok {
+			var v interface{}
+			if v, ok = file[f.Name]; !ok {
+				return
+			}
+			value, source = fileValue(v), *path
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s: invalid value %q for %s: %w", source, value, f.Name, serr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.TURNSecret != "" && (c.TURNUsername != "" || c.TURNCredential != "") {
+		return nil, fmt.Errorf("-turn-secret and static TURN credentials are mutually exclusive")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if c.TLSCert != "" && len(c.ACMEDomains) > 0 {
+		return nil, fmt.Errorf("-tls-cert and -acme-domains are mutually exclusive")
+	}
+	if c.PublishJWTSecret != "" && c.PublishJWTKey != "" {
+		return nil, fmt.Errorf("-publish-jwt-secret and -publish-jwt-key are mutually exclusive")
+	}
+	if c.HTTPRedirect != "" && !c.TLS() {
+		return nil, fmt.Errorf("-http-redirect needs -tls-cert or -acme-domains")
+	}
+	if c.SessionStore != "" && !strings.HasPrefix(c.SessionStore, "redis://") && !strings.HasPrefix(c.SessionStore, "rediss://") {
+		return nil, fmt.Errorf("-session-store must be a redis:// or rediss:// URL")
+	}
+	if c.OIDCIssuer != "" && c.OIDCClientID == "" {
+		return nil, fmt.Errorf("-oidc-issuer needs -oidc-client-id")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return nil, fmt.Errorf("-log-format must be text or json")
+	}
+	if c.Viewing != "open" && c.Viewing != "token" {
+		return nil, fmt.Errorf("-viewing must be open or token")
+	}
+	if c.Signaling != "websocket" && c.Signaling != "http" {
+		return nil, fmt.Errorf("-signaling must be websocket or http")
+	}
+	if c.Viewing == "token" && c.ViewTokenSecret == "" {
+		return nil, fmt.Errorf("-viewing token needs -view-token-secret")
+	}
+	if c.InstanceID == "" {
+		return nil, fmt.Errorf("-instance-id must not be empty")
+	}
+	if c.TURNTTL <= 0 {
+		return nil, fmt.Errorf("-turn-ttl must be positive")
+	}
+	return c, nil
+}
+
+// STUN and TURN URLs of the PeerConnections of a role, viewers have their
+// own when configured
+func (c *Config) ICEServersFor(role string) []string {
+	if role == "viewer" && len(c.ViewerICEServers) > 0 {
+		return c.ViewerICEServers
+	}
+	return c.ICEServers
+}
+
+// Whether the HTTP server serves HTTPS
+func (c *Config) TLS() bool {
+	return c.TLSCert != "" || len(c.ACMEDomains) > 0
+}
+
+// Default instance ID, the host's name
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "sfu"
+	}
+	return name
+}
+
+// Environment variable of a flag, e.g. SFU_ICE_SERVERS for -ice-servers
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// Flag syntax of a value in the config file, lists are comma-separated
+func fileValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fileValue(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Comma-separated flag, setting it replaces the default
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Flag of the ICE port range as min-max
+type portRangeValue Config
+
+func (p *portRangeValue) String() string {
+	if p == nil || p.ICEPortMax == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", p.ICEPortMin, p.ICEPortMax)
+}
+
+func (p *portRangeValue) Set(s string) error {
+	if s == "" {
+		p.ICEPortMin, p.ICEPortMax = 0, 0
+		return nil
+	}
+	low, high, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("expected min-max")
+	}
+	min, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return err
+	}
+	max, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return err
+	}
+	if min == 0 || max < min {
+		return fmt.Errorf("expected 0 < min <= max")
+	}
+	p.ICEPortMin, p.ICEPortMax = uint16(min), uint16(max)
+	return nil
+}
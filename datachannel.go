@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var dataLog = newLogger("data")
+
+// Open data channels of a peer
+type dataChannels struct {
+	mu   sync.Mutex
+	list []*webrtc.DataChannel
+}
+
+// Keep a data channel until it closes
+func (c *dataChannels) add(dc *webrtc.DataChannel) {
+	c.mu.Lock()
+	c.list = append(c.list, dc)
+	c.mu.Unlock()
+
+	dc.OnClose(func() {
+		c.mu.Lock()
+		if i := slices.Index(c.list, dc); i >= 0 {
+			c.list = slices.Delete(c.list, i, i+1)
+		}
+		c.mu.Unlock()
+	})
+}
+
+// Send a message on the open channels with the label, the last error if
+// one failed
+func (c *dataChannels) send(label string, msg webrtc.DataChannelMessage) error {
+	c.mu.Lock()
+	channels := slices.Clone(c.list)
+	c.mu.Unlock()
+
+	var err error
+	for _, dc := range channels {
+		if dc.Label() != label || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if msg.IsString {
+			err = dc.SendText(string(msg.Data))
+		} else {
+			err = dc.Send(msg.Data)
+		}
+	}
+	return err
+}
+
+// Whether a publisher asks for a data-only stream with ?mode=data. Such a
+// stream carries no media: messages the publisher sends on a data channel
+// go out to every viewer on their channel of the same label and viewers'
+// messages to the publisher, e.g. to measure data channel throughput,
+// ordering and reliability through the server at scale. Each side opens its
+// own channels, so their ordering and retransmits are those it chose.
+func parseDataOnly(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("mode") {
+	case "":
+		return false, nil
+	case "data":
+		return true, nil
+	}
+	return false, newSignalingError(http.StatusBadRequest, "mode must be data")
+}
+
+// Whether an offer has audio or video sections, which data-only publishers
+// may not send
+func offerHasMedia(offer webrtc.SessionDescription) bool {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return false
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if kind := media.MediaName.Media; strings.EqualFold(kind, "audio") || strings.EqualFold(kind, "video") {
+			return true
+		}
+	}
+	return false
+}
+
+// Relay a data channel of a data-only stream's publisher to its viewers,
+// recording its messages like those of other publishers
+func relayPublisherChannel(room *Room, p *Publisher, dc *webrtc.DataChannel) {
+	p.channels.add(dc)
+	logDataChannel(p.peer, dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		recordMessage(room, "publisher "+p.id, dc.Label(), msg)
+		for _, v := range room.getViewers() {
+			v.sendData(dc.Label(), msg)
+		}
+	})
+}
+
+// Relay a data channel of a viewer of a data-only stream to its publisher
+func relayViewerChannel(room *Room, v *Viewer, dc *webrtc.DataChannel) {
+	v.channels.add(dc)
+	logDataChannel(v.peer, dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		recordMessage(room, "viewer "+v.id, dc.Label(), msg)
+		if p := room.getPublisher(); p != nil && p.dataOnly {
+			if err := p.channels.send(dc.Label(), msg); err != nil {
+				p.log(dataLog).warnf("[publisher %s] Error sending on data channel %q: %v", p.id, dc.Label(), err)
+			}
+		}
+	})
+}
+
+// Log the reliability a peer chose for a data channel
+func logDataChannel(p *peer, dc *webrtc.DataChannel) {
+	reliability := "reliable"
+	if n := dc.MaxRetransmits(); n != nil {
+		reliability = fmt.Sprintf("at most %d retransmits", *n)
+	} else if ms := dc.MaxPacketLifeTime(); ms != nil {
+		reliability = fmt.Sprintf("at most %dms lifetime", *ms)
+	}
+	order := "ordered"
+	if !dc.Ordered() {
+		order = "unordered"
+	}
+	p.log(dataLog).infof("[%s %s] Data channel %q opened, %s and %s.", p.role, p.id, dc.Label(), order, reliability)
+}
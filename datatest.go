@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How long a data channel test measures by default and at most
+	defaultDataTest = 10 * time.Second
+	maxDataTest     = 60 * time.Second
+	// Test connections that send nothing for this long are closed
+	dataTestTimeout = 30 * time.Second
+	// How long results stay available from /api/datatests/{id}
+	dataTestRetention = time.Hour
+	// Echoes are dropped while this much is waiting to be sent, so a client
+	// sending faster than its path carries can't grow the server's buffers
+	maxDataTestBuffered = 4 << 20
+	// Label of the channels the server echoes, it sinks the others
+	dataTestEchoLabel = "echo"
+)
+
+var dataTestLog = newLogger("datatest")
+
+// Outcome of a data channel test, sent to the client as
+// {"type":"data-test-result","dataResult":{...}} and kept at
+// /api/datatests/{id}
+type dataTestResult struct {
+	ID      string    `json:"id"`
+	Started time.Time `json:"started"`
+	// Seconds measured, from the first message
+	Duration float64             `json:"duration"`
+	Running  bool                `json:"running,omitempty"`
+	Channels []dataChannelResult `json:"channels"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// What arrived on one of the test's channels, with the reliability the
+// client opened it with
+type dataChannelResult struct {
+	Label          string  `json:"label"`
+	Echo           bool    `json:"echo"`
+	Ordered        bool    `json:"ordered"`
+	MaxRetransmits *uint16 `json:"maxRetransmits,omitempty"`
+	MaxLifetime    *uint16 `json:"maxPacketLifeTime,omitempty"`
+	Messages       int     `json:"messages"`
+	Bytes          int     `json:"bytes"`
+	// Bits per second received from the first to the last message
+	Bitrate        int `json:"bitrate"`
+	EchoedMessages int `json:"echoedMessages,omitempty"`
+	// Echoes dropped while too much was waiting to be sent
+	DroppedEchoes int `json:"droppedEchoes,omitempty"`
+
+	first, last time.Time
+}
+
+// Data channel test in progress or done
+type dataTest struct {
+	mu       sync.Mutex
+	result   dataTestResult
+	channels []*dataChannelResult
+	done     bool
+	ended    time.Time
+}
+
+var (
+	dataTestsMu sync.Mutex
+	dataTests   = make(map[string]*dataTest)
+)
+
+// Length of the data channel test from the ?duration= of the request
+func parseDataTestDuration(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("duration")
+	if value == "" {
+		return defaultDataTest, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 || d > maxDataTest {
+		return 0, newSignalingError(http.StatusBadRequest, "duration must be a duration up to "+maxDataTest.String())
+	}
+	return d, nil
+}
+
+func (t *dataTest) observe(c *dataChannelResult, size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	now := time.Now()
+	if c.first.IsZero() {
+		c.first = now
+	}
+	c.last = now
+	c.Messages++
+	c.Bytes += size
+}
+
+func (t *dataTest) echoed(c *dataChannelResult, sent bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sent {
+		c.EchoedMessages++
+	} else {
+		c.DroppedEchoes++
+	}
+}
+
+// Result so far, or the final one once the test is done
+func (t *dataTest) snapshot() dataTestResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := t.result
+	res.Running = !t.done
+	res.Channels = make([]dataChannelResult, 0, len(t.channels))
+	var first, last time.Time
+	for _, c := range t.channels {
+		r := *c
+		if elapsed := c.last.Sub(c.first); elapsed > 0 {
+			r.Bitrate = int(float64(c.Bytes*8) / elapsed.Seconds())
+		}
+		if !c.first.IsZero() && (first.IsZero() || c.first.Before(first)) {
+			first = c.first
+		}
+		if c.last.After(last) {
+			last = c.last
+		}
+		res.Channels = append(res.Channels, r)
+	}
+	sort.Slice(res.Channels, func(i, j int) bool { return res.Channels[i].Label < res.Channels[j].Label })
+	if !first.IsZero() {
+		res.Duration = last.Sub(first).Seconds()
+	} else if t.done {
+		res.Error = "No messages received"
+	}
+	return res
+}
+
+// Drop results older than dataTestRetention, with dataTestsMu held
+func expireDataTests() {
+	for id, t := range dataTests {
+		t.mu.Lock()
+		expired := t.done && time.Since(t.ended) > dataTestRetention
+		t.mu.Unlock()
+		if expired {
+			delete(dataTests, id)
+		}
+	}
+}
+
+// Set up a throwaway PeerConnection measuring the data channels the client
+// opens: messages on channels labeled "echo" are sent back as they are, the
+// others are only counted. The test runs for duration from the first
+// message; onResult then gets the result and the connection is closed.
+// request is the correlation ID the test is logged with.
+func negotiateDataTest(request string, offer webrtc.SessionDescription, duration time.Duration, onCandidate func(*webrtc.ICECandidate), onResult func(dataTestResult)) (*peer, *webrtc.SessionDescription, error) {
+	if services.isStopping() {
+		return nil, nil, errShuttingDown
+	}
+	dlog := dataTestLog.withRequest(request)
+	config, settingEngine, err := peerConnectionSettings("publisher")
+	if err != nil {
+		dlog.errorf("Error configuring PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(config)
+	if err != nil {
+		dlog.errorf("Error creating PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
+	}
+
+	p := newPeer("data-test", "", request, pc)
+	dlog = p.log(dataTestLog)
+	test := &dataTest{result: dataTestResult{ID: p.id, Started: time.Now()}}
+	dataTestsMu.Lock()
+	expireDataTests()
+	dataTests[p.id] = test
+	dataTestsMu.Unlock()
+
+	var finishOnce sync.Once
+	finish := func() {
+		finishOnce.Do(func() {
+			test.mu.Lock()
+			test.done = true
+			test.ended = time.Now()
+			test.mu.Unlock()
+			res := test.snapshot()
+			if res.Error == "" {
+				dlog.infof("[data-test %s] %d channels measured over %.1fs.", p.id, len(res.Channels), res.Duration)
+			} else {
+				dlog.warnf("[data-test %s] %s.", p.id, res.Error)
+			}
+			onResult(res)
+			p.close(func() {})
+		})
+	}
+	timeout := time.AfterFunc(dataTestTimeout, finish)
+	var startOnce sync.Once
+
+	pc.OnICECandidate(onCandidate)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		dlog.debugf("[data-test %s] Peer Connection State has changed: %s", p.id, s.String())
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			timeout.Stop()
+			finish()
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		c := &dataChannelResult{Label: dc.Label(), Echo: dc.Label() == dataTestEchoLabel, Ordered: dc.Ordered(), MaxRetransmits: dc.MaxRetransmits(), MaxLifetime: dc.MaxPacketLifeTime()}
+		test.mu.Lock()
+		test.channels = append(test.channels, c)
+		test.mu.Unlock()
+		logDataChannel(p, dc)
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			startOnce.Do(func() {
+				timeout.Stop()
+				time.AfterFunc(duration, finish)
+			})
+			test.observe(c, len(msg.Data))
+			if !c.Echo {
+				return
+			}
+			if dc.BufferedAmount() > maxDataTestBuffered {
+				test.echoed(c, false)
+				return
+			}
+			var err error
+			if msg.IsString {
+				err = dc.SendText(string(msg.Data))
+			} else {
+				err = dc.Send(msg.Data)
+			}
+			test.echoed(c, err == nil)
+		})
+	})
+
+	// Negotiation failed, the error is the result
+	fail := func() {
+		finishOnce.Do(func() {})
+		timeout.Stop()
+		dataTestsMu.Lock()
+		delete(dataTests, p.id)
+		dataTestsMu.Unlock()
+		p.close(func() {})
+	}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		dlog.errorf("Error setting remote description: %v", err)
+		fail()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set remote description")
+	}
+	p.flushPendingCandidates()
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		dlog.errorf("Error creating answer: %v", err)
+		fail()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		dlog.errorf("Error setting local description: %v", err)
+		fail()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
+	}
+	dlog.infof("[data-test %s] Measuring data channels for %v.", p.id, duration)
+	return p, &answer, nil
+}
+
+// Handler for GET /api/datatests/{id}, the result of a data channel test,
+// so far while it is running
+func dataTestHandler(w http.ResponseWriter, r *http.Request) {
+	dataTestsMu.Lock()
+	test, ok := dataTests[r.PathValue("id")]
+	dataTestsMu.Unlock()
+	if !ok {
+		http.Error(w, "No such data channel test", http.StatusNotFound)
+		return
+	}
+	res := test.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
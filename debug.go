@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+)
+
+// Whether the runtime diagnostics under /debug/ are served, from -debug
+var debugEnabled bool
+
+func init() {
+	// Counts of what the forwarding loops hold on to, next to expvar's
+	// memstats, so leaks show up in /debug/vars
+	expvar.Publish("sfu", expvar.Func(func() interface{} {
+		rooms := listRooms()
+		var publishers, viewers, viewerTracks, fanouts int
+		for _, room := range rooms {
+			if room.getPublisher() != nil {
+				publishers++
+			}
+			fanouts += len(room.tracks())
+			for _, v := range room.getViewers() {
+				viewers++
+				viewerTracks += len(v.getTracks())
+			}
+		}
+		peersMu.Lock()
+		peerCount := len(peers)
+		peersMu.Unlock()
+		wsSessionsMu.Lock()
+		sockets := len(wsSessions)
+		wsSessionsMu.Unlock()
+		return map[string]int{
+			"goroutines":   runtime.NumGoroutine(),
+			"rooms":        len(rooms),
+			"publishers":   publishers,
+			"viewers":      viewers,
+			"fanouts":      fanouts,
+			"viewerTracks": viewerTracks,
+			"peers":        peerCount,
+			"sockets":      sockets,
+		}
+	}))
+}
+
+// Guard of the handlers net/http/pprof and expvar register on the default
+// mux as they are imported: paths under /debug/ answer 404 unless -debug is
+// set and need an admin when accounts are enabled, like the admin API.
+func guardDebug(h http.Handler) http.Handler {
+	admin := requireAccount(true, h.ServeHTTP)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := path.Clean("/" + r.URL.Path); p != "/debug" && !strings.HasPrefix(p, "/debug/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !debugEnabled {
+			http.NotFound(w, r)
+			return
+		}
+		admin(w, r)
+	})
+}
+
+// Handler for GET /debug/goroutines, the stack of every goroutine as a
+// panic prints them, e.g. to find forwarding loops of closed peers that
+// never exited. /debug/pprof/goroutine?debug=1 groups them by stack instead.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d goroutines\n\n", runtime.NumGoroutine())
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
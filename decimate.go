@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Largest decimation a viewer can ask for
+const maxDecimation = 64
+
+// Drops video frames of a viewer track so the viewer gets about one frame in
+// every, for thumbnails, monitoring walls and metered connections. Only
+// frames nothing else refers to are dropped: VP8 sent with temporal layers
+// loses its upper layers, each one halving the frame rate, and other video
+// is cut to the keyframe of every N-th GOP, a still picture refreshed as
+// often as the publisher sends keyframes (see -max-keyframe-interval).
+// Viewers can also cap the temporal layers of VP8, a quality ladder without
+// simulcast or transcoding.
+type frameDecimator struct {
+	every int
+	// Lowest temporal layers kept, 0 for all
+	layers int
+
+	started bool
+	// Timestamp of the current frame and whether it is forwarded
+	frameTS   uint32
+	keepFrame bool
+	// Highest VP8 temporal layer seen, layered once one was
+	layered bool
+	maxTID  uint8
+	// Keyframes seen since the track started on its fanout
+	keyframes int
+	// VP8 frames with a picture ID left out, the picture IDs of the next
+	// ones are moved back by as many
+	pictureIDGap uint16
+}
+
+// Whether a packet of the track's video is forwarded. Frames are told apart
+// by their timestamp and decided on their first packet.
+func (d *frameDecimator) keep(mimeType string, packet *rtp.Packet) bool {
+	if d.every <= 1 && d.layers == 0 {
+		return true
+	}
+	if d.started && packet.Timestamp == d.frameTS {
+		return d.keepFrame
+	}
+	d.started, d.frameTS = true, packet.Timestamp
+	d.keepFrame = d.keepNewFrame(mimeType, packet.Payload)
+	if !d.keepFrame && strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		if _, ok := vp8PictureID(packet.Payload); ok {
+			d.pictureIDGap++
+		}
+	}
+	return d.keepFrame
+}
+
+// Packet to forward, a copy whose VP8 picture ID follows the last frame
+// forwarded once frames were left out
+func (d *frameDecimator) renumber(mimeType string, packet *rtp.Packet) *rtp.Packet {
+	if d.pictureIDGap == 0 || !strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return packet
+	}
+	shifted := *packet
+	shifted.Payload = shiftVP8PictureID(packet.Payload, d.pictureIDGap)
+	return &shifted
+}
+
+func (d *frameDecimator) keepNewFrame(mimeType string, payload []byte) bool {
+	tid, hasTID := vp8TemporalLayer(mimeType, payload)
+	if hasTID {
+		d.layered = true
+		if tid > d.maxTID {
+			d.maxTID = tid
+		}
+	}
+	if d.layered {
+		keepTID := int(d.maxTID)
+		if d.every > 1 {
+			// Every layer dropped halves the frame rate
+			keepTID -= bits.Len(uint(d.every)) - 1
+		}
+		if d.layers > 0 && d.layers-1 < keepTID {
+			keepTID = d.layers - 1
+		}
+		// The base layer stays
+		return tid == 0 || int(tid) <= keepTID
+	}
+	if d.every <= 1 {
+		return true
+	}
+	if !isKeyframe(mimeType, payload) {
+		return false
+	}
+	d.keyframes++
+	return (d.keyframes-1)%d.every == 0
+}
+
+// Start over on a new fanout, its first keyframe is forwarded
+func (d *frameDecimator) restart() {
+	d.started, d.layered, d.maxTID, d.keyframes, d.pictureIDGap = false, false, 0, 0, 0
+}
+
+// Decimation of a viewer's video by the ?decimate= of the request, e.g.
+// decimate=4 for about one frame in four. 0 when not given.
+func parseDecimation(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("decimate")
+	if value == "" {
+		return 0, nil
+	}
+	return validDecimation(value)
+}
+
+func validDecimation(value string) (int, error) {
+	every, err := strconv.Atoi(value)
+	if err != nil || every < 1 || every > maxDecimation {
+		return 0, newSignalingError(http.StatusBadRequest, "decimate must be a number from 1 to "+strconv.Itoa(maxDecimation))
+	}
+	return every, nil
+}
+
+// Forward about one frame in every of the viewer's video, the current tracks
+// and those added later. 1 forwards every frame again.
+func (v *Viewer) setDecimation(every int) {
+	v.decimation.Store(int32(every))
+	for _, t := range v.getTracks() {
+		t.setDecimation(every)
+	}
+	if every > 1 {
+		v.log(viewLog).infof("[viewer %s] Video decimated to one frame in %d.", v.id, every)
+	}
+}
+
+func (t *viewerTrack) setDecimation(every int) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.mu.Lock()
+	t.decimator.every = every
+	t.mu.Unlock()
+}
+
+// Handler for POST /view/decimate {"id":"<viewer ID>","every":4} changing
+// the share of the video frames a viewer receives
+func viewDecimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID    string `json:"id"`
+		Every int    `json:"every"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	every, err := validDecimation(strconv.Itoa(req.Every))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	p := lookupPeer(req.ID)
+	if p == nil || p.role != "viewer" {
+		http.Error(w, "Unknown peer", http.StatusNotFound)
+		return
+	}
+	var viewer *Viewer
+	if room := getRoom(p.stream); room != nil {
+		viewer = room.getViewer(p.id)
+	}
+	if viewer == nil {
+		http.Error(w, "Unknown peer", http.StatusNotFound)
+		return
+	}
+	viewer.setDecimation(every)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID    string `json:"id"`
+		Every int    `json:"every"`
+	}{viewer.id, every})
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Outputs attached to a stream through the API, at most this many each
+const maxEgressesPerStream = 8
+
+var egressLog = newLogger("egress")
+
+var (
+	// Attached outputs by stream, in the order they were attached
+	egresses   = make(map[string][]egress)
+	egressesMu sync.Mutex
+)
+
+// An output of a stream. Viewers are egresses of their own accord, the
+// others are attached with POST /api/streams/{stream}/egress and stay
+// until detached, following the stream across publisher sessions where
+// they can. Any combination can be attached to a stream, including several
+// of a type.
+type egress interface {
+	egressID() string
+	status() egressStatus
+	stop()
+}
+
+// State of an egress as returned by the API, without credentials
+type egressStatus struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Target    string     `json:"target,omitempty"`
+	Running   bool       `json:"running"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	// Egress rule that attached it, see streamRule
+	Rule string `json:"rule,omitempty"`
+}
+
+// A viewer watching over WebRTC
+type viewerEgress struct {
+	room   *Room
+	viewer *Viewer
+}
+
+func (e viewerEgress) egressID() string { return e.viewer.id }
+
+func (e viewerEgress) status() egressStatus {
+	return egressStatus{ID: e.viewer.id, Type: "webrtc", Target: remoteAddress(e.viewer.pc), Running: true}
+}
+
+func (e viewerEgress) stop() { e.room.closeViewer(e.viewer) }
+
+// A push to an RTMP or MPEG-TS endpoint
+type restreamEgress struct {
+	id string
+	*restream
+}
+
+func (e *restreamEgress) egressID() string { return e.id }
+
+func (e *restreamEgress) status() egressStatus {
+	st := e.restream.status()
+	typ := "rtmp"
+	if e.format == restreamMPEGTS {
+		typ = "mpegts"
+	}
+	return egressStatus{ID: e.id, Type: typ, Target: st.URL, Running: st.Running, Since: st.Since, LastError: st.LastError}
+}
+
+// Plain RTP to an external consumer
+type forwardEgress struct {
+	*externalForward
+}
+
+func (e forwardEgress) egressID() string { return e.ID }
+
+func (e forwardEgress) status() egressStatus {
+	target := "video " + e.Video + ", audio " + e.Audio
+	switch {
+	case e.Audio == "":
+		target = "video " + e.Video
+	case e.Video == "":
+		target = "audio " + e.Audio
+	}
+	return egressStatus{ID: e.ID, Type: "rtp", Target: target, Running: getRoom(e.Stream) == e.room && e.room.getPublisher() != nil}
+}
+
+// How long a WebM recording waits for the publisher's second track, the
+// file has the tracks there are when it starts
+const recordEgressTrackWait = time.Second
+
+// Recording of every publishing session of the stream
+type recordEgress struct {
+	id   string
+	room *Room
+	webm bool
+
+	mu        sync.Mutex
+	recorded  *Publisher
+	rec       *recording
+	lastError string
+	stopped   bool
+}
+
+func startRecordEgress(stream string, webm bool) *recordEgress {
+	e := &recordEgress{id: newID(), room: getOrCreateRoom(stream), webm: webm}
+	e.room.subscribeTracks(e)
+	return e
+}
+
+// Start recording each new publisher of the stream on its first track. A
+// WebM file needs its tracks up front, so it waits for both a video and an
+// audio track for a moment.
+func (e *recordEgress) trackAdded(p *Publisher, t *trackFanout) {
+	if !e.webm {
+		e.record(p)
+		return
+	}
+	var video, audio bool
+	for _, t := range p.getTracks() {
+		video = video || t.Kind() == webrtc.RTPCodecTypeVideo
+		audio = audio || t.Kind() == webrtc.RTPCodecTypeAudio
+	}
+	if video && audio {
+		e.record(p)
+	} else {
+		time.AfterFunc(recordEgressTrackWait, func() { e.record(p) })
+	}
+}
+
+func (e *recordEgress) trackRemoved(*Publisher, *trackFanout) {}
+
+func (e *recordEgress) record(p *Publisher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped || e.recorded == p || e.room.getPublisher() != p {
+		return
+	}
+	e.recorded = p
+	rec, err := p.startRecording(e.webm)
+	e.rec = rec
+	if err != nil {
+		e.lastError = err.Error()
+		egressLog.withStream(e.room.name).warnf("Error recording publisher %s: %v", p.id, err)
+	}
+}
+
+func (e *recordEgress) egressID() string { return e.id }
+
+func (e *recordEgress) status() egressStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := egressStatus{ID: e.id, Type: "record", Target: media.String(), LastError: e.lastError}
+	if e.rec != nil && !e.stopped {
+		e.rec.mu.Lock()
+		st.Running, st.Since = !e.rec.stopped, &e.rec.started
+		e.rec.mu.Unlock()
+	}
+	return st
+}
+
+func (e *recordEgress) stop() {
+	e.room.unsubscribeTracks(e)
+	e.mu.Lock()
+	e.stopped = true
+	if e.recorded != nil && e.rec != nil && e.recorded.currentRecording() == e.rec {
+		e.recorded.stopRecording()
+	}
+	e.mu.Unlock()
+	e.room.removeIfEmpty()
+}
+
+// HLS kept running while the stream is live, instead of only while players
+// request it
+type hlsEgress struct {
+	id     string
+	stream string
+	done   chan struct{}
+}
+
+func startHLSEgress(stream string) *hlsEgress {
+	e := &hlsEgress{id: newID(), stream: stream, done: make(chan struct{})}
+	go func() {
+		tick := time.NewTicker(restreamCheckInterval)
+		defer tick.Stop()
+		for {
+			if room := getRoom(stream); room != nil && room.getPublisher() != nil {
+				if p, err := getHLSPipeline(stream); err == nil {
+					p.touch()
+				}
+			}
+			select {
+			case <-tick.C:
+			case <-e.done:
+				return
+			}
+		}
+	}()
+	return e
+}
+
+func (e *hlsEgress) egressID() string { return e.id }
+
+func (e *hlsEgress) status() egressStatus {
+	hlsPipelinesMu.Lock()
+	_, running := hlsPipelines[e.stream]
+	hlsPipelinesMu.Unlock()
+	return egressStatus{ID: e.id, Type: "hls", Target: "/hls/" + e.stream + "/" + hlsPlaylist, Running: running}
+}
+
+// The pipeline stops once players no longer request it
+func (e *hlsEgress) stop() { close(e.done) }
+
+// Viewers and attached outputs of a stream
+func streamEgresses(stream string) []egress {
+	var list []egress
+	if room := getRoom(stream); room != nil {
+		for _, v := range room.getViewers() {
+			list = append(list, viewerEgress{room: room, viewer: v})
+		}
+	}
+	egressesMu.Lock()
+	list = append(list, egresses[stream]...)
+	egressesMu.Unlock()
+	return list
+}
+
+// Detach all outputs, on shutdown
+func stopEgresses() {
+	egressesMu.Lock()
+	defer egressesMu.Unlock()
+	for stream, list := range egresses {
+		for _, e := range list {
+			e.stop()
+		}
+		delete(egresses, stream)
+	}
+}
+
+// Handler for GET /api/streams/{stream}/egress, for the stream's owner: the
+// stream's viewers and attached outputs
+func listEgressHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	list := []egressStatus{}
+	for _, e := range streamEgresses(stream) {
+		list = append(list, e.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Output to attach to a stream, as POST /api/streams/{stream}/egress and
+// egress rules take it
+type egressRequest struct {
+	Type   string `json:"type"`
+	URL    string `json:"url,omitempty"`
+	Video  string `json:"video,omitempty"`
+	Audio  string `json:"audio,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func (req egressRequest) validate() error {
+	switch req.Type {
+	case "rtmp":
+		if !validRestreamURL(req.URL) {
+			return newSignalingError(http.StatusBadRequest, "Invalid RTMP URL, expected rtmp:// or rtmps://")
+		}
+	case "mpegts":
+		if !validMPEGTSURL(req.URL) {
+			return newSignalingError(http.StatusBadRequest, "Invalid MPEG-TS URL, expected udp://, tcp:// or srt://")
+		}
+	case "rtp", "hls":
+	case "record":
+		if req.Format != "" && req.Format != "separate" && req.Format != "webm" {
+			return newSignalingError(http.StatusBadRequest, "Format must be separate or webm")
+		}
+	default:
+		return newSignalingError(http.StatusBadRequest, "Invalid type, expected rtmp, mpegts, rtp, record or hls")
+	}
+	return nil
+}
+
+// Start the output of req for the stream, with egressesMu held; the caller
+// attaches it
+func startEgress(stream string, req egressRequest) (egress, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if len(egresses[stream]) >= maxEgressesPerStream {
+		return nil, newSignalingError(http.StatusTooManyRequests, "Too many outputs attached to this stream")
+	}
+
+	var e egress
+	switch req.Type {
+	case "rtmp":
+		e = &restreamEgress{id: newID(), restream: startRestream(stream, req.URL, restreamFLV)}
+	case "mpegts":
+		e = &restreamEgress{id: newID(), restream: startRestream(stream, req.URL, restreamMPEGTS)}
+	case "rtp":
+		forward, err := startExternalForward(stream, req.Video, req.Audio)
+		if err != nil {
+			return nil, err
+		}
+		e = forwardEgress{forward}
+	case "record":
+		e = startRecordEgress(stream, req.Format == "webm")
+	case "hls":
+		e = startHLSEgress(stream)
+	}
+	return e, nil
+}
+
+// Handler for POST /api/streams/{stream}/egress, for the stream's owner,
+// attaching an output:
+//
+//	{"type": "rtmp", "url": "rtmp://a.rtmp.youtube.com/live2/KEY"}
+//	{"type": "mpegts", "url": "srt://host:9000?passphrase=..."}
+//	{"type": "rtp", "video": "host:5004", "audio": "host:5006"}
+//	{"type": "record", "format": "webm"}
+//	{"type": "hls"}
+func attachEgressHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	var req egressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	egressesMu.Lock()
+	e, err := startEgress(stream, req)
+	if err == nil {
+		egresses[stream] = append(egresses[stream], e)
+	}
+	egressesMu.Unlock()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	st := e.status()
+	egressLog.withStream(stream).infof("Attached %s output %s.", st.Type, st.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(st)
+}
+
+// Handler for DELETE /api/streams/{stream}/egress/{id}, for the stream's
+// owner: detaches an output or disconnects a viewer
+func detachEgressHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	id := r.PathValue("id")
+
+	egressesMu.Lock()
+	for i, e := range egresses[stream] {
+		if e.egressID() != id {
+			continue
+		}
+		egresses[stream] = append(egresses[stream][:i:i], egresses[stream][i+1:]...)
+		if len(egresses[stream]) == 0 {
+			delete(egresses, stream)
+		}
+		egressesMu.Unlock()
+		typ := e.status().Type
+		e.stop()
+		egressLog.withStream(stream).infof("Detached %s output %s.", typ, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	egressesMu.Unlock()
+
+	if room := getRoom(stream); room != nil {
+		if v := room.getViewer(id); v != nil {
+			room.closeViewer(v)
+			egressLog.withStream(stream).infof("Disconnected viewer %s.", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "No such output", http.StatusNotFound)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Events held for a slow stream before they are dropped
+	peerEventBuffer = 64
+	// Comment lines keeping idle streams open through proxies
+	peerEventKeepalive = 15 * time.Second
+)
+
+var eventsLog = newLogger("events")
+
+// Event of a peer on its /events/{id} stream: a gathered "candidate",
+// "end-of-candidates", a change of the "connection-state" or "ice-state",
+// or an "offer" of new tracks to answer with POST /renegotiate
+type peerEvent struct {
+	Type      string                     `json:"type"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	State     string                     `json:"state,omitempty"`
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+}
+
+// Follow the peer's events, starting with the candidates gathered so far.
+// Call the returned function once done.
+func (p *peer) subscribeEvents() (<-chan peerEvent, func()) {
+	ch := make(chan peerEvent, peerEventBuffer)
+	p.iceMutex.Lock()
+	for i := range p.iceCandidates {
+		ch <- peerEvent{Type: "candidate", Candidate: &p.iceCandidates[i]}
+	}
+	p.iceCandidates = nil
+	if p.gathered {
+		ch <- peerEvent{Type: "end-of-candidates"}
+	}
+	if p.eventSubs == nil {
+		p.eventSubs = make(map[chan peerEvent]struct{})
+	}
+	p.eventSubs[ch] = struct{}{}
+	p.iceMutex.Unlock()
+
+	return ch, func() {
+		p.iceMutex.Lock()
+		delete(p.eventSubs, ch)
+		p.iceMutex.Unlock()
+	}
+}
+
+// Push an event to the peer's streams, with iceMutex held. Returns false
+// when nobody follows the peer.
+func (p *peer) publishEventLocked(e peerEvent) bool {
+	for ch := range p.eventSubs {
+		select {
+		case ch <- e:
+		default:
+			p.log(eventsLog).warnf("[%s %s] Event stream too slow, %s dropped.", p.role, p.id, e.Type)
+		}
+	}
+	return len(p.eventSubs) > 0
+}
+
+// Whether an /events stream follows the peer
+func (p *peer) followed() bool {
+	p.iceMutex.Lock()
+	defer p.iceMutex.Unlock()
+	return len(p.eventSubs) > 0
+}
+
+func (p *peer) publishEvent(e peerEvent) {
+	p.iceMutex.Lock()
+	p.publishEventLocked(e)
+	p.iceMutex.Unlock()
+}
+
+// Handler for GET /events/{id}, Server-Sent Events of a publisher's or
+// viewer's gathered ICE candidates and connection state changes as they
+// happen, for clients signaling over plain HTTP rather than /ws. It needs
+// the peer ID and, as ?secret=, the secret the client got with its answer.
+// The stream starts with the current connection state and ends once the
+// connection is closed.
+//
+//	event: candidate
+//	data: {"type":"candidate","candidate":{"candidate":"candidate:...","sdpMid":"0","sdpMLineIndex":0}}
+func peerEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := authorizedPeer(r, id)
+	if p == nil || p.pc == nil || (p.role != "publisher" && p.role != "viewer") {
+		http.Error(w, "No such peer", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := p.subscribeEvents()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	closed := false
+	write := func(e peerEvent) bool {
+		closed = closed || e.Type == "connection-state" && e.State == webrtc.PeerConnectionStateClosed.String()
+		data, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !write(peerEvent{Type: "connection-state", State: p.pc.ConnectionState().String()}) {
+		return
+	}
+	p.log(eventsLog).debugf("[%s %s] Event stream opened.", p.role, p.id)
+
+	keepalive := time.NewTicker(peerEventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if !write(e) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-p.done:
+			// Deliver what was published before the peer closed
+			for {
+				select {
+				case e := <-events:
+					write(e)
+				default:
+					if !closed {
+						write(peerEvent{Type: "connection-state", State: webrtc.PeerConnectionStateClosed.String()})
+					}
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Handler for POST /events/{id}, an ICE candidate the client gathered, the
+// other direction of the peer's event stream, so clients signaling over
+// plain HTTP trickle their candidates too. Needs the peer ID and secret
+// like the stream.
+//
+//	{"candidate":"candidate:...","sdpMid":"0","sdpMLineIndex":0}
+func peerCandidateHandler(w http.ResponseWriter, r *http.Request) {
+	p := authorizedPeer(r, r.PathValue("id"))
+	if p == nil || p.pc == nil || (p.role != "publisher" && p.role != "viewer") {
+		http.Error(w, "No such peer", http.StatusNotFound)
+		return
+	}
+
+	var candidate webrtc.ICECandidateInit
+	if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
+		http.Error(w, "Invalid ICE candidate", http.StatusBadRequest)
+		return
+	}
+	if err := p.addRemoteCandidate(candidate); err != nil {
+		p.log(eventsLog).errorf("[%s %s] Error adding ICE candidate: %v", p.role, p.id, err)
+		http.Error(w, "Failed to add ICE candidate", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
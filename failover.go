@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Image shown to viewers of streams gone offline, from -offline-slate
+var offlineSlateImage string
+
+// Frame rate of the offline slate, a still image needs few frames
+const slateFramerate = "5"
+
+var failoverLog = newLogger("failover")
+
+var (
+	offlineSlates   = make(map[string]*offlineSlate)
+	offlineSlatesMu sync.Mutex
+)
+
+// Video of the -offline-slate image encoded by ffmpeg, shared by the viewers
+// of every stream gone offline whose video has its codec. Started by the
+// first one and stopped once nobody watches it.
+type offlineSlate struct {
+	codec  webrtc.RTPCodecCapability
+	fanout *trackFanout
+	ffmpeg *ffmpegProcess
+	conn   *net.UDPConn
+
+	mu       sync.Mutex
+	lastUsed time.Time
+}
+
+// Move the viewers left on the tracks of a stream whose publisher is gone,
+// and of its failover stream once that ended too, to the live publisher of
+// the stream's failover stream, or to the offline slate, rather than leave
+// them on the last frame. They move back as a publisher joins the stream.
+func (r *Room) failover() {
+	if services.isStopping() {
+		return
+	}
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	if r.getPublisher() != nil {
+		return
+	}
+
+	var backup *Publisher
+	target := getMetadata(r.name).Failover
+	if b := getRoom(target); target != "" && target != r.name && b != nil {
+		backup = b.getPublisher()
+	}
+	moved, slated := 0, 0
+	for _, v := range r.getViewers() {
+		for _, vt := range v.getTracks() {
+			current := vt.currentFanout()
+			// Co-hosts still publishing keep their viewers
+			if r.trackOwner(current) != nil || (current.slate && !current.isClosed()) {
+				continue
+			}
+			if f := backupTrack(backup, current); f != nil {
+				if f != current {
+					vt.switchTo(f)
+					backup.requestKeyframe(f.key())
+					moved++
+				}
+				continue
+			}
+			if offlineSlateImage == "" || current.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			f, err := getOfflineSlate(current.Codec())
+			if err != nil {
+				failoverLog.withStream(r.name).warnf("Error showing the offline slate: %v", err)
+				continue
+			}
+			if f != nil {
+				vt.switchTo(f)
+				slated++
+			}
+		}
+	}
+	switch {
+	case moved > 0:
+		failoverLog.withStream(r.name).infof("%d viewer tracks moved to stream %s.", moved, target)
+		go r.events.notify(r, streamNotice{Type: "failover", Publisher: backup.displayID, Failover: target})
+	case slated > 0:
+		failoverLog.withStream(r.name).infof("%d viewer tracks moved to the offline slate.", slated)
+		go r.events.notify(r, streamNotice{Type: "failover", Failover: "offline-slate"})
+	}
+}
+
+// Track of the failover stream's publisher a viewer track on current can
+// move to, nil when it has none. Transcoded video stays on the slate.
+func backupTrack(backup *Publisher, current *trackFanout) *trackFanout {
+	if backup == nil || current.transcoded {
+		return nil
+	}
+	for _, f := range backup.fanouts() {
+		if f.compatible(current) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Fail over the streams using the room as their failover stream, whose
+// viewers it was feeding, once it ended
+func (r *Room) failoverDependents() {
+	for _, room := range listRooms() {
+		if room != r && room.getPublisher() == nil && getMetadata(room.name).Failover == r.name {
+			room.failover()
+		}
+	}
+}
+
+// Fanout of the offline slate in a codec, nil for codecs it isn't encoded to
+func getOfflineSlate(codec webrtc.RTPCodecCapability) (*trackFanout, error) {
+	offlineSlatesMu.Lock()
+	defer offlineSlatesMu.Unlock()
+
+	if s, ok := offlineSlates[codec.MimeType]; ok {
+		s.touch()
+		return s.fanout, nil
+	}
+	for _, c := range variantCodecs() {
+		if !strings.EqualFold(c.MimeType, codec.MimeType) {
+			continue
+		}
+		s, err := startOfflineSlate(c)
+		if err != nil {
+			return nil, err
+		}
+		offlineSlates[codec.MimeType] = s
+		return s.fanout, nil
+	}
+	return nil, nil
+}
+
+func startOfflineSlate(codec webrtc.RTPCodecCapability) (*offlineSlate, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimPrefix(codec.MimeType, "video/"))
+	fanout := newTrackFanout(codec, "video-"+name, "offline", "", webrtc.RTPCodecTypeVideo)
+	fanout.transcoded, fanout.slate = true, true
+	s := &offlineSlate{codec: codec, fanout: fanout, conn: conn, lastUsed: time.Now()}
+
+	// H264 needs even frame sizes
+	args := []string{"-re", "-loop", "1", "-framerate", slateFramerate, "-i", offlineSlateImage, "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2"}
+	if s.ffmpeg, err = startFFmpeg("offline-slate", append(args, rtpEncoderArgs(name, conn)...)...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	failoverLog.infof("Offline slate started in %s.", codec.MimeType)
+
+	go readRTP(conn, func(packet *rtp.Packet) {
+		s.fanout.WriteRTP(packet)
+	})
+	go s.run()
+	return s, nil
+}
+
+// Stop the slate once nobody watched it for variantIdleTimeout or ffmpeg
+// exits
+func (s *offlineSlate) run() {
+	idle := time.NewTicker(variantIdleTimeout / 4)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-idle.C:
+			if s.stopIfIdle() {
+				failoverLog.infof("No viewers of the %s offline slate left, slate stopped.", s.codec.MimeType)
+				return
+			}
+		case <-s.ffmpeg.exited():
+			failoverLog.warnf("ffmpeg exited, %s offline slate stopped.", s.codec.MimeType)
+			s.stop()
+			return
+		}
+	}
+}
+
+func (s *offlineSlate) touch() {
+	s.mu.Lock()
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+}
+
+// Stop the slate if it had no viewers for variantIdleTimeout, checked with
+// the slates' lock held so no viewer gets it in between
+func (s *offlineSlate) stopIfIdle() bool {
+	offlineSlatesMu.Lock()
+	if s.fanout.viewerCount() > 0 {
+		s.touch()
+	}
+	s.mu.Lock()
+	idle := time.Since(s.lastUsed) > variantIdleTimeout
+	s.mu.Unlock()
+	if idle && offlineSlates[s.codec.MimeType] == s {
+		delete(offlineSlates, s.codec.MimeType)
+	}
+	offlineSlatesMu.Unlock()
+
+	if idle {
+		s.stop()
+	}
+	return idle
+}
+
+func (s *offlineSlate) stop() {
+	offlineSlatesMu.Lock()
+	if offlineSlates[s.codec.MimeType] == s {
+		delete(offlineSlates, s.codec.MimeType)
+	}
+	offlineSlatesMu.Unlock()
+
+	s.ffmpeg.stop()
+	s.conn.Close()
+	s.fanout.close()
+}
+
+// Move a viewer track from the offline slate back to its stream's codec
+// variant, viewers whose offer lacks the published codec get it again
+func (v *Viewer) resumeVariant(room *Room, vt *viewerTrack, codec webrtc.RTPCodecCapability) {
+	f, err := getCodecVariant(room, codec)
+	if err != nil {
+		variantLog.withStream(room.name).warnf("Error transcoding video to %s: %v", codec.MimeType, err)
+		return
+	}
+	if current := vt.currentFanout(); current.slate {
+		vt.switchTo(f)
+		v.log(failoverLog).debugf("[viewer %s] Back on the %s video from the offline slate.", v.id, codec.MimeType)
+	}
+}
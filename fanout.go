@@ -0,0 +1,529 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Largest GOP kept for replay, longer ones are not cached
+const maxGOPPackets = 4096
+
+// Header extension of the RID an RTX packet repairs
+const sdesRepairRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+// Replay the current GOP to viewers as they attach
+var gopCacheEnabled = true
+
+// Forwards one publisher track to the tracks of its viewers and keeps the
+// packets since the last keyframe, so a new viewer can start decoding right
+// away instead of waiting for the next keyframe
+type trackFanout struct {
+	id       string
+	streamID string
+	// Simulcast layer, empty for a single encoding
+	rid   string
+	kind  webrtc.RTPCodecType
+	codec webrtc.RTPCodecCapability
+	// Header extensions of the publisher's session not to forward, the
+	// MID and RID of viewers are their own
+	dropExtensions []uint8
+
+	mu           sync.Mutex
+	viewers      map[*viewerTrack]struct{}
+	gop          []*rtp.Packet
+	gopTimestamp uint32
+	received     uint64
+	// Bytes written to viewers so far
+	sent   uint64
+	closed bool
+	// Frame size of the last VP8 keyframe, 0 until one is seen
+	width, height int
+	// VP8 temporal layers seen, 0 without any
+	temporalLayers int
+	// Highest sequence number received and the packets received behind it,
+	// retransmissions mostly
+	highestSeq  uint16
+	seqReceived bool
+	late        uint64
+	// Video of a codecVariant or the offline slate, not published
+	transcoded bool
+	slate      bool
+}
+
+// Outbound track of one viewer. It is fed by a trackFanout once the viewer's
+// sender is bound to it, and can be moved to the fanout of another
+// publisher without the viewer noticing.
+type viewerTrack struct {
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+
+	mu     sync.Mutex
+	fanout *trackFanout
+	// Fanout of another simulcast layer to move to on its next keyframe
+	next *trackFanout
+	// Set by Bind
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+	primed      bool
+	rewriter    rtpRewriter
+	decimator   frameDecimator
+	// Loss injected by a certification: one packet in lossEvery is dropped
+	// until lossUntil
+	lossEvery int
+	lossUntil time.Time
+	lossCount int
+}
+
+func newTrackFanout(codec webrtc.RTPCodecCapability, id, streamID, rid string, kind webrtc.RTPCodecType) *trackFanout {
+	return &trackFanout{id: id, streamID: streamID, rid: rid, kind: kind, codec: codec, viewers: make(map[*viewerTrack]struct{})}
+}
+
+func (f *trackFanout) ID() string                       { return f.id }
+func (f *trackFanout) RID() string                      { return f.rid }
+func (f *trackFanout) Kind() webrtc.RTPCodecType        { return f.kind }
+func (f *trackFanout) Codec() webrtc.RTPCodecCapability { return f.codec }
+
+// Track to add to a viewer's PeerConnection
+func (f *trackFanout) newViewerTrack() *viewerTrack {
+	return &viewerTrack{fanout: f, id: f.id, streamID: f.streamID, kind: f.kind}
+}
+
+// Forward a packet of the publisher to every viewer, returning the bytes
+// written to them
+func (f *trackFanout) WriteRTP(packet *rtp.Packet) uint64 {
+	f.mu.Lock()
+	f.received += uint64(len(packet.Payload))
+	switch diff := int16(packet.SequenceNumber - f.highestSeq); {
+	case !f.seqReceived || diff > 0:
+		f.highestSeq, f.seqReceived = packet.SequenceNumber, true
+	default:
+		f.late++
+	}
+	if f.kind == webrtc.RTPCodecTypeVideo {
+		if w, h, ok := vp8FrameSize(f.codec.MimeType, packet.Payload); ok {
+			f.width, f.height = w, h
+		}
+		if tid, ok := vp8TemporalLayer(f.codec.MimeType, packet.Payload); ok && int(tid) >= f.temporalLayers {
+			f.temporalLayers = int(tid) + 1
+		}
+		if gopCacheEnabled {
+			f.cache(packet)
+		}
+	}
+	if featureEnabled(featureNewForwarder) {
+		return f.forwardUnlocked(packet)
+	}
+	defer f.mu.Unlock()
+
+	var sent uint64
+	for v := range f.viewers {
+		ok, n := v.forward(f, f.gop, packet)
+		sent += n
+		if !ok {
+			delete(f.viewers, v)
+		}
+	}
+	f.sent += sent
+	return sent
+}
+
+// Forward a packet like WriteRTP with the fanout's mutex held on entry,
+// released before writing to the viewers. Only the publisher's read loop
+// writes to a fanout, so the packets still go out in order.
+func (f *trackFanout) forwardUnlocked(packet *rtp.Packet) uint64 {
+	viewers := make([]*viewerTrack, 0, len(f.viewers))
+	for v := range f.viewers {
+		viewers = append(viewers, v)
+	}
+	// Cached packets are never changed, only replaced by a new GOP
+	gop := f.gop
+	f.mu.Unlock()
+
+	var sent uint64
+	var gone []*viewerTrack
+	for _, v := range viewers {
+		ok, n := v.forward(f, gop, packet)
+		sent += n
+		if !ok {
+			gone = append(gone, v)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, v := range gone {
+		// The track may have moved back in the meantime
+		if !v.fedBy(f) {
+			delete(f.viewers, v)
+		}
+	}
+	f.sent += sent
+	return sent
+}
+
+// Number of viewer tracks the fanout feeds
+func (f *trackFanout) viewerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.viewers)
+}
+
+// Mark the fanout as ended once the publisher's track is gone, its viewers
+// wait for the track of a new publisher
+func (f *trackFanout) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.gop = nil
+}
+
+func (f *trackFanout) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// Key of the fanout among the publisher's tracks, one per simulcast layer
+func (f *trackFanout) key() string {
+	if f.rid == "" {
+		return f.id
+	}
+	return f.id + ":" + f.rid
+}
+
+// Payload bytes received so far, used to rank simulcast layers
+func (f *trackFanout) bytesReceived() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.received
+}
+
+// Move the viewers of the fanout to another one, for a simulcast layer
+// that ended while others of the same track go on
+func (f *trackFanout) moveViewers(to *trackFanout) int {
+	f.mu.Lock()
+	viewers := make([]*viewerTrack, 0, len(f.viewers))
+	for v := range f.viewers {
+		viewers = append(viewers, v)
+	}
+	f.mu.Unlock()
+
+	moved := 0
+	for _, v := range viewers {
+		if v.currentFanout() == f {
+			v.switchTo(to)
+			moved++
+		}
+	}
+	return moved
+}
+
+// Move the viewers of the fanout to another simulcast layer like
+// switchLayer, returning those moved. Viewers already moving there are left
+// alone.
+func (f *trackFanout) moveLayer(to *trackFanout) []*viewerTrack {
+	f.mu.Lock()
+	viewers := make([]*viewerTrack, 0, len(f.viewers))
+	for v := range f.viewers {
+		viewers = append(viewers, v)
+	}
+	f.mu.Unlock()
+
+	var moved []*viewerTrack
+	for _, v := range viewers {
+		if v.currentFanout() == f && v.pendingLayer() != to {
+			v.switchLayer(to)
+			moved = append(moved, v)
+		}
+	}
+	return moved
+}
+
+// Whether tracks of the fanout can be moved to other
+func (f *trackFanout) compatible(other *trackFanout) bool {
+	return f.kind == other.kind && strings.EqualFold(f.codec.MimeType, other.codec.MimeType)
+}
+
+// Bytes of the packets in the GOP cache
+func (f *trackFanout) cachedBytes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, p := range f.gop {
+		n += p.MarshalSize()
+	}
+	return n
+}
+
+// Frame size of the track's video as of its last keyframe, 0 when unknown
+func (f *trackFanout) frameSize() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.width, f.height
+}
+
+// VP8 temporal layers of the track seen so far, 0 without any
+func (f *trackFanout) temporalLayerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.temporalLayers
+}
+
+// Highest sequence number received and the packets received late, false
+// before any
+func (f *trackFanout) sequence() (uint16, uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.highestSeq, f.late, f.seqReceived
+}
+
+// Packets of the keyframe starting the cached GOP, nil without one
+func (f *trackFanout) keyframe() []*rtp.Packet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var packets []*rtp.Packet
+	for _, p := range f.gop {
+		if p.Timestamp != f.gopTimestamp {
+			break
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// Start a new GOP on each keyframe and append to it until the next one
+func (f *trackFanout) cache(packet *rtp.Packet) {
+	if isKeyframe(f.codec.MimeType, packet.Payload) && (len(f.gop) == 0 || packet.Timestamp != f.gopTimestamp) {
+		f.gop = append(f.gop[:0:0], packet)
+		f.gopTimestamp = packet.Timestamp
+		return
+	}
+	if len(f.gop) == 0 {
+		return
+	}
+	if len(f.gop) >= maxGOPPackets {
+		f.gop = nil
+		return
+	}
+	f.gop = append(f.gop, packet)
+}
+
+// Write a packet of the fanout, gop being its cached GOP. Returns false once
+// the track no longer takes packets from the fanout, and the bytes written.
+func (v *viewerTrack) forward(f *trackFanout, gop []*rtp.Packet, packet *rtp.Packet) (bool, uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.writeStream == nil {
+		return v.fanout == f, 0
+	}
+	if v.next == f {
+		// Change layers where the new one can be decoded on its own
+		if !isKeyframe(f.codec.MimeType, packet.Payload) {
+			return true, 0
+		}
+		v.fanout, v.next = f, nil
+		v.primed = true
+		v.decimator.restart()
+	}
+	if v.fanout != f {
+		return false, 0
+	}
+	if !v.primed {
+		v.primed = true
+		v.decimator.restart()
+		// The current packet is the last one of the cached GOP
+		if len(gop) > 0 && gop[len(gop)-1] == packet {
+			var sent uint64
+			for _, p := range gop {
+				sent += v.send(f, p)
+			}
+			return true, sent
+		}
+	}
+	return true, v.send(f, packet)
+}
+
+// Write a packet unless the decimator drops it, the next packets taking
+// its sequence number. Must be called with the track's mutex held.
+func (v *viewerTrack) send(f *trackFanout, packet *rtp.Packet) uint64 {
+	if v.loseNext() {
+		return 0
+	}
+	if !v.decimator.keep(f.codec.MimeType, packet) {
+		v.rewriter.drop(&packet.Header)
+		return 0
+	}
+	return v.write(f, v.decimator.renumber(f.codec.MimeType, packet))
+}
+
+// Whether the track takes packets from the fanout or moves to it next
+func (v *viewerTrack) fedBy(f *trackFanout) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fanout == f || v.next == f
+}
+
+// Must be called with the track's mutex held, returns the bytes written
+func (v *viewerTrack) write(f *trackFanout, packet *rtp.Packet) uint64 {
+	header := packet.Header
+	v.rewriter.rewrite(&header)
+	header.SSRC = uint32(v.ssrc)
+	header.PayloadType = uint8(v.payloadType)
+	if len(header.Extensions) > 0 {
+		header.Extensions = append([]rtp.Extension(nil), header.Extensions...)
+		for _, id := range f.dropExtensions {
+			header.DelExtension(id)
+		}
+		header.Extension = len(header.Extensions) > 0
+	}
+	n, err := v.writeStream.WriteRTP(&header, packet.Payload)
+	if err != nil {
+		return 0
+	}
+	return uint64(n)
+}
+
+// IDs of the MID, RID and repaired RID header extensions negotiated with the publisher
+func simulcastExtensionIDs(receiver *webrtc.RTPReceiver) []uint8 {
+	var ids []uint8
+	for _, e := range receiver.GetParameters().HeaderExtensions {
+		switch e.URI {
+		case sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdesRepairRTPStreamIDURI:
+			ids = append(ids, uint8(e.ID))
+		}
+	}
+	return ids
+}
+
+// Bind is called by the viewer's RTPSender once it starts sending
+func (v *viewerTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	f := v.currentFanout()
+	codec, ok := matchCodec(f.codec, t.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	v.mu.Lock()
+	v.ssrc = t.SSRC()
+	v.payloadType = codec.PayloadType
+	v.writeStream = t.WriteStream()
+	v.rewriter.clockRate = codec.ClockRate
+	v.mu.Unlock()
+
+	f.mu.Lock()
+	f.viewers[v] = struct{}{}
+	f.mu.Unlock()
+	return codec, nil
+}
+
+func (v *viewerTrack) currentFanout() *trackFanout {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fanout
+}
+
+// Feed the track from another fanout. The rewriter keeps sequence numbers
+// and timestamps continuous, and the new fanout's GOP is replayed first.
+func (v *viewerTrack) switchTo(f *trackFanout) {
+	v.mu.Lock()
+	old := v.fanout
+	bound := v.writeStream != nil
+	v.fanout = f
+	v.next = nil
+	v.primed = false
+	v.mu.Unlock()
+
+	if old == f || !bound {
+		return
+	}
+	old.mu.Lock()
+	delete(old.viewers, v)
+	old.mu.Unlock()
+
+	f.mu.Lock()
+	f.viewers[v] = struct{}{}
+	f.mu.Unlock()
+}
+
+// Move the track to another simulcast layer once that layer sends a
+// keyframe, the current one is forwarded until then. Codecs whose keyframes
+// we cannot detect switch right away.
+func (v *viewerTrack) switchLayer(f *trackFanout) {
+	if !canMonitorKeyframes(f.codec.MimeType) {
+		v.switchTo(f)
+		return
+	}
+
+	v.mu.Lock()
+	bound := v.writeStream != nil
+	if v.fanout == f || !bound {
+		v.fanout, v.next = f, nil
+		v.mu.Unlock()
+		return
+	}
+	v.next = f
+	v.mu.Unlock()
+
+	f.mu.Lock()
+	f.viewers[v] = struct{}{}
+	f.mu.Unlock()
+}
+
+func (v *viewerTrack) pendingLayer() *trackFanout {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.next
+}
+
+// Negotiated codec for the track, preferring one with the same fmtp line
+func matchCodec(want webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	var match *webrtc.RTPCodecParameters
+	for i, codec := range negotiated {
+		if !strings.EqualFold(codec.MimeType, want.MimeType) {
+			continue
+		}
+		if codec.SDPFmtpLine == want.SDPFmtpLine {
+			return codec, true
+		}
+		if match == nil {
+			match = &negotiated[i]
+		}
+	}
+	if match == nil {
+		return webrtc.RTPCodecParameters{}, false
+	}
+	return *match, true
+}
+
+func (v *viewerTrack) Unbind(webrtc.TrackLocalContext) error {
+	v.mu.Lock()
+	f, next := v.fanout, v.next
+	v.writeStream = nil
+	v.next = nil
+	v.mu.Unlock()
+
+	f.mu.Lock()
+	delete(f.viewers, v)
+	f.mu.Unlock()
+	if next != nil {
+		next.mu.Lock()
+		delete(next.viewers, v)
+		next.mu.Unlock()
+	}
+	return nil
+}
+
+func (v *viewerTrack) ID() string                { return v.id }
+func (v *viewerTrack) RID() string               { return "" }
+func (v *viewerTrack) StreamID() string          { return v.streamID }
+func (v *viewerTrack) Kind() webrtc.RTPCodecType { return v.kind }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// Names of the feature flags
+const (
+	featureChaos        = "chaos"
+	featureNewForwarder = "new-forwarder"
+	featureLLHLS        = "ll-hls"
+	featureTranscoding  = "transcoding"
+)
+
+const (
+	// Share of the packets forwarded to viewers dropped in chaos mode
+	chaosLossRate = 0.02
+	// Changes of the flags kept for GET /api/admin/features
+	featureAuditSize = 100
+)
+
+// A risky feature that can be turned on and off while the server runs, to
+// try it on live streams and back out right away if it misbehaves
+type featureFlag struct {
+	name        string
+	description string
+	enabled     atomic.Bool
+}
+
+var features = map[string]*featureFlag{
+	featureChaos: {name: featureChaos,
+		description: "drop 2% of the packets forwarded to viewers, to exercise NACKs, PLIs and the players' loss handling"},
+	featureNewForwarder: {name: featureNewForwarder,
+		description: "write packets to viewers after releasing the track's fanout, so joining viewers and stats don't wait on slow writes"},
+	featureLLHLS: {name: featureLLHLS,
+		description: "low-latency HLS for pipelines started from now on: 1s segments and a shorter playlist"},
+	featureTranscoding: {name: featureTranscoding,
+		description: "re-encode H264 for HLS and restreams too, with a keyframe every segment, instead of copying it"},
+}
+
+var featureLog = newLogger("features")
+
+// Change of a flag through the admin API
+type featureChange struct {
+	Time    time.Time `json:"time"`
+	Feature string    `json:"feature"`
+	Enabled bool      `json:"enabled"`
+	// Account that changed it, or the client address while accounts are
+	// disabled
+	By      string `json:"by"`
+	Request string `json:"request,omitempty"`
+}
+
+var featureAudit struct {
+	mu      sync.Mutex
+	changes []featureChange
+}
+
+// Whether a feature is turned on, cheap enough for the packet path
+func featureEnabled(name string) bool {
+	f := features[name]
+	return f != nil && f.enabled.Load()
+}
+
+// Turn on the features of a comma separated list, from -features
+func enableFeatures(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f := features[name]
+		if f == nil {
+			return fmt.Errorf("unknown feature %q, known are %s", name, strings.Join(featureNames(), ", "))
+		}
+		f.enabled.Store(true)
+		featureLog.infof("Feature %s enabled.", name)
+	}
+	return nil
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Whether chaos mode drops the next packet
+func chaosDrop() bool {
+	return featureEnabled(featureChaos) && rand.Float64() < chaosLossRate
+}
+
+// Interceptor dropping packets on their way to the network in chaos mode,
+// each stream on its own and after the NACK responder kept them, so every
+// viewer loses different packets and can get them retransmitted
+type chaosInterceptorFactory struct{}
+
+func (chaosInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &chaosInterceptor{}, nil
+}
+
+type chaosInterceptor struct {
+	interceptor.NoOp
+}
+
+func (*chaosInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if chaosDrop() {
+			return header.MarshalSize() + len(payload), nil
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+type featureStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// State of the flags and their changes, newest first
+func currentFeatures() interface{} {
+	list := make([]featureStatus, 0, len(features))
+	for _, name := range featureNames() {
+		f := features[name]
+		list = append(list, featureStatus{Name: name, Description: f.description, Enabled: f.enabled.Load()})
+	}
+
+	featureAudit.mu.Lock()
+	audit := make([]featureChange, 0, len(featureAudit.changes))
+	for i := len(featureAudit.changes) - 1; i >= 0; i-- {
+		audit = append(audit, featureAudit.changes[i])
+	}
+	featureAudit.mu.Unlock()
+
+	return struct {
+		Features []featureStatus `json:"features"`
+		Audit    []featureChange `json:"audit"`
+	}{list, audit}
+}
+
+// Handler for GET /api/admin/features, every flag, whether it is on and
+// who changed the flags when
+func listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentFeatures())
+}
+
+// Handler for PUT /api/admin/features/{name}, {"enabled": true} turns the
+// flag on and {"enabled": false} off again
+func setFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	f := features[r.PathValue("name")]
+	if f == nil {
+		http.Error(w, "No such feature", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, `Expected {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+		return
+	}
+
+	change := featureChange{Time: time.Now(), Feature: f.name, Enabled: *req.Enabled, By: r.RemoteAddr, Request: requestID(r)}
+	if a := currentAccount(r); a != nil {
+		change.By = a.Username
+	}
+	featureAudit.mu.Lock()
+	was := f.enabled.Swap(*req.Enabled)
+	if was != *req.Enabled {
+		featureAudit.changes = append(featureAudit.changes, change)
+		if len(featureAudit.changes) > featureAuditSize {
+			featureAudit.changes = featureAudit.changes[len(featureAudit.changes)-featureAuditSize:]
+		}
+	}
+	featureAudit.mu.Unlock()
+
+	if was != *req.Enabled {
+		state := "disabled"
+		if *req.Enabled {
+			state = "enabled"
+		}
+		adminLog.forRequest(r).infof("Feature %s %s by %s", f.name, state, change.By)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(featureStatus{Name: f.name, Description: f.description, Enabled: *req.Enabled})
+}
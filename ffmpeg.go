@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Path or name of the ffmpeg binary used for egress
+var ffmpegPath = "ffmpeg"
+
+const (
+	// How long ffmpeg gets to finish its output after an interrupt
+	ffmpegStopTimeout = 5 * time.Second
+
+	// Time ffmpeg gets to open its inputs before the publisher is asked for
+	// a keyframe to start the output with
+	ffmpegInputDelay = time.Second
+)
+
+var ffmpegLog = newLogger("ffmpeg")
+
+// Running ffmpeg processes, for the resource usage of their streams
+var (
+	ffmpegProcesses   = make(map[*ffmpegProcess]struct{})
+	ffmpegProcessesMu sync.Mutex
+)
+
+// A running ffmpeg process, its stderr goes to the log
+type ffmpegProcess struct {
+	stream string
+	cmd    *exec.Cmd
+	done   chan struct{}
+
+	stopOnce sync.Once
+}
+
+// Run ffmpeg with the given arguments for a stream
+func startFFmpeg(stream string, args ...string) (*ffmpegProcess, error) {
+	path, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		ffmpegLog.withStream(stream).errorf("Error finding ffmpeg: %v", err)
+		return nil, newSignalingError(http.StatusServiceUnavailable, "ffmpeg is not available")
+	}
+
+	cmd := exec.Command(path, append([]string{"-hide_banner", "-loglevel", "warning", "-nostdin"}, args...)...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &ffmpegProcess{stream: stream, cmd: cmd, done: make(chan struct{})}
+	ffmpegProcessesMu.Lock()
+	ffmpegProcesses[p] = struct{}{}
+	ffmpegProcessesMu.Unlock()
+	ffmpegLog.withStream(stream).debugf("Started ffmpeg, pid %d.", cmd.Process.Pid)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			ffmpegLog.withStream(stream).warnf("%s", scanner.Text())
+		}
+		err := cmd.Wait()
+		ffmpegLog.withStream(stream).debugf("ffmpeg exited: %v", err)
+		ffmpegProcessesMu.Lock()
+		delete(ffmpegProcesses, p)
+		ffmpegProcessesMu.Unlock()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// Closed once the process exited
+func (p *ffmpegProcess) exited() <-chan struct{} {
+	return p.done
+}
+
+// Interrupt ffmpeg so it finishes its output, killing it if it does not
+// exit in time. Waits for the process to exit.
+func (p *ffmpegProcess) stop() {
+	p.stopOnce.Do(func() {
+		p.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-p.done:
+		case <-time.After(ffmpegStopTimeout):
+			ffmpegLog.withStream(p.stream).warnf("ffmpeg did not exit, killing it.")
+			p.cmd.Process.Kill()
+		}
+	})
+	<-p.done
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Payload types announced in the SDP of forwarded streams
+const (
+	forwardVideoPayloadType = 96
+	forwardAudioPayloadType = 111
+)
+
+var forwardLog = newLogger("forward")
+
+// Sends a room's first video and audio track as plain RTP over UDP, for
+// ffmpeg, GStreamer and the like. Sequence numbers and timestamps stay
+// continuous across publisher takeovers so the consumer keeps decoding.
+type rtpForward struct {
+	room *Room
+
+	mu      sync.Mutex
+	conn    *net.UDPConn
+	outputs []*forwardOutput
+}
+
+// One media section of a forward
+type forwardOutput struct {
+	kind        webrtc.RTPCodecType
+	codec       webrtc.RTPCodecCapability
+	payloadType uint8
+	addr        *net.UDPAddr
+
+	source   *trackFanout
+	rewriter rtpRewriter
+}
+
+// Forward the current tracks of the room to the given addresses, either
+// may be nil to leave out that kind
+func newRTPForward(room *Room, videoAddr, audioAddr *net.UDPAddr) (*rtpForward, error) {
+	f := &rtpForward{room: room}
+	for _, t := range room.tracks() {
+		switch {
+		case t.Kind() == webrtc.RTPCodecTypeVideo && videoAddr != nil && f.output(t.Kind()) == nil:
+			f.outputs = append(f.outputs, &forwardOutput{kind: t.Kind(), codec: t.Codec(), payloadType: forwardVideoPayloadType, addr: videoAddr, source: t})
+		case t.Kind() == webrtc.RTPCodecTypeAudio && audioAddr != nil && f.output(t.Kind()) == nil:
+			f.outputs = append(f.outputs, &forwardOutput{kind: t.Kind(), codec: t.Codec(), payloadType: forwardAudioPayloadType, addr: audioAddr, source: t})
+		}
+	}
+	if len(f.outputs) == 0 {
+		return nil, newSignalingError(http.StatusServiceUnavailable, "Stream is not live")
+	}
+	for _, o := range f.outputs {
+		o.rewriter.clockRate = o.codec.ClockRate
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	f.conn = conn
+	return f, nil
+}
+
+func (f *rtpForward) output(kind webrtc.RTPCodecType) *forwardOutput {
+	for _, o := range f.outputs {
+		if o.kind == kind {
+			return o
+		}
+	}
+	return nil
+}
+
+func (f *rtpForward) writeRTP(t *trackFanout, packet *rtp.Packet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o := f.output(t.Kind())
+	if f.conn == nil || o == nil {
+		return
+	}
+	if o.source != t {
+		return
+	}
+
+	header := packet.Header
+	o.rewriter.rewrite(&header)
+	header.PayloadType = o.payloadType
+	header.Extension = false
+	header.Extensions = nil
+	buf, err := (&rtp.Packet{Header: header, Payload: packet.Payload}).Marshal()
+	if err != nil {
+		return
+	}
+	f.conn.WriteToUDP(buf, o.addr)
+}
+
+// Follow the track of a new publisher
+func (f *rtpForward) trackAdded(p *Publisher, t *trackFanout) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o := f.output(t.Kind()); o != nil && o.source != t && o.source.compatible(t) && !p.hasTrack(o.source) {
+		f.switchSource(p, o, t)
+	}
+}
+
+// Continue on another simulcast layer once the forwarded one ended
+func (f *rtpForward) trackRemoved(p *Publisher, t *trackFanout) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o := f.output(t.Kind()); o != nil && o.source == t {
+		if next := p.bestLayer(t.ID()); next != nil {
+			f.switchSource(p, o, next)
+		}
+	}
+}
+
+// Must be called with the forward's mutex held
+func (f *rtpForward) switchSource(p *Publisher, o *forwardOutput, t *trackFanout) {
+	o.source = t
+	if o.kind == webrtc.RTPCodecTypeVideo {
+		p.requestKeyframe(t.key())
+	}
+}
+
+// SDP describing the forwarded streams to their consumer
+func (f *rtpForward) sdp() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var b strings.Builder
+	host := "IN IP4 127.0.0.1"
+	if len(f.outputs) > 0 {
+		host = sdpAddress(f.outputs[0].addr.IP)
+	}
+	fmt.Fprintf(&b, "v=0\r\no=- 0 0 %s\r\ns=%s\r\nc=%s\r\nt=0 0\r\n", host, f.room.name, host)
+	for _, o := range f.outputs {
+		mimeType := strings.SplitN(o.codec.MimeType, "/", 2)
+		encoding := mimeType[len(mimeType)-1]
+		fmt.Fprintf(&b, "m=%s %d RTP/AVP %d\r\n", o.kind, o.addr.Port, o.payloadType)
+		if addr := sdpAddress(o.addr.IP); addr != host {
+			fmt.Fprintf(&b, "c=%s\r\n", addr)
+		}
+		if o.codec.Channels > 0 {
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d/%d\r\n", o.payloadType, encoding, o.codec.ClockRate, o.codec.Channels)
+		} else {
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", o.payloadType, encoding, o.codec.ClockRate)
+		}
+		if o.codec.SDPFmtpLine != "" {
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", o.payloadType, o.codec.SDPFmtpLine)
+		}
+	}
+	return b.String()
+}
+
+// Network and address of an SDP connection line
+func sdpAddress(ip net.IP) string {
+	if ip.To4() == nil {
+		return "IN IP6 " + ip.String()
+	}
+	return "IN IP4 " + ip.String()
+}
+
+// Mime type of the forwarded track of a kind, empty when left out
+func (f *rtpForward) mimeType(kind webrtc.RTPCodecType) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o := f.output(kind); o != nil {
+		return o.codec.MimeType
+	}
+	return ""
+}
+
+func (f *rtpForward) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// Free local UDP port for a consumer to listen on
+func freeUDPPort() (*net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// Forwards of a stream started through the API, at most this many each
+const maxForwardsPerStream = 4
+
+var (
+	// Forwards to external consumers by stream and ID
+	externalForwards   = make(map[string]map[string]*externalForward)
+	externalForwardsMu sync.Mutex
+)
+
+// A forward to a consumer outside the server, such as a GStreamer or ffmpeg
+// pipeline. It stays a sink of the room until stopped, following the
+// tracks of later publishers.
+type externalForward struct {
+	ID     string `json:"id"`
+	Stream string `json:"stream"`
+	Video  string `json:"video,omitempty"`
+	Audio  string `json:"audio,omitempty"`
+	// Session description for the consumer, e.g. ffmpeg -i forward.sdp
+	SDP string `json:"sdp"`
+
+	room    *Room
+	forward *rtpForward
+}
+
+func (e *externalForward) stop() {
+	e.room.removeSink(e.forward)
+	e.forward.close()
+	e.room.removeIfEmpty()
+}
+
+// Stop all forwards to external consumers, on shutdown
+func stopExternalForwards() {
+	externalForwardsMu.Lock()
+	defer externalForwardsMu.Unlock()
+	for stream, forwards := range externalForwards {
+		for _, e := range forwards {
+			e.stop()
+		}
+		delete(externalForwards, stream)
+	}
+}
+
+// Forward the live stream to host:port addresses, either may be empty
+func startExternalForward(stream, video, audio string) (*externalForward, error) {
+	videoAddr, err := resolveForwardAddr(video)
+	if err != nil {
+		return nil, err
+	}
+	audioAddr, err := resolveForwardAddr(audio)
+	if err != nil {
+		return nil, err
+	}
+	if videoAddr == nil && audioAddr == nil {
+		return nil, newSignalingError(http.StatusBadRequest, "Missing video or audio address")
+	}
+	room := getRoom(stream)
+	if room == nil {
+		return nil, newSignalingError(http.StatusServiceUnavailable, "Stream is not live")
+	}
+	forward, err := newRTPForward(room, videoAddr, audioAddr)
+	if err != nil {
+		return nil, err
+	}
+	room.addSink(forward)
+	if publisher := room.getPublisher(); publisher != nil {
+		publisher.requestKeyframe()
+	}
+
+	e := &externalForward{ID: newID(), Stream: stream, SDP: forward.sdp(), room: room, forward: forward}
+	if o := forward.output(webrtc.RTPCodecTypeVideo); o != nil {
+		e.Video = o.addr.String()
+	}
+	if o := forward.output(webrtc.RTPCodecTypeAudio); o != nil {
+		e.Audio = o.addr.String()
+	}
+	forwardLog.withStream(stream).infof("Forwarding RTP to video %s, audio %s.", e.Video, e.Audio)
+	return e, nil
+}
+
+// Address of a consumer, nil when empty
+func resolveForwardAddr(s string) (*net.UDPAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil || addr.Port == 0 || addr.IP == nil {
+		return nil, newSignalingError(http.StatusBadRequest, fmt.Sprintf("Invalid address %q, expected host:port", s))
+	}
+	return addr, nil
+}
+
+// Handler for POST /api/streams/{stream}/forward, for the stream's owner:
+// {"action": "start", "video": "host:port", "audio": "host:port"} sends the
+// publisher's RTP to the addresses and returns the SDP describing it,
+// {"action": "stop", "id": "..."} ends that forward.
+func forwardHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	var req struct {
+		Action string `json:"action"`
+		ID     string `json:"id"`
+		Video  string `json:"video"`
+		Audio  string `json:"audio"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	externalForwardsMu.Lock()
+	defer externalForwardsMu.Unlock()
+
+	switch req.Action {
+	case "start":
+		if len(externalForwards[stream]) >= maxForwardsPerStream {
+			http.Error(w, "Too many forwards of this stream", http.StatusTooManyRequests)
+			return
+		}
+		e, err := startExternalForward(stream, req.Video, req.Audio)
+		if err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		if externalForwards[stream] == nil {
+			externalForwards[stream] = make(map[string]*externalForward)
+		}
+		externalForwards[stream][e.ID] = e
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+	case "stop":
+		e, ok := externalForwards[stream][req.ID]
+		if !ok {
+			http.Error(w, "No such forward", http.StatusNotFound)
+			return
+		}
+		e.stop()
+		delete(externalForwards[stream], req.ID)
+		if len(externalForwards[stream]) == 0 {
+			delete(externalForwards, stream)
+		}
+		forwardLog.withStream(stream).infof("Stopped forwarding RTP to video %s, audio %s.", e.Video, e.Audio)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+	}
+}
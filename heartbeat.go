@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Label of the data channel viewers send their playback state on
+	heartbeatChannelLabel = "heartbeat"
+	// Viewers without a heartbeat for this long no longer count as watching
+	heartbeatTimeout = time.Minute
+	// Minutes of concurrent-viewer history kept per stream
+	audienceHistoryMinutes = 24 * 60
+)
+
+// Playback states a heartbeat may report
+var playbackStates = map[string]bool{"playing": true, "paused": true, "buffering": true}
+
+var heartbeatLog = newLogger("heartbeat")
+
+var audience = &audienceTracker{streams: make(map[string]*streamAudience)}
+
+type audienceTracker struct {
+	mu      sync.Mutex
+	streams map[string]*streamAudience
+}
+
+// Heartbeats of a stream's viewers, bucketed by minute
+type streamAudience struct {
+	points []audiencePoint
+
+	// Minute being counted and the last state of each viewer seen in it
+	minute time.Time
+	seen   map[string]string
+	// Reactions and raised hands during the minute
+	reactions, hands int
+
+	viewers map[string]*viewerPlayback
+	// Reactions of the stream so far, by reaction
+	reactionTotals map[string]int
+}
+
+// Viewers that sent a heartbeat during a minute, by their last state
+type audiencePoint struct {
+	Minute    time.Time `json:"minute"`
+	Viewers   int       `json:"viewers"`
+	Playing   int       `json:"playing"`
+	Paused    int       `json:"paused"`
+	Buffering int       `json:"buffering"`
+	Reactions int       `json:"reactions"`
+	Hands     int       `json:"raisedHands"`
+}
+
+// Last heartbeat of a viewer
+type viewerPlayback struct {
+	ID       string    `json:"id"`
+	State    string    `json:"state"`
+	Position float64   `json:"position"`
+	Updated  time.Time `json:"updated"`
+}
+
+type heartbeat struct {
+	State    string  `json:"state"`
+	Position float64 `json:"position"`
+}
+
+// Count the heartbeats a viewer sends on its heartbeat data channel
+func startHeartbeats(viewer *Viewer, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var hb heartbeat
+		if err := json.Unmarshal(msg.Data, &hb); err != nil || !playbackStates[hb.State] {
+			viewer.log(heartbeatLog).debugf("[viewer %s] Invalid heartbeat ignored.", viewer.id)
+			return
+		}
+		audience.record(viewer.stream, viewer.identity().analyticsID, hb, time.Now())
+	})
+}
+
+func (t *audienceTracker) record(stream, viewerID string, hb heartbeat, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.get(stream)
+	a.advance(now)
+	a.seen[viewerID] = hb.State
+	a.viewers[viewerID] = &viewerPlayback{ID: viewerID, State: hb.State, Position: hb.Position, Updated: now}
+}
+
+// Count a reaction of a viewer of the stream, or a raised hand when empty
+func (t *audienceTracker) recordInteraction(stream, reaction string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.get(stream)
+	a.advance(now)
+	if reaction == "" {
+		a.hands++
+		return
+	}
+	a.reactions++
+	a.reactionTotals[reaction]++
+}
+
+// Must be called with the lock held
+func (t *audienceTracker) get(stream string) *streamAudience {
+	a, ok := t.streams[stream]
+	if !ok {
+		a = &streamAudience{seen: make(map[string]string), viewers: make(map[string]*viewerPlayback), reactionTotals: make(map[string]int)}
+		t.streams[stream] = a
+	}
+	return a
+}
+
+// Close the counted minute once time moved past it, adding empty points
+// for the minutes nobody watched
+func (a *streamAudience) advance(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	if a.minute.IsZero() {
+		a.minute = minute
+	}
+	if !minute.After(a.minute) {
+		return
+	}
+
+	a.points = append(a.points, a.current())
+	for m := a.minute.Add(time.Minute); m.Before(minute) && len(a.points) < 2*audienceHistoryMinutes; m = m.Add(time.Minute) {
+		a.points = append(a.points, audiencePoint{Minute: m})
+	}
+	if len(a.points) > audienceHistoryMinutes {
+		a.points = a.points[len(a.points)-audienceHistoryMinutes:]
+	}
+	a.minute = minute
+	a.seen = make(map[string]string)
+	a.reactions, a.hands = 0, 0
+
+	for id, v := range a.viewers {
+		if now.Sub(v.Updated) > heartbeatTimeout {
+			delete(a.viewers, id)
+		}
+	}
+}
+
+// Point of the minute still being counted
+func (a *streamAudience) current() audiencePoint {
+	p := audiencePoint{Minute: a.minute, Viewers: len(a.seen), Reactions: a.reactions, Hands: a.hands}
+	for _, state := range a.seen {
+		switch state {
+		case "playing":
+			p.Playing++
+		case "paused":
+			p.Paused++
+		case "buffering":
+			p.Buffering++
+		}
+	}
+	return p
+}
+
+// Curve of the last minutes of a stream, oldest first and ending with the
+// current minute, the viewers currently watching and the reactions so far
+func (t *audienceTracker) report(stream string, minutes int, now time.Time) ([]audiencePoint, []viewerPlayback, map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.streams[stream]
+	if !ok {
+		return []audiencePoint{}, []viewerPlayback{}, map[string]int{}
+	}
+	a.advance(now)
+
+	points := append(append([]audiencePoint(nil), a.points...), a.current())
+	if len(points) > minutes {
+		points = points[len(points)-minutes:]
+	}
+	viewers := make([]viewerPlayback, 0, len(a.viewers))
+	for _, v := range a.viewers {
+		viewers = append(viewers, *v)
+	}
+	return points, viewers, maps.Clone(a.reactionTotals)
+}
+
+// Handler for GET /api/analytics/viewers?stream=name&minutes=60, the
+// minute-by-minute concurrent viewers of a stream with their reactions and
+// raised hands, and the stream's reactions so far by reaction
+func audienceReportHandler(w http.ResponseWriter, r *http.Request) {
+	stream := r.URL.Query().Get("stream")
+	if !streamNamePattern.MatchString(stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeView(r, stream); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	minutes := 60
+	if s := r.URL.Query().Get("minutes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > audienceHistoryMinutes {
+			http.Error(w, "Invalid minutes", http.StatusBadRequest)
+			return
+		}
+		minutes = n
+	}
+
+	points, viewers, reactions := audience.report(stream, minutes, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stream":    stream,
+		"points":    points,
+		"viewers":   viewers,
+		"reactions": reactions,
+	})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Directory the HLS playlists and segments of streams are written to, and
+// served from. Shared media storage gets a copy under hls/<stream>/ for
+// other hosts or a CDN to serve.
+var hlsDir = filepath.Join(os.TempDir(), "sfu-hls")
+
+const (
+	// Pipelines without requests for this long are stopped
+	hlsIdleTimeout = time.Minute
+
+	// Longest a first request waits for ffmpeg to write the playlist
+	hlsStartTimeout = 15 * time.Second
+
+	// How often new segments are copied to shared media storage
+	hlsCopyInterval = time.Second
+)
+
+const hlsPlaylist = "playlist.m3u8"
+
+var hlsSegmentPattern = regexp.MustCompile(`^seg[0-9]{5}\.ts$`)
+
+var hlsLog = newLogger("hls")
+
+var (
+	hlsPipelines   = make(map[string]*hlsPipeline)
+	hlsPipelinesMu sync.Mutex
+)
+
+// An HLS rendition of a live stream: its tracks are forwarded as RTP to an
+// ffmpeg that writes the segments. Started by the first request for the
+// stream's playlist and stopped once nobody asks for it anymore.
+type hlsPipeline struct {
+	stream  string
+	dir     string
+	room    *Room
+	forward *rtpForward
+	ffmpeg  *ffmpegProcess
+
+	mu          sync.Mutex
+	lastRequest time.Time
+
+	// Playlist and segments copied to shared media storage
+	copyMu   sync.Mutex
+	playlist []byte
+	copied   map[string]bool
+}
+
+// Pipeline of the stream, started when there is none yet
+func getHLSPipeline(stream string) (*hlsPipeline, error) {
+	hlsPipelinesMu.Lock()
+	defer hlsPipelinesMu.Unlock()
+
+	if p, ok := hlsPipelines[stream]; ok {
+		return p, nil
+	}
+	room := getRoom(stream)
+	if room == nil || room.getPublisher() == nil {
+		return nil, newSignalingError(http.StatusNotFound, "Stream is not live")
+	}
+	p, err := startHLSPipeline(room)
+	if err != nil {
+		return nil, err
+	}
+	hlsPipelines[stream] = p
+	return p, nil
+}
+
+func startHLSPipeline(room *Room) (*hlsPipeline, error) {
+	videoAddr, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	audioAddr, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	forward, err := newRTPForward(room, videoAddr, audioAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &hlsPipeline{stream: room.name, room: room, forward: forward, lastRequest: time.Now()}
+	if err := p.start(); err != nil {
+		forward.close()
+		if p.dir != "" {
+			os.RemoveAll(p.dir)
+		}
+		return nil, err
+	}
+	room.addSink(forward)
+	hlsLog.withStream(p.stream).infof("HLS started in %s.", p.dir)
+
+	go p.run()
+	return p, nil
+}
+
+// Write the SDP of the forward and start ffmpeg on it
+func (p *hlsPipeline) start() error {
+	if err := os.MkdirAll(hlsDir, 0o755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(hlsDir, "stream-")
+	if err != nil {
+		return err
+	}
+	p.dir = dir
+
+	sdpPath := filepath.Join(dir, "input.sdp")
+	if err := os.WriteFile(sdpPath, []byte(p.forward.sdp()), 0o644); err != nil {
+		return err
+	}
+
+	// Low-latency HLS only shortens the segments and the playlist, ffmpeg
+	// doesn't write the partial segments of the full spec
+	segment, listSize := "2", "6"
+	if featureEnabled(featureLLHLS) {
+		segment, listSize = "1", "4"
+	}
+	args := []string{"-protocol_whitelist", "file,udp,rtp", "-i", sdpPath}
+	switch video := p.forward.mimeType(webrtc.RTPCodecTypeVideo); {
+	case video == "":
+	case strings.EqualFold(video, webrtc.MimeTypeH264) && !featureEnabled(featureTranscoding):
+		args = append(args, "-c:v", "copy")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency")
+		if featureEnabled(featureTranscoding) {
+			args = append(args, "-force_key_frames", "expr:gte(t,n_forced*"+segment+")")
+		}
+	}
+	if p.forward.mimeType(webrtc.RTPCodecTypeAudio) != "" {
+		args = append(args, "-c:a", "aac")
+	}
+	args = append(args,
+		"-f", "hls", "-hls_time", segment, "-hls_list_size", listSize, "-hls_flags", "delete_segments",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, hlsPlaylist),
+	)
+
+	p.ffmpeg, err = startFFmpeg(p.stream, args...)
+	return err
+}
+
+// Ask for a keyframe once ffmpeg listens, then stop the pipeline when it
+// goes idle or ffmpeg exits
+func (p *hlsPipeline) run() {
+	keyframe := time.NewTimer(ffmpegInputDelay)
+	defer keyframe.Stop()
+	idle := time.NewTicker(hlsIdleTimeout / 4)
+	defer idle.Stop()
+	var copyTick <-chan time.Time
+	if media.shared() {
+		ticker := time.NewTicker(hlsCopyInterval)
+		defer ticker.Stop()
+		copyTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-copyTick:
+			p.copyToStorage()
+		case <-keyframe.C:
+			if publisher := p.room.getPublisher(); publisher != nil {
+				publisher.requestKeyframe()
+			}
+		case <-idle.C:
+			if p.idle() {
+				hlsLog.withStream(p.stream).infof("HLS idle, stopping.")
+				p.stop()
+				return
+			}
+		case <-p.ffmpeg.exited():
+			hlsLog.withStream(p.stream).warnf("ffmpeg exited, stopping HLS.")
+			p.stop()
+			return
+		}
+	}
+}
+
+func (p *hlsPipeline) touch() {
+	p.mu.Lock()
+	p.lastRequest = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *hlsPipeline) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.lastRequest) > hlsIdleTimeout
+}
+
+func (p *hlsPipeline) stop() {
+	hlsPipelinesMu.Lock()
+	if hlsPipelines[p.stream] == p {
+		delete(hlsPipelines, p.stream)
+	}
+	hlsPipelinesMu.Unlock()
+
+	p.room.removeSink(p.forward)
+	p.forward.close()
+	p.ffmpeg.stop()
+	os.RemoveAll(p.dir)
+	p.removeFromStorage()
+}
+
+// Name of a file of the pipeline in media storage
+func (p *hlsPipeline) storageName(file string) string {
+	return "hls/" + p.stream + "/" + file
+}
+
+// Copy the segments of a new playlist to media storage, then the playlist,
+// and remove the segments ffmpeg deleted
+func (p *hlsPipeline) copyToStorage() {
+	p.copyMu.Lock()
+	defer p.copyMu.Unlock()
+
+	playlist, err := os.ReadFile(filepath.Join(p.dir, hlsPlaylist))
+	if err != nil || bytes.Equal(playlist, p.playlist) {
+		return
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if line = strings.TrimSpace(line); hlsSegmentPattern.MatchString(line) {
+			listed[line] = true
+		}
+	}
+	if p.copied == nil {
+		p.copied = make(map[string]bool)
+	}
+	for file := range listed {
+		if p.copied[file] {
+			continue
+		}
+		if err := p.copyFile(file); err != nil {
+			hlsLog.withStream(p.stream).warnf("Error copying %s to %s: %v", file, media, err)
+			return
+		}
+		p.copied[file] = true
+	}
+	if err := writeMediaFile(p.storageName(hlsPlaylist), func(w io.Writer) error {
+		_, err := w.Write(playlist)
+		return err
+	}); err != nil {
+		hlsLog.withStream(p.stream).warnf("Error copying the playlist to %s: %v", media, err)
+		return
+	}
+	p.playlist = playlist
+	for file := range p.copied {
+		if !listed[file] {
+			media.remove(p.storageName(file))
+			delete(p.copied, file)
+		}
+	}
+}
+
+func (p *hlsPipeline) copyFile(file string) error {
+	in, err := os.Open(filepath.Join(p.dir, file))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := media.create(p.storageName(file))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Remove the copies of the stopped pipeline
+func (p *hlsPipeline) removeFromStorage() {
+	p.copyMu.Lock()
+	defer p.copyMu.Unlock()
+	if p.playlist == nil {
+		return
+	}
+	media.remove(p.storageName(hlsPlaylist))
+	for file := range p.copied {
+		media.remove(p.storageName(file))
+	}
+	p.playlist, p.copied = nil, nil
+}
+
+// Stop all pipelines, on shutdown
+func stopHLSPipelines() {
+	hlsPipelinesMu.Lock()
+	list := make([]*hlsPipeline, 0, len(hlsPipelines))
+	for _, p := range hlsPipelines {
+		list = append(list, p)
+	}
+	hlsPipelinesMu.Unlock()
+
+	for _, p := range list {
+		p.stop()
+	}
+}
+
+// Wait for ffmpeg to write the first playlist
+func (p *hlsPipeline) waitForPlaylist(r *http.Request) bool {
+	path := filepath.Join(p.dir, hlsPlaylist)
+	deadline := time.NewTimer(hlsStartTimeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(200 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			return false
+		case <-p.ffmpeg.exited():
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// Handler for GET /hls/{stream}/{file}, serving the playlist and segments
+// of a stream to whoever may view it. The playlist starts the pipeline.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	stream, file := r.PathValue("stream"), r.PathValue("file")
+	if !streamNamePattern.MatchString(stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	if file != hlsPlaylist && !hlsSegmentPattern.MatchString(file) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := authorizeView(r, stream); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	var p *hlsPipeline
+	if file == hlsPlaylist {
+		var err error
+		if p, err = getHLSPipeline(stream); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		if !p.waitForPlaylist(r) {
+			http.Error(w, "Stream is not available as HLS yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		hlsPipelinesMu.Lock()
+		p = hlsPipelines[stream]
+		hlsPipelinesMu.Unlock()
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	p.touch()
+
+	// Segments need the playlist's token or signature too
+	if query := viewQuery(r); file == hlsPlaylist && query != "" {
+		data, err := os.ReadFile(filepath.Join(p.dir, file))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(signPlaylist(data, query))
+		return
+	}
+
+	f, err := os.Open(filepath.Join(p.dir, file))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
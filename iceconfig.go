@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE servers of a PeerConnection of the role, publisher or viewer: the STUN
+// URLs as configured and the TURN URLs with their credentials. With
+// -turn-secret these are issued for the user as the TURN REST API that
+// coturn implements describes, the username being the expiry time and the
+// password its HMAC under the secret.
+func iceServers(role, user string) []webrtc.ICEServer {
+	var stun, turn []string
+	for _, u := range settings.ICEServersFor(role) {
+		if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+			turn = append(turn, u)
+		} else {
+			stun = append(stun, u)
+		}
+	}
+
+	var servers []webrtc.ICEServer
+	if len(stun) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: stun})
+	}
+	if len(turn) > 0 {
+		server := webrtc.ICEServer{URLs: turn, Username: settings.TURNUsername, Credential: settings.TURNCredential}
+		if settings.TURNSecret != "" {
+			server.Username = fmt.Sprintf("%d:%s", time.Now().Add(settings.TURNTTL).Unix(), user)
+			mac := hmac.New(sha1.New, []byte(settings.TURNSecret))
+			mac.Write([]byte(server.Username))
+			server.Credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// ICE server as RTCPeerConnection takes it
+type browserICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Handler for GET /api/ice-config?role=publisher|viewer, the configuration
+// browsers create their PeerConnections with, so they use the same STUN and
+// TURN servers as the server's end. Fetched for every connection since TURN
+// credentials may expire.
+func iceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	role := r.URL.Query().Get("role")
+	switch role {
+	case "":
+		role = "publisher"
+	case "publisher", "viewer":
+	default:
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	user := "anonymous"
+	if a := currentAccount(r); a != nil {
+		user = a.Username
+	}
+
+	servers := []browserICEServer{}
+	for _, s := range iceServers(role, user) {
+		credential, _ := s.Credential.(string)
+		servers = append(servers, browserICEServer{URLs: s.URLs, Username: s.Username, Credential: credential})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":       role,
+		"iceServers": servers,
+	})
+}
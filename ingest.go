@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// H264 NAL unit types ingest looks at
+const (
+	h264NALUIDR = 5
+	h264NALUSPS = 7
+	h264NALUPPS = 8
+)
+
+var ingestLog = newLogger("ingest")
+
+// Source of a stream's media: a WebRTC publisher, an RTMP connection, an
+// RTSP camera or RTP received over UDP. Protocols other than WebRTC publish
+// through an ingestSession, so forwarding, recording and egress are the
+// same whatever the media came over; adding a protocol means implementing
+// this and feeding the session's tracks.
+type ingest interface {
+	// Name of the protocol, e.g. "rtmp"
+	protocol() string
+	// Where the media comes from, without credentials
+	remote() string
+}
+
+// A WebRTC publisher, which feeds its fanouts directly
+type webrtcIngest struct {
+	pc *webrtc.PeerConnection
+}
+
+func (i webrtcIngest) protocol() string { return "webrtc" }
+func (i webrtcIngest) remote() string   { return remoteAddress(i.pc) }
+
+// Remote address of the selected candidate pair, empty until connected
+func remoteAddress(pc *webrtc.PeerConnection) string {
+	pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return ""
+	}
+	return net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+}
+
+// Protocol the publisher's media comes over, "local" for media the server
+// produces itself like replays
+func (p *Publisher) protocol() string {
+	if p.source == nil {
+		return "local"
+	}
+	return p.source.protocol()
+}
+
+// Publishing session of an ingest: a local publisher of the stream whose
+// tracks are normalized for viewers
+type ingestSession struct {
+	source    ingest
+	room      *Room
+	publisher *Publisher
+
+	mu     sync.Mutex
+	tracks []*ingestTrack
+}
+
+// One track of an ingest session
+type ingestTrack struct {
+	session *ingestSession
+	fanout  *trackFanout
+
+	// H264 is packetized again for the viewers' MTU, with its parameter sets
+	// before each IDR
+	decoder    *rtph264.Decoder
+	packetizer rtp.Packetizer
+	sps, pps   []byte
+}
+
+func newIngestSession(source ingest, stream string, owner *account) *ingestSession {
+	publisher := newLocalPublisher(stream, owner)
+	publisher.source = source
+	return &ingestSession{source: source, room: getOrCreateRoom(stream), publisher: publisher}
+}
+
+// Add a track, viewers get it once the session took over. For H264 the SPS
+// and PPS out of band, if any, are sent before the first IDR.
+func (s *ingestSession) addTrack(codec webrtc.RTPCodecCapability, kind webrtc.RTPCodecType, sps, pps []byte) (*ingestTrack, error) {
+	t := &ingestTrack{session: s, sps: sps, pps: pps}
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+		t.decoder = &rtph264.Decoder{PacketizationMode: 1}
+		if err := t.decoder.Init(); err != nil {
+			return nil, err
+		}
+		t.packetizer = rtp.NewPacketizer(localPublisherMTU, 0, rand.Uint32(), &codecs.H264Payloader{}, rtp.NewRandomSequencer(), codec.ClockRate)
+	}
+	t.fanout = s.publisher.addFanout(newTrackFanout(codec, kind.String(), s.source.protocol(), "", kind), 0)
+
+	s.mu.Lock()
+	s.tracks = append(s.tracks, t)
+	s.mu.Unlock()
+	s.room.publishTrack(s.publisher, t.fanout)
+	return t, nil
+}
+
+// Become the stream's publisher, replacing the current one
+func (s *ingestSession) takeOver() {
+	old := s.room.setPublisher(s.publisher)
+	s.publisher.continueRecording(old)
+	if old != nil {
+		ingestLog.withStream(s.room.name).infof("Stream taken over from publisher %s by %s from %s.", old.id, s.source.protocol(), s.source.remote())
+		s.room.closePublisher(old)
+	}
+}
+
+// Closed once the session ended or another publisher took over
+func (s *ingestSession) done() <-chan struct{} {
+	return s.publisher.done
+}
+
+// End the session, leaving the stream without a publisher
+func (s *ingestSession) close() {
+	s.mu.Lock()
+	tracks := s.tracks
+	s.tracks = nil
+	s.mu.Unlock()
+	for _, t := range tracks {
+		s.room.unpublishTrack(s.publisher, t.fanout)
+	}
+	s.room.closePublisher(s.publisher)
+}
+
+// Publish an RTP packet of the source
+func (t *ingestTrack) writeRTP(pkt *rtp.Packet) {
+	if t.decoder == nil {
+		packet := &rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+		packet.Extension, packet.Extensions = false, nil
+		t.session.room.publishRTP(t.session.publisher, t.fanout, packet)
+		return
+	}
+
+	nalus, err := t.decoder.Decode(pkt)
+	if err != nil {
+		return
+	}
+	var frame []byte
+	idr := false
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264NALUSPS:
+			t.sps = append([]byte(nil), nalu...)
+			continue
+		case h264NALUPPS:
+			t.pps = append([]byte(nil), nalu...)
+			continue
+		case h264NALUIDR:
+			idr = true
+		}
+		frame = appendAnnexB(frame, nalu)
+	}
+	if frame == nil {
+		return
+	}
+	if idr && t.sps != nil && t.pps != nil {
+		frame = append(appendAnnexB(appendAnnexB(nil, t.sps), t.pps), frame...)
+	}
+	t.writeFrame(frame, pkt.Timestamp)
+}
+
+// Publish an H264 access unit in Annex B format
+func (t *ingestTrack) writeFrame(frame []byte, timestamp uint32) {
+	for _, packet := range t.packetizer.Packetize(frame, 0) {
+		packet.Timestamp = timestamp
+		t.session.room.publishRTP(t.session.publisher, t.fanout, packet)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long a stream's recording is kept open after its publisher left with
+// -input-switching, for another input to continue it
+const inputSwitchHold = 10 * time.Second
+
+// Whether streams switch between WebRTC and RTMP inputs: WebRTC publishers
+// are asked for H264 like RTMP sends, so viewers keep their tracks across a
+// switch, and recordings wait for the next input when one leaves
+var inputSwitching bool
+
+// Recordings of streams whose publisher left, by stream, until another one
+// takes over or the hold ends
+var (
+	heldRecordingsMu sync.Mutex
+	heldRecordings   = make(map[string]*heldRecording)
+)
+
+type heldRecording struct {
+	rec   *recording
+	timer *time.Timer
+}
+
+// Codecs a new publisher of the room is asked for, in order of preference:
+// those its viewers are receiving, so they keep playing once it takes over,
+// then H264 with -input-switching, then -codecs
+func publisherCodecsFor(room *Room) []string {
+	var prefer []string
+	for _, v := range room.getViewers() {
+		for _, vt := range v.getTracks() {
+			if mimeType := vt.currentFanout().Codec().MimeType; !containsFold(prefer, mimeType) {
+				prefer = append(prefer, mimeType)
+			}
+		}
+	}
+	if inputSwitching && !containsFold(prefer, webrtc.MimeTypeH264) {
+		prefer = append(prefer, webrtc.MimeTypeH264)
+	}
+	for _, mimeType := range publisherCodecs {
+		if !containsFold(prefer, mimeType) {
+			prefer = append(prefer, mimeType)
+		}
+	}
+	return prefer
+}
+
+// Continue the recording of the publisher p takes over from, or the one held
+// since the stream's last publisher left, with p's tracks. Tracks of the
+// same kind and codec go on in the same files.
+func (p *Publisher) continueRecording(old *Publisher) {
+	var rec *recording
+	if old != nil {
+		old.recordingMu.Lock()
+		rec = old.recording
+		old.recording = nil
+		old.recordingMu.Unlock()
+	}
+	heldRecordingsMu.Lock()
+	if held := heldRecordings[p.stream]; held != nil && held.timer.Stop() {
+		delete(heldRecordings, p.stream)
+		if rec == nil {
+			rec = held.rec
+		} else {
+			go held.rec.stop()
+		}
+	}
+	heldRecordingsMu.Unlock()
+	if rec == nil {
+		return
+	}
+
+	p.recordingMu.Lock()
+	current := p.recording
+	if current == nil {
+		p.recording = rec
+	}
+	p.recordingMu.Unlock()
+	if current != nil {
+		rec.stop()
+		return
+	}
+	p.log(recorderLog).infof("[publisher %s] Recording continues with this %s input.", p.id, p.protocol())
+	p.requestKeyframe()
+}
+
+// Keep the recording of a publisher that left open for the stream's next
+// input with -input-switching or -publisher-grace, stopping it once the hold
+// ends. Stopped at once otherwise, for a publisher ending its stream or while
+// shutting down.
+func (p *Publisher) holdRecording() {
+	hold := recordingHold()
+	if hold <= 0 || p.endStream.Load() || services.isStopping() {
+		p.stopRecording()
+		return
+	}
+	p.recordingMu.Lock()
+	rec := p.recording
+	p.recording = nil
+	p.recordingMu.Unlock()
+	if rec == nil {
+		return
+	}
+
+	held := &heldRecording{rec: rec}
+	heldRecordingsMu.Lock()
+	previous := heldRecordings[p.stream]
+	heldRecordings[p.stream] = held
+	held.timer = time.AfterFunc(hold, func() {
+		heldRecordingsMu.Lock()
+		if heldRecordings[p.stream] == held {
+			delete(heldRecordings, p.stream)
+		}
+		heldRecordingsMu.Unlock()
+		rec.stop()
+	})
+	heldRecordingsMu.Unlock()
+	if previous != nil && previous.timer.Stop() {
+		previous.rec.stop()
+	}
+	p.log(recorderLog).infof("[publisher %s] Left, recording waits %v for another input.", p.id, hold)
+}
+
+// Stop the recordings held for a next input, on shutdown
+func stopHeldRecordings() {
+	heldRecordingsMu.Lock()
+	var list []*recording
+	for stream, held := range heldRecordings {
+		if held.timer.Stop() {
+			list = append(list, held.rec)
+		}
+		delete(heldRecordings, stream)
+	}
+	heldRecordingsMu.Unlock()
+	for _, rec := range list {
+		rec.stop()
+	}
+}
+
+// Whether the recording with the ID is held for the next input of its stream
+func recordingHeld(id string) bool {
+	heldRecordingsMu.Lock()
+	defer heldRecordingsMu.Unlock()
+	for _, held := range heldRecordings {
+		if held.rec.fileName("") == id {
+			return true
+		}
+	}
+	return false
+}
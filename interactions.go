@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Label of the data channel viewers send reactions and raised hands on,
+	// and publishers and viewers get them relayed on
+	interactionChannelLabel = "interactions"
+	// How often the reactions of a stream are relayed, added up
+	interactionInterval = 500 * time.Millisecond
+	// Reactions a viewer may send per second, and at once
+	reactionRate  = 2
+	reactionBurst = 10
+	// Longest reaction in bytes, e.g. an emoji or a short word
+	maxReactionLength = 32
+)
+
+var interactionLog = newLogger("interaction")
+
+// Message of a viewer on its interactions channel:
+//
+//	{"type": "reaction", "reaction": "👏"}
+//	{"type": "raise-hand"}
+//	{"type": "lower-hand"}
+//
+// Publishers may lower a viewer's hand with {"type": "lower-hand", "viewer": "id"}.
+type interactionMessage struct {
+	Type     string `json:"type"`
+	Reaction string `json:"reaction,omitempty"`
+	Viewer   string `json:"viewer,omitempty"`
+}
+
+// Relayed to the publishers and viewers of a stream every interactionInterval
+// something changed: the reactions since the last update by reaction, and
+// the viewers with their hand raised, longest first
+type interactionUpdate struct {
+	Type        string         `json:"type"`
+	Reactions   map[string]int `json:"reactions,omitempty"`
+	RaisedHands []raisedHand   `json:"raisedHands"`
+}
+
+type raisedHand struct {
+	Viewer string    `json:"viewer"`
+	User   string    `json:"user,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Reactions and raised hands of a room's viewers waiting to be relayed
+type roomInteractions struct {
+	mu        sync.Mutex
+	reactions map[string]int
+	hands     map[string]raisedHand
+	changed   bool
+	// Reaction allowance of each viewer, refilled at reactionRate
+	buckets map[string]*rateBucket
+}
+
+// Allowance of messages refilled at a rate up to a burst
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a message from the sender's allowance in buckets, false once it is
+// used up
+func allowMessage(buckets map[string]*rateBucket, sender string, rate, burst float64, now time.Time) bool {
+	b, ok := buckets[sender]
+	if !ok {
+		b = &rateBucket{tokens: burst, last: now}
+		buckets[sender] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Take a reaction from the viewer's allowance, false once it is used up
+func (in *roomInteractions) allowReaction(viewer string, now time.Time) bool {
+	if in.buckets == nil {
+		in.buckets = make(map[string]*rateBucket)
+	}
+	return allowMessage(in.buckets, viewer, reactionRate, reactionBurst, now)
+}
+
+// Handle the interactions channel a viewer opened
+func startInteractions(room *Room, v *Viewer, dc *webrtc.DataChannel) {
+	v.channels.add(dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m interactionMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			v.log(interactionLog).debugf("[viewer %s] Invalid interaction ignored.", v.id)
+			return
+		}
+		now := time.Now()
+		in := &room.interactions
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		switch m.Type {
+		case "reaction":
+			if m.Reaction == "" || len(m.Reaction) > maxReactionLength || !utf8.ValidString(m.Reaction) {
+				return
+			}
+			if !in.allowReaction(v.id, now) {
+				return
+			}
+			if in.reactions == nil {
+				in.reactions = make(map[string]int)
+			}
+			in.reactions[m.Reaction]++
+			in.changed = true
+			audience.recordInteraction(room.name, m.Reaction, now)
+		case "raise-hand":
+			if _, raised := in.hands[v.id]; raised {
+				return
+			}
+			if in.hands == nil {
+				in.hands = make(map[string]raisedHand)
+			}
+			h := raisedHand{Viewer: v.id, Since: now}
+			if v.account != nil {
+				h.User = v.account.Username
+			}
+			in.hands[v.id] = h
+			in.changed = true
+			audience.recordInteraction(room.name, "", now)
+			v.log(interactionLog).infof("[viewer %s] Raised their hand.", v.id)
+		case "lower-hand":
+			in.lowerHand(v.id)
+		}
+	})
+}
+
+// Handle the interactions channel a publisher opened, on which it gets the
+// updates and may lower hands
+func startPublisherInteractions(room *Room, p *Publisher, dc *webrtc.DataChannel) {
+	p.channels.add(dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m interactionMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Type != "lower-hand" || m.Viewer == "" {
+			return
+		}
+		room.interactions.mu.Lock()
+		room.interactions.lowerHand(m.Viewer)
+		room.interactions.mu.Unlock()
+	})
+}
+
+// Must be called with the lock held
+func (in *roomInteractions) lowerHand(viewer string) {
+	if _, raised := in.hands[viewer]; raised {
+		delete(in.hands, viewer)
+		in.changed = true
+	}
+}
+
+// Forget a viewer that left, lowering its hand
+func (in *roomInteractions) viewerLeft(viewer string) {
+	in.mu.Lock()
+	in.lowerHand(viewer)
+	delete(in.buckets, viewer)
+	in.mu.Unlock()
+}
+
+// The update to relay if anything changed since the last one
+func (in *roomInteractions) flush() (interactionUpdate, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.changed {
+		return interactionUpdate{}, false
+	}
+	u := interactionUpdate{Type: "interactions", Reactions: in.reactions, RaisedHands: make([]raisedHand, 0, len(in.hands))}
+	for _, h := range in.hands {
+		u.RaisedHands = append(u.RaisedHands, h)
+	}
+	sort.Slice(u.RaisedHands, func(i, j int) bool { return u.RaisedHands[i].Since.Before(u.RaisedHands[j].Since) })
+	in.reactions = nil
+	in.changed = false
+	return u, true
+}
+
+// Relay the interactions of every room to its publishers and viewers
+func runInteractions(ctx context.Context) error {
+	ticker := time.NewTicker(interactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, room := range listRooms() {
+			u, ok := room.interactions.flush()
+			if !ok {
+				continue
+			}
+			data, err := json.Marshal(u)
+			if err != nil {
+				continue
+			}
+			msg := webrtc.DataChannelMessage{IsString: true, Data: data}
+			for _, p := range append(room.getCohosts(), room.getPublisher()) {
+				if p == nil {
+					continue
+				}
+				if err := p.channels.send(interactionChannelLabel, msg); err != nil {
+					p.log(interactionLog).warnf("[publisher %s] Error sending interactions: %v", p.id, err)
+				}
+			}
+			for _, v := range room.getViewers() {
+				v.sendData(interactionChannelLabel, msg)
+			}
+		}
+	}
+}
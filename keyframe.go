@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// Longest keyframe spacing tolerated before PLIs are sent to the publisher,
+// zero disables enforcement
+var maxKeyframeInterval time.Duration
+
+var keyframeLog = newLogger("keyframe")
+
+var (
+	keyframeMonitors   = make(map[webrtc.SSRC]*keyframeMonitor)
+	keyframeMonitorsMu sync.Mutex
+)
+
+// Tracks keyframe spacing of one ingest track
+type keyframeMonitor struct {
+	mu           sync.Mutex
+	stream       string
+	log          moduleLogger
+	ssrc         webrtc.SSRC
+	mimeType     string
+	started      time.Time
+	lastKeyframe time.Time
+	keyframes    int
+	lastGOP      time.Duration
+	maxGOP       time.Duration
+	violations   int
+	plisSent     int
+	lastPLI      time.Time
+}
+
+// Entry of the stream health report
+type trackHealth struct {
+	Stream           string  `json:"stream"`
+	SSRC             uint32  `json:"ssrc"`
+	MimeType         string  `json:"mimeType"`
+	Keyframes        int     `json:"keyframes"`
+	LastKeyframeAgeS float64 `json:"lastKeyframeAgeSeconds"`
+	LastGOPS         float64 `json:"lastGopSeconds"`
+	MaxGOPS          float64 `json:"maxGopSeconds"`
+	LongGOP          bool    `json:"longGop"`
+	Violations       int     `json:"violations"`
+	PLIsSent         int     `json:"plisSent"`
+}
+
+// Whether the RTP payload starts a keyframe, for the codecs we can inspect
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		frame, err := vp8.Unmarshal(payload)
+		if err != nil || vp8.S != 1 || vp8.PID != 0 || len(frame) == 0 {
+			return false
+		}
+		// Inverse key frame flag of the VP8 frame tag
+		return frame[0]&0x01 == 0
+
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264HasIDR(payload)
+	}
+	return false
+}
+
+// Frame size announced by a VP8 keyframe starting in the RTP payload
+func vp8FrameSize(mimeType string, payload []byte) (int, int, bool) {
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return 0, 0, false
+	}
+	var vp8 codecs.VP8Packet
+	frame, err := vp8.Unmarshal(payload)
+	// Frame tag, start code, then 14 bits each of width and height
+	if err != nil || vp8.S != 1 || vp8.PID != 0 || len(frame) < 10 || frame[0]&0x01 != 0 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	return int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff), true
+}
+
+func h264HasIDR(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	nalType := payload[0] & 0x1F
+	switch nalType {
+	case 5, 7: // IDR slice, SPS
+		return true
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if t := payload[offset] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			offset += size
+		}
+	case 28: // FU-A, only the first fragment counts
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	}
+	return false
+}
+
+// Whether keyframes of this codec can be detected
+func canMonitorKeyframes(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeVP8) || strings.EqualFold(mimeType, webrtc.MimeTypeH264)
+}
+
+// Start monitoring an ingest track. Call observe for every packet and stop
+// when the track ends.
+func startKeyframeMonitor(p *peer, track *webrtc.TrackRemote) *keyframeMonitor {
+	m := &keyframeMonitor{
+		stream:   p.stream,
+		log:      p.log(keyframeLog),
+		ssrc:     track.SSRC(),
+		mimeType: track.Codec().MimeType,
+		started:  time.Now(),
+	}
+
+	keyframeMonitorsMu.Lock()
+	keyframeMonitors[m.ssrc] = m
+	keyframeMonitorsMu.Unlock()
+
+	if maxKeyframeInterval > 0 {
+		go m.enforce(p.pc)
+	}
+	return m
+}
+
+func (m *keyframeMonitor) stop() {
+	keyframeMonitorsMu.Lock()
+	defer keyframeMonitorsMu.Unlock()
+
+	if keyframeMonitors[m.ssrc] == m {
+		delete(keyframeMonitors, m.ssrc)
+	}
+}
+
+func (m *keyframeMonitor) observe(packet *rtp.Packet) {
+	if !isKeyframe(m.mimeType, packet.Payload) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	// A keyframe is split over several packets, only count its first one
+	if !m.lastKeyframe.IsZero() && now.Sub(m.lastKeyframe) < 100*time.Millisecond {
+		return
+	}
+	if !m.lastKeyframe.IsZero() {
+		m.lastGOP = now.Sub(m.lastKeyframe)
+		if m.lastGOP > m.maxGOP {
+			m.maxGOP = m.lastGOP
+		}
+	}
+	m.lastKeyframe = now
+	m.keyframes++
+}
+
+// Ask the publisher for a keyframe whenever the current GOP runs past the limit
+func (m *keyframeMonitor) enforce(pc *webrtc.PeerConnection) {
+	klog := m.log
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed || pc.ConnectionState() == webrtc.PeerConnectionStateFailed {
+			return
+		}
+
+		keyframeMonitorsMu.Lock()
+		active := keyframeMonitors[m.ssrc] == m
+		keyframeMonitorsMu.Unlock()
+		if !active {
+			return
+		}
+
+		m.mu.Lock()
+		since := m.lastKeyframe
+		if since.IsZero() {
+			since = m.started
+		}
+		overdue := time.Since(since) > maxKeyframeInterval && time.Since(m.lastPLI) > maxKeyframeInterval
+		if overdue {
+			m.violations++
+			m.plisSent++
+			m.lastPLI = time.Now()
+		}
+		m.mu.Unlock()
+
+		if overdue {
+			klog.warnf("SSRC %d has gone %s without a keyframe, sending PLI", m.ssrc, time.Since(since).Round(time.Millisecond))
+			if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(m.ssrc)}}); err != nil {
+				klog.errorf("Error sending PLI: %v", err)
+			}
+		}
+	}
+}
+
+// Read the RTCP a viewer sends for one track and pass its PLI and FIR on to
+// the publisher, so the viewer can recover from decoding errors
+func relayKeyframeRequests(room *Room, viewer *Viewer, sender *webrtc.RTPSender, track *viewerTrack) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		requested := false
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				requested = true
+			}
+		}
+		if !requested {
+			continue
+		}
+
+		if publisher := room.trackOwner(track.currentFanout()); publisher != nil {
+			layer := track.currentFanout().key()
+			viewer.log(keyframeLog).debugf("[viewer %s] Relaying keyframe request for track %s.", viewer.id, layer)
+			publisher.requestKeyframe(layer)
+		}
+	}
+}
+
+func (m *keyframeMonitor) health() trackHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := trackHealth{
+		Stream:     m.stream,
+		SSRC:       uint32(m.ssrc),
+		MimeType:   m.mimeType,
+		Keyframes:  m.keyframes,
+		LastGOPS:   m.lastGOP.Seconds(),
+		MaxGOPS:    m.maxGOP.Seconds(),
+		Violations: m.violations,
+		PLIsSent:   m.plisSent,
+	}
+	if !m.lastKeyframe.IsZero() {
+		h.LastKeyframeAgeS = time.Since(m.lastKeyframe).Seconds()
+	}
+	if maxKeyframeInterval > 0 {
+		h.LongGOP = m.maxGOP > maxKeyframeInterval || m.violations > 0
+	}
+	return h
+}
+
+// Handler for the stream health report, of the streams the caller may view
+func streamHealthHandler(w http.ResponseWriter, r *http.Request) {
+	keyframeMonitorsMu.Lock()
+	all := make([]trackHealth, 0, len(keyframeMonitors))
+	for _, m := range keyframeMonitors {
+		all = append(all, m.health())
+	}
+	keyframeMonitorsMu.Unlock()
+
+	// Checked once per stream, outside the monitors' lock
+	viewable := make(map[string]bool)
+	tracks := make([]trackHealth, 0, len(all))
+	for _, h := range all {
+		ok, checked := viewable[h.Stream]
+		if !checked {
+			ok = authorizeView(r, h.Stream) == nil
+			viewable[h.Stream] = ok
+		}
+		if ok {
+			tracks = append(tracks, h)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"maxKeyframeIntervalSeconds": maxKeyframeInterval.Seconds(),
+		"tracks":                     tracks,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+)
+
+var moderationLog = newLogger("moderation")
+
+// Handler for DELETE /api/admin/publishers/{id} and /api/admin/viewers/{id},
+// disconnecting a publisher or viewer of this instance, e.g. to end an
+// abusive stream. Its signaling socket gets {"type":"kicked"} with the
+// ?reason= of the request; when a publisher is kicked, the viewers of its
+// stream get {"type":"publisher-kicked"} and wait for the next publisher,
+// or {"type":"cohost-left"} when it is a co-host.
+// Peers of other instances sharing the session store answer 421 naming the
+// instance to send the request to.
+func kickHandler(role string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		reason := r.URL.Query().Get("reason")
+		for _, room := range listRooms() {
+			if role == "publisher" {
+				if p := room.getPublisher(); p != nil && p.id == id {
+					kickPublisher(room, p, reason)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				// Kicking a co-host leaves the host and other co-hosts live
+				if p := room.getCohost(id); p != nil {
+					notifySockets(signalMessage{Type: "kicked", Stream: room.name, ID: id, Reason: reason}, p.peer)
+					room.closePublisher(p)
+					p.log(moderationLog).infof("[publisher %s] Co-host kicked by an admin.", id)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				continue
+			}
+			for _, v := range room.getViewers() {
+				if v.id == id {
+					notifySockets(signalMessage{Type: "kicked", Stream: room.name, ID: id, Reason: reason}, v.peer)
+					room.closeViewer(v)
+					v.log(moderationLog).infof("[viewer %s] Kicked by an admin.", id)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
+		unknownPeer(w, id, role)
+	}
+}
+
+// Disconnect the publisher, RTMP and other ingest connections included, and
+// tell the stream's viewers
+func kickPublisher(room *Room, p *Publisher, reason string) {
+	notifySockets(signalMessage{Type: "kicked", Stream: room.name, ID: p.id, Reason: reason}, p.peer)
+	viewers := room.getViewers()
+	peers := make([]*peer, len(viewers))
+	for i, v := range viewers {
+		peers[i] = v.peer
+	}
+	notifySockets(signalMessage{Type: "publisher-kicked", Stream: room.name, ID: p.id, Reason: reason}, peers...)
+	p.endStream.Store(true)
+	room.closePublisher(p)
+	p.log(moderationLog).infof("[publisher %s] Kicked by an admin, %d viewers told.", p.id, len(viewers))
+}
+
+// Send a message on the signaling sockets of the peers, those connected
+// over HTTP have none
+func notifySockets(msg signalMessage, peers ...*peer) {
+	for _, s := range socketsOf(peers...) {
+		s.send(msg)
+	}
+}
+
+// Signaling sockets of the peers
+func socketsOf(peers ...*peer) []*wsSession {
+	wanted := make(map[*peer]bool, len(peers))
+	for _, p := range peers {
+		wanted[p] = true
+	}
+	wsSessionsMu.Lock()
+	var sockets []*wsSession
+	for s := range wsSessions {
+		if p := s.currentPeer(); p != nil && wanted[p] {
+			sockets = append(sockets, s)
+		}
+	}
+	wsSessionsMu.Unlock()
+	return sockets
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Label of the data channel viewers open for RTT probes
+	latencyChannelLabel  = "latency"
+	latencyProbeInterval = 5 * time.Second
+	// Samples kept per region for the distribution
+	latencyRegionSamples = 1000
+)
+
+// Optional GeoIP database used to map viewer addresses to regions
+var geoDB *geoip2.Reader
+
+var latencyLog = newLogger("latency")
+
+var latency = &latencyTracker{
+	viewers: make(map[string]*viewerLatency),
+	regions: make(map[string][]float64),
+}
+
+type latencyTracker struct {
+	mu      sync.Mutex
+	viewers map[string]*viewerLatency
+	regions map[string][]float64
+}
+
+type viewerLatency struct {
+	ID      string    `json:"id"`
+	Stream  string    `json:"stream"`
+	Region  string    `json:"region"`
+	Address string    `json:"address"`
+	LastRTT float64   `json:"lastRttMs"`
+	Samples int       `json:"samples"`
+	Since   time.Time `json:"since"`
+}
+
+type latencyProbe struct {
+	Type string `json:"type"`
+	Seq  int    `json:"seq"`
+	Sent int64  `json:"sent"`
+}
+
+// Summary of the RTT distribution of one region
+type regionLatency struct {
+	Viewers int     `json:"viewers"`
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50Ms"`
+	P90     float64 `json:"p90Ms"`
+	P99     float64 `json:"p99Ms"`
+	Max     float64 `json:"maxMs"`
+}
+
+func openGeoIP(path string) {
+	if path == "" {
+		return
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		fatalf("Failed to open GeoIP database: %v", err)
+	}
+	geoDB = db
+	latencyLog.infof("GeoIP database loaded: %s", path)
+}
+
+// Region of an address: continent and country from GeoIP when available
+func lookupRegion(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return "local"
+	}
+	if geoDB == nil {
+		return "unknown"
+	}
+
+	record, err := geoDB.Country(ip)
+	if err != nil || record.Country.IsoCode == "" {
+		return "unknown"
+	}
+	return record.Continent.Code + "/" + record.Country.IsoCode
+}
+
+// Probe the RTT of a viewer over its latency data channel. The client echoes
+// every probe back unchanged.
+func startLatencyProbe(viewer *Viewer, dc *webrtc.DataChannel) {
+	pc := viewer.pc
+	v := &viewerLatency{ID: viewer.id, Stream: viewer.stream, Region: "unknown", Since: time.Now()}
+
+	dc.OnOpen(func() {
+		if pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			v.Address = pair.Remote.Address
+			v.Region = lookupRegion(pair.Remote.Address)
+		}
+		latency.add(v)
+		latencyLog.withStream(v.Stream).debugf("Probing viewer %s (region %s)", v.ID, v.Region)
+
+		go func() {
+			ticker := time.NewTicker(latencyProbeInterval)
+			defer ticker.Stop()
+			for seq := 0; ; seq++ {
+				probe, _ := json.Marshal(latencyProbe{Type: "ping", Seq: seq, Sent: time.Now().UnixNano()})
+				if err := dc.SendText(string(probe)); err != nil {
+					return
+				}
+				<-ticker.C
+				if dc.ReadyState() != webrtc.DataChannelStateOpen {
+					return
+				}
+			}
+		}()
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var probe latencyProbe
+		if err := json.Unmarshal(msg.Data, &probe); err != nil || probe.Type != "ping" {
+			return
+		}
+		rtt := float64(time.Now().UnixNano()-probe.Sent) / float64(time.Millisecond)
+		latency.record(v, rtt)
+	})
+
+	dc.OnClose(func() {
+		latency.remove(v)
+	})
+}
+
+func (t *latencyTracker) add(v *viewerLatency) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.viewers[v.ID] = v
+}
+
+func (t *latencyTracker) remove(v *viewerLatency) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.viewers, v.ID)
+}
+
+func (t *latencyTracker) record(v *viewerLatency, rtt float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v.LastRTT = rtt
+	v.Samples++
+
+	samples := append(t.regions[v.Region], rtt)
+	if len(samples) > latencyRegionSamples {
+		samples = samples[len(samples)-latencyRegionSamples:]
+	}
+	t.regions[v.Region] = samples
+}
+
+// Handler for the per-region latency report, admins only as it lists each
+// viewer's address
+func latencyReportHandler(w http.ResponseWriter, r *http.Request) {
+	latency.mu.Lock()
+	regions := make(map[string]regionLatency, len(latency.regions))
+	for region, samples := range latency.regions {
+		regions[region] = summarizeLatency(samples)
+	}
+	viewers := make([]viewerLatency, 0, len(latency.viewers))
+	for _, v := range latency.viewers {
+		viewers = append(viewers, *v)
+		summary := regions[v.Region]
+		summary.Viewers++
+		regions[v.Region] = summary
+	}
+	latency.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"regions": regions,
+		"viewers": viewers,
+	})
+}
+
+func summarizeLatency(samples []float64) regionLatency {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	s := regionLatency{Samples: len(sorted)}
+	if len(sorted) == 0 {
+		return s
+	}
+	s.P50 = percentile(sorted, 0.50)
+	s.P90 = percentile(sorted, 0.90)
+	s.P99 = percentile(sorted, 0.99)
+	s.Max = sorted[len(sorted)-1]
+	return s
+}
+
+// Nearest-rank percentile of sorted samples
+func percentile(sorted []float64, p float64) float64 {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Longest a subsystem gets to finish once asked to stop
+const subsystemStopTimeout = 10 * time.Second
+
+// States of a subsystem as reported by the health endpoint
+const (
+	subsystemStarting = "starting"
+	subsystemRunning  = "running"
+	subsystemStopping = "stopping"
+	subsystemStopped  = "stopped"
+	subsystemFailed   = "failed"
+)
+
+var lifecycleLog = newLogger("lifecycle")
+
+// The server's background subsystems, run by main
+var services = &lifecycle{}
+
+// Runs the long-lived subsystems of the server: they start in the order
+// they were added, each once the one before is ready, and stop in reverse
+// order, once the server shuts down or any of them fails
+type lifecycle struct {
+	mu         sync.Mutex
+	subsystems []*subsystem
+	stopping   bool
+}
+
+// A subsystem runs until its context is done, calling ready once set up.
+// Returning earlier without an error means it had nothing to do, e.g.
+// because it is disabled.
+type subsystem struct {
+	name string
+	run  func(ctx context.Context, ready func()) error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu    sync.Mutex
+	state string
+	err   error
+	since time.Time
+}
+
+// Health of a subsystem as returned by GET /api/health
+type subsystemHealth struct {
+	Name  string    `json:"name"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// Add a subsystem that is ready as soon as it runs
+func (l *lifecycle) add(name string, run func(ctx context.Context) error) {
+	l.addReady(name, func(ctx context.Context, ready func()) error {
+		ready()
+		return run(ctx)
+	})
+}
+
+// Add a subsystem the ones after it depend on, e.g. a listener, which calls
+// ready once they may start
+func (l *lifecycle) addReady(name string, run func(ctx context.Context, ready func()) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subsystems = append(l.subsystems, &subsystem{name: name, run: run, state: subsystemStarting, since: time.Now()})
+}
+
+// Run all subsystems until ctx is done or one of them fails, and return
+// that failure once all of them stopped
+func (l *lifecycle) run(ctx context.Context) error {
+	l.mu.Lock()
+	subsystems := append([]*subsystem(nil), l.subsystems...)
+	l.mu.Unlock()
+
+	g, gctx := errgroup.WithContext(ctx)
+	started := 0
+	for _, s := range subsystems {
+		if gctx.Err() != nil {
+			break
+		}
+		var sctx context.Context
+		sctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+		ready := make(chan struct{})
+		var readyOnce sync.Once
+		started++
+
+		g.Go(func() error {
+			defer close(s.done)
+			err := s.run(sctx, func() {
+				readyOnce.Do(func() {
+					s.setState(subsystemRunning, nil)
+					close(ready)
+				})
+			})
+			if err != nil && sctx.Err() == nil {
+				s.setState(subsystemFailed, err)
+				lifecycleLog.errorf("%s failed: %v", s.name, err)
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+			s.setState(subsystemStopped, nil)
+			return nil
+		})
+
+		// The next one starts once this one is ready, or had nothing to do
+		select {
+		case <-ready:
+			lifecycleLog.debugf("Started %s.", s.name)
+		case <-s.done:
+		case <-gctx.Done():
+		}
+	}
+
+	<-gctx.Done()
+	l.mu.Lock()
+	l.stopping = true
+	l.mu.Unlock()
+	lifecycleLog.infof("Shutting down.")
+
+	// Those after a failure or shutdown during startup never ran
+	for _, s := range subsystems[started:] {
+		s.setState(subsystemStopped, nil)
+	}
+	timedOut := false
+	for i := started - 1; i >= 0; i-- {
+		s := subsystems[i]
+		if s.getState() == subsystemRunning {
+			s.setState(subsystemStopping, nil)
+		}
+		s.cancel()
+		select {
+		case <-s.done:
+			lifecycleLog.debugf("Stopped %s.", s.name)
+		case <-time.After(subsystemStopTimeout):
+			lifecycleLog.warnf("%s did not stop within %v.", s.name, subsystemStopTimeout)
+			timedOut = true
+		}
+	}
+	if timedOut {
+		return fmt.Errorf("subsystems did not stop within %v", subsystemStopTimeout)
+	}
+	return g.Wait()
+}
+
+// Subsystem with nothing to run that cleans up once the server stops
+func onShutdown(stop func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		<-ctx.Done()
+		stop()
+		return nil
+	}
+}
+
+func (s *subsystem) setState(state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == subsystemFailed {
+		return
+	}
+	s.state, s.err, s.since = state, err, time.Now()
+}
+
+func (s *subsystem) getState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *subsystem) health() subsystemHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := subsystemHealth{Name: s.name, State: s.state, Since: s.since}
+	if s.err != nil {
+		h.Error = s.err.Error()
+	}
+	return h
+}
+
+// State of each subsystem, in the order they start
+func (l *lifecycle) health() []subsystemHealth {
+	l.mu.Lock()
+	subsystems := append([]*subsystem(nil), l.subsystems...)
+	l.mu.Unlock()
+	list := make([]subsystemHealth, 0, len(subsystems))
+	for _, s := range subsystems {
+		list = append(list, s.health())
+	}
+	return list
+}
+
+// Handler for GET /api/health, the state of each subsystem. Responds 503
+// while shutting down or when a subsystem failed.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if services.isStopping() {
+		status = "stopping"
+	}
+	list := services.health()
+	for _, h := range list {
+		if h.State == subsystemFailed {
+			status = "failed"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"subsystems": list,
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestFailed = errors.New("failed to start")
+
+// Records what subsystems did, in order
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func TestLifecycleStartOrder(t *testing.T) {
+	l := &lifecycle{}
+	events := &eventLog{}
+	running := make(chan struct{})
+	for _, name := range []string{"a", "b", "c"} {
+		l.addReady(name, func(ctx context.Context, ready func()) error {
+			events.add("start " + name)
+			// Long enough for the next one to start early if it did not
+			// wait for this one
+			time.Sleep(10 * time.Millisecond)
+			events.add("ready " + name)
+			ready()
+			if name == "c" {
+				close(running)
+			}
+			<-ctx.Done()
+			events.add("stop " + name)
+			return nil
+		})
+	}
+	for _, h := range l.health() {
+		if h.State != subsystemStarting {
+			t.Errorf("%s is %s before running, want %s", h.Name, h.State, subsystemStarting)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- l.run(ctx) }()
+	<-running
+
+	var names []string
+	for _, h := range l.health() {
+		names = append(names, h.Name)
+		if h.State != subsystemRunning {
+			t.Errorf("%s is %s, want %s", h.Name, h.State, subsystemRunning)
+		}
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(names, want) {
+		t.Errorf("subsystems %v, want them in the order added %v", names, want)
+	}
+
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("run returned %v", err)
+	}
+	want := []string{"start a", "ready a", "start b", "ready b", "start c", "ready c", "stop c", "stop b", "stop a"}
+	if got := events.list(); !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestLifecycleRun(t *testing.T) {
+	tests := []struct {
+		name string
+		// Subsystem that fails right away, and one that returns without
+		// an error as if disabled
+		fail, disabled string
+		// Whether the test stops the server by cancelling the context
+		cancel    bool
+		want      []string
+		wantState map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "stops in reverse order on context cancel",
+			cancel:    true,
+			want:      []string{"start a", "start b", "start c", "stop c", "stop b", "stop a"},
+			wantState: map[string]string{"a": subsystemStopped, "b": subsystemStopped, "c": subsystemStopped},
+		},
+		{
+			name:      "disabled subsystem keeps the others running",
+			disabled:  "b",
+			cancel:    true,
+			want:      []string{"start a", "start b", "start c", "stop c", "stop a"},
+			wantState: map[string]string{"a": subsystemStopped, "b": subsystemStopped, "c": subsystemStopped},
+		},
+		{
+			name:      "failure stops the others in reverse order and starts no more",
+			fail:      "b",
+			want:      []string{"start a", "start b", "stop a"},
+			wantState: map[string]string{"a": subsystemStopped, "b": subsystemFailed, "c": subsystemStopped},
+			wantErr:   "b: failed to start",
+		},
+		{
+			name:      "failure of the first subsystem",
+			fail:      "a",
+			want:      []string{"start a"},
+			wantState: map[string]string{"a": subsystemFailed, "b": subsystemStopped, "c": subsystemStopped},
+			wantErr:   "a: failed to start",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lifecycle{}
+			events := &eventLog{}
+			var running sync.WaitGroup
+			for _, name := range []string{"a", "b", "c"} {
+				switch name {
+				case tt.fail:
+					l.addReady(name, func(ctx context.Context, ready func()) error {
+						events.add("start " + name)
+						return errTestFailed
+					})
+				case tt.disabled:
+					l.addReady(name, func(ctx context.Context, ready func()) error {
+						events.add("start " + name)
+						return nil
+					})
+				default:
+					running.Add(1)
+					l.addReady(name, func(ctx context.Context, ready func()) error {
+						events.add("start " + name)
+						ready()
+						running.Done()
+						<-ctx.Done()
+						events.add("stop " + name)
+						return ctx.Err()
+					})
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := make(chan error, 1)
+			go func() { result <- l.run(ctx) }()
+			if tt.cancel {
+				running.Wait()
+				cancel()
+			}
+
+			var err error
+			select {
+			case err = <-result:
+			case <-time.After(subsystemStopTimeout):
+				t.Fatal("run did not return")
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("run returned %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("run returned %v, want %s", err, tt.wantErr)
+			case tt.wantErr != "" && !errors.Is(err, errTestFailed):
+				t.Errorf("run returned %v, which does not wrap the subsystem's error", err)
+			}
+
+			if got := events.list(); !slices.Equal(got, tt.want) {
+				t.Errorf("ran %v, want %v", got, tt.want)
+			}
+			for _, h := range l.health() {
+				if h.State != tt.wantState[h.Name] {
+					t.Errorf("%s is %s, want %s", h.Name, h.State, tt.wantState[h.Name])
+				}
+			}
+			if !l.isStopping() {
+				t.Error("lifecycle not reported as stopping after run returned")
+			}
+		})
+	}
+}
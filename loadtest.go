@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Most synthetic viewers one load test may start
+	maxLoadTestViewers = 500
+	// How long a load test runs by default and at most
+	defaultLoadTest = time.Minute
+	maxLoadTest     = 10 * time.Minute
+	// Synthetic viewers not connected by then count as failed
+	loadTestConnectTimeout = 15 * time.Second
+	// How long results stay available once a test is done
+	loadTestRetention = time.Hour
+)
+
+var loadTestLog = newLogger("loadtest")
+
+// Aggregate of a load test's synthetic viewers, polled by the load test page
+// from /api/admin/loadtests/{id}
+type loadTestStatus struct {
+	ID      string    `json:"id"`
+	Stream  string    `json:"stream"`
+	Started time.Time `json:"started"`
+	Running bool      `json:"running"`
+	// Synthetic viewers asked for, and how many of them are in each state
+	Viewers      int `json:"viewers"`
+	Connecting   int `json:"connecting"`
+	Connected    int `json:"connected"`
+	Failed       int `json:"failed"`
+	Disconnected int `json:"disconnected"`
+	// Milliseconds from joining to connecting, averaged over the connected
+	ConnectTime     float64 `json:"connectTime"`
+	PacketsReceived uint64  `json:"packetsReceived"`
+	// Gaps in the RTP sequence numbers of the received tracks
+	PacketsLost   uint64 `json:"packetsLost"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	// Bits per second received by all viewers together over the last second
+	Bitrate int    `json:"bitrate"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Load test in progress or done: synthetic viewers of a stream, each a
+// PeerConnection of this process negotiated with the SFU as a browser
+// viewer's would be, receiving and counting the stream's media
+type loadTest struct {
+	mu      sync.Mutex
+	status  loadTestStatus
+	viewers []*syntheticViewer
+	// Sum of the connect times of the connected viewers
+	connectTimes time.Duration
+	cancel       context.CancelFunc
+	ended        time.Time
+	// Correlation ID of the request starting the test, its viewers are
+	// logged with
+	request string
+
+	packets, lost, bytes atomic.Uint64
+}
+
+// One of a load test's viewers: the client PeerConnection and the viewer the
+// SFU set up for it
+type syntheticViewer struct {
+	pc     *webrtc.PeerConnection
+	viewer *Viewer
+	state  string
+}
+
+var (
+	loadTestsMu sync.Mutex
+	loadTests   = make(map[string]*loadTest)
+
+	loadTestAPIOnce sync.Once
+	loadTestAPI     *webrtc.API
+)
+
+// API of the synthetic viewers' connections, with the default codecs and
+// interceptors so they send NACKs and receiver reports as browsers do
+func syntheticViewerAPI() *webrtc.API {
+	loadTestAPIOnce.Do(func() {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			panic(err)
+		}
+		i := &interceptor.Registry{}
+		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+			panic(err)
+		}
+		settingEngine := webrtc.SettingEngine{LoggerFactory: pionLoggerFactory{}}
+		loadTestAPI = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+	})
+	return loadTestAPI
+}
+
+// Move a synthetic viewer to a state, counting it in the status
+func (t *loadTest) setState(v *syntheticViewer, state string, joined time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.status.Running || v.state == state || v.state == "failed" || v.state == "disconnected" {
+		return
+	}
+	t.count(v.state, -1)
+	t.count(state, 1)
+	if state == "connected" {
+		t.connectTimes += time.Since(joined)
+	}
+	v.state = state
+}
+
+// Add n to the count of a state, with t.mu held
+func (t *loadTest) count(state string, n int) {
+	switch state {
+	case "connecting":
+		t.status.Connecting += n
+	case "connected":
+		t.status.Connected += n
+	case "failed":
+		t.status.Failed += n
+	case "disconnected":
+		t.status.Disconnected += n
+	}
+}
+
+func (t *loadTest) snapshot() loadTestStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.status
+	if connected := st.Connected + st.Disconnected; connected > 0 && t.connectTimes > 0 {
+		st.ConnectTime = float64(t.connectTimes.Milliseconds()) / float64(connected)
+	}
+	st.PacketsReceived, st.PacketsLost, st.BytesReceived = t.packets.Load(), t.lost.Load(), t.bytes.Load()
+	return st
+}
+
+// Drop results older than loadTestRetention, with loadTestsMu held
+func expireLoadTests() {
+	for id, t := range loadTests {
+		t.mu.Lock()
+		expired := !t.status.Running && time.Since(t.ended) > loadTestRetention
+		t.mu.Unlock()
+		if expired {
+			delete(loadTests, id)
+		}
+	}
+}
+
+// Start a load test of n synthetic viewers joining a live stream, admitted
+// like other viewers as -viewer-join-rate allows, for duration. The viewers
+// run in this process, so they take CPU and bandwidth of the instance they
+// test: results are a lower bound of what it handles with remote viewers.
+func startLoadTest(request, stream string, n int, duration time.Duration) (*loadTest, error) {
+	if services.isStopping() {
+		return nil, errShuttingDown
+	}
+	room := getRoom(stream)
+	if room == nil || room.getPublisher() == nil || len(room.tracks()) == 0 {
+		return nil, newSignalingError(http.StatusNotFound, "Stream is not live")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	t := &loadTest{
+		status:  loadTestStatus{ID: newID(), Stream: stream, Started: time.Now(), Running: true, Viewers: n},
+		cancel:  cancel,
+		request: request,
+	}
+	loadTestsMu.Lock()
+	expireLoadTests()
+	loadTests[t.status.ID] = t
+	loadTestsMu.Unlock()
+
+	loadTestLog.withStream(stream).withRequest(request).infof("[loadtest %s] Starting %d synthetic viewers for %v.", t.status.ID, n, duration)
+	go t.run(ctx, room, n)
+	return t, nil
+}
+
+// Join the synthetic viewers one after the other, measure the bitrate until
+// the test ends, then close them
+func (t *loadTest) run(ctx context.Context, room *Room, n int) {
+	tlog := loadTestLog.withStream(room.name).withRequest(t.request)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		last := uint64(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				bytes := t.bytes.Load()
+				t.mu.Lock()
+				t.status.Bitrate = int((bytes - last) * 8)
+				t.mu.Unlock()
+				last = bytes
+			}
+		}
+	}()
+
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		v := &syntheticViewer{state: "connecting"}
+		t.mu.Lock()
+		t.viewers = append(t.viewers, v)
+		t.status.Connecting++
+		t.mu.Unlock()
+		if err := t.join(ctx, room, v); err != nil {
+			tlog.warnf("[loadtest %s] Synthetic viewer %d could not join: %v", t.status.ID, i+1, err)
+			t.setState(v, "failed", time.Time{})
+			if _, ok := err.(*signalingError); ok && ctx.Err() == nil {
+				t.mu.Lock()
+				t.status.Error = err.Error()
+				t.mu.Unlock()
+				break
+			}
+		}
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	// Viewers keep the state they ended the test in as they are closed
+	t.mu.Lock()
+	viewers := t.viewers
+	t.status.Running, t.status.Bitrate = false, 0
+	t.ended = time.Now()
+	t.mu.Unlock()
+	for _, v := range viewers {
+		if v.viewer != nil {
+			room.closeViewer(v.viewer)
+		}
+		if v.pc != nil {
+			v.pc.Close()
+		}
+	}
+	st := t.snapshot()
+	tlog.infof("[loadtest %s] Done: %d of %d viewers connected, %d disconnected early, %d failed, %d bytes received.",
+		st.ID, st.Connected, st.Viewers, st.Disconnected, st.Failed, st.BytesReceived)
+}
+
+// Negotiate one synthetic viewer, receiving the stream's tracks until its
+// connection closes
+func (t *loadTest) join(ctx context.Context, room *Room, v *syntheticViewer) error {
+	joined := time.Now()
+	if err := admitViewer(ctx, room.name); err != nil {
+		return err
+	}
+	pc, err := syntheticViewerAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	v.pc = pc
+	t.mu.Unlock()
+	for _, track := range room.tracks() {
+		if _, err := pc.AddTransceiverFromKind(track.Kind(), webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+	}
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		var highest uint16
+		started := false
+		for {
+			packet, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			if gap := packet.SequenceNumber - highest; started && gap > 1 && gap < 0x8000 {
+				t.lost.Add(uint64(gap - 1))
+			}
+			if gap := packet.SequenceNumber - highest; !started || gap < 0x8000 {
+				highest, started = packet.SequenceNumber, true
+			}
+			t.packets.Add(1)
+			t.bytes.Add(uint64(packet.MarshalSize()))
+		}
+	})
+	timeout := time.AfterFunc(loadTestConnectTimeout, func() { t.setState(v, "failed", joined) })
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		switch s {
+		case webrtc.PeerConnectionStateConnected:
+			timeout.Stop()
+			t.setState(v, "connected", joined)
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateDisconnected:
+			timeout.Stop()
+			t.mu.Lock()
+			connected := v.state == "connected"
+			t.mu.Unlock()
+			if connected {
+				t.setState(v, "disconnected", joined)
+			} else {
+				t.setState(v, "failed", joined)
+			}
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// The SFU's candidates wait for the answer to be applied
+	var candidatesMu sync.Mutex
+	var pending []webrtc.ICECandidateInit
+	answered := false
+	onCandidate := func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		candidatesMu.Lock()
+		defer candidatesMu.Unlock()
+		if !answered {
+			pending = append(pending, c.ToJSON())
+			return
+		}
+		pc.AddICECandidate(c.ToJSON())
+	}
+	viewer, answer, err := negotiateViewer(t.request, room.name, nil, *pc.LocalDescription(), peerOverrides{}, viewerRTCP, onCandidate)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	v.viewer = viewer
+	t.mu.Unlock()
+	if err := pc.SetRemoteDescription(*answer); err != nil {
+		return err
+	}
+	candidatesMu.Lock()
+	answered = true
+	for _, c := range pending {
+		pc.AddICECandidate(c)
+	}
+	candidatesMu.Unlock()
+	viewer.log(loadTestLog).debugf("[loadtest %s] Viewer %s joined.", t.status.ID, viewer.id)
+	return nil
+}
+
+// Stop every running load test, for shutdown and resets
+func stopLoadTests() {
+	loadTestsMu.Lock()
+	list := make([]*loadTest, 0, len(loadTests))
+	for _, t := range loadTests {
+		list = append(list, t)
+	}
+	loadTestsMu.Unlock()
+	for _, t := range list {
+		t.cancel()
+	}
+}
+
+// Data of the load test page: the live streams to pick from
+type loadTestPage struct {
+	pageData
+	Streams    []string
+	MaxViewers int
+}
+
+// Handler for the load test page, starting synthetic viewers of a live stream
+// and following their aggregate stats
+func loadTestPageHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := loadTestPage{pageData: newPageData(), MaxViewers: maxLoadTestViewers}
+		for _, room := range listRooms() {
+			if room.getPublisher() != nil {
+				data.Streams = append(data.Streams, room.name)
+			}
+		}
+		sort.Strings(data.Streams)
+		renderPage(w, r, tmpl, "loadtest.html", data)
+	}
+}
+
+// Handler for GET /api/admin/loadtests, the load tests of the last hour,
+// newest first
+func listLoadTestsHandler(w http.ResponseWriter, r *http.Request) {
+	loadTestsMu.Lock()
+	expireLoadTests()
+	list := make([]loadTestStatus, 0, len(loadTests))
+	for _, t := range loadTests {
+		list = append(list, t.snapshot())
+	}
+	loadTestsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Handler for POST /api/admin/loadtests, starting synthetic viewers of a
+// live stream:
+//
+//	{"stream": "demo", "viewers": 50, "duration": "2m"}
+func startLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Stream   string `json:"stream"`
+		Viewers  int    `json:"viewers"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid load test", http.StatusBadRequest)
+		return
+	}
+	if req.Viewers < 1 || req.Viewers > maxLoadTestViewers {
+		http.Error(w, fmt.Sprintf("viewers must be between 1 and %d", maxLoadTestViewers), http.StatusBadRequest)
+		return
+	}
+	duration := defaultLoadTest
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxLoadTest {
+			http.Error(w, "duration must be a duration up to "+maxLoadTest.String(), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	t, err := startLoadTest(requestID(r), req.Stream, req.Viewers, duration)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t.snapshot())
+}
+
+func findLoadTest(w http.ResponseWriter, r *http.Request) *loadTest {
+	loadTestsMu.Lock()
+	t := loadTests[r.PathValue("id")]
+	loadTestsMu.Unlock()
+	if t == nil {
+		http.Error(w, "No such load test", http.StatusNotFound)
+	}
+	return t
+}
+
+// Handler for GET /api/admin/loadtests/{id}
+func loadTestHandler(w http.ResponseWriter, r *http.Request) {
+	t := findLoadTest(w, r)
+	if t == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.snapshot())
+}
+
+// Handler for DELETE /api/admin/loadtests/{id}, ending a load test early
+// and closing its viewers, its results are kept
+func stopLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	t := findLoadTest(w, r)
+	if t == nil {
+		return
+	}
+	t.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
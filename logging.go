@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+var currentLogLevel atomic.Int32
+
+// Where every module logger writes, text on stderr until setLogFormat. The
+// level is checked by the module loggers, the handler takes everything.
+var logHandler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+var (
+	adminLog     = newLogger("admin")
+	mainLog      = newLogger("main")
+	httpLog      = newLogger("http")
+	iceLog       = newLogger("ice")
+	publishLog   = newLogger("publish")
+	rtpLog       = newLogger("rtp")
+	signalingLog = newLogger("signaling")
+	viewLog      = newLogger("view")
+	watchdogLog  = newLogger("watchdog")
+)
+
+// Modules and streams whose debug messages are logged whatever the global level
+var debugFilters = struct {
+	mu      sync.RWMutex
+	modules map[string]bool
+	streams map[string]bool
+}{modules: map[string]bool{}, streams: map[string]bool{}}
+
+func init() {
+	currentLogLevel.Store(int32(levelInfo))
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func (l logLevel) slogLevel() slog.Level {
+	switch l {
+	case levelDebug:
+		return slog.LevelDebug
+	case levelWarn:
+		return slog.LevelWarn
+	case levelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+func setLogLevel(level logLevel) {
+	currentLogLevel.Store(int32(level))
+}
+
+// Write log lines as text or JSON from now on, called once at startup. What
+// libraries print with the log package goes there as well.
+func setLogFormat(format string) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "json" {
+		logHandler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		logHandler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(logHandler).With("module", "log"))
+}
+
+// Log an error and exit, for startup failures
+func fatalf(format string, args ...interface{}) {
+	mainLog.output(levelError, format, args...)
+	os.Exit(1)
+}
+
+// Logger of one module, optionally bound to a stream and to the request and
+// peer a message is about
+type moduleLogger struct {
+	module  string
+	stream  string
+	request string
+	peer    string
+}
+
+func newLogger(module string) moduleLogger {
+	return moduleLogger{module: module}
+}
+
+func (l moduleLogger) withStream(stream string) moduleLogger {
+	l.stream = stream
+	return l
+}
+
+func (l moduleLogger) withRequest(id string) moduleLogger {
+	l.request = id
+	return l
+}
+
+// Logger bound to the correlation ID of a request, see withRequestID
+func (l moduleLogger) forRequest(r *http.Request) moduleLogger {
+	return l.withRequest(requestID(r))
+}
+
+func (l moduleLogger) withPeer(id string) moduleLogger {
+	l.peer = id
+	return l
+}
+
+func (l moduleLogger) enabled(level logLevel) bool {
+	if level >= logLevel(currentLogLevel.Load()) {
+		return true
+	}
+	if level != levelDebug {
+		return false
+	}
+
+	debugFilters.mu.RLock()
+	defer debugFilters.mu.RUnlock()
+	return debugFilters.modules[l.module] || (l.stream != "" && debugFilters.streams[l.stream])
+}
+
+func (l moduleLogger) output(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	r := slog.NewRecord(time.Now(), level.slogLevel(), fmt.Sprintf(format, args...), 0)
+	r.AddAttrs(slog.String("module", l.module))
+	if l.stream != "" {
+		r.AddAttrs(slog.String("stream", l.stream))
+	}
+	if l.request != "" {
+		r.AddAttrs(slog.String("request", l.request))
+	}
+	if l.peer != "" {
+		r.AddAttrs(slog.String("peer", l.peer))
+	}
+	logHandler.Handle(context.Background(), r)
+}
+
+func (l moduleLogger) debugf(format string, args ...interface{}) {
+	l.output(levelDebug, format, args...)
+}
+
+func (l moduleLogger) infof(format string, args ...interface{}) {
+	l.output(levelInfo, format, args...)
+}
+
+func (l moduleLogger) warnf(format string, args ...interface{}) {
+	l.output(levelWarn, format, args...)
+}
+
+func (l moduleLogger) errorf(format string, args ...interface{}) {
+	l.output(levelError, format, args...)
+}
+
+// Loggers of pion's ICE, DTLS, SCTP and other components, as the module
+// loggers of their scope, so the level and debug filters apply to them too,
+// e.g. {"modules":["ice"]} for the ICE agent's debug messages. Their trace
+// messages are dropped.
+type pionLoggerFactory struct{}
+
+func (pionLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return pionLogger{newLogger(scope)}
+}
+
+type pionLogger struct {
+	moduleLogger
+}
+
+func (pionLogger) Trace(string)                           {}
+func (pionLogger) Tracef(string, ...interface{})          {}
+func (l pionLogger) Debug(msg string)                     { l.output(levelDebug, "%s", msg) }
+func (l pionLogger) Debugf(f string, args ...interface{}) { l.output(levelDebug, f, args...) }
+func (l pionLogger) Info(msg string)                      { l.output(levelInfo, "%s", msg) }
+func (l pionLogger) Infof(f string, args ...interface{})  { l.output(levelInfo, f, args...) }
+func (l pionLogger) Warn(msg string)                      { l.output(levelWarn, "%s", msg) }
+func (l pionLogger) Warnf(f string, args ...interface{})  { l.output(levelWarn, f, args...) }
+func (l pionLogger) Error(msg string)                     { l.output(levelError, "%s", msg) }
+func (l pionLogger) Errorf(f string, args ...interface{}) { l.output(levelError, f, args...) }
+
+// Current level and debug filters, as exchanged with /api/admin/loglevel
+type logSettings struct {
+	Level   string   `json:"level"`
+	Modules []string `json:"modules"`
+	Streams []string `json:"streams"`
+}
+
+func currentLogSettings() logSettings {
+	debugFilters.mu.RLock()
+	defer debugFilters.mu.RUnlock()
+
+	current := logSettings{
+		Level:   logLevel(currentLogLevel.Load()).String(),
+		Modules: sortedKeys(debugFilters.modules),
+		Streams: sortedKeys(debugFilters.streams),
+	}
+	return current
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// Handler to read and change the log level and debug filters at runtime.
+// POST {"level":"debug"} changes the global level, {"modules":["ice"]} or
+// {"streams":["demo"]} replace the debug filters; omitted fields are kept.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			Level   *string   `json:"level"`
+			Modules *[]string `json:"modules"`
+			Streams *[]string `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid log settings", http.StatusBadRequest)
+			return
+		}
+
+		if req.Level != nil {
+			level, err := parseLogLevel(*req.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			setLogLevel(level)
+		}
+
+		debugFilters.mu.Lock()
+		if req.Modules != nil {
+			debugFilters.modules = toSet(*req.Modules)
+		}
+		if req.Streams != nil {
+			debugFilters.streams = toSet(*req.Streams)
+		}
+		debugFilters.mu.Unlock()
+
+		settings := currentLogSettings()
+		adminLog.infof("Log level set to %s, debug modules %v, debug streams %v", settings.Level, settings.Modules, settings.Streams)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentLogSettings())
+}
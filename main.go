@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
-	"log"
+	"net"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pion/interceptor"
-	"github.com/pion/interceptor/pkg/intervalpli"
 	"github.com/pion/webrtc/v3"
+
+	"w/config"
 )
 
 // Embed the contents of the templates and static directories
@@ -22,27 +29,42 @@ import (
 //go:embed static/*
 var content embed.FS
 
-var (
-	publisherTrack *webrtc.TrackLocalStaticRTP
-	trackMutex     sync.Mutex
+// Settings loaded from flags, the environment and the config file
+var settings = config.Default()
+
+// Configuration and setting engine of the publisher and viewer
+// PeerConnections, by role
+func peerConnectionSettings(role string) (webrtc.Configuration, webrtc.SettingEngine, error) {
+	c := webrtc.Configuration{ICEServers: iceServers(role, "sfu")}
+	settingEngine := webrtc.SettingEngine{LoggerFactory: pionLoggerFactory{}}
+	if settings.ICEPortMax > 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(settings.ICEPortMin, settings.ICEPortMax); err != nil {
+			return c, settingEngine, err
+		}
+	}
+	return c, settingEngine, nil
+}
 
-	peerConnectionPublisher *webrtc.PeerConnection
-	peerConnectionViewer    *webrtc.PeerConnection
+// API of PeerConnections receiving a publisher's media, with the default
+// codecs and interceptors, RTCP reports as rtcp asks counted into f, and the
+// simulcast header extensions
+func publisherAPI(settingEngine webrtc.SettingEngine, rtcp rtcpSettings, f *rtcpFeedback) *webrtc.API {
+	i := &interceptor.Registry{}
 
-	// ice for publisher
-	iceCandidatesP           = make([]webrtc.ICECandidateInit, 0)
-	iceMutexP                sync.Mutex
-	pendingRemoteCandidatesP []webrtc.ICECandidateInit // to store early remote candidates coming when remote description is not ready
-	remoteCandidatesMtxP     sync.Mutex
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
 
-	// ice for viewer
-	iceCandidatesV           = make([]webrtc.ICECandidateInit, 0)
-	iceMutexV                sync.Mutex
-	pendingRemoteCandidatesV []webrtc.ICECandidateInit // to store early remote candidates coming when remote description is not ready
-	remoteCandidatesMtxV     sync.Mutex
-)
+	if err := registerInterceptors(m, i, rtcp, f); err != nil {
+		panic(err)
+	}
 
-type P struct {
+	// Header extensions carrying the RID of each simulcast layer
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		panic(err)
+	}
+	return webrtc.NewAPI(webrtc.WithInterceptorRegistry(i), webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(settingEngine))
 }
 
 // Function to parse the SDP from the request body
@@ -61,170 +83,297 @@ func parseSDP(r *http.Request, sdp *webrtc.SessionDescription) error {
 	return nil
 }
 
-// Watchdog to check publisher connection status and RTP senders
-func startWatchdog() {
+// Watchdog to check publisher connection status and RTP senders, and to
+// reap the peers left behind, see reapStalePeers
+func runWatchdog(ctx context.Context) error {
 	ticker := time.NewTicker(10 * time.Second) // Check every 10 seconds
-	go func() {
-		for range ticker.C {
-			trackMutex.Lock()
-			if peerConnectionPublisher != nil && publisherTrack != nil {
-				log.Println("Watchdog: Publisher is connected.")
-				// Check and log RTP senders and tracks
-				senders := peerConnectionPublisher.GetSenders()
-				if len(senders) > 0 {
-					for i, sender := range senders {
-						if sender.Track() != nil {
-							log.Printf("Watchdog: Sender %d - Kind: %s, Label: %v\n", i+1, sender.Track().Kind(), sender.Track())
-						} else {
-							log.Printf("Watchdog: Sender %d - No track attached\n", i+1)
-						}
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		reapStalePeers()
+		list := listRooms()
+		if len(list) == 0 {
+			watchdogLog.infof("No publisher connected.")
+		}
+		for _, room := range list {
+			wlog := watchdogLog.withStream(room.name)
+			publisher := room.getPublisher()
+			if publisher != nil {
+				wlog = publisher.log(watchdogLog)
+			}
+			if publisher != nil && publisher.dataOnly {
+				wlog.infof("Data-only publisher is connected, %d viewers.", len(room.getViewers()))
+				continue
+			}
+			if publisher == nil || len(publisher.getTracks()) == 0 {
+				wlog.infof("No publisher connected, %d viewers waiting.", len(room.getViewers()))
+				continue
+			}
+
+			wlog.infof("Publisher is connected, %d viewers.", len(room.getViewers()))
+			if publisher.pc == nil {
+				continue
+			}
+			// Check and log RTP senders and tracks
+			senders := publisher.pc.GetSenders()
+			if len(senders) > 0 {
+				for i, sender := range senders {
+					if sender.Track() != nil {
+						wlog.debugf("Sender %d - Kind: %s, Label: %v", i+1, sender.Track().Kind(), sender.Track())
+					} else {
+						wlog.debugf("Sender %d - No track attached", i+1)
 					}
-				} else {
-					log.Println("Watchdog: No senders available.")
 				}
 			} else {
-				log.Println("Watchdog: No publisher connected.")
+				wlog.debugf("No senders available.")
 			}
-			trackMutex.Unlock()
 		}
-	}()
+	}
 }
 
 // Handler for the publisher
 func publishHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("/publish: Publisher connection initiated.")
+	stream, err := streamName(r)
+	if err != nil {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+
+	plog := publishLog.withStream(stream).forRequest(r)
+	plog.infof("Publisher connection initiated.")
+
+	key, owner, err := authorizePublisher(publishToken(r), streamKeyParam(r), stream, currentAccount(r))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	dataOnly, err := parseDataOnly(r)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	cohost, err := parseCohost(r)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	rtcp, err := parseRTCPSettings(r, publisherRTCP)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	overrides, err := parsePeerOverrides(r, "publisher")
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
 
 	var offer webrtc.SessionDescription
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
 		http.Error(w, "Invalid offer", http.StatusBadRequest)
 		return
 	}
-	log.Println("/publish: SDP parsed successfully. SDP Type:", offer.Type.String())
-
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	plog.debugf("SDP parsed successfully. SDP Type: %s", offer.Type.String())
+
+	// Gathered candidates either go out on the streamed response or wait for the /events stream
+	streamed := wantsStreamedAnswer(r)
+	gathered := make(chan *webrtc.ICECandidate, 16)
+	var onCandidate func(*webrtc.ICECandidate)
+	if streamed {
+		onCandidate = streamCandidates(r.Context(), gathered)
 	}
 
-	settingEngine := webrtc.SettingEngine{}
-	i := &interceptor.Registry{}
+	publisher, answer, err := negotiatePublisher(requestID(r), stream, owner, offer, dataOnly, cohost, rtcp, overrides, onCandidate)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	trackStreamKey(key, stream, publisher)
 
-	m := &webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
-		panic(err)
+	// Log the SDP for debugging purposes
+	plog.debugf("Sending SDP answer")
+
+	w.Header().Set("X-Peer-ID", publisher.id)
+	w.Header().Set(peerSecretHeader, publisher.secret)
+	if streamed {
+		writeStreamedAnswer(w, r, "/publish", publisher.id, *answer, gathered)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
 	}
 
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
+	plog.debugf("Publisher process completed.")
+}
+
+// Set up the publisher PeerConnection of a stream for an offer and return the
+// answer. Locally gathered ICE candidates are handed to onCandidate, or queued
+// for the peer's /events stream when it is nil. The owner is nil when accounts are disabled.
+// Data-only publishers may only offer data channels. rtcp are the
+// publisher's RTCP report settings, overrides the settings it picked, and
+// request the correlation ID the publisher's messages are logged with.
+func negotiatePublisher(request, stream string, owner *account, offer webrtc.SessionDescription, dataOnly, cohost bool, rtcp rtcpSettings, overrides peerOverrides, onCandidate func(*webrtc.ICECandidate)) (*Publisher, *webrtc.SessionDescription, error) {
+	if services.isStopping() {
+		return nil, nil, errShuttingDown
+	}
+	plog := publishLog.withStream(stream).withRequest(request)
+	if dataOnly && offerHasMedia(offer) {
+		return nil, nil, newSignalingError(http.StatusBadRequest, "Data-only publishers send no audio or video")
+	}
+	if cohost && dataOnly {
+		return nil, nil, newSignalingError(http.StatusBadRequest, "Co-hosts send audio or video")
+	}
+	if overrides.AudioOnly && offerHasVideo(offer) {
+		return nil, nil, newSignalingError(http.StatusBadRequest, "Audio-only publishers send no video")
+	}
+	if room := getRoom(stream); cohost && (room == nil || room.getPublisher() == nil) {
+		return nil, nil, newSignalingError(http.StatusConflict, "Stream has no host to co-host with")
 	}
 
-	// This interceptor sends a PLI every 3 seconds, when new peer joins it will get keyframe to start with automatically.
-	// on production, need to have PLI logic (keyframe) that will only be requested when new peer joins
-	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
+	config, settingEngine, err := peerConnectionSettings("publisher")
 	if err != nil {
-		panic(err)
+		plog.errorf("Error configuring PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
 	}
-	i.Add(intervalPliFactory)
+	config.ICETransportPolicy = overrides.ICETransportPolicy
 
 	// create new peer connection
-	p, err := webrtc.NewAPI(webrtc.WithInterceptorRegistry(i), webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(config)
+	feedback := newRTCPFeedback(rtcp)
+	pc, err := publisherAPI(settingEngine, rtcp, feedback).NewPeerConnection(config)
 	if err != nil {
-		log.Println("/publish: Error creating PeerConnection:", err)
-		http.Error(w, "Failed to create PeerConnection", http.StatusInternalServerError)
-		return
+		plog.errorf("Error creating PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
 	}
-	peerConnectionPublisher = p
 
-	// Create Track that we send video back to browser on
-	outputTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
-	if err != nil {
-		panic(err)
+	room := getOrCreateRoom(stream)
+	publisher := &Publisher{peer: newPeer("publisher", stream, request, pc), owner: owner, source: webrtcIngest{pc: pc}, dataOnly: dataOnly, cohost: cohost, codecs: overrides.Codecs}
+	publisher.feedback.Store(feedback)
+	plog = publisher.log(publishLog)
+	if rtcp != publisherRTCP {
+		plog.infof("[publisher %s] RTCP reports %v.", publisher.id, rtcp)
 	}
-
-	// Add this newly created track to the PeerConnection
-	rtpSender, err := peerConnectionPublisher.AddTrack(outputTrack)
-	if err != nil {
-		panic(err)
+	if !overrides.isDefault() {
+		plog.infof("[publisher %s] Connection overrides: %v.", publisher.id, overrides)
+	}
+	if owner != nil {
+		plog.infof("[publisher %s] Publishing as user %s.", publisher.id, owner.Username)
+	}
+	if dataOnly {
+		plog.infof("[publisher %s] Publishing data channels only.", publisher.id)
+	}
+	if cohost {
+		plog.infof("[publisher %s] Joining as a co-host.", publisher.id)
+	}
+	if onCandidate == nil {
+		onCandidate = publisher.queueCandidate
 	}
 
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
+	if !dataOnly {
+		// Create Track that we send video back to browser on
+		outputTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
+		if err != nil {
+			panic(err)
 		}
-	}()
+
+		// Add this newly created track to the PeerConnection
+		rtpSender, err := pc.AddTrack(outputTrack)
+		if err != nil {
+			panic(err)
+		}
+
+		// Read incoming RTCP packets
+		// Before these packets are returned they are processed by interceptors. For things
+		// like NACK this needs to be called.
+		go func() {
+			rtcpBuf := make([]byte, 1500)
+			for {
+				if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+					return
+				}
+			}
+		}()
+	}
 
 	// Log ICE connection state changes
-	peerConnectionPublisher.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("/publish: ICE Connection State has changed: %s\n", state.String())
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		publisher.log(iceLog).infof("[publisher %s] ICE Connection State has changed: %s", publisher.id, state.String())
+		publisher.publishEvent(peerEvent{Type: "ice-state", State: state.String()})
 	})
 
-	peerConnectionPublisher.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c != nil {
-			iceMutexP.Lock()
-			iceCandidatesP = append(iceCandidatesP, c.ToJSON())
-			iceMutexP.Unlock()
+	pc.OnICECandidate(onCandidate)
+
+	// Chat, cues and captions of the publisher are recorded with the stream,
+	// its interactions channel gets the reactions of the viewers
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == interactionChannelLabel {
+			startPublisherInteractions(room, publisher, dc)
+			return
+		}
+		if dataOnly {
+			relayPublisherChannel(room, publisher, dc)
+			return
 		}
+		recordDataChannel(room, "publisher "+publisher.id, dc)
 	})
 
-	peerConnectionPublisher.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("Peer Connection State has changed: %s\n", s.String())
+	// Viewers are told while the publisher's connection is interrupted
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		plog.infof("[publisher %s] Peer Connection State has changed: %s", publisher.id, s.String())
+		publisher.publishEvent(peerEvent{Type: "connection-state", State: s.String()})
 
 		if s == webrtc.PeerConnectionStateConnected {
-			fmt.Println("Peer connected")
+			plog.infof("[publisher %s] Peer connected", publisher.id)
+			if publisher.reconnecting.Swap(false) && room.getPublisher() == publisher {
+				room.events.notify(room, streamNotice{Type: "publisher-reconnected", Publisher: publisher.displayID})
+			}
 		}
-
-		if s == webrtc.PeerConnectionStateFailed {
-			fmt.Println("Peer Connection has gone to failed exiting")
-			os.Exit(0)
+		if s == webrtc.PeerConnectionStateDisconnected && room.getPublisher() == publisher && !publisher.reconnecting.Swap(true) {
+			room.events.notify(room, streamNotice{Type: "publisher-reconnecting", Publisher: publisher.displayID})
 		}
 
-		if s == webrtc.PeerConnectionStateClosed {
-			fmt.Println("Peer Connection has gone to closed exiting")
-			os.Exit(0)
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			room.closePublisher(publisher)
 		}
 	})
 
 	// Handle incoming media from the publisher and log RTP packets
-	peerConnectionPublisher.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Println("/publish: Received track from publisher. Kind:", track.Kind(), "SSRC:", track.SSRC())
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		plog.infof("Received track from publisher. Kind: %s SSRC: %d RID: %q", track.Kind(), track.SSRC(), track.RID())
 
-		trackMutex.Lock()
-		defer trackMutex.Unlock()
+		localTrack := publisher.addTrack(track, receiver)
+		plog.infof("Publisher %s track %s initialized (%s).", track.Kind(), localTrack.key(), track.Codec().MimeType)
 
-		if publisherTrack == nil {
-			publisherTrack, err = webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, "video", "sfu")
-			if err != nil {
-				log.Println("/publish: Error creating local track:", err)
-				return
-			}
-			log.Println("/publish: Publisher track initialized.")
+		// Viewers and outputs of a previous publisher continue on this track
+		room.publishTrack(publisher, localTrack)
+
+		// Watch keyframe spacing of video tracks we can parse
+		var monitor *keyframeMonitor
+		if track.Kind() == webrtc.RTPCodecTypeVideo && canMonitorKeyframes(track.Codec().MimeType) {
+			monitor = startKeyframeMonitor(publisher.peer, track)
 		}
 
 		// Log RTP packets from the publisher
 		go func() {
+			defer room.unpublishTrack(publisher, localTrack)
+			if monitor != nil {
+				defer monitor.stop()
+			}
 			for {
 				packet, _, err := track.ReadRTP()
 				if err != nil {
-					log.Println("/publish: Error reading RTP packet:", err)
+					publisher.log(rtpLog).errorf("Error reading RTP packet: %v", err)
 					break
 				}
 
-				// Log RTP packet details
-				//log.Printf("/publish: RTP Packet - SSRC: %d, Sequence: %d, Timestamp: %d, PayloadType: %d\n",
-				//packet.SSRC, packet.SequenceNumber, packet.Timestamp, packet.PayloadType)
-
+				if monitor != nil {
+					monitor.observe(packet)
+				}
 				// Write the RTP packet to the local publisher track
-				if err := publisherTrack.WriteRTP(packet); err != nil {
-					log.Println("/publish: Error writing RTP to local track:", err)
+				if err := room.publishRTP(publisher, localTrack, packet); err != nil {
+					publisher.log(rtpLog).errorf("Error writing RTP to local track: %v", err)
 					break
 				}
 			}
@@ -232,262 +381,800 @@ func publishHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// Set the remote description
-	err = peerConnectionPublisher.SetRemoteDescription(offer)
+	err = pc.SetRemoteDescription(offer)
 	if err != nil {
-		log.Println("/publish: Error setting remote description:", err)
-		http.Error(w, "Could not set remote description", http.StatusInternalServerError)
-		return
+		plog.errorf("Error setting remote description: %v", err)
+		room.closePublisher(publisher)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set remote description")
+	}
+	plog.debugf("Remote description set.")
+	publisher.flushPendingCandidates()
+	if !dataOnly {
+		sender := chatSender{ID: publisher.displayID, Role: "publisher"}
+		if owner != nil {
+			sender.User = owner.Username
+		}
+		openChat(room, publisher.peer, sender, &publisher.channels)
+	}
+
+	prefer := publisher.codecOrder(room)
+	for _, t := range pc.GetTransceivers() {
+		if err := orderPublisherCodecs(t, prefer); err != nil {
+			plog.warnf("Error ordering %s codecs: %v", t.Kind(), err)
+		}
 	}
-	log.Println("/publish: Remote description set.")
 
 	// Create an answer and send it back
-	answer, err := peerConnectionPublisher.CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		log.Println("/publish: Error creating answer:", err)
-		http.Error(w, "Could not create answer", http.StatusInternalServerError)
-		return
+		plog.errorf("Error creating answer: %v", err)
+		room.closePublisher(publisher)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
 	}
 
-	err = peerConnectionPublisher.SetLocalDescription(answer)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
-		log.Println("/publish: Error setting local description:", err)
-		http.Error(w, "Could not set local description", http.StatusInternalServerError)
-		return
+		plog.errorf("Error setting local description: %v", err)
+		room.closePublisher(publisher)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
 	}
-	log.Println("/publish: Local description set. Sending SDP answer.")
+	plog.debugf("Local description set. Sending SDP answer.")
 
-	// Log the SDP for debugging purposes
-	log.Printf("/publish: Sending SDP answer\n")
+	// Co-hosts join the host, viewers reconnect to get their tracks
+	if cohost {
+		if err := room.addCohost(publisher); err != nil {
+			room.closePublisher(publisher)
+			return nil, nil, err
+		}
+		notifyViewers(room, signalMessage{Type: "cohost-joined", Stream: stream, ID: publisher.id})
+		return publisher, &answer, nil
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(answer)
+	// The newest publisher of a stream takes over from the previous one
+	old := room.setPublisher(publisher)
+	publisher.continueRecording(old)
+	if old != nil {
+		plog.infof("Stream taken over from publisher %s.", old.id)
+		room.closePublisher(old)
+	}
 
-	log.Println("/publish: Publisher process completed.")
+	return publisher, &answer, nil
 }
 
 // Handler for the viewer
 func viewHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("/view: Viewer connection initiated.")
+	stream, err := streamName(r)
+	if err != nil {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	// or by the peer ID of its host or a co-host, ?publisher=
+	if id := r.URL.Query().Get("publisher"); id != "" {
+		room, _ := findPublisher(id)
+		if room == nil || (r.URL.Query().Has("stream") && room.name != stream) {
+			streamNotFound(w, r)
+			return
+		}
+		stream = room.name
+	}
+
+	vlog := viewLog.withStream(stream).forRequest(r)
+	vlog.infof("Viewer connection initiated.")
+
+	// A transfer code takes over the session of another device's viewer
+	// instead of a token
+	var transferred *Viewer
+	a := currentAccount(r)
+	if code := r.URL.Query().Get("transfer"); code != "" {
+		if transferred, err = redeemTransfer(code, stream); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		a = transferred.account
+	} else if err := authorizeView(r, stream); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if getRoom(stream) == nil {
+		vlog.warnf("Stream does not exist.")
+		streamNotFound(w, r)
+		return
+	}
+
+	// Viewers may restrict the answer to a codec, e.g. ?codec=h264, relay
+	// through TURN or leave out video, see peerOverrides
+	overrides, err := parsePeerOverrides(r, "viewer")
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	rtcp, err := parseRTCPSettings(r, viewerRTCP)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	// and wait for a publisher's tracks that haven't arrived yet, ?wait=10s
+	trackWait, err := parseTrackWait(r)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	// Thumbnails and monitoring walls take fewer frames, ?decimate=4, and
+	// slow links fewer VP8 temporal layers, ?temporalLayer=1
+	decimation, err := parseDecimation(r)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	temporalLayer, err := parseTemporalLayer(r)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
 
 	var offer webrtc.SessionDescription
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
 		http.Error(w, "Invalid offer", http.StatusBadRequest)
 		return
 	}
-	log.Println("/view: SDP parsed successfully. SDP Type:", offer.Type.String())
+	vlog.debugf("SDP parsed successfully. SDP Type: %s", offer.Type.String())
+
+	// Gathered candidates either go out on the streamed response or wait for the /events stream
+	streamed := wantsStreamedAnswer(r)
+	gathered := make(chan *webrtc.ICECandidate, 16)
+	var onCandidate func(*webrtc.ICECandidate)
+	if streamed {
+		onCandidate = streamCandidates(r.Context(), gathered)
+	}
 
-	var err error
-	viewPeerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		log.Println("/view: Error creating PeerConnection:", err)
-		http.Error(w, "Failed to create PeerConnection", http.StatusInternalServerError)
+	if err := admitViewer(r.Context(), stream); err != nil {
+		writeSignalingError(w, err)
 		return
 	}
-	peerConnectionViewer = viewPeerConnection
+	waitForTracks(r.Context(), stream, trackWait)
 
-	trackMutex.Lock()
-	if publisherTrack == nil {
-		log.Println("/view: No publisher track available. Viewer cannot connect.")
-		http.Error(w, "No publisher available", http.StatusServiceUnavailable)
-		trackMutex.Unlock()
+	viewer, answer, err := negotiateViewer(requestID(r), stream, a, offer, overrides, rtcp, onCandidate)
+	if err != nil {
+		writeSignalingError(w, err)
 		return
 	}
-	log.Println("/view: Publisher track found. Viewer can connect.")
-	trackMutex.Unlock()
+	if transferred != nil {
+		viewer.takeOver(transferred)
+	} else {
+		viewer.setIdentity(viewerIdentity{token: r.URL.Query().Get("token")})
+	}
+	if decimation > 1 {
+		viewer.setDecimation(decimation)
+	}
+	if temporalLayer >= 0 {
+		viewer.setTemporalLayer(temporalLayer)
+	}
+
+	w.Header().Set("X-Peer-ID", viewer.id)
+	w.Header().Set(peerSecretHeader, viewer.secret)
+	if streamed {
+		writeStreamedAnswer(w, r, "/view", viewer.id, *answer, gathered)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
+	}
 
-	// Add the publisher's track to the viewer's peer connection
-	_, err = peerConnectionViewer.AddTrack(publisherTrack)
+	vlog.debugf("Viewer process completed.")
+}
+
+// PeerConnection of a viewer with what its interceptors observe
+type viewerConnection struct {
+	pc       *webrtc.PeerConnection
+	startup  *viewerStartup
+	feedback *rtcpFeedback
+}
+
+// New PeerConnection for a viewer, with the default codecs and interceptors,
+// RTCP reports as rtcp asks, and one observing what is forwarded to measure
+// the viewer's startup time. Its ICE transport policy is that of overrides.
+func newViewerConnection(rtcp rtcpSettings, overrides peerOverrides) (*viewerConnection, error) {
+	c := &viewerConnection{startup: &viewerStartup{}, feedback: newRTCPFeedback(rtcp)}
+	i := &interceptor.Registry{}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
+
+	if err := registerInterceptors(m, i, rtcp, c.feedback); err != nil {
+		panic(err)
+	}
+	if err := registerBandwidthEstimator(m, i, c.feedback); err != nil {
+		panic(err)
+	}
+	i.Add(&startupInterceptorFactory{startup: c.startup})
+
+	config, settingEngine, err := peerConnectionSettings("viewer")
 	if err != nil {
-		log.Println("/view: Error adding publisher track to viewer:", err)
-		http.Error(w, "Could not add track", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	config.ICETransportPolicy = overrides.ICETransportPolicy
+	if c.pc, err = webrtc.NewAPI(webrtc.WithInterceptorRegistry(i), webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(config); err != nil {
+		return nil, err
 	}
-	log.Println("/view: Publisher track added to viewer connection.")
+	return c, nil
+}
+
+// Set up a viewer PeerConnection on a stream for an offer and return the
+// answer. Locally gathered ICE candidates are handed to onCandidate, or queued
+// for the peer's /events stream when it is nil. a is the logged in user viewing, if any,
+// overrides the settings it picked, rtcp the viewer's RTCP report settings
+// and request the correlation ID its messages are logged with.
+func negotiateViewer(request, stream string, a *account, offer webrtc.SessionDescription, overrides peerOverrides, rtcp rtcpSettings, onCandidate func(*webrtc.ICECandidate)) (*Viewer, *webrtc.SessionDescription, error) {
+	if services.isStopping() {
+		return nil, nil, errShuttingDown
+	}
+	vlog := viewLog.withStream(stream).withRequest(request)
+
+	room := getRoom(stream)
+	if room == nil {
+		vlog.warnf("Stream does not exist.")
+		return nil, nil, newSignalingError(http.StatusNotFound, "No such stream")
+	}
+
+	// Viewers of data-only streams only get their data channels relayed
+	var publisherTracks []*trackFanout
+	p := room.getPublisher()
+	dataOnly := p != nil && p.dataOnly
+	if !dataOnly {
+		publisherTracks = append(room.tracks(), room.cohostTracks()...)
+	}
+	if overrides.AudioOnly {
+		publisherTracks = slices.DeleteFunc(publisherTracks, func(t *trackFanout) bool { return t.Kind() == webrtc.RTPCodecTypeVideo })
+	}
+	if !dataOnly && len(publisherTracks) == 0 && overrides.AudioOnly {
+		return nil, nil, newSignalingError(http.StatusServiceUnavailable, "No publisher audio available")
+	}
+	if !dataOnly && len(publisherTracks) == 0 {
+		vlog.warnf("No publisher track available. Viewer cannot connect.")
+		return nil, nil, newSignalingError(http.StatusServiceUnavailable, "No publisher available")
+	}
+	preferCodec := overrides.Codecs
+	if codecVariantsEnabled && !dataOnly && !overrides.AudioOnly {
+		publisherTracks = withCodecVariants(room, publisherTracks, offerCodecs(offer, webrtc.RTPCodecTypeVideo), preferCodec)
+	}
+	vlog.debugf("%d publisher tracks found. Viewer can connect.", len(publisherTracks))
 
-	peerConnectionViewer.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c != nil {
-			iceMutexV.Lock()
-			iceCandidatesV = append(iceCandidatesV, c.ToJSON())
-			iceMutexV.Unlock()
+	// Prewarmed connections send reports as viewers do by default and
+	// gather every kind of candidate
+	var conn *viewerConnection
+	if rtcp == viewerRTCP && overrides.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+		conn = takePrewarmedViewer(stream)
+	}
+	var err error
+	if conn == nil {
+		if conn, err = newViewerConnection(rtcp, overrides); err != nil {
+			vlog.errorf("Error creating PeerConnection: %v", err)
+			return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
 		}
+	}
+	pc, startup := conn.pc, conn.startup
+
+	viewer := &Viewer{peer: newPeer("viewer", stream, request, pc), account: a, startup: startup, audioOnly: overrides.AudioOnly}
+	viewer.feedback.Store(conn.feedback)
+	// Tracks published meanwhile are added once the viewer has its answer
+	viewer.negotiationMu.Lock()
+	defer viewer.negotiationMu.Unlock()
+	vlog = viewer.log(viewLog)
+	if rtcp != viewerRTCP {
+		vlog.infof("[viewer %s] RTCP reports %v.", viewer.id, rtcp)
+	}
+	if !overrides.isDefault() {
+		vlog.infof("[viewer %s] Connection overrides: %v.", viewer.id, overrides)
+	}
+	if a != nil {
+		vlog.infof("[viewer %s] Viewing as user %s.", viewer.id, a.Username)
+	}
+	startup.viewerID = viewer.id
+	startup.stream = stream
+	if onCandidate == nil {
+		onCandidate = viewer.queueCandidate
+	}
+	// Subscribe the viewer to every track of the publisher
+	for _, publisherTrack := range publisherTracks {
+		if p != nil {
+			publisherTrack = p.viewerLayer(publisherTrack)
+		}
+		track := publisherTrack.newViewerTrack()
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			vlog.errorf("Error adding publisher track %s to viewer: %v", publisherTrack.ID(), err)
+			room.closeViewer(viewer)
+			return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not add track")
+		}
+		viewer.tracksMu.Lock()
+		viewer.tracks = append(viewer.tracks, track)
+		viewer.tracksMu.Unlock()
+		if len(preferCodec) > 0 {
+			for _, t := range pc.GetTransceivers() {
+				if t.Sender() != sender {
+					continue
+				}
+				if err := preferCodecs(t, publisherTrack, preferCodec); err != nil {
+					vlog.warnf("[viewer %s] Codec preference not applied to track %s: %v", viewer.id, publisherTrack.ID(), err)
+					room.closeViewer(viewer)
+					return nil, nil, err
+				}
+			}
+		}
+		go relayKeyframeRequests(room, viewer, sender, track)
+		vlog.debugf("Publisher %s track %s added to viewer connection.", publisherTrack.Kind(), publisherTrack.ID())
+	}
+	room.addViewer(viewer)
+
+	pc.OnICECandidate(onCandidate)
+
+	// Viewers open a data channel used to probe their round trip time, the
+	// messages of their other channels are recorded with the stream
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == latencyChannelLabel {
+			startLatencyProbe(viewer, dc)
+			return
+		}
+		if dc.Label() == heartbeatChannelLabel {
+			startHeartbeats(viewer, dc)
+			return
+		}
+		if dc.Label() == interactionChannelLabel {
+			startInteractions(room, viewer, dc)
+			return
+		}
+		if dataOnly {
+			relayViewerChannel(room, viewer, dc)
+			return
+		}
+		viewer.channels.add(dc)
+		recordDataChannel(room, "viewer "+viewer.id, dc)
 	})
 
 	// Log ICE connection state changes
-	peerConnectionViewer.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("/view: ICE Connection State has changed: %s\n", state.String())
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		viewer.log(iceLog).infof("[viewer %s] ICE Connection State has changed: %s", viewer.id, state.String())
+		viewer.publishEvent(peerEvent{Type: "ice-state", State: state.String()})
 	})
 
-	peerConnectionViewer.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("[viewer] Peer Connection State has changed: %s\n", s.String())
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		vlog.infof("[viewer %s] Peer Connection State has changed: %s", viewer.id, s.String())
+		viewer.publishEvent(peerEvent{Type: "connection-state", State: s.String()})
 
 		if s == webrtc.PeerConnectionStateConnected {
-			fmt.Println("[viewer] Peer connected")
-		}
+			vlog.infof("[viewer %s] Peer connected", viewer.id)
 
-		if s == webrtc.PeerConnectionStateFailed {
-			fmt.Println("Peer Connection has gone to failed exiting")
-			os.Exit(0)
+			// Keyframes are only requested when a viewer needs one to start decoding
+			if publisher := room.getPublisher(); publisher != nil {
+				publisher.requestKeyframe()
+			}
+			for _, cohost := range room.getCohosts() {
+				cohost.requestKeyframe()
+			}
+			startup.markConnected()
+			viewer.completeTransfer()
 		}
 
-		if s == webrtc.PeerConnectionStateClosed {
-			fmt.Println("Peer Connection has gone to closed exiting")
-			os.Exit(0)
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			room.closeViewer(viewer)
 		}
 	})
 
 	// Set the remote description
-	err = peerConnectionViewer.SetRemoteDescription(offer)
+	err = pc.SetRemoteDescription(offer)
 	if err != nil {
-		log.Println("/view: Error setting remote description:", err)
-		http.Error(w, "Could not set remote description", http.StatusInternalServerError)
-		return
+		vlog.errorf("Error setting remote description: %v", err)
+		room.closeViewer(viewer)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set remote description")
+	}
+	vlog.debugf("Remote description set.")
+	viewer.flushPendingCandidates()
+	if !dataOnly {
+		sender := chatSender{ID: viewer.displayID, Role: "viewer"}
+		if a != nil {
+			sender.User = a.Username
+		}
+		openChat(room, viewer.peer, sender, &viewer.channels)
+		openStreamEvents(room, viewer)
 	}
-	log.Println("/view: Remote description set.")
 
 	// Create an answer and send it back
-	answer, err := peerConnectionViewer.CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		log.Println("/view: Error creating answer:", err)
-		http.Error(w, "Could not create answer", http.StatusInternalServerError)
-		return
+		vlog.errorf("Error creating answer: %v", err)
+		room.closeViewer(viewer)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
 	}
 
-	err = peerConnectionViewer.SetLocalDescription(answer)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
-		log.Println("/view: Error setting local description:", err)
-		http.Error(w, "Could not set local description", http.StatusInternalServerError)
-		return
+		vlog.errorf("Error setting local description: %v", err)
+		room.closeViewer(viewer)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
 	}
-	log.Println("/view: Local description set. Sending SDP answer.")
+	vlog.debugf("Local description set. Sending SDP answer.")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(answer)
+	// Tracks only reach the viewer when its offer has a media section for them
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() != nil && t.Sender().Track() != nil && t.Mid() == "" {
+			vlog.warnf("[viewer %s] Offer has no %s media section left for track %s.", viewer.id, t.Kind(), t.Sender().Track().ID())
+		}
+	}
+	startup.markAnswerSent()
 
-	log.Println("/view: Viewer process completed.")
+	return viewer, &answer, nil
 }
 
 func main() {
-	// Start the watchdog
-	startWatchdog()
-
-	// Parse the HTML template
-	tmpl := template.Must(template.ParseFS(content, "templates/index.html"))
-
-	// Serve the main page with CSP headers
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Security-Policy", "script-src 'self';")
-		err := tmpl.Execute(w, nil)
-		if err != nil {
-			log.Println("/: Error rendering template:", err)
-			http.Error(w, "Failed to render template", http.StatusInternalServerError)
-		} else {
-			log.Println("/: Main page served successfully.")
-		}
-	})
-
-	// Set up the handlers for publishing and viewing streams
-	http.HandleFunc("/publish", publishHandler)
-	http.HandleFunc("/view", viewHandler)
+	accountsPath := flag.String("accounts-db", "", "path to the SQLite accounts database, publishing and admin pages are open when empty")
+	featureList := flag.String("features", "", "comma separated feature flags to start with, toggled at runtime with /api/admin/features: "+strings.Join(featureNames(), ", "))
+	geoipPath := flag.String("geoip-db", "", "path to a MaxMind GeoIP2/GeoLite2 database used to group viewer latency by region")
+	flag.Float64Var(&monitorVolume, "monitor-volume", monitorVolume, "volume of each stream on the operator audio monitor, 0 to 1")
+	flag.BoolVar(&meshEnabled, "mesh", false, "connect participants of rooms with up to 3 members peer-to-peer, relaying only their signaling")
+	flag.Float64Var(&viewerJoinRate, "viewer-join-rate", viewerJoinRate, "viewer joins admitted per second and stream, later ones are queued (0 disables)")
+	flag.IntVar(&viewerJoinBurst, "viewer-join-burst", viewerJoinBurst, "viewer joins admitted at once before -viewer-join-rate applies")
+	flag.Float64Var(&layerPruneCPU, "prune-cpu", 0, "share of the machine's CPU, e.g. 0.9, above which viewers no longer get the highest simulcast layer (0 disables)")
+	flag.Float64Var(&layerPruneEgress, "prune-egress", 0, "bits per second sent to viewers, e.g. 9e8, above which they no longer get the highest simulcast layer (0 disables)")
+	flag.StringVar(&recordingsDir, "recordings-dir", recordingsDir, "directory recordings of streams are written to")
+	flag.StringVar(&mediaStorageURL, "media-storage", "", "where recordings go instead of -recordings-dir, and HLS segments are copied to: nfs:/path for a shared mount or s3://bucket/prefix for an S3-compatible store")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "URL of the S3-compatible store of -media-storage, e.g. http://minio:9000, AWS S3 of -s3-region by default")
+	flag.StringVar(&s3Region, "s3-region", s3Region, "region requests to -s3-endpoint are signed for")
+	flag.StringVar(&s3AccessKey, "s3-access-key", "", "access key of -s3-endpoint, AWS_ACCESS_KEY_ID by default")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", "", "secret key of -s3-endpoint, AWS_SECRET_ACCESS_KEY by default")
+	flag.DurationVar(&captureBuffer, "capture-buffer", captureBuffer, "how much of each stream is kept in memory for /api/streams/{name}/capture to write out (0 disables)")
+	flag.StringVar(&streamKeysPath, "stream-keys", streamKeysPath, "file stream keys made with /api/streamkeys are kept in (empty keeps them in memory)")
+	flag.DurationVar(&storyboardInterval, "storyboard-interval", storyboardInterval, "time between the seek bar thumbnails of recording storyboards (0 disables them)")
+	flag.BoolVar(&gopCacheEnabled, "gop-cache", true, "replay the last GOP of each video track to viewers as they join")
+	flag.DurationVar(&pliInterval, "pli-interval", pliInterval, "shortest time between PLIs on a publisher track, keyframe requests in between are coalesced")
+	flag.StringVar(&ffmpegPath, "ffmpeg", ffmpegPath, "path to the ffmpeg binary used for HLS output")
+	flag.BoolVar(&codecVariantsEnabled, "codec-variants", false, "transcode a stream's video to VP8 or H264 with ffmpeg for viewers whose offer lacks the published codec")
+	flag.StringVar(&offlineSlateImage, "offline-slate", "", "image ffmpeg shows as video to the viewers of streams gone offline without a live failover stream (empty leaves them on the last frame)")
+	flag.StringVar(&hlsDir, "hls-dir", hlsDir, "directory HLS playlists and segments are written to")
+	flag.BoolVar(&preflightEnabled, "preflight", preflightEnabled, "check on startup that the listen addresses are free, TLS files readable, media storage writable, TURN servers reachable and ffmpeg found, and exit listing what isn't")
+	peerOverrideList := flag.String("peer-overrides", strings.Join(overrideNames, ","), "comma separated overrides publishers and viewers may send with their offer: "+strings.Join(overrideNames, ", ")+" (empty allows none)")
+	flag.DurationVar(&stalePeerTimeout, "stale-peer-timeout", stalePeerTimeout, "close publishers, viewers and other sessions whose PeerConnection wasn't connected for this long (0 only closes those failed or closed)")
+	flag.DurationVar(&publisherGrace, "publisher-grace", publisherGrace, "how long a stream whose publisher dropped stays live for it to publish again, its viewers and recording continuing with the new connection (0 ends the stream right away)")
+	flag.BoolVar(&inputSwitching, "input-switching", false, "let streams switch between WebRTC and RTMP inputs: WebRTC publishers are asked for H264 and recordings wait 10s for the next input")
+	flag.StringVar(&rtmpAddr, "rtmp", rtmpAddr, "address RTMP publishers connect to, empty disables RTMP ingest")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "how often the WebRTC stats of each session are collected for export (0 disables)")
+	flag.DurationVar(&publisherRTCP.Interval, "publisher-rtcp-interval", publisherRTCP.Interval, "time between the RTCP receiver reports sent to publishers, ?rtcpInterval= of a publisher overrides it")
+	flag.Float64Var(&publisherRTCP.Fraction, "publisher-rtcp-fraction", 0, "largest share of a publisher's media its RTCP may take, reports beyond it are skipped (0 for no limit), ?rtcpFraction= overrides it")
+	flag.DurationVar(&viewerRTCP.Interval, "viewer-rtcp-interval", viewerRTCP.Interval, "time between the RTCP sender reports sent to viewers, ?rtcpInterval= of a viewer overrides it")
+	flag.Float64Var(&viewerRTCP.Fraction, "viewer-rtcp-fraction", 0, "largest share of a viewer's media its RTCP may take, reports beyond it are skipped (0 for no limit), ?rtcpFraction= overrides it")
+	flag.IntVar(&rembMinBitrate, "remb-min-bitrate", rembMinBitrate, "lowest bitrate in bit/s REMB feedback asks publishers for, from their viewers' bandwidth estimates (0 disables REMB)")
+	flag.DurationVar(&maxKeyframeInterval, "max-keyframe-interval", 0, "send PLIs to publishers whose keyframes are further apart than this (0 disables)")
+	flag.BoolVar(&debugEnabled, "debug", false, "serve pprof profiles, expvar and goroutine dumps under /debug/, to admins when -accounts-db is set")
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatalf("%v", err)
+	}
+	settings = conf
 
-	// ice for publisher
-	http.HandleFunc("/ice-candidate-p", handleIceCandidatePublisher)
-	http.HandleFunc("/ice-candidates-p", handleIceCandidatesPublisher)
+	setLogFormat(settings.LogFormat)
+	if l, err := parseLogLevel(settings.LogLevel); err != nil {
+		fatalf("%v", err)
+	} else {
+		setLogLevel(l)
+	}
+	if publisherCodecs, err = parseCodecPreference(strings.Join(settings.Codecs, ",")); err != nil {
+		fatalf("%v", err)
+	}
+	if allowedOverrides, err = parseAllowedOverrides(*peerOverrideList); err != nil {
+		fatalf("-peer-overrides: %v", err)
+	}
+	if err := publisherRTCP.check(); err != nil {
+		fatalf("-publisher-rtcp-*: %v", err)
+	}
+	if err := viewerRTCP.check(); err != nil {
+		fatalf("-viewer-rtcp-*: %v", err)
+	}
+	if err := enableFeatures(*featureList); err != nil {
+		fatalf("-features: %v", err)
+	}
 
-	// ice for viewer
-	http.HandleFunc("/ice-candidate-v", handleIceCandidateViewer)
-	http.HandleFunc("/ice-candidates-v", handleIceCandidatesViewer)
+	if media, err = openMediaStorage(mediaStorageURL); err != nil {
+		fatalf("%v", err)
+	}
+	if media.shared() {
+		storageLog.infof("Media storage: %s.", media)
+	}
 
-	// Serve static JavaScript files
-	http.Handle("/static/", http.FileServer(http.FS(content)))
+	if preflightEnabled {
+		if problems := preflight(); len(problems) > 0 {
+			for _, p := range problems {
+				preflightLog.errorf("%s", p)
+			}
+			fatalf("%d configuration problems found, fix them or skip the checks with -preflight=false", len(problems))
+		}
+	}
 
-	// Start the HTTP server
-	log.Println("Server running at http://localhost:8080")
-	err := http.ListenAndServe(":8080", nil)
+	tlsConfig, err := serverTLSConfig()
 	if err != nil {
-		log.Fatal("Server failed:", err)
+		fatalf("%v", err)
 	}
-}
 
-func handleIceCandidatePublisher(w http.ResponseWriter, r *http.Request) {
-	var candidate webrtc.ICECandidateInit
-	if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
-		http.Error(w, "Invalid ICE candidate", http.StatusBadRequest)
-		return
+	if err := loadPublishJWTKey(); err != nil {
+		fatalf("Error loading publish JWT key: %v", err)
 	}
 
-	remoteCandidatesMtxP.Lock()
-	defer remoteCandidatesMtxP.Unlock()
+	openGeoIP(*geoipPath)
 
-	if peerConnectionPublisher == nil {
-		return
+	openAccounts(*accountsPath)
+	if (settings.OIDCIssuer != "" || settings.RequireLogin) && accountsDB == nil {
+		fatalf("-oidc-issuer and -require-login need -accounts-db")
+	}
+	if err := openOIDC(context.Background()); err != nil {
+		fatalf("Error discovering OpenID Connect provider: %v", err)
 	}
 
-	desc := peerConnectionPublisher.RemoteDescription()
-	if desc == nil {
-		pendingRemoteCandidatesP = append(pendingRemoteCandidatesP, candidate)
-		return
+	if err := loadStreamKeys(); err != nil {
+		fatalf("Error loading stream keys: %v", err)
 	}
 
-	if err := peerConnectionPublisher.AddICECandidate(candidate); err != nil {
-		http.Error(w, "Failed to add ICE candidate", http.StatusInternalServerError)
-		return
+	if err := openSessionStore(settings.SessionStore); err != nil {
+		fatalf("Error opening session store: %v", err)
 	}
 
-	//fmt.Println("[publilsher peer] ice candidate", candidate)
-}
+	// Background subsystems, each started once the one before is ready, the
+	// listeners once listening, and stopped in reverse order on shutdown: the
+	// sessions first, new signaling is refused from then on, then the
+	// servers, egress, recordings so their files are complete, and the
+	// session store last
+	services.add("sessions", runSessionStore)
+	services.add("watchdog", runWatchdog)
+	services.add("usage", runUsageSampler)
+	services.add("prune", runLayerPruner)
+	services.add("recordings", onShutdown(stopRecordings))
+	services.add("hls", onShutdown(stopHLSPipelines))
+	services.add("restream", onShutdown(stopRestreams))
+	services.add("forward", onShutdown(stopExternalForwards))
+	services.add("egress", onShutdown(stopEgresses))
+	services.add("rules", runRules)
+	services.add("remb", runREMB)
+	services.add("interactions", runInteractions)
+	services.add("rtsp", onShutdown(stopRTSPSources))
+	services.add("rtp", onShutdown(stopRTPIngests))
+	services.addReady("rtmp", func(ctx context.Context, ready func()) error { return runRTMPIngest(ctx, rtmpAddr, ready) })
+	services.addReady("http", func(ctx context.Context, ready func()) error {
+		return runHTTPServer(ctx, settings.Listen, tlsConfig, ready)
+	})
+	services.addReady("http-redirect", func(ctx context.Context, ready func()) error {
+		return runHTTPRedirect(ctx, settings.HTTPRedirect, ready)
+	})
+	services.add("prewarm", onShutdown(stopPrewarming))
+	services.add("loadtest", onShutdown(stopLoadTests))
+	services.add("certify", onShutdown(stopCertifications))
+	services.add("peers", onShutdown(drainPeers))
 
-func handleIceCandidatesPublisher(w http.ResponseWriter, r *http.Request) {
-	iceMutexP.Lock()
-	candidates := iceCandidatesP
-	iceCandidatesP = nil
-	iceMutexP.Unlock()
+	// Parse the HTML templates
+	tmpl := template.Must(template.ParseFS(content, "templates/*.html"))
 
-	if candidates == nil {
-		candidates = []webrtc.ICECandidateInit{}
-	}
+	// Serve the main page with CSP headers
+	http.HandleFunc("/", requireLogin(true, func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, tmpl, "index.html", indexPage{newPageData()})
+	}))
+
+	// Serve the manual signaling console
+	http.HandleFunc("/console", requireAccount(true, func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, tmpl, "console.html", consolePage{newPageData()})
+	}))
+
+	// Operator audio monitor of all live streams
+	http.HandleFunc("/monitor", requireAccount(true, monitorPageHandler(tmpl)))
+
+	// Capacity tests with synthetic viewers run by this instance
+	http.HandleFunc("/loadtest", requireAccount(true, loadTestPageHandler(tmpl)))
+	http.HandleFunc("GET /api/admin/loadtests", requireAccount(true, listLoadTestsHandler))
+	http.HandleFunc("POST /api/admin/loadtests", requireAccount(true, startLoadTestHandler))
+	http.HandleFunc("GET /api/admin/loadtests/{id}", requireAccount(true, loadTestHandler))
+	http.HandleFunc("DELETE /api/admin/loadtests/{id}", requireAccount(true, stopLoadTestHandler))
+
+	// Recovery tests of the client of a connected publisher or viewer
+	http.HandleFunc("POST /api/admin/certifications", requireAccount(true, startCertificationHandler))
+	http.HandleFunc("GET /api/admin/certifications/{id}", requireAccount(true, certificationHandler))
+
+	// Mesh room page, rooms go through the SFU right away without -mesh
+	http.HandleFunc("/mesh", func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, tmpl, "mesh.html", meshPage{newPageData(), maxMeshSize})
+	})
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(candidates)
-}
+	// Set up the handlers for publishing and viewing streams
+	http.HandleFunc("/publish", requireLogin(false, publishHandler))
+	http.HandleFunc("/view", requireLogin(false, viewHandler))
+	http.HandleFunc("/view/quality", requireLogin(false, viewQualityHandler))
+	http.HandleFunc("/view/decimate", requireLogin(false, viewDecimateHandler))
+	http.HandleFunc("/view/temporal-layer", requireLogin(false, viewTemporalLayerHandler))
+
+	// Dry-run validation of offers for client debugging
+	http.HandleFunc("/api/validate-offer", validateOfferHandler)
+
+	// Runtime log level and debug filters
+	http.HandleFunc("/api/admin/loglevel", requireAccount(true, logLevelHandler))
+
+	// Feature flags turned on and off at runtime, and who changed them
+	http.HandleFunc("GET /api/admin/features", requireAccount(true, listFeaturesHandler))
+	http.HandleFunc("PUT /api/admin/features/{name}", requireAccount(true, setFeatureHandler))
+
+	// Streams ranked by the bandwidth, memory and CPU they use
+	http.HandleFunc("GET /api/admin/usage", requireAccount(true, usageHandler))
+
+	// STUN and TURN servers for browser PeerConnections
+	http.HandleFunc("GET /api/ice-config", iceConfigHandler)
+
+	// Stats history of publisher and viewer sessions, as webrtc-internals dumps
+	http.HandleFunc("GET /api/admin/sessions", requireAccount(true, statsSessionsHandler))
+	http.HandleFunc("GET /api/admin/sessions/{id}/stats", requireAccount(true, statsDumpHandler))
+
+	// Live stats of a publisher or viewer, for the owner of its stream
+	http.HandleFunc("GET /api/peers/{id}/stats", peerStatsHandler)
+	http.HandleFunc("POST /api/viewers/{id}/transfer", transferHandler)
 
-func handleIceCandidateViewer(w http.ResponseWriter, r *http.Request) {
-	var candidate webrtc.ICECandidateInit
-	if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
-		http.Error(w, "Invalid ICE candidate", http.StatusBadRequest)
-		return
-	}
+	// Publishers and viewers of every instance sharing the session store
+	http.HandleFunc("GET /api/admin/peers", requireAccount(true, peerRecordsHandler))
+
+	// Results of data channel tests
+	http.HandleFunc("GET /api/datatests/{id}", dataTestHandler)
+
+	// Tear everything down between test runs
+	http.HandleFunc("POST /api/admin/reset", requireAccount(true, resetHandler))
 
-	remoteCandidatesMtxV.Lock()
-	defer remoteCandidatesMtxV.Unlock()
+	// Disconnect a publisher or viewer
+	http.HandleFunc("DELETE /api/admin/publishers/{id}", requireAccount(true, kickHandler("publisher")))
+	http.HandleFunc("POST /api/admin/publishers/{id}/mute", requireAccount(true, muteHandler))
+	http.HandleFunc("DELETE /api/admin/publishers/{id}/mute", requireAccount(true, muteHandler))
+	http.HandleFunc("DELETE /api/admin/viewers/{id}", requireAccount(true, kickHandler("viewer")))
 
-	if peerConnectionViewer == nil {
-		return
-	}
+	// Registration, login and logout
+	http.HandleFunc("/api/account", accountHandler)
+	http.HandleFunc("/api/account/", accountHandler)
 
-	desc := peerConnectionViewer.RemoteDescription()
-	if desc == nil {
-		pendingRemoteCandidatesV = append(pendingRemoteCandidatesV, candidate)
-		return
-	}
+	// OpenID Connect login with -oidc-issuer
+	http.HandleFunc("GET /api/account/oidc/login", requireOIDC(oidcLoginHandler))
+	http.HandleFunc("GET "+oidcCallbackPath, requireOIDC(oidcCallbackHandler))
 
-	if err := peerConnectionViewer.AddICECandidate(candidate); err != nil {
-		http.Error(w, "Failed to add ICE candidate", http.StatusInternalServerError)
-		return
-	}
+	// Metrics in the Prometheus text format
+	http.HandleFunc("/metrics", metricsHandler)
 
-	fmt.Println("[viewer peer] ice candidate", candidate)
-}
+	// Runtime diagnostics with -debug, next to /debug/pprof/ and /debug/vars
+	http.HandleFunc("GET /debug/goroutines", goroutinesHandler)
 
-func handleIceCandidatesViewer(w http.ResponseWriter, r *http.Request) {
-	iceMutexV.Lock()
-	candidates := iceCandidatesV
-	iceCandidatesV = nil
-	iceMutexV.Unlock()
+	// API tokens of machine integrations, managed by admins
+	http.HandleFunc("GET /api/admin/tokens", requireAccount(true, requireAccountsDB(listTokensHandler)))
+	http.HandleFunc("POST /api/admin/tokens", requireAccount(true, requireAccountsDB(createTokenHandler)))
+	http.HandleFunc("GET /api/admin/tokens/{id}", requireAccount(true, requireAccountsDB(getTokenHandler)))
+	http.HandleFunc("PUT /api/admin/tokens/{id}", requireAccount(true, requireAccountsDB(updateTokenHandler)))
+	http.HandleFunc("DELETE /api/admin/tokens/{id}", requireAccount(true, requireAccountsDB(deleteTokenHandler)))
+	http.HandleFunc("POST /api/admin/tokens/{id}/rotate", requireAccount(true, requireAccountsDB(rotateTokenHandler)))
 
-	if candidates == nil {
-		candidates = []webrtc.ICECandidateInit{}
+	// Revocable stream keys for publishing
+	http.HandleFunc("GET /api/streamkeys", requireAccount(false, listStreamKeysHandler))
+	http.HandleFunc("POST /api/streamkeys", requireAccount(false, createStreamKeyHandler))
+	http.HandleFunc("DELETE /api/streamkeys/{id}", requireAccount(false, deleteStreamKeyHandler))
+
+	// Directory of live public streams
+	http.HandleFunc("/browse", browseHandler(tmpl))
+
+	// Page of a stream with link preview tags, and its thumbnail
+	http.HandleFunc("GET /watch/{stream}", watchHandler(tmpl))
+	http.HandleFunc("GET /api/streams/{stream}/thumbnail.jpg", thumbnailHandler)
+	http.HandleFunc("/api/streams", streamsHandler)
+
+	// Recording of live streams, started and stopped by the stream's owner,
+	// captures of their last moments, and replay of recordings on a new stream
+	http.HandleFunc("/api/recordings/start", recordingsHandler)
+	http.HandleFunc("/api/recordings/stop", recordingsHandler)
+	http.HandleFunc("POST /api/recordings/{id}/replay", replayHandler)
+	http.HandleFunc("GET /api/recordings/{id}/storyboard.vtt", storyboardHandler("storyboard.vtt"))
+	http.HandleFunc("GET /api/recordings/{id}/storyboard.jpg", storyboardHandler("storyboard.jpg"))
+	http.HandleFunc("POST /api/streams/{stream}/capture", requireStreamOwner(captureHandler))
+
+	// Stream metadata, changed only by the stream's owner
+	http.HandleFunc("GET /api/streams/{stream}/metadata", getMetadataHandler)
+	http.HandleFunc("PUT /api/streams/{stream}/metadata", requireStreamOwner(putMetadataHandler))
+
+	// Expiring signed URLs and view tokens of a stream for sharing
+	http.HandleFunc("POST /api/streams/{stream}/signed-url", requireStreamOwner(signedURLHandler))
+	http.HandleFunc("POST /api/streams/{stream}/view-token", requireStreamOwner(viewTokenHandler))
+
+	// Viewer connections created ahead of an expected audience
+	http.HandleFunc("GET /api/streams/{stream}/prewarm", requireStreamOwner(prewarmStatusHandler))
+	http.HandleFunc("POST /api/streams/{stream}/prewarm", requireStreamOwner(prewarmHandler))
+	http.HandleFunc("DELETE /api/streams/{stream}/prewarm", requireStreamOwner(cancelPrewarmHandler))
+
+	// HLS rendition of live streams, started by the first playlist request
+	http.HandleFunc("GET /hls/{stream}/{file}", hlsHandler)
+
+	// Pushing a stream out to an external RTMP endpoint
+	http.HandleFunc("POST /api/streams/{stream}/restream", requireStreamOwner(restreamHandler))
+
+	// Outputs of a stream, attached and detached in any combination
+	http.HandleFunc("GET /api/streams/{stream}/egress", requireStreamOwner(listEgressHandler))
+	http.HandleFunc("POST /api/streams/{stream}/egress", requireStreamOwner(attachEgressHandler))
+	http.HandleFunc("DELETE /api/streams/{stream}/egress/{id}", requireStreamOwner(detachEgressHandler))
+
+	// Egress and webhook rules matching streams by their tags
+	http.HandleFunc("GET /api/admin/rules", requireAccount(true, listRulesHandler))
+	http.HandleFunc("POST /api/admin/rules", requireAccount(true, createRuleHandler))
+	http.HandleFunc("DELETE /api/admin/rules/{id}", requireAccount(true, deleteRuleHandler))
+
+	// Sending a stream as plain RTP to an external UDP consumer
+	http.HandleFunc("POST /api/streams/{stream}/forward", requireStreamOwner(forwardHandler))
+
+	// Publishing an RTSP camera on a stream
+	http.HandleFunc("POST /api/streams/{stream}/rtsp", requireStreamOwner(rtspSourceHandler))
+
+	// Publishing RTP sent to UDP ports on a stream
+	http.HandleFunc("POST /api/streams/{stream}/rtp", requireStreamOwner(rtpIngestHandler))
+
+	// Keyframe spacing and PLI enforcement per ingest track
+	http.HandleFunc("/api/streams/health", streamHealthHandler)
+
+	// Viewer latency distribution per region, for admins as it lists the
+	// viewers' addresses
+	http.HandleFunc("/api/analytics/latency", requireAccount(true, latencyReportHandler))
+
+	// Concurrent viewers per minute from the viewers' heartbeats
+	http.HandleFunc("GET /api/analytics/viewers", audienceReportHandler)
+
+	// WebSocket signaling for offers, answers and trickle ICE
+	http.HandleFunc("/ws", requireLogin(false, wsHandler))
+
+	// New offers of connected publishers and viewers, and answers to the server's
+	http.HandleFunc("POST /renegotiate", renegotiateHandler)
+
+	// Candidates and connection state of either as Server-Sent Events, and
+	// the client's candidates the other way
+	http.HandleFunc("GET /events/{id}", peerEventsHandler)
+	http.HandleFunc("POST /events/{id}", peerCandidateHandler)
+
+	// Serve static JavaScript files
+	http.Handle("/static/", http.FileServer(http.FS(content)))
+
+	// State of the background subsystems
+	http.HandleFunc("GET /api/health", healthHandler)
+
+	// Liveness and readiness probes
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+
+	// Run until interrupted or a subsystem fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := services.run(ctx); err != nil {
+		fatalf("Server failed: %v", err)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(candidates)
+// Serve HTTP until ctx is done, calling ready once listening, then let
+// running requests finish
+func runHTTPServer(ctx context.Context, addr string, tlsConfig *tls.Config, ready func()) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ready()
+	scheme := "http"
+	if tlsConfig != nil {
+		ln, scheme = tls.NewListener(ln, tlsConfig), "https"
+	}
+	server := &http.Server{Addr: addr, Handler: withRequestID(guardDebug(http.DefaultServeMux)), TLSConfig: tlsConfig}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(ln)
+	}()
+	httpLog.infof("Server running at %s://localhost%s", scheme, addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), subsystemStopTimeout/2)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		httpLog.warnf("Error shutting down, closing remaining connections: %v", err)
+		server.Close()
+	}
+	return nil
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Largest room kept peer-to-peer, the next participant moves it to the SFU
+const maxMeshSize = 3
+
+// Let small rooms connect their participants directly, with the server only
+// relaying signaling
+var meshEnabled = false
+
+var meshLog = newLogger("mesh")
+
+var (
+	meshRooms   = make(map[string]*meshRoom)
+	meshRoomsMu sync.Mutex
+)
+
+// Participants of a mesh room by member ID. Once migrated, members publish
+// to <stream>.<member ID> through the SFU and view each other's streams.
+type meshRoom struct {
+	stream   string
+	members  map[string]*wsSession
+	migrated bool
+}
+
+// Join the mesh room of a stream. The member gets the IDs of the others and
+// sends them offers; when the room grows past maxMeshSize everyone is told
+// to migrate to the SFU.
+func (s *wsSession) joinMesh(stream string) {
+	if s.mesh != nil || s.role != "" {
+		s.sendError("Already joined")
+		return
+	}
+
+	meshRoomsMu.Lock()
+	room, ok := meshRooms[stream]
+	if !ok {
+		room = &meshRoom{stream: stream, members: make(map[string]*wsSession)}
+		meshRooms[stream] = room
+	}
+
+	s.meshID = newID()
+	s.mesh = room
+	others := room.memberIDs()
+	room.members[s.meshID] = s
+
+	migrate := !room.migrated && (!meshEnabled || len(room.members) > maxMeshSize)
+	if migrate {
+		room.migrated = true
+	}
+	members := room.sessions()
+	migrated := room.migrated
+	meshRoomsMu.Unlock()
+
+	meshLog.withStream(stream).infof("[member %s] Joined, %d members.", s.meshID, len(members))
+	s.send(signalMessage{Type: "mesh-joined", ID: s.meshID, Stream: stream, Peers: others, Migrated: migrated})
+	for _, m := range members {
+		if m != s {
+			m.send(signalMessage{Type: "mesh-peer-joined", ID: s.meshID})
+		}
+	}
+
+	if migrate {
+		meshLog.withStream(stream).infof("Room has %d members, migrating to the SFU.", len(members))
+		for _, m := range members {
+			m.send(signalMessage{Type: "mesh-migrate", Stream: stream})
+		}
+	}
+}
+
+// Pass an offer, answer or candidate on to another member of the room
+func (s *wsSession) relayMesh(msg signalMessage) {
+	if s.mesh == nil {
+		s.sendError("Not in a mesh room")
+		return
+	}
+
+	meshRoomsMu.Lock()
+	to := s.mesh.members[msg.To]
+	meshRoomsMu.Unlock()
+	if to == nil {
+		s.sendError("Unknown mesh peer " + msg.To)
+		return
+	}
+
+	to.send(signalMessage{Type: "mesh-signal", From: s.meshID, SDP: msg.SDP, Candidate: msg.Candidate})
+}
+
+func (s *wsSession) leaveMesh() {
+	if s.mesh == nil {
+		return
+	}
+
+	meshRoomsMu.Lock()
+	room := s.mesh
+	delete(room.members, s.meshID)
+	if len(room.members) == 0 && meshRooms[room.stream] == room {
+		delete(meshRooms, room.stream)
+	}
+	members := room.sessions()
+	meshRoomsMu.Unlock()
+
+	meshLog.withStream(room.stream).infof("[member %s] Left, %d members.", s.meshID, len(members))
+	for _, m := range members {
+		m.send(signalMessage{Type: "mesh-peer-left", ID: s.meshID})
+	}
+}
+
+// Must be called with meshRoomsMu held
+func (r *meshRoom) memberIDs() []string {
+	ids := make([]string, 0, len(r.members))
+	for id := range r.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Must be called with meshRoomsMu held
+func (r *meshRoom) sessions() []*wsSession {
+	list := make([]*wsSession, 0, len(r.members))
+	for _, s := range r.members {
+		list = append(list, s)
+	}
+	return list
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 2000
+	maxStreamTags        = 16
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9._-]{1,32}$`)
+
+// Descriptive metadata of a stream, kept in the session store
+type streamMetadata struct {
+	Stream      string `json:"stream"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Visibility  string `json:"visibility"`
+	// Labels egress and webhook rules match on, see streamRule
+	Tags    []string  `json:"tags,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Updated time.Time `json:"updated"`
+
+	// Stream whose publisher viewers are moved to while this one is offline
+	Failover string `json:"failover,omitempty"`
+
+	// Token viewers of a private stream present, only shown to managers
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+// Serializes changes of this instance, instances sharing a store may still
+// overwrite each other's concurrent changes
+var metadataMu sync.Mutex
+
+func getMetadata(stream string) streamMetadata {
+	m := streamMetadata{Stream: stream, Visibility: visibilityPublic}
+	data, err := sessions.get(storeMetadata, stream)
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil && err != errNotStored {
+		storeLog.withStream(stream).warnf("Error loading metadata: %v", err)
+	}
+	return m
+}
+
+// Handler for reading the metadata of a stream. Private streams need their
+// token, which is only included for the owner and admins.
+func getMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	stream := r.PathValue("stream")
+	if !streamNamePattern.MatchString(stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeView(r, stream); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	m := getMetadata(stream)
+	m.Owner = streamOwner(stream)
+	if authorizeStream(currentAccount(r), stream, actionManage) != nil {
+		m.AccessToken = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// Handler for changing the metadata of a stream, for its owner. Omitted
+// fields are kept; making a stream private gives it a new access token.
+func putMetadataHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	var req struct {
+		Title       *string  `json:"title"`
+		Description *string  `json:"description"`
+		Visibility  *string  `json:"visibility"`
+		Tags        []string `json:"tags"`
+		Failover    *string  `json:"failover"`
+		RotateToken bool     `json:"rotateToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid metadata", http.StatusBadRequest)
+		return
+	}
+	if (req.Title != nil && len(*req.Title) > maxTitleLength) || (req.Description != nil && len(*req.Description) > maxDescriptionLength) {
+		http.Error(w, "Metadata too long", http.StatusBadRequest)
+		return
+	}
+	if req.Visibility != nil && !validVisibility(*req.Visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	if req.Failover != nil && *req.Failover != "" && (!streamNamePattern.MatchString(*req.Failover) || *req.Failover == stream) {
+		http.Error(w, "Failover must be the name of another stream", http.StatusBadRequest)
+		return
+	}
+	tags, err := parseTags(req.Tags)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	metadataMu.Lock()
+	m := getMetadata(stream)
+	if req.Title != nil {
+		m.Title = *req.Title
+	}
+	if req.Description != nil {
+		m.Description = *req.Description
+	}
+	if req.Visibility != nil {
+		m.Visibility = *req.Visibility
+	}
+	retag := req.Tags != nil && !slices.Equal(tags, m.Tags)
+	if req.Tags != nil {
+		m.Tags = tags
+	}
+	if req.Failover != nil {
+		m.Failover = *req.Failover
+	}
+	switch {
+	case m.Visibility != visibilityPrivate:
+		m.AccessToken = ""
+	case m.AccessToken == "" || req.RotateToken:
+		m.AccessToken = newID() + newID()
+	}
+	m.Updated = time.Now()
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = sessions.put(storeMetadata, stream, data, 0)
+	}
+	metadataMu.Unlock()
+	if err != nil {
+		storeLog.withStream(stream).errorf("Error saving metadata: %v", err)
+		http.Error(w, "Could not save metadata", http.StatusInternalServerError)
+		return
+	}
+	if retag {
+		applyStreamRules(stream, listRules())
+	}
+
+	getMetadataHandler(w, r)
+}
+
+// Tags of a stream as given, lowercased, sorted and without duplicates
+func parseTags(given []string) ([]string, error) {
+	tags := []string{}
+	for _, t := range given {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !tagPattern.MatchString(t) {
+			return nil, newSignalingError(http.StatusBadRequest, "Tags must be 1 to 32 letters, digits, dots, dashes or underscores")
+		}
+		if !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) > maxStreamTags {
+		return nil, newSignalingError(http.StatusBadRequest, fmt.Sprintf("At most %d tags", maxStreamTags))
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
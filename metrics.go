@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Samples kept per summary for quantile estimation
+const summaryWindow = 1024
+
+var summaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+var (
+	summaries   []*summaryMetric
+	summariesMu sync.Mutex
+)
+
+// Prometheus style summary over a sliding window of observations
+type summaryMetric struct {
+	name string
+	help string
+
+	mu     sync.Mutex
+	window []float64
+	next   int
+	count  uint64
+	sum    float64
+}
+
+func newSummary(name, help string) *summaryMetric {
+	s := &summaryMetric{name: name, help: help}
+
+	summariesMu.Lock()
+	summaries = append(summaries, s)
+	summariesMu.Unlock()
+	return s
+}
+
+func (s *summaryMetric) observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.window) < summaryWindow {
+		s.window = append(s.window, v)
+	} else {
+		s.window[s.next] = v
+		s.next = (s.next + 1) % summaryWindow
+	}
+	s.count++
+	s.sum += v
+}
+
+// Forget every observation
+func (s *summaryMetric) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window, s.next, s.count, s.sum = nil, 0, 0, 0
+}
+
+func (s *summaryMetric) write(w http.ResponseWriter) {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.window...)
+	count, sum := s.count, s.sum
+	s.mu.Unlock()
+	sort.Float64s(sorted)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", s.name, s.help)
+	fmt.Fprintf(w, "# TYPE %s summary\n", s.name)
+	if len(sorted) > 0 {
+		for _, q := range summaryQuantiles {
+			fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", s.name, q, percentile(sorted, q))
+		}
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", s.name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", s.name, count)
+}
+
+func writeGauge(w http.ResponseWriter, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+// Handler for metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !canReadMetrics(r) {
+		http.Error(w, "Admin session or token with the metrics scope required", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	list := listRooms()
+	publishers, viewers := 0, 0
+	for _, room := range list {
+		if room.getPublisher() != nil {
+			publishers++
+		}
+		viewers += len(room.getViewers())
+	}
+	writeGauge(w, "sfu_rooms", "Rooms currently registered.", float64(len(list)))
+	writeGauge(w, "sfu_publishers", "Publishers currently connected.", float64(publishers))
+	writeGauge(w, "sfu_viewers", "Viewers currently attached.", float64(viewers))
+	writeGauge(w, "sfu_viewers_queued", "Viewers waiting for admission.", float64(queuedViewers()))
+	writeCounter(w, "sfu_viewer_admissions_rejected_total", "Viewers turned away while too many were joining.", float64(admissionsRejected.Load()))
+
+	writePLIMetrics(w)
+	writeLayerPruneMetrics(w)
+
+	summariesMu.Lock()
+	defer summariesMu.Unlock()
+	for _, s := range summaries {
+		s.write(w)
+	}
+}
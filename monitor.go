@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Volume operators hear each stream at on the monitor page, 0 to 1
+var monitorVolume = 0.2
+
+var monitorLog = newLogger("monitor")
+
+// Set up an operator PeerConnection receiving the audio of every live stream.
+// The server has no Opus encoder, so each stream's audio arrives as its own
+// track, named after the stream, and the page mixes them at monitorVolume.
+// Streams going live later are picked up when the operator reconnects.
+// request is the correlation ID the monitor is logged with.
+func negotiateMonitor(request string, offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*peer, *webrtc.SessionDescription, error) {
+	if services.isStopping() {
+		return nil, nil, errShuttingDown
+	}
+	mlog := monitorLog.withRequest(request)
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
+
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		mlog.errorf("Error creating PeerConnection: %v", err)
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Failed to create PeerConnection")
+	}
+
+	monitor := newPeer("monitor", "", request, pc)
+	mlog = monitor.log(monitorLog)
+	closeMonitor := func() { monitor.close(func() {}) }
+
+	streams := 0
+	for _, room := range listRooms() {
+		for _, t := range monitoredTracks(room) {
+			track := t.newViewerTrack()
+			track.id = room.name + "-" + t.ID()
+			track.streamID = room.name
+			if _, err := pc.AddTrack(track); err != nil {
+				mlog.errorf("Error adding audio of stream %q: %v", room.name, err)
+				closeMonitor()
+				return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not add track")
+			}
+			streams++
+		}
+	}
+	mlog.infof("[monitor %s] Monitoring audio of %d streams.", monitor.id, streams)
+
+	pc.OnICECandidate(onCandidate)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		mlog.infof("[monitor %s] Peer Connection State has changed: %s", monitor.id, s.String())
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			closeMonitor()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		mlog.errorf("Error setting remote description: %v", err)
+		closeMonitor()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set remote description")
+	}
+	monitor.flushPendingCandidates()
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		mlog.errorf("Error creating answer: %v", err)
+		closeMonitor()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		mlog.errorf("Error setting local description: %v", err)
+		closeMonitor()
+		return nil, nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
+	}
+
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() != nil && t.Sender().Track() != nil && t.Mid() == "" {
+			mlog.warnf("[monitor %s] Offer has no audio media section left for %s.", monitor.id, t.Sender().Track().ID())
+		}
+	}
+	return monitor, &answer, nil
+}
+
+// Audio tracks of the room's publisher
+func monitoredTracks(room *Room) []*trackFanout {
+	var list []*trackFanout
+	for _, t := range room.tracks() {
+		if t.Kind() == webrtc.RTPCodecTypeAudio {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// Data of the monitor page: the initial volume and the audio tracks live
+type monitorPage struct {
+	pageData
+	Volume float64
+	Tracks int
+}
+
+// Handler for the operator monitor page
+func monitorPageHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := monitorPage{pageData: newPageData(), Volume: monitorVolume}
+		for _, room := range listRooms() {
+			data.Tracks += len(monitoredTracks(room))
+		}
+		renderPage(w, r, tmpl, "monitor.html", data)
+	}
+}
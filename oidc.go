@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Cookie keeping the state of a login while the user is at the provider
+	oidcStateCookieName = "sfu_oidc"
+	oidcLoginTimeout    = 10 * time.Minute
+	oidcCallbackPath    = "/api/account/oidc/callback"
+)
+
+// Provider of -oidc-issuer and the verifier of its ID tokens, nil when
+// users don't log in with OpenID Connect
+var (
+	oidcProvider *oidc.Provider
+	oidcVerifier *oidc.IDTokenVerifier
+)
+
+// Login in progress, kept in the state cookie
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// Claims of an ID token users are named after
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	Nonce             string `json:"nonce"`
+}
+
+// Discover the provider of -oidc-issuer
+func openOIDC(ctx context.Context) error {
+	if settings.OIDCIssuer == "" {
+		return nil
+	}
+	provider, err := oidc.NewProvider(ctx, settings.OIDCIssuer)
+	if err != nil {
+		return err
+	}
+	oidcProvider = provider
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: settings.OIDCClientID})
+	accountLog.infof("Users log in with OpenID Connect at %s.", settings.OIDCIssuer)
+	return nil
+}
+
+// OAuth2 client of the provider, redirecting back to the host of the request
+// unless -oidc-redirect-url is set
+func oidcConfig(r *http.Request) *oauth2.Config {
+	redirect := settings.OIDCRedirectURL
+	if redirect == "" {
+		redirect = externalURL(r) + oidcCallbackPath
+	}
+	return &oauth2.Config{
+		ClientID:     settings.OIDCClientID,
+		ClientSecret: settings.OIDCClientSecret,
+		Endpoint:     oidcProvider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Page to return to after logging in, only paths of this server
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// Handler for GET /api/account/oidc/login?next=/, sending the user to the
+// provider to log in
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randomString()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	login := oidcLogin{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier(), Next: localRedirect(r.URL.Query().Get("next"))}
+	data, _ := json.Marshal(login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/api/account/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, oidcConfig(r).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+}
+
+// Handler for GET /api/account/oidc/callback, where the provider sends the
+// user back with a code for their ID token. Its subject is mapped to a user,
+// created on first login, who gets a session like after a password login.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	c, err := r.Cookie(oidcStateCookieName)
+	if err == nil {
+		var data []byte
+		if data, err = base64.RawURLEncoding.DecodeString(c.Value); err == nil {
+			err = json.Unmarshal(data, &login)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: "/api/account/oidc", MaxAge: -1})
+	q := r.URL.Query()
+	if err != nil || login.State == "" || q.Get("state") != login.State {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		accountLog.warnf("OpenID Connect login failed: %s %s", e, q.Get("error_description"))
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	token, err := oidcConfig(r).Exchange(ctx, q.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		accountLog.warnf("Error exchanging OpenID Connect code: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Login failed: no ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := oidcVerifier.Verify(ctx, rawIDToken)
+	var claims oidcClaims
+	if err == nil {
+		err = idToken.Claims(&claims)
+	}
+	if err == nil && claims.Nonce != login.Nonce {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		accountLog.warnf("Rejected OpenID Connect ID token: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	a, err := oidcAccount(idToken.Issuer, idToken.Subject, claims)
+	if err == nil {
+		err = startSession(w, r, a)
+	}
+	if err != nil {
+		accountLog.errorf("Error logging in OpenID Connect subject %s: %v", idToken.Subject, err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	accountLog.infof("User %s logged in with OpenID Connect.", a.Username)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+// User of an OpenID Connect subject, created on its first login and named
+// after its preferred username or email. The first user becomes an admin
+// like with registration; OIDC users have no password.
+func oidcAccount(issuer, subject string, claims oidcClaims) (*account, error) {
+	a := &account{}
+	err := accountsDB.QueryRow(`SELECT u.id, u.username, u.admin FROM oidc_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, issuer, subject).Scan(&a.ID, &a.Username, &a.Admin)
+	if err != sql.ErrNoRows {
+		return a, err
+	}
+
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base := oidcUsername(name)
+	tx, err := accountsDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i := 1; ; i++ {
+		a.Username = base
+		if i > 1 {
+			suffix := fmt.Sprintf("-%d", i)
+			a.Username = base[:min(len(base), 32-len(suffix))] + suffix
+		}
+		var taken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, a.Username).Scan(&taken); err != nil {
+			return nil, err
+		}
+		if taken == 0 {
+			break
+		}
+	}
+	// No bcrypt hash matches "!", so the user can't log in with a password.
+	// Counted in the same statement, like in registerAccount, so of two
+	// first logins at once only one becomes admin.
+	err = tx.QueryRow(`INSERT INTO users (username, password_hash, admin, created)
+		SELECT ?, '!', (SELECT COUNT(*) FROM users) = 0, ? RETURNING id, admin`,
+		a.Username, time.Now().Unix()).Scan(&a.ID, &a.Admin)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO oidc_identities (issuer, subject, user_id, created) VALUES (?, ?, ?, ?)`, issuer, subject, a.ID, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	accountLog.infof("User %s created for OpenID Connect subject %s.", a.Username, subject)
+	return a, nil
+}
+
+// Username of usernamePattern made from a name of the provider
+func oidcUsername(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if len(name) < 3 {
+		name = "user" + name
+	}
+	return name
+}
+
+// Wrap a handler so it is only served with -oidc-issuer
+func requireOIDC(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidcProvider == nil {
+			http.Error(w, "OpenID Connect login is disabled", http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Wrap a page or signaling handler so it needs a logged in user with
+// -require-login. Pages send the user to the provider to log in, when there
+// is one.
+func requireLogin(page bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if settings.RequireLogin && currentAccount(r) == nil {
+			if page && oidcProvider != nil {
+				http.Redirect(w, r, "/api/account/oidc/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			if !page {
+				http.Error(w, "Login required", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Overrides clients may send with their offer, as named in -peer-overrides
+const (
+	overrideICETransportPolicy = "iceTransportPolicy"
+	overrideCodec              = "codec"
+	overrideAudioOnly          = "audioOnly"
+)
+
+var overrideNames = []string{overrideICETransportPolicy, overrideCodec, overrideAudioOnly}
+
+// Overrides clients may send, from -peer-overrides, all of them by default
+var allowedOverrides = map[string]bool{overrideICETransportPolicy: true, overrideCodec: true, overrideAudioOnly: true}
+
+// PeerConnection settings a publisher or viewer picks for itself with the
+// query of its offer, where the server's policy lets it:
+//
+//   - ?iceTransportPolicy=relay sends all media through the TURN servers,
+//     for clients that must not reveal their address
+//   - ?codec= the codecs in order of preference, e.g. ?codec=h264. Viewers
+//     get their tracks in them as before, publishers are asked for them
+//     ahead of those the server prefers, and only for those of -codecs
+//     when it is given.
+//   - ?audioOnly=true leaves out video, viewers get none and publishers may
+//     send none
+type peerOverrides struct {
+	ICETransportPolicy webrtc.ICETransportPolicy
+	Codecs             []string
+	AudioOnly          bool
+}
+
+// Whether the connection is set up as everyone's, e.g. to take a
+// prewarmed one
+func (o peerOverrides) isDefault() bool {
+	return o.ICETransportPolicy != webrtc.ICETransportPolicyRelay && len(o.Codecs) == 0 && !o.AudioOnly
+}
+
+func (o peerOverrides) String() string {
+	var list []string
+	if o.ICETransportPolicy == webrtc.ICETransportPolicyRelay {
+		list = append(list, "relayed")
+	}
+	if len(o.Codecs) > 0 {
+		list = append(list, "codecs "+strings.Join(o.Codecs, ", "))
+	}
+	if o.AudioOnly {
+		list = append(list, "audio only")
+	}
+	return strings.Join(list, ", ")
+}
+
+// Overrides of a publisher's or viewer's request, checked against the
+// server's policy
+func parsePeerOverrides(r *http.Request, role string) (peerOverrides, error) {
+	var o peerOverrides
+	query := r.URL.Query()
+	for _, name := range overrideNames {
+		if query.Has(name) && !allowedOverrides[name] {
+			return o, newSignalingError(http.StatusForbidden, name+" is not allowed on this server")
+		}
+	}
+
+	switch value := query.Get(overrideICETransportPolicy); value {
+	case "", "all":
+	case "relay":
+		if !hasTURNServer(role) {
+			return o, newSignalingError(http.StatusBadRequest, "No TURN server to relay through")
+		}
+		o.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return o, newSignalingError(http.StatusBadRequest, "iceTransportPolicy must be all or relay")
+	}
+
+	codecs, err := parseCodecPreference(query.Get(overrideCodec))
+	if err != nil {
+		return o, err
+	}
+	if role == "publisher" && len(publisherCodecs) > 0 {
+		for _, mimeType := range codecs {
+			if !containsFold(publisherCodecs, mimeType) {
+				return o, newSignalingError(http.StatusBadRequest, fmt.Sprintf("Codec %s is not published on this server", mimeType))
+			}
+		}
+	}
+	o.Codecs = codecs
+
+	if value := query.Get(overrideAudioOnly); value != "" {
+		if o.AudioOnly, err = strconv.ParseBool(value); err != nil {
+			return o, newSignalingError(http.StatusBadRequest, "audioOnly must be true or false")
+		}
+	}
+	return o, nil
+}
+
+// Whether the ICE servers of the role include a TURN server
+func hasTURNServer(role string) bool {
+	for _, u := range settings.ICEServersFor(role) {
+		if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Overrides clients may send by the comma separated names of
+// -peer-overrides, none when it is empty
+func parseAllowedOverrides(s string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(overrideNames, name) {
+			return nil, fmt.Errorf("unknown override %q, expected %s", name, strings.Join(overrideNames, ", "))
+		}
+		allowed[name] = true
+	}
+	return allowed, nil
+}
+
+// Whether an offer has a video m-line that isn't rejected
+func offerHasVideo(offer webrtc.SessionDescription) bool {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return false
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if strings.EqualFold(media.MediaName.Media, "video") && media.MediaName.Port.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Codecs the publisher is asked for, in order of preference: those it
+// asked to send, then publisherCodecsFor
+func (p *Publisher) codecOrder(room *Room) []string {
+	prefer := append([]string(nil), p.codecs...)
+	for _, mimeType := range publisherCodecsFor(room) {
+		if !containsFold(prefer, mimeType) {
+			prefer = append(prefer, mimeType)
+		}
+	}
+	return prefer
+}
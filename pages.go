@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"os/exec"
+	"runtime/debug"
+	"sync"
+)
+
+// Version of the server, set with -ldflags "-X main.version=v1.2.3" or
+// otherwise taken from the build info
+var version string
+
+var versionOnce sync.Once
+
+func serverVersion() string {
+	versionOnce.Do(func() {
+		if version != "" {
+			return
+		}
+		version = "devel"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+			return
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				version = "devel-" + s.Value[:12]
+			}
+		}
+	})
+	return version
+}
+
+// What every page template renders with: the server version, and how the
+// page scripts reach the server and what it offers, which they read from
+// the data attributes of the body instead of hardcoding them
+type pageData struct {
+	Version string
+	// "websocket" or "http", from -signaling
+	Signaling string
+	// Endpoints of the signaling socket, offers and peer events
+	SocketPath, PublishPath, ViewPath, EventsPath string
+
+	Features pageFeatures
+}
+
+// Parts of the server that are configured, for pages to show or hide
+type pageFeatures struct {
+	Accounts bool
+	OIDC     bool
+	Mesh     bool
+	Capture  bool
+	HLS      bool
+}
+
+func newPageData() pageData {
+	_, err := exec.LookPath(ffmpegPath)
+	return pageData{
+		Version:     serverVersion(),
+		Signaling:   settings.Signaling,
+		SocketPath:  "/ws",
+		PublishPath: "/publish",
+		ViewPath:    "/view",
+		EventsPath:  "/events/",
+		Features: pageFeatures{
+			Accounts: accountsDB != nil,
+			OIDC:     oidcProvider != nil,
+			Mesh:     meshEnabled,
+			Capture:  captureBuffer > 0,
+			HLS:      err == nil,
+		},
+	}
+}
+
+// Data of the main page
+type indexPage struct {
+	pageData
+}
+
+// Data of the signaling console
+type consolePage struct {
+	pageData
+}
+
+// Data of the mesh room page
+type meshPage struct {
+	pageData
+	MaxMembers int
+}
+
+// Render a page template to a buffer first, so a failing template answers
+// with an error instead of half a page
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, name string, data any) {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		httpLog.forRequest(r).errorf("Error rendering template %s: %v", name, err)
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "script-src 'self';")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Live WebRTC stats of a publisher or viewer of this instance, from
+// GET /api/peers/{id}/stats. Times are in seconds as in the stats of the
+// WebRTC spec.
+type peerStats struct {
+	ID              string    `json:"id"`
+	Role            string    `json:"role"`
+	Stream          string    `json:"stream,omitempty"`
+	Time            time.Time `json:"time"`
+	ConnectionState string    `json:"connectionState"`
+	ICEState        string    `json:"iceState"`
+	// Bytes of the ICE transport, media, RTCP and data channels together
+	BytesSent     uint64              `json:"bytesSent"`
+	BytesReceived uint64              `json:"bytesReceived"`
+	CandidatePair *candidatePairStats `json:"candidatePair,omitempty"`
+	// Streams a publisher sends the SFU, and the SFU sends a viewer
+	Inbound  []inboundStreamStats  `json:"inbound,omitempty"`
+	Outbound []outboundStreamStats `json:"outbound,omitempty"`
+	// Available bandwidth of a viewer, from its congestion control feedback
+	BandwidthEstimate *bandwidthEstimate `json:"bandwidthEstimate,omitempty"`
+}
+
+// Google congestion control estimate of the bandwidth towards a viewer, in
+// bits per second. The target is the lower of the loss and delay based
+// estimates; usage and state are those of the delay based one.
+type bandwidthEstimate struct {
+	TargetBitrate      int     `json:"targetBitrate"`
+	LossTargetBitrate  int     `json:"lossTargetBitrate"`
+	DelayTargetBitrate int     `json:"delayTargetBitrate"`
+	AverageLoss        float64 `json:"averageLoss"`
+	Usage              string  `json:"usage"`
+	State              string  `json:"state"`
+}
+
+// The candidate pair carrying the connection
+type candidatePairStats struct {
+	State                    string         `json:"state"`
+	Local                    candidateStats `json:"local"`
+	Remote                   candidateStats `json:"remote"`
+	CurrentRoundTripTime     float64        `json:"currentRoundTripTime"`
+	AvailableOutgoingBitrate float64        `json:"availableOutgoingBitrate,omitempty"`
+}
+
+type candidateStats struct {
+	Address       string `json:"address"`
+	Port          int32  `json:"port"`
+	Protocol      string `json:"protocol"`
+	CandidateType string `json:"candidateType"`
+	RelayProtocol string `json:"relayProtocol,omitempty"`
+}
+
+// RTP stream received by the SFU. Jitter and loss are those of the receiver
+// reports the SFU sends; the NACK, PLI and FIR counts those it sent.
+type inboundStreamStats struct {
+	SSRC            uint32  `json:"ssrc"`
+	Kind            string  `json:"kind"`
+	Codec           string  `json:"codec"`
+	RID             string  `json:"rid,omitempty"`
+	PacketsReceived uint64  `json:"packetsReceived"`
+	PacketsLost     int64   `json:"packetsLost"`
+	FractionLost    float64 `json:"fractionLost"`
+	Jitter          float64 `json:"jitter"`
+	BytesReceived   uint64  `json:"bytesReceived"`
+	NACKCount       uint32  `json:"nackCount"`
+	PLICount        uint32  `json:"pliCount"`
+	FIRCount        uint32  `json:"firCount"`
+}
+
+// RTP stream sent by the SFU. Round trip time, jitter and loss are those of
+// the receiver reports of the peer; the NACK, PLI and FIR counts those it sent.
+type outboundStreamStats struct {
+	SSRC          uint32  `json:"ssrc"`
+	Kind          string  `json:"kind"`
+	Codec         string  `json:"codec"`
+	PacketsSent   uint64  `json:"packetsSent"`
+	BytesSent     uint64  `json:"bytesSent"`
+	RoundTripTime float64 `json:"roundTripTime"`
+	PacketsLost   int64   `json:"packetsLost"`
+	FractionLost  float64 `json:"fractionLost"`
+	Jitter        float64 `json:"jitter"`
+	NACKCount     uint32  `json:"nackCount"`
+	PLICount      uint32  `json:"pliCount"`
+	FIRCount      uint32  `json:"firCount"`
+}
+
+func (p *peer) stats() peerStats {
+	pc := p.pc
+	st := peerStats{
+		ID: p.id, Role: p.role, Stream: p.stream, Time: time.Now(),
+		ConnectionState: pc.ConnectionState().String(),
+		ICEState:        pc.ICEConnectionState().String(),
+	}
+
+	report := pc.GetStats()
+	var pair *webrtc.ICECandidatePairStats
+	for _, s := range report {
+		switch s := s.(type) {
+		case webrtc.TransportStats:
+			st.BytesSent, st.BytesReceived = s.BytesSent, s.BytesReceived
+		case webrtc.ICECandidatePairStats:
+			// The nominated pair, or another that succeeded
+			if s.State == webrtc.StatsICECandidatePairStateSucceeded && (pair == nil || (s.Nominated && !pair.Nominated)) {
+				pair = &s
+			}
+		}
+	}
+	if pair != nil {
+		st.CandidatePair = &candidatePairStats{
+			State:                    string(pair.State),
+			Local:                    candidateFromReport(report, pair.LocalCandidateID),
+			Remote:                   candidateFromReport(report, pair.RemoteCandidateID),
+			CurrentRoundTripTime:     pair.CurrentRoundTripTime,
+			AvailableOutgoingBitrate: pair.AvailableOutgoingBitrate,
+		}
+	}
+
+	// Connections without the SFU's interceptors, like the audio monitor's,
+	// have no stream stats
+	f := p.feedback.Load()
+	if f == nil {
+		return st
+	}
+	for _, r := range pc.GetReceivers() {
+		for _, t := range r.Tracks() {
+			if t.SSRC() == 0 {
+				continue
+			}
+			in := inboundStreamStats{SSRC: uint32(t.SSRC()), Kind: t.Kind().String(), Codec: t.Codec().MimeType, RID: t.RID()}
+			if s := f.streamStats(in.SSRC); s != nil {
+				in.PacketsReceived = s.InboundRTPStreamStats.PacketsReceived
+				in.BytesReceived = s.InboundRTPStreamStats.BytesReceived
+				in.NACKCount = s.InboundRTPStreamStats.NACKCount
+				in.PLICount = s.InboundRTPStreamStats.PLICount
+				in.FIRCount = s.InboundRTPStreamStats.FIRCount
+			}
+			if rr, ok := f.sentReport(in.SSRC); ok {
+				in.PacketsLost = int64(rr.TotalLost)
+				in.FractionLost = float64(rr.FractionLost) / 256
+				if clockRate := t.Codec().ClockRate; clockRate > 0 {
+					in.Jitter = float64(rr.Jitter) / float64(clockRate)
+				}
+			}
+			st.Inbound = append(st.Inbound, in)
+		}
+	}
+	for _, s := range pc.GetSenders() {
+		params := s.GetParameters()
+		if s.Track() == nil || len(params.Encodings) == 0 {
+			continue
+		}
+		out := outboundStreamStats{SSRC: uint32(params.Encodings[0].SSRC), Kind: s.Track().Kind().String()}
+		if len(params.Codecs) > 0 {
+			out.Codec = params.Codecs[0].MimeType
+		}
+		if s := f.streamStats(out.SSRC); s != nil {
+			out.PacketsSent = s.OutboundRTPStreamStats.PacketsSent
+			out.BytesSent = s.OutboundRTPStreamStats.BytesSent
+			out.NACKCount = s.OutboundRTPStreamStats.NACKCount
+			out.PLICount = s.OutboundRTPStreamStats.PLICount
+			out.FIRCount = s.OutboundRTPStreamStats.FIRCount
+			out.RoundTripTime = s.RemoteInboundRTPStreamStats.RoundTripTime.Seconds()
+			out.PacketsLost = s.RemoteInboundRTPStreamStats.PacketsLost
+			out.FractionLost = s.RemoteInboundRTPStreamStats.FractionLost
+			out.Jitter = s.RemoteInboundRTPStreamStats.Jitter
+		}
+		st.Outbound = append(st.Outbound, out)
+	}
+
+	if e := f.bandwidthEstimator(); e != nil {
+		st.BandwidthEstimate = &bandwidthEstimate{TargetBitrate: e.GetTargetBitrate()}
+		s := e.GetStats()
+		st.BandwidthEstimate.LossTargetBitrate, _ = s["lossTargetBitrate"].(int)
+		st.BandwidthEstimate.DelayTargetBitrate, _ = s["delayTargetBitrate"].(int)
+		st.BandwidthEstimate.AverageLoss, _ = s["averageLoss"].(float64)
+		st.BandwidthEstimate.Usage, _ = s["usage"].(string)
+		st.BandwidthEstimate.State, _ = s["state"].(string)
+	}
+	return st
+}
+
+func candidateFromReport(report webrtc.StatsReport, id string) candidateStats {
+	c, ok := report[id].(webrtc.ICECandidateStats)
+	if !ok {
+		return candidateStats{}
+	}
+	return candidateStats{Address: c.IP, Port: c.Port, Protocol: c.Protocol, CandidateType: c.CandidateType.String(), RelayProtocol: c.RelayProtocol}
+}
+
+// Handler for GET /api/peers/{id}/stats, the live stats of a publisher or
+// viewer of this instance, for admins and the owner of the peer's stream
+// only, as they include the addresses of the peer's candidates.
+func peerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := lookupPeer(id)
+	if p == nil || p.pc == nil || (p.role != "publisher" && p.role != "viewer") {
+		http.Error(w, "No such peer", http.StatusNotFound)
+		return
+	}
+	if err := authorizeStream(currentAccount(r), p.stream, actionManage); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.stats())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Publisher or viewer as listed by /api/admin/peers. Peers of other
+// instances sharing the session store only have their record; those of this
+// instance also have their live state, what the watchdog logs.
+type peerStatus struct {
+	peerRecord
+	// Seconds since the peer connected
+	Uptime float64 `json:"uptime"`
+
+	User            string `json:"user,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	ConnectionState string `json:"connectionState,omitempty"`
+	ICEState        string `json:"iceState,omitempty"`
+	// Tracks a publisher sends, or a viewer receives
+	Tracks []peerTrackStatus `json:"tracks,omitempty"`
+	// Publisher whose tracks a viewer receives, and the viewers of a publisher
+	Publisher string   `json:"publisher,omitempty"`
+	Viewers   []string `json:"viewers,omitempty"`
+	// Whether a publisher is a co-host of the stream, and what is muted
+	Cohost bool     `json:"cohost,omitempty"`
+	Muted  []string `json:"muted,omitempty"`
+}
+
+type peerTrackStatus struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Codec string `json:"codec"`
+	// Simulcast layer of a publisher's track, or the one a viewer receives
+	RID string `json:"rid,omitempty"`
+}
+
+func fanoutStatus(id string, f *trackFanout) peerTrackStatus {
+	return peerTrackStatus{ID: id, Kind: f.Kind().String(), Codec: f.Codec().MimeType, RID: f.RID()}
+}
+
+// Fill in the live state of a peer of this instance, left out when it is no
+// longer one of its publishers or viewers
+func localPeerStatus(s *peerStatus) {
+	room := getRoom(s.Stream)
+	if room == nil {
+		return
+	}
+	publisher := room.getPublisher()
+	switch s.Role {
+	case "publisher":
+		if publisher == nil || publisher.id != s.ID {
+			if publisher = room.getCohost(s.ID); publisher == nil {
+				return
+			}
+			s.Cohost = true
+		}
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if publisher.isMuted(kind) {
+				s.Muted = append(s.Muted, kind.String())
+			}
+		}
+		if publisher.owner != nil {
+			s.User = publisher.owner.Username
+		}
+		s.Protocol = publisher.protocol()
+		publisher.trackMutex.Lock()
+		for _, f := range publisher.tracks {
+			s.Tracks = append(s.Tracks, fanoutStatus(f.ID(), f))
+		}
+		publisher.trackMutex.Unlock()
+		sort.Slice(s.Tracks, func(i, j int) bool {
+			if s.Tracks[i].ID != s.Tracks[j].ID {
+				return s.Tracks[i].ID < s.Tracks[j].ID
+			}
+			return s.Tracks[i].RID < s.Tracks[j].RID
+		})
+		for _, v := range room.getViewers() {
+			s.Viewers = append(s.Viewers, v.id)
+		}
+		sort.Strings(s.Viewers)
+
+	case "viewer":
+		var viewer *Viewer
+		for _, v := range room.getViewers() {
+			if v.id == s.ID {
+				viewer = v
+			}
+		}
+		if viewer == nil {
+			return
+		}
+		if viewer.account != nil {
+			s.User = viewer.account.Username
+		}
+		for _, vt := range viewer.getTracks() {
+			f := vt.currentFanout()
+			s.Tracks = append(s.Tracks, fanoutStatus(vt.ID(), f))
+			if publisher != nil && publisher.hasTrack(f) {
+				s.Publisher = publisher.id
+			}
+		}
+
+	default:
+		return
+	}
+
+	if p := lookupPeer(s.ID); p != nil && p.pc != nil {
+		s.ConnectionState = p.pc.ConnectionState().String()
+		s.ICEState = p.pc.ICEConnectionState().String()
+	}
+}
+
+// Handler for GET /api/admin/peers, the publishers and viewers of every
+// instance sharing the session store, ?stream= limiting them to one
+func peerRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	stream := r.URL.Query().Get("stream")
+	now := time.Now()
+	list := []peerStatus{}
+	for _, rec := range listPeerRecords() {
+		if stream != "" && rec.Stream != stream {
+			continue
+		}
+		s := peerStatus{peerRecord: rec, Uptime: now.Sub(rec.Created).Seconds()}
+		if rec.Instance == settings.InstanceID {
+			localPeerStatus(&s)
+		}
+		list = append(list, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Shortest time between two PLIs on a publisher track, requests in between
+// are coalesced into one sent when the interval is up
+var pliInterval = 500 * time.Millisecond
+
+// Keyframe requests toward the publisher of a stream
+type pliCounters struct {
+	sent      uint64
+	coalesced uint64
+}
+
+var (
+	pliStats   = make(map[string]*pliCounters)
+	pliStatsMu sync.Mutex
+)
+
+// Per-track PLI timing of a publisher
+type pliThrottle struct {
+	mu      sync.Mutex
+	last    map[webrtc.SSRC]time.Time
+	pending map[webrtc.SSRC]bool
+}
+
+func countPLIs(stream string, sent, coalesced int) {
+	pliStatsMu.Lock()
+	defer pliStatsMu.Unlock()
+
+	c, ok := pliStats[stream]
+	if !ok {
+		c = &pliCounters{}
+		pliStats[stream] = c
+	}
+	c.sent += uint64(sent)
+	c.coalesced += uint64(coalesced)
+}
+
+// Send PLIs for the SSRCs now, or once the interval since the last one is
+// up
+func (p *Publisher) sendPLIs(ssrcs []webrtc.SSRC) {
+	now := time.Now()
+	var due []webrtc.SSRC
+	coalesced := 0
+
+	p.pli.mu.Lock()
+	if p.pli.last == nil {
+		p.pli.last = make(map[webrtc.SSRC]time.Time)
+		p.pli.pending = make(map[webrtc.SSRC]bool)
+	}
+	for _, ssrc := range ssrcs {
+		wait := p.pli.last[ssrc].Add(pliInterval).Sub(now)
+		if wait <= 0 {
+			p.pli.last[ssrc] = now
+			due = append(due, ssrc)
+			continue
+		}
+		coalesced++
+		if !p.pli.pending[ssrc] {
+			p.pli.pending[ssrc] = true
+			time.AfterFunc(wait, func() { p.flushPLI(ssrc) })
+		}
+	}
+	p.pli.mu.Unlock()
+
+	countPLIs(p.stream, 0, coalesced)
+	p.writePLIs(due)
+}
+
+// Send the PLI coalesced for an SSRC
+func (p *Publisher) flushPLI(ssrc webrtc.SSRC) {
+	p.pli.mu.Lock()
+	delete(p.pli.pending, ssrc)
+	p.pli.last[ssrc] = time.Now()
+	p.pli.mu.Unlock()
+
+	if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	p.writePLIs([]webrtc.SSRC{ssrc})
+}
+
+func (p *Publisher) writePLIs(ssrcs []webrtc.SSRC) {
+	if len(ssrcs) == 0 {
+		return
+	}
+	packets := make([]rtcp.Packet, 0, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		packets = append(packets, &rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)})
+	}
+
+	p.log(roomLog).debugf("[publisher %s] Requesting a keyframe on %d video tracks.", p.id, len(packets))
+	if err := p.pc.WriteRTCP(packets); err != nil {
+		p.log(roomLog).errorf("[publisher %s] Error sending PLI: %v", p.id, err)
+		return
+	}
+	countPLIs(p.stream, len(packets), 0)
+}
+
+// Write the PLI counters of every stream in the Prometheus text format
+func writePLIMetrics(w http.ResponseWriter) {
+	pliStatsMu.Lock()
+	streams := make([]string, 0, len(pliStats))
+	for stream := range pliStats {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	counters := make([]pliCounters, len(streams))
+	for i, stream := range streams {
+		counters[i] = *pliStats[stream]
+	}
+	pliStatsMu.Unlock()
+
+	fmt.Fprintf(w, "# HELP sfu_plis_sent_total PLIs sent to the publisher of a stream.\n")
+	fmt.Fprintf(w, "# TYPE sfu_plis_sent_total counter\n")
+	for i, stream := range streams {
+		fmt.Fprintf(w, "sfu_plis_sent_total{stream=%q} %d\n", stream, counters[i].sent)
+	}
+	fmt.Fprintf(w, "# HELP sfu_pli_requests_coalesced_total Keyframe requests folded into a PLI already sent or due.\n")
+	fmt.Fprintf(w, "# TYPE sfu_pli_requests_coalesced_total counter\n")
+	for i, stream := range streams {
+		fmt.Fprintf(w, "sfu_pli_requests_coalesced_total{stream=%q} %d\n", stream, counters[i].coalesced)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Whether the configuration is checked before anything starts, from
+// -preflight
+var preflightEnabled = true
+
+var preflightLog = newLogger("preflight")
+
+// Check that the configuration can work before any subsystem starts: the
+// listen addresses are free, the certificate files readable, media storage
+// writable, the TURN servers reachable and ffmpeg there when asked for.
+// Returns every problem found at once with what to change, instead of the
+// first request running into one of them.
+func preflight() []string {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, l := range []struct{ flag, addr string }{
+		{"-listen", settings.Listen},
+		{"-http-redirect", settings.HTTPRedirect},
+		{"-rtmp", rtmpAddr},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			fail("%s %s can't be listened on: %v; stop what uses it or pick another address", l.flag, l.addr, unwrapOpError(err))
+			continue
+		}
+		ln.Close()
+	}
+
+	for _, f := range []struct{ flag, path string }{
+		{"-tls-cert", settings.TLSCert},
+		{"-tls-key", settings.TLSKey},
+		{"-offline-slate", offlineSlateImage},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if file, err := os.Open(f.path); err != nil {
+			fail("%s %s isn't readable: %v", f.flag, f.path, unwrapOpError(err))
+		} else {
+			file.Close()
+		}
+	}
+	if len(settings.ACMEDomains) > 0 {
+		if err := checkWritableDir(settings.ACMECacheDir); err != nil {
+			fail("-acme-cache %s isn't writable: %v", settings.ACMECacheDir, err)
+		}
+	}
+
+	if err := checkMediaStorage(); err != nil {
+		fail("Media storage %s isn't writable: %v; check -media-storage or -recordings-dir and their credentials", media, err)
+	}
+
+	if path, err := exec.LookPath(ffmpegPath); err != nil {
+		// ffmpeg is only needed once HLS or restreaming is used, so
+		// missing it is only fatal when -ffmpeg points somewhere or
+		// viewers rely on it for their codec
+		switch {
+		case flagSet("ffmpeg"):
+			fail("-ffmpeg %s not found: %v", ffmpegPath, unwrapOpError(err))
+		case codecVariantsEnabled:
+			fail("-codec-variants needs ffmpeg, %s not found: install it or set -ffmpeg", ffmpegPath)
+		case offlineSlateImage != "":
+			fail("-offline-slate needs ffmpeg, %s not found: install it or set -ffmpeg", ffmpegPath)
+		default:
+			preflightLog.warnf("ffmpeg not found, HLS output and restreaming are unavailable: install it or set -ffmpeg.")
+		}
+	} else if err := checkWritableDir(hlsDir); err != nil {
+		fail("-hls-dir %s isn't writable for %s: %v", hlsDir, path, err)
+	}
+
+	for _, err := range checkTURNReachable() {
+		fail("%v; check -ice-servers and the firewall between here and the server", err)
+	}
+
+	return problems
+}
+
+// Whether a flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// The error of a failed syscall without the operation and path around it,
+// which the problem messages name themselves
+func unwrapOpError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Err
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// Create a directory if needed and write a file to it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return unwrapOpError(err)
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return unwrapOpError(err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Write a file to media storage and remove it again
+func checkMediaStorage() error {
+	const name = ".preflight"
+	f, err := media.create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		media.remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return media.remove(name)
+}
+
+// Probe each configured TURN server, the errors of those not answering
+func checkTURNReachable() []error {
+	urls := turnServerURLs()
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := probeTURN(u); err != nil {
+				errs[i] = fmt.Errorf("TURN server %s unreachable: %v", u, unwrapOpError(err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Most viewer connections waiting for their viewers across all streams
+	maxPrewarmedViewers = 1000
+	// How long prewarmed connections wait by default and at most
+	defaultPrewarmValidity = 15 * time.Minute
+	maxPrewarmValidity     = time.Hour
+)
+
+var prewarmLog = newLogger("prewarm")
+
+// Viewer connections created ahead of a stream's expected audience, e.g.
+// before a scheduled go-live. Creating a PeerConnection, with its DTLS
+// certificate, media engine and interceptors, is most of the work of
+// answering a viewer besides ICE; viewers joining at once take a ready one
+// instead. Their candidates are still gathered for each offer.
+type prewarmPool struct {
+	stream  string
+	target  int
+	expires time.Time
+	ready   []*viewerConnection
+	timer   *time.Timer
+	closed  bool
+}
+
+var (
+	prewarmMu    sync.Mutex
+	prewarmPools = make(map[string]*prewarmPool)
+)
+
+// Take a prewarmed connection of the stream, nil when none is ready
+func takePrewarmedViewer(stream string) *viewerConnection {
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	pool := prewarmPools[stream]
+	if pool == nil || len(pool.ready) == 0 {
+		return nil
+	}
+	v := pool.ready[len(pool.ready)-1]
+	pool.ready = pool.ready[:len(pool.ready)-1]
+	prewarmLog.withStream(stream).debugf("Viewer takes a prewarmed connection, %d left.", len(pool.ready))
+	return v
+}
+
+// Create the pool's connections one after the other until it has its target
+// or is closed
+func (pool *prewarmPool) fill() {
+	plog := prewarmLog.withStream(pool.stream)
+	for {
+		prewarmMu.Lock()
+		closed, ready := pool.closed, len(pool.ready)
+		prewarmMu.Unlock()
+		if closed {
+			return
+		}
+		if ready >= pool.target {
+			plog.infof("%d viewer connections ready.", ready)
+			return
+		}
+
+		c, err := newViewerConnection(viewerRTCP, peerOverrides{})
+		if err != nil {
+			plog.errorf("Error creating PeerConnection: %v", err)
+			return
+		}
+		prewarmMu.Lock()
+		if pool.closed {
+			prewarmMu.Unlock()
+			c.pc.Close()
+			return
+		}
+		pool.ready = append(pool.ready, c)
+		prewarmMu.Unlock()
+	}
+}
+
+// Close the pool's unused connections, with prewarmMu held
+func (pool *prewarmPool) close() {
+	pool.closed = true
+	pool.timer.Stop()
+	if prewarmPools[pool.stream] == pool {
+		delete(prewarmPools, pool.stream)
+	}
+	ready := pool.ready
+	pool.ready = nil
+	go func() {
+		for _, v := range ready {
+			v.pc.Close()
+		}
+	}()
+}
+
+// Close every prewarmed connection, on shutdown
+func stopPrewarming() {
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	for _, pool := range prewarmPools {
+		pool.close()
+	}
+}
+
+type prewarmStatus struct {
+	Target  int       `json:"target"`
+	Ready   int       `json:"ready"`
+	Expires time.Time `json:"expires"`
+}
+
+// Handler for GET /api/streams/{stream}/prewarm, how many of the stream's
+// prewarmed connections are ready
+func prewarmStatusHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	prewarmMu.Lock()
+	pool := prewarmPools[stream]
+	var status prewarmStatus
+	if pool != nil {
+		status = prewarmStatus{Target: pool.target, Ready: len(pool.ready), Expires: pool.expires}
+	}
+	prewarmMu.Unlock()
+	if pool == nil {
+		http.Error(w, "No prewarmed connections", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Handler for DELETE /api/streams/{stream}/prewarm, closing the stream's
+// unused prewarmed connections
+func cancelPrewarmHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	prewarmMu.Lock()
+	if pool := prewarmPools[stream]; pool != nil {
+		pool.close()
+	}
+	prewarmMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for POST /api/streams/{stream}/prewarm, creating viewer
+// connections for an expected audience in the background:
+//
+//	{"viewers": 500, "expiresIn": "15m"}
+//
+// They replace those prewarmed for the stream before, all streams together
+// have at most 1000, and unused ones are closed once they expire.
+func prewarmHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	if services.isStopping() {
+		writeSignalingError(w, errShuttingDown)
+		return
+	}
+	var req struct {
+		Viewers   int    `json:"viewers"`
+		ExpiresIn string `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	validity := defaultPrewarmValidity
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxPrewarmValidity {
+			http.Error(w, "expiresIn must be a positive duration up to "+maxPrewarmValidity.String(), http.StatusBadRequest)
+			return
+		}
+		validity = d
+	}
+	// The connections carry TURN credentials that expire
+	if settings.TURNSecret != "" && validity > settings.TURNTTL {
+		validity = settings.TURNTTL
+	}
+
+	prewarmMu.Lock()
+	others := 0
+	for name, pool := range prewarmPools {
+		if name != stream {
+			others += pool.target
+		}
+	}
+	if req.Viewers <= 0 || others+req.Viewers > maxPrewarmedViewers {
+		prewarmMu.Unlock()
+		http.Error(w, "viewers must be between 1 and the 1000 connections all streams may prewarm", http.StatusBadRequest)
+		return
+	}
+	if previous := prewarmPools[stream]; previous != nil {
+		previous.close()
+	}
+	pool := &prewarmPool{stream: stream, target: req.Viewers, expires: time.Now().Add(validity)}
+	pool.timer = time.AfterFunc(validity, func() {
+		prewarmMu.Lock()
+		defer prewarmMu.Unlock()
+		if !pool.closed {
+			prewarmLog.withStream(stream).infof("Prewarmed connections expired, %d unused.", len(pool.ready))
+			pool.close()
+		}
+	})
+	prewarmPools[stream] = pool
+	status := prewarmStatus{Target: pool.target, Expires: pool.expires}
+	prewarmMu.Unlock()
+
+	prewarmLog.withStream(stream).infof("Prewarming %d viewer connections for %v.", req.Viewers, validity)
+	go pool.fill()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the server's load is checked for layer pruning
+const layerPruneInterval = 5 * time.Second
+
+// Share of the thresholds the load must fall below for the highest layers
+// to be forwarded again, so pruning doesn't flap around them
+const layerPruneHysteresis = 0.8
+
+// Share of the machine's CPU, e.g. 0.9, and bits per second sent to viewers
+// above which the highest simulcast layer of every track is no longer
+// forwarded to viewers, 0 disables either
+var (
+	layerPruneCPU    float64
+	layerPruneEgress float64
+)
+
+var pruneLog = newLogger("prune")
+
+var (
+	// Whether the highest simulcast layers are pruned, and how often they
+	// were since the server started
+	layersPruned atomic.Bool
+	layerPrunes  atomic.Uint64
+
+	// Viewer tracks moved off a pruned layer, to move back once the load is
+	// back to normal
+	prunedTracks   = make(map[*viewerTrack]prunedTrack)
+	prunedTracksMu sync.Mutex
+)
+
+// Layer a viewer track was moved off and the one it was moved to
+type prunedTrack struct {
+	publisher *Publisher
+	from, to  *trackFanout
+}
+
+// CPU time of the server and bytes sent by each room at the last sample
+type loadSampler struct {
+	at    time.Time
+	cpu   time.Duration
+	bytes map[*Room]uint64
+}
+
+// Share of the machine's CPU the server used and bits per second it sent to
+// viewers since the last sample, 0 on the first
+func (s *loadSampler) sample() (cpu, egress float64) {
+	now := time.Now()
+	used, err := procCPUTime(os.Getpid())
+	if err != nil {
+		pruneLog.debugf("Error reading CPU time: %v", err)
+	}
+	bytes := make(map[*Room]uint64)
+	var sent uint64
+	for _, room := range listRooms() {
+		bytes[room] = room.bytesOut.Load()
+		if last, ok := s.bytes[room]; ok {
+			sent += bytes[room] - last
+		}
+	}
+	if !s.at.IsZero() {
+		elapsed := now.Sub(s.at).Seconds()
+		if err == nil {
+			cpu = (used - s.cpu).Seconds() / elapsed / float64(runtime.NumCPU())
+		}
+		egress = float64(sent) * 8 / elapsed
+	}
+	s.at, s.cpu, s.bytes = now, used, bytes
+	return cpu, egress
+}
+
+// Prune the highest simulcast layers while the server is above
+// -prune-cpu or -prune-egress, until ctx is done
+func runLayerPruner(ctx context.Context) error {
+	if layerPruneCPU <= 0 && layerPruneEgress <= 0 {
+		return nil
+	}
+	sampler := &loadSampler{}
+	sampler.sample()
+
+	ticker := time.NewTicker(layerPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			cpu, egress := sampler.sample()
+			setLayersPruned(overloaded(cpu, egress, layersPruned.Load()), cpu, egress)
+			if layersPruned.Load() {
+				pruneLayers()
+			}
+		}
+	}
+}
+
+// Whether the load calls for pruning: above either threshold, or while
+// pruned not yet back below the hysteresis share of both
+func overloaded(cpu, egress float64, pruned bool) bool {
+	limit := 1.0
+	if pruned {
+		limit = layerPruneHysteresis
+	}
+	return layerPruneCPU > 0 && cpu > layerPruneCPU*limit || layerPruneEgress > 0 && egress > layerPruneEgress*limit
+}
+
+// Start or end pruning, telling the viewers of simulcast streams
+func setLayersPruned(pruned bool, cpu, egress float64) {
+	if layersPruned.Swap(pruned) == pruned {
+		return
+	}
+	event := "layers-restored"
+	if pruned {
+		event = "layers-pruned"
+		layerPrunes.Add(1)
+		pruneLog.warnf("Server at %.0f%% CPU sending %.1f Mbit/s, no longer forwarding the highest simulcast layers.", cpu*100, egress/1e6)
+	} else {
+		pruneLog.infof("Server at %.0f%% CPU sending %.1f Mbit/s, forwarding the highest simulcast layers again.", cpu*100, egress/1e6)
+		restoreLayers()
+	}
+	for _, room := range listRooms() {
+		if p := room.getPublisher(); p != nil && p.hasSimulcast() {
+			go room.events.notify(room, streamNotice{Type: event, Publisher: p.displayID})
+		}
+	}
+}
+
+// Move the viewers of the highest layer of every simulcast track to the
+// layer below, each one on that layer's next keyframe. Runs on every check
+// while pruned, to catch viewers that joined or asked for a layer meanwhile.
+func pruneLayers() {
+	for _, room := range listRooms() {
+		p := room.getPublisher()
+		if p == nil {
+			continue
+		}
+		for _, t := range p.getTracks() {
+			layers := p.layers(t.ID())
+			if len(layers) < 2 {
+				continue
+			}
+			moved := layers[0].moveLayer(layers[1])
+			if len(moved) == 0 {
+				continue
+			}
+			prunedTracksMu.Lock()
+			for _, vt := range moved {
+				prunedTracks[vt] = prunedTrack{publisher: p, from: layers[0], to: layers[1]}
+			}
+			prunedTracksMu.Unlock()
+			p.requestKeyframe(layers[1].key())
+			p.log(pruneLog).infof("[publisher %s] %d viewers of layer %q of track %s moved to layer %q.", p.id, len(moved), layers[0].RID(), t.ID(), layers[1].RID())
+		}
+	}
+}
+
+// Move the viewer tracks pruning moved back to their layer, unless they
+// changed layers since or the layer ended
+func restoreLayers() {
+	prunedTracksMu.Lock()
+	moved := prunedTracks
+	prunedTracks = make(map[*viewerTrack]prunedTrack)
+	prunedTracksMu.Unlock()
+
+	for vt, m := range moved {
+		if vt.currentFanout() != m.to || !m.publisher.hasTrack(m.from) {
+			continue
+		}
+		vt.switchLayer(m.from)
+		m.publisher.requestKeyframe(m.from.key())
+	}
+}
+
+// Simulcast layers of a track viewers may get, highest first: all of them,
+// or all but the highest while it is pruned
+func (p *Publisher) viewerLayers(id string) []*trackFanout {
+	layers := p.layers(id)
+	if layersPruned.Load() && len(layers) > 1 {
+		return layers[1:]
+	}
+	return layers
+}
+
+// Layer of the publisher's track a new viewer gets, the track itself unless
+// it is a pruned layer
+func (p *Publisher) viewerLayer(t *trackFanout) *trackFanout {
+	if t.RID() == "" || !layersPruned.Load() || !p.hasTrack(t) {
+		return t
+	}
+	if layers := p.layers(t.ID()); len(layers) > 1 && layers[0] == t {
+		return layers[1]
+	}
+	return t
+}
+
+// Whether any track of the publisher is sent in several layers
+func (p *Publisher) hasSimulcast() bool {
+	for _, t := range p.getTracks() {
+		if t.RID() != "" && len(p.layers(t.ID())) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeLayerPruneMetrics(w http.ResponseWriter) {
+	pruned := 0.0
+	if layersPruned.Load() {
+		pruned = 1
+	}
+	writeGauge(w, "sfu_simulcast_layers_pruned", "Whether the highest simulcast layers are withheld from viewers under load.", pruned)
+	writeCounter(w, "sfu_simulcast_layer_prunes_total", "Times the highest simulcast layers were withheld from viewers under load.", float64(layerPrunes.Load()))
+}
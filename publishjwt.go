@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Clock difference tolerated on the expiry of publish tokens
+const publishTokenLeeway = 30 * time.Second
+
+// Audiences of publish and view tokens, so a token of one is never taken
+// for the other even when both are signed with the same secret
+const (
+	publishTokenAudience = "publish"
+	viewTokenAudience    = "view"
+)
+
+var errAudienceRequired = errors.New("token has no audience, issue it with an aud claim or drop -require-token-audience")
+
+// Check the audience of a token parsed without one required: a wrong one is
+// rejected, a missing one only with -require-token-audience, as tokens
+// issued before audiences were checked have none
+func checkTokenAudience(claims *streamClaims, audience string, log moduleLogger) error {
+	if len(claims.Audience) == 0 {
+		if settings.RequireTokenAudience {
+			return errAudienceRequired
+		}
+		log.warnf("Accepted a token without an audience, issue tokens with \"aud\": %q before -require-token-audience becomes the default.", audience)
+		return nil
+	}
+	if !slices.Contains(claims.Audience, audience) {
+		return jwt.ErrTokenInvalidAudience
+	}
+	return nil
+}
+
+// Key publish tokens are verified with and the algorithms accepted for it,
+// nil when publishing needs no token
+var (
+	publishJWTKey     interface{}
+	publishJWTMethods []string
+)
+
+// Claims of a publish or view token, e.g.
+// {"stream":"demo","aud":"publish","exp":1760000000}.
+// The stream of a publish token may be a pattern such as "ci-*", see
+// grantsStream.
+type streamClaims struct {
+	Stream string `json:"stream"`
+	jwt.RegisteredClaims
+}
+
+// Load the key of -publish-jwt-secret or -publish-jwt-key
+func loadPublishJWTKey() error {
+	switch {
+	case settings.PublishJWTSecret != "":
+		publishJWTKey = []byte(settings.PublishJWTSecret)
+		publishJWTMethods = []string{"HS256", "HS384", "HS512"}
+	case settings.PublishJWTKey != "":
+		data, err := os.ReadFile(settings.PublishJWTKey)
+		if err != nil {
+			return err
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return err
+		}
+		publishJWTKey = key
+		publishJWTMethods = []string{"RS256", "RS384", "RS512"}
+	}
+	return nil
+}
+
+// Check the publish token of a publisher of the stream: it must be signed
+// with the configured key, unexpired, for the publish audience and name the
+// stream or a pattern matching it. Anybody may
+// publish while no key is configured; accounts are checked on top.
+func authorizePublishToken(token, stream string) error {
+	if publishJWTKey == nil {
+		return nil
+	}
+	if token == "" {
+		return newSignalingError(http.StatusUnauthorized, "Publish token required")
+	}
+	var claims streamClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) { return publishJWTKey, nil },
+		jwt.WithValidMethods(publishJWTMethods), jwt.WithExpirationRequired(), jwt.WithLeeway(publishTokenLeeway))
+	if err == nil {
+		err = checkTokenAudience(&claims, publishTokenAudience, publishLog.withStream(stream))
+	}
+	if err != nil {
+		publishLog.withStream(stream).warnf("Rejected publish token: %v", err)
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return newSignalingError(http.StatusUnauthorized, "Publish token expired")
+		case errors.Is(err, errAudienceRequired):
+			return newSignalingError(http.StatusUnauthorized, "Publish token needs the \"publish\" audience")
+		}
+		return newSignalingError(http.StatusUnauthorized, "Invalid publish token")
+	}
+	if !grantsStream(claims.Stream, stream) {
+		return newSignalingError(http.StatusForbidden, "Publish token is for another stream")
+	}
+	return nil
+}
+
+// Publish token of a request, from an Authorization: Bearer header that
+// isn't an API token or the ?token= of the URL
+func publishToken(r *http.Request) string {
+	if token, ok := bearerToken(r); ok && !strings.HasPrefix(token, apiTokenPrefix) {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Simulcast layers a viewer can ask for
+var qualityLevels = []string{"high", "mid", "low"}
+
+// Layer a video track of a viewer receives
+type trackQuality struct {
+	Track   string `json:"track"`
+	Layer   string `json:"layer"`
+	Pending bool   `json:"pending,omitempty"`
+}
+
+// Pick the layer for a quality among layers sorted highest first
+func layerForQuality(layers []*trackFanout, quality string) *trackFanout {
+	if len(layers) == 0 {
+		return nil
+	}
+	switch quality {
+	case "low":
+		return layers[len(layers)-1]
+	case "mid":
+		return layers[(len(layers)-1)/2]
+	}
+	return layers[0]
+}
+
+// Move the viewer's simulcast video tracks to the layer matching quality,
+// each one on the layer's next keyframe
+func (v *Viewer) setQuality(publisher *Publisher, quality string) []trackQuality {
+	var result []trackQuality
+	for _, t := range v.getTracks() {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		current := t.currentFanout()
+		layer := layerForQuality(publisher.viewerLayers(current.ID()), quality)
+		if layer == nil {
+			continue
+		}
+		if layer != current {
+			t.switchLayer(layer)
+			publisher.requestKeyframe(layer.key())
+		}
+		result = append(result, trackQuality{Track: t.ID(), Layer: layer.RID(), Pending: t.pendingLayer() != nil})
+	}
+	if len(result) > 0 {
+		v.log(viewLog).infof("[viewer %s] Quality set to %s.", v.id, quality)
+	}
+	return result
+}
+
+// Handler for POST /view/quality {"id":"<viewer ID>","quality":"high|mid|low"}
+// switching the simulcast layers a viewer receives
+func viewQualityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID      string `json:"id"`
+		Quality string `json:"quality"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	valid := false
+	for _, q := range qualityLevels {
+		valid = valid || q == req.Quality
+	}
+	if !valid {
+		http.Error(w, "Quality must be high, mid or low", http.StatusBadRequest)
+		return
+	}
+
+	p := lookupPeer(req.ID)
+	if p == nil || p.role != "viewer" {
+		http.Error(w, "Unknown peer", http.StatusNotFound)
+		return
+	}
+	var viewer *Viewer
+	var publisher *Publisher
+	if room := getRoom(p.stream); room != nil {
+		viewer, publisher = room.getViewer(p.id), room.getPublisher()
+	}
+	if viewer == nil || publisher == nil {
+		http.Error(w, "Stream is not live", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(viewer.setQuality(publisher, req.Quality))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// Longest a readiness check may take
+	readinessTimeout = 2 * time.Second
+	// How long the outcome of probing the TURN servers is reused, so frequent
+	// probes don't send them a request each
+	turnCheckInterval = 10 * time.Second
+)
+
+// When the process started, for /healthz
+var processStarted = time.Now()
+
+// Outcome of one readiness check
+type readinessCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Milliseconds the check took
+	Latency float64 `json:"latency"`
+}
+
+var (
+	turnCheckMu   sync.Mutex
+	turnChecks    []readinessCheck
+	turnCheckedAt time.Time
+)
+
+// Handler for GET /healthz, answering 200 as long as the process serves
+// HTTP, for liveness probes. Shutting down doesn't make it fail, restarting
+// the process wouldn't help.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"instance": settings.InstanceID,
+		"uptime":   time.Since(processStarted).Seconds(),
+	})
+}
+
+// Handler for GET /readyz, whether the instance should get new sessions,
+// for load balancers and readiness probes: the HTTP server runs and the
+// server isn't shutting down, no subsystem failed, the session store
+// answers, and the TURN servers of -ice-servers are reachable when there
+// are any. Responds 503 with the failed checks otherwise.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := []readinessCheck{
+		runCheck("http", func() error {
+			if services.isStopping() {
+				return errShuttingDown
+			}
+			for _, h := range services.health() {
+				if h.State == subsystemFailed {
+					return fmt.Errorf("%s failed: %s", h.Name, h.Error)
+				}
+			}
+			return nil
+		}),
+		runCheck("session-store", func() error { return sessions.ping(ctx) }),
+	}
+	checks = append(checks, checkTURNServers()...)
+
+	status := "ready"
+	for _, c := range checks {
+		if c.Status == "failed" {
+			status = "not ready"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func runCheck(name string, check func() error) readinessCheck {
+	started := time.Now()
+	err := check()
+	c := readinessCheck{Name: name, Status: "ok", Latency: float64(time.Since(started).Microseconds()) / 1000}
+	if err != nil {
+		c.Status, c.Error = "failed", err.Error()
+	}
+	return c
+}
+
+// Probe each TURN URL of publishers and viewers, reusing the outcome for
+// turnCheckInterval
+func checkTURNServers() []readinessCheck {
+	turnCheckMu.Lock()
+	defer turnCheckMu.Unlock()
+	if time.Since(turnCheckedAt) < turnCheckInterval {
+		return turnChecks
+	}
+
+	urls := turnServerURLs()
+	checks := make([]readinessCheck, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = runCheck("turn "+u, func() error { return probeTURN(u) })
+		}()
+	}
+	wg.Wait()
+	turnChecks, turnCheckedAt = checks, time.Now()
+	return checks
+}
+
+// The TURN servers handed to publishers and viewers, each once
+func turnServerURLs() []string {
+	var urls []string
+	for _, role := range []string{"publisher", "viewer"} {
+		for _, u := range settings.ICEServersFor(role) {
+			if (strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")) && !containsFold(urls, u) {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// Send a STUN binding request to a TURN server, which answers it without
+// credentials. Over TCP and TLS connecting is enough.
+func probeTURN(raw string) error {
+	uri, err := stun.ParseURI(raw)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port))
+	dialer := &net.Dialer{Timeout: readinessTimeout}
+	switch {
+	case uri.Scheme == stun.SchemeTypeTURNS:
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: uri.Host})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case uri.Proto == stun.ProtoTypeTCP:
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	conn, err := dialer.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(readinessTimeout))
+	request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := conn.Write(request.Raw); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !stun.IsMessage(buf[:n]) {
+		return errors.New("not a STUN response")
+	}
+	return nil
+}
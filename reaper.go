@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long a peer's PeerConnection may go without being connected before
+// the watchdog closes it, from -stale-peer-timeout
+var stalePeerTimeout = 5 * time.Minute
+
+// Close the peers whose PeerConnection failed or closed without them leaving,
+// or wasn't connected for stalePeerTimeout, e.g. clients that posted an offer
+// and never set up ICE. Publishers and viewers leave their room as they do on
+// hanging up; peers whose room is already gone are only forgotten.
+func reapStalePeers() {
+	peersMu.Lock()
+	list := make([]*peer, 0, len(peers))
+	for _, p := range peers {
+		list = append(list, p)
+	}
+	peersMu.Unlock()
+
+	now := time.Now()
+	for _, p := range list {
+		if p.pc == nil {
+			continue
+		}
+		state := p.pc.ConnectionState()
+		if state == webrtc.PeerConnectionStateConnected {
+			p.lastSeen.Store(now.UnixNano())
+			continue
+		}
+		seen := p.created
+		if last := p.lastSeen.Load(); last != 0 {
+			seen = time.Unix(0, last)
+		}
+		dead := state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed
+		if !dead && (stalePeerTimeout <= 0 || now.Sub(seen) < stalePeerTimeout) {
+			continue
+		}
+		p.log(watchdogLog).infof("[%s %s] PeerConnection %s, not connected since %s, closing.", p.role, p.id, state, seen.Format(time.RFC3339))
+		reapPeer(p)
+	}
+}
+
+func reapPeer(p *peer) {
+	room := getRoom(p.stream)
+	switch {
+	case p.role == "publisher" && room != nil:
+		if _, publisher := findPublisher(p.id); publisher != nil {
+			room.closePublisher(publisher)
+			return
+		}
+	case p.role == "viewer" && room != nil:
+		if viewer := room.getViewer(p.id); viewer != nil {
+			room.closeViewer(viewer)
+			return
+		}
+	case p.role != "publisher" && p.role != "viewer":
+		// Tests and monitors clean up as their PeerConnection closes
+		if p.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			p.pc.Close()
+			return
+		}
+	}
+	p.close(func() {})
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// Directory recordings are written to unless -media-storage is set
+var recordingsDir = "recordings"
+
+var recorderLog = newLogger("recorder")
+
+// Writer of one track's RTP to a media file
+type rtpFileWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// Recording of a publisher, one file per track: VP8 to IVF, H264 to an
+// Annex B stream and Opus to OGG, or its first video and audio track muxed
+// into a WebM file. Of a simulcast track only the highest layer is recorded.
+// Data channel messages of the publisher and its viewers go to a JSONL
+// sidecar. A publisher taking over the stream continues the recording.
+type recording struct {
+	stream  string
+	started time.Time
+
+	mu      sync.Mutex
+	webm    *webmWriter
+	writers map[string]rtpFileWriter
+	feeds   map[string]*recordingFeed
+	files   []string
+	skipped map[string]bool
+	events  storageFile
+	stopped bool
+	// Time of the events written, time.Now unless the packets are written
+	// after the fact, as of a capture
+	clock func() time.Time
+}
+
+// Track feeding one file or WebM track of a recording, by the key of the
+// track the file was opened for. When another publisher takes over, its
+// track of the same kind and codec feeds on, rewritten to follow the
+// packets before it.
+type recordingFeed struct {
+	key       string
+	publisher *Publisher
+	kind      webrtc.RTPCodecType
+	mimeType  string
+	rewriter  rtpRewriter
+}
+
+// Line of a recording's JSONL sidecar. OffsetMs counts from the start of
+// the recording; a "track" line tells when each media file starts, so
+// events can be placed on the media timeline.
+type recordingEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	OffsetMs float64   `json:"offsetMs"`
+	Track    string    `json:"track,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	From     string    `json:"from,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Binary   []byte    `json:"binary,omitempty"`
+}
+
+// State of a recording as returned by the recordings API
+type recordingInfo struct {
+	ID      string    `json:"id"`
+	Stream  string    `json:"stream"`
+	Started time.Time `json:"started"`
+	Files   []string  `json:"files"`
+}
+
+// Start recording the publisher to separate files, or to one WebM file
+// when webm is set. Its video tracks are asked for a keyframe so the files
+// start decodable. Returns nil when already recording.
+func (p *Publisher) startRecording(webm bool) (*recording, error) {
+	rec := &recording{stream: p.stream, started: time.Now(), writers: make(map[string]rtpFileWriter), feeds: make(map[string]*recordingFeed), skipped: make(map[string]bool)}
+	if webm {
+		var videoKey, audioKey string
+		for _, t := range p.getTracks() {
+			switch {
+			case videoKey == "" && strings.EqualFold(t.Codec().MimeType, webrtc.MimeTypeVP8):
+				videoKey = t.key()
+			case audioKey == "" && strings.EqualFold(t.Codec().MimeType, webrtc.MimeTypeOpus):
+				audioKey = t.key()
+			}
+		}
+		if videoKey == "" && audioKey == "" {
+			return nil, newSignalingError(http.StatusBadRequest, "WebM recording needs a VP8 or Opus track")
+		}
+		rec.webm = newWebMWriter(rec.fileName("")+".webm", videoKey, audioKey)
+	}
+
+	p.recordingMu.Lock()
+	if p.recording != nil {
+		p.recordingMu.Unlock()
+		return nil, newSignalingError(http.StatusConflict, "Stream is already being recorded")
+	}
+	p.recording = rec
+	p.recordingMu.Unlock()
+
+	rec.mu.Lock()
+	rec.writeEvent(recordingEvent{Type: "start"})
+	rec.mu.Unlock()
+
+	p.log(recorderLog).infof("[publisher %s] Recording started.", p.id)
+	p.requestKeyframe()
+	return rec, nil
+}
+
+// Stop the publisher's recording and close its files, nil when not recording
+func (p *Publisher) stopRecording() *recording {
+	p.recordingMu.Lock()
+	rec := p.recording
+	p.recording = nil
+	p.recordingMu.Unlock()
+
+	if rec == nil {
+		return nil
+	}
+	rec.stop()
+	return rec
+}
+
+// Close the recording's files and prepare its storyboard
+func (rec *recording) stop() {
+	rec.close()
+	recorderLog.withStream(rec.stream).infof("Recording %s stopped, %d files.", rec.fileName(""), len(rec.info().Files))
+	prepareStoryboard(rec.fileName(""))
+}
+
+// Stop the recordings of all publishers so their files are complete, on
+// shutdown
+func stopRecordings() {
+	for _, room := range listRooms() {
+		if p := room.getPublisher(); p != nil {
+			p.stopRecording()
+		}
+	}
+	stopHeldRecordings()
+}
+
+// Base names of the recordings still being written, by publishers and
+// cohosts or held for the next publisher of their stream
+func activeRecordings() map[string]bool {
+	active := make(map[string]bool)
+	add := func(rec *recording) {
+		if rec == nil {
+			return
+		}
+		rec.mu.Lock()
+		if !rec.stopped {
+			active[rec.fileName("")] = true
+		}
+		rec.mu.Unlock()
+	}
+	for _, room := range listRooms() {
+		for _, p := range append(room.getCohosts(), room.getPublisher()) {
+			if p != nil {
+				add(p.currentRecording())
+			}
+		}
+	}
+	heldRecordingsMu.Lock()
+	for _, held := range heldRecordings {
+		add(held.rec)
+	}
+	heldRecordingsMu.Unlock()
+	return active
+}
+
+func (p *Publisher) currentRecording() *recording {
+	p.recordingMu.Lock()
+	defer p.recordingMu.Unlock()
+	return p.recording
+}
+
+// Record the messages of a data channel to the sidecar of the publisher's
+// recording while there is one
+func recordDataChannel(room *Room, from string, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		recordMessage(room, from, dc.Label(), msg)
+	})
+}
+
+func recordMessage(room *Room, from, label string, msg webrtc.DataChannelMessage) {
+	if p := room.getPublisher(); p != nil {
+		if rec := p.currentRecording(); rec != nil {
+			rec.message(from, label, msg)
+		}
+	}
+}
+
+// Hand a packet of one of the publisher's tracks to the recording, if any
+func (p *Publisher) record(t *trackFanout, packet *rtp.Packet) {
+	if rec := p.currentRecording(); rec != nil {
+		rec.write(p, t, packet)
+	}
+}
+
+func (rec *recording) write(p *Publisher, t *trackFanout, packet *rtp.Packet) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.stopped || rec.skipped[t.key()] {
+		return
+	}
+	feed := rec.feed(p, t)
+	if feed == nil && rec.webm == nil {
+		if t.RID() != "" && p.bestLayer(t.ID()) != t {
+			rec.skipped[t.key()] = true
+			return
+		}
+		w, err := rec.open(t)
+		if err != nil {
+			recorderLog.withStream(rec.stream).errorf("Error opening recording of track %s: %v", t.key(), err)
+			rec.skipped[t.key()] = true
+			return
+		}
+		rec.writers[t.key()] = w
+		feed = rec.addFeed(p, t)
+	} else if feed == nil {
+		if t.key() != rec.webm.videoKey && t.key() != rec.webm.audioKey {
+			return
+		}
+		feed = rec.addFeed(p, t)
+	}
+
+	rewritten := *packet
+	feed.rewriter.rewrite(&rewritten.Header)
+	if rec.webm != nil {
+		rec.writeWebM(feed.key, &rewritten)
+		return
+	}
+	if err := rec.writers[feed.key].WriteRTP(&rewritten); err != nil {
+		recorderLog.withStream(rec.stream).errorf("Error recording track %s: %v", feed.key, err)
+	}
+}
+
+// Feed of the track, or one a previous publisher's track of the same kind
+// and codec left, which the track takes over. Must be called with the
+// recording's mutex held.
+func (rec *recording) feed(p *Publisher, t *trackFanout) *recordingFeed {
+	if feed, ok := rec.feeds[t.key()]; ok {
+		return feed
+	}
+	if t.RID() != "" && p.bestLayer(t.ID()) != t {
+		return nil
+	}
+	for key, feed := range rec.feeds {
+		if feed.publisher != p && feed.kind == t.Kind() && strings.EqualFold(feed.mimeType, t.Codec().MimeType) {
+			delete(rec.feeds, key)
+			feed.publisher = p
+			rec.feeds[t.key()] = feed
+			recorderLog.withStream(rec.stream).debugf("Recording of track %s continues with track %s of publisher %s.", feed.key, t.key(), p.id)
+			return feed
+		}
+	}
+	return nil
+}
+
+// Must be called with the recording's mutex held
+func (rec *recording) addFeed(p *Publisher, t *trackFanout) *recordingFeed {
+	feed := &recordingFeed{key: t.key(), publisher: p, kind: t.Kind(), mimeType: t.Codec().MimeType}
+	feed.rewriter.clockRate = t.Codec().ClockRate
+	rec.feeds[t.key()] = feed
+	return feed
+}
+
+// Must be called with the recording's mutex held
+func (rec *recording) writeWebM(key string, packet *rtp.Packet) {
+	started := rec.webm.started
+	if err := rec.webm.writeRTP(key, packet); err != nil {
+		recorderLog.withStream(rec.stream).errorf("Error recording track %s to WebM: %v", key, err)
+		return
+	}
+	if !started && rec.webm.started {
+		name := rec.webm.name
+		rec.files = append(rec.files, name)
+		rec.writeEvent(recordingEvent{Type: "track", Track: rec.webm.videoKey, File: name})
+		recorderLog.withStream(rec.stream).debugf("Recording to %s.", name)
+	}
+}
+
+// Name of a file of the recording, by stream, start time and suffix
+func (rec *recording) fileName(suffix string) string {
+	name := fmt.Sprintf("%s-%s", rec.stream, rec.started.Format("20060102-150405"))
+	if suffix != "" {
+		name += "-" + suffix
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+// Create the file of a track, named by stream, start time and track ID.
+// Must be called with the recording's mutex held.
+func (rec *recording) open(t *trackFanout) (rtpFileWriter, error) {
+	name := rec.fileName(t.key())
+	codec := t.Codec()
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		name += ".ivf"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		name += ".h264"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		name += ".ogg"
+	default:
+		return nil, fmt.Errorf("cannot record %s", codec.MimeType)
+	}
+	f, err := media.create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var w rtpFileWriter
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		w, err = ivfwriter.NewWith(f)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		w = h264writer.NewWith(f)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		// Writing to a stream, it leaves the last page unmarked as the end,
+		// which players and replays don't need
+		w, err = oggwriter.NewWith(f, codec.ClockRate, codec.Channels)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rec.files = append(rec.files, name)
+	rec.writeEvent(recordingEvent{Type: "track", Track: t.key(), File: name})
+	recorderLog.withStream(rec.stream).debugf("Recording track %s to %s.", t.key(), name)
+	return w, nil
+}
+
+// Record a data channel message of the publisher or a viewer
+func (rec *recording) message(from, label string, msg webrtc.DataChannelMessage) {
+	e := recordingEvent{Type: "message", Label: label, From: from}
+	if msg.IsString {
+		e.Text = string(msg.Data)
+	} else {
+		e.Binary = msg.Data
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !rec.stopped {
+		rec.writeEvent(e)
+	}
+}
+
+// Append a line to the sidecar, created on first use. Must be called with
+// the recording's mutex held.
+func (rec *recording) writeEvent(e recordingEvent) {
+	if rec.events == nil {
+		name := rec.fileName("events.jsonl")
+		f, err := media.create(name)
+		if err != nil {
+			recorderLog.withStream(rec.stream).errorf("Error creating recording sidecar: %v", err)
+			return
+		}
+		rec.events = f
+		rec.files = append(rec.files, name)
+	}
+
+	now := time.Now()
+	if rec.clock != nil {
+		now = rec.clock()
+	}
+	e.Time = now
+	e.OffsetMs = float64(now.Sub(rec.started).Microseconds()) / 1000
+	line, _ := json.Marshal(e)
+	if _, err := rec.events.Write(append(line, '\n')); err != nil {
+		recorderLog.withStream(rec.stream).errorf("Error writing recording sidecar: %v", err)
+	}
+}
+
+func (rec *recording) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.writeEvent(recordingEvent{Type: "stop"})
+	rec.stopped = true
+	for key, w := range rec.writers {
+		if err := w.Close(); err != nil {
+			recorderLog.withStream(rec.stream).errorf("Error closing recording of track %s: %v", key, err)
+		}
+	}
+	rec.writers = nil
+	if rec.webm != nil {
+		if err := rec.webm.Close(); err != nil {
+			recorderLog.withStream(rec.stream).errorf("Error closing WebM recording: %v", err)
+		}
+	}
+	if rec.events != nil {
+		rec.events.Close()
+	}
+}
+
+func (rec *recording) info() recordingInfo {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	files := append([]string{}, rec.files...)
+	sort.Strings(files)
+	return recordingInfo{ID: rec.fileName(""), Stream: rec.stream, Started: rec.started, Files: files}
+}
+
+// Handler for POST /api/recordings/start and /api/recordings/stop with
+// {"stream":"name"}, allowed to the stream's owner. Start takes
+// "format":"webm" for a single muxed file.
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Stream string `json:"stream"`
+		Format string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !streamNamePattern.MatchString(req.Stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	if req.Format != "" && req.Format != "separate" && req.Format != "webm" {
+		http.Error(w, "Format must be separate or webm", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeStream(currentAccount(r), req.Stream, actionManage); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	var publisher *Publisher
+	if room := getRoom(req.Stream); room != nil {
+		publisher = room.getPublisher()
+	}
+	if publisher == nil {
+		http.Error(w, "Stream is not live", http.StatusServiceUnavailable)
+		return
+	}
+
+	var rec *recording
+	switch r.URL.Path {
+	case "/api/recordings/start":
+		var err error
+		if rec, err = publisher.startRecording(req.Format == "webm"); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+	case "/api/recordings/stop":
+		if rec = publisher.stopRecording(); rec == nil {
+			http.Error(w, "Stream is not being recorded", http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec.info())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How often publishers are told the bitrate their viewers can take
+	rembInterval = time.Second
+	// Viewers are left out until their estimate had time to ramp up from
+	// viewerInitialBitrate
+	rembWarmup = 10 * time.Second
+	// Bitrate announced once a publisher has no viewers to adapt to anymore,
+	// lifting the limit of its earlier REMBs
+	rembUnlimited = 50_000_000
+)
+
+// Lowest bitrate publishers are asked for, from -remb-min-bitrate, so a
+// single struggling viewer can't starve everyone else. 0 disables REMB.
+var rembMinBitrate = 150_000
+
+var rembLog = newLogger("remb")
+
+// Send each WebRTC publisher a REMB with the lowest bandwidth estimate of
+// its stream's viewers, so its encoder ramps the bitrate down while viewers
+// are struggling and back up as they recover. Simulcast publishers are left
+// alone: their viewers move between layers instead.
+func runREMB(ctx context.Context) error {
+	if rembMinBitrate <= 0 {
+		return nil
+	}
+	// Bitrate last announced to each publisher
+	sent := make(map[*Publisher]uint64)
+
+	ticker := time.NewTicker(rembInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		live := make(map[*Publisher]bool)
+		for _, room := range listRooms() {
+			bitrate, ok := viewersBitrate(room)
+			for _, p := range append(room.getCohosts(), room.getPublisher()) {
+				if p == nil || p.pc == nil || p.dataOnly || p.simulcast() {
+					continue
+				}
+				live[p] = true
+				if !ok {
+					// Lift the limit once nobody is left to adapt to
+					if _, limited := sent[p]; limited {
+						p.sendREMB(rembUnlimited)
+						delete(sent, p)
+					}
+					continue
+				}
+				p.sendREMB(bitrate)
+				sent[p] = bitrate
+			}
+		}
+		for p := range sent {
+			if !live[p] {
+				delete(sent, p)
+			}
+		}
+	}
+}
+
+// Lowest bandwidth estimate of the room's viewers, no lower than
+// rembMinBitrate, and whether any viewer has one
+func viewersBitrate(room *Room) (uint64, bool) {
+	var lowest uint64
+	found := false
+	for _, v := range room.getViewers() {
+		f := v.feedback.Load()
+		if f == nil || !f.twccReceived.Load() || time.Since(v.created) < rembWarmup || v.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		e := f.bandwidthEstimator()
+		if e == nil {
+			continue
+		}
+		if b := uint64(max(e.GetTargetBitrate(), rembMinBitrate)); !found || b < lowest {
+			lowest, found = b, true
+		}
+	}
+	return lowest, found
+}
+
+// Whether the publisher sends simulcast layers
+func (p *Publisher) simulcast() bool {
+	p.trackMutex.Lock()
+	defer p.trackMutex.Unlock()
+	for _, t := range p.tracks {
+		if t.RID() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell the publisher the bitrate its video tracks may use together
+func (p *Publisher) sendREMB(bitrate uint64) {
+	p.trackMutex.Lock()
+	ssrcs := make([]uint32, 0, len(p.videoSSRCs))
+	for _, ssrc := range p.videoSSRCs {
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+	p.trackMutex.Unlock()
+	if len(ssrcs) == 0 || p.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return
+	}
+
+	if err := p.pc.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: float32(bitrate), SSRCs: ssrcs}}); err != nil {
+		p.log(rembLog).warnf("[publisher %s] Error sending REMB: %v", p.id, err)
+		return
+	}
+	p.log(rembLog).debugf("[publisher %s] REMB of %d bit/s sent.", p.id, bitrate)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var renegotiateLog = newLogger("renegotiate")
+
+// Answer a new offer of a connected publisher or viewer on its
+// PeerConnection, e.g. one adding a screen share track, or apply the
+// client's answer to an offer the server sent. Returns the answer to an
+// offer, nil for an answer.
+func renegotiatePeer(p *peer, desc webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	switch desc.Type {
+	case webrtc.SDPTypeOffer:
+		var prepare func()
+		if p.role == "publisher" {
+			if room, publisher := findPublisher(p.id); room != nil {
+				prepare = func() {
+					prefer := publisher.codecOrder(room)
+					for _, t := range p.pc.GetTransceivers() {
+						if err := orderPublisherCodecs(t, prefer); err != nil {
+							p.log(renegotiateLog).warnf("Error ordering %s codecs: %v", t.Kind(), err)
+						}
+					}
+				}
+			}
+		}
+		return p.answerRenegotiation(desc, prepare)
+	case webrtc.SDPTypeAnswer:
+		if err := p.applyRenegotiationAnswer(desc); err != nil {
+			return nil, err
+		}
+		if p.role == "viewer" {
+			viewerRenegotiated(p)
+		}
+		return nil, nil
+	}
+	return nil, newSignalingError(http.StatusBadRequest, "Expected an offer or an answer")
+}
+
+// Set a new offer of the client and answer it. prepare runs once the offer
+// is applied, before the answer is created.
+func (p *peer) answerRenegotiation(offer webrtc.SessionDescription, prepare func()) (*webrtc.SessionDescription, error) {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+	plog := p.log(renegotiateLog)
+
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		return nil, newSignalingError(http.StatusConflict, "Renegotiation already in progress")
+	}
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		plog.warnf("[%s %s] Error setting renegotiated offer: %v", p.role, p.id, err)
+		return nil, newSignalingError(http.StatusBadRequest, "Could not set remote description")
+	}
+	if prepare != nil {
+		prepare()
+	}
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		plog.errorf("[%s %s] Error creating answer: %v", p.role, p.id, err)
+		return nil, newSignalingError(http.StatusInternalServerError, "Could not create answer")
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		plog.errorf("[%s %s] Error setting local description: %v", p.role, p.id, err)
+		return nil, newSignalingError(http.StatusInternalServerError, "Could not set local description")
+	}
+	plog.infof("[%s %s] Renegotiated by the client.", p.role, p.id)
+	return &answer, nil
+}
+
+// Set the client's answer to the server's last offer
+func (p *peer) applyRenegotiationAnswer(answer webrtc.SessionDescription) error {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
+	if p.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return newSignalingError(http.StatusConflict, "No offer to answer")
+	}
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		p.log(renegotiateLog).warnf("[%s %s] Error setting renegotiated answer: %v", p.role, p.id, err)
+		return newSignalingError(http.StatusBadRequest, "Could not set remote description")
+	}
+	p.log(renegotiateLog).infof("[%s %s] Renegotiated by the server.", p.role, p.id)
+	return nil
+}
+
+// Once a viewer took its new tracks, start them with a keyframe, and offer
+// those added while the last offer was out
+func viewerRenegotiated(p *peer) {
+	room := getRoom(p.stream)
+	if room == nil {
+		return
+	}
+	if publisher := room.getPublisher(); publisher != nil {
+		publisher.requestKeyframe()
+	}
+	if v := room.getViewer(p.id); v != nil && v.offerPending.Swap(false) {
+		v.offerTracks()
+	}
+}
+
+// Add a track published after the viewer connected, e.g. a screen share or
+// an audio track that arrived late, and offer it to the viewer
+func (v *Viewer) addLateTrack(room *Room, p *Publisher, t *trackFanout) {
+	if v.audioOnly && t.Kind() == webrtc.RTPCodecTypeVideo {
+		return
+	}
+	v.negotiationMu.Lock()
+	for _, vt := range v.getTracks() {
+		if f := vt.currentFanout(); f.ID() == t.ID() && p.hasTrack(f) {
+			v.negotiationMu.Unlock()
+			return
+		}
+	}
+	track := p.viewerLayer(t).newViewerTrack()
+	track.setDecimation(int(v.decimation.Load()))
+	track.setTemporalLayers(int(v.temporalLayers.Load()))
+	sender, err := v.pc.AddTrack(track)
+	if err != nil {
+		v.negotiationMu.Unlock()
+		v.log(renegotiateLog).debugf("[viewer %s] Track %s not added: %v", v.id, t.key(), err)
+		return
+	}
+	v.tracksMu.Lock()
+	v.tracks = append(v.tracks, track)
+	v.tracksMu.Unlock()
+	v.negotiationMu.Unlock()
+
+	go relayKeyframeRequests(room, v, sender, track)
+	v.log(renegotiateLog).infof("[viewer %s] Track %s of publisher %s added.", v.id, t.key(), p.id)
+	v.offerTracks()
+}
+
+// Send the viewer an offer with its current tracks over its signaling
+// socket or /events stream. Viewers that follow neither keep what they
+// negotiated until they reconnect.
+func (v *Viewer) offerTracks() {
+	v.negotiationMu.Lock()
+	defer v.negotiationMu.Unlock()
+	if v.pc.CurrentRemoteDescription() == nil {
+		return
+	}
+	if v.pc.SignalingState() != webrtc.SignalingStateStable {
+		v.offerPending.Store(true)
+		return
+	}
+	if len(socketsOf(v.peer)) == 0 && !v.followed() {
+		v.log(renegotiateLog).infof("[viewer %s] No signaling socket or event stream to offer new tracks on.", v.id)
+		return
+	}
+
+	offer, err := v.pc.CreateOffer(nil)
+	if err != nil {
+		v.log(renegotiateLog).errorf("[viewer %s] Error creating offer: %v", v.id, err)
+		return
+	}
+	if err := v.pc.SetLocalDescription(offer); err != nil {
+		v.log(renegotiateLog).errorf("[viewer %s] Error setting local description: %v", v.id, err)
+		return
+	}
+	notifySockets(signalMessage{Type: "offer", ID: v.id, Stream: v.stream, SDP: &offer}, v.peer)
+	v.publishEvent(peerEvent{Type: "offer", SDP: &offer})
+	v.log(renegotiateLog).debugf("[viewer %s] Offer of new tracks sent.", v.id)
+}
+
+// Handler for POST /renegotiate?id=..., a publisher's or viewer's new
+// offer, answered like the first one, or its answer to an offer the server
+// sent over the peer's /events stream. Like that stream, it needs the peer
+// ID and secret the client got with its answer, as it can restart ICE and
+// swap the peer's media.
+func renegotiateHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	p := authorizedPeer(r, id)
+	if p == nil || p.pc == nil || (p.role != "publisher" && p.role != "viewer") {
+		http.Error(w, "No such peer", http.StatusNotFound)
+		return
+	}
+
+	var desc webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&desc); err != nil {
+		http.Error(w, "Invalid session description", http.StatusBadRequest)
+		return
+	}
+	answer, err := renegotiatePeer(p, desc)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if answer == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// ID of a recording: the stream name and the time it started
+var recordingIDPattern = regexp.MustCompile(`^([A-Za-z0-9._-]{1,64})-[0-9]{8}-[0-9]{6}$`)
+
+var replayLog = newLogger("replay")
+
+// Frame of a recorded track and its time from the start of the track
+type replayFrame struct {
+	at   time.Duration
+	data []byte
+}
+
+// Frames of a recorded track in order, io.EOF after the last one
+type replaySource interface {
+	next() (replayFrame, error)
+}
+
+// Recorded track and when it started on the recording's timeline
+type replayTrack struct {
+	id     string
+	offset time.Duration
+	codec  webrtc.RTPCodecCapability
+	kind   webrtc.RTPCodecType
+	source replaySource
+}
+
+// A recording loaded for replay: its tracks and data channel messages,
+// both placed by their offset from the start of the recording
+type replay struct {
+	id       string
+	stream   string
+	tracks   []*replayTrack
+	messages []recordingEvent
+	files    []io.ReadCloser
+}
+
+// Open the media files and read the sidecar of a recording
+func loadReplay(id string) (*replay, error) {
+	match := recordingIDPattern.FindStringSubmatch(id)
+	if match == nil {
+		return nil, newSignalingError(http.StatusBadRequest, "Invalid recording ID")
+	}
+	events, err := media.open(id + "-events.jsonl")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, newSignalingError(http.StatusNotFound, "Recording not found")
+	} else if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+
+	rp := &replay{id: id, stream: match[1]}
+	scanner := bufio.NewScanner(events)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e recordingEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			rp.close()
+			return nil, fmt.Errorf("reading sidecar of recording %s: %w", id, err)
+		}
+		switch e.Type {
+		case "track":
+			if err := rp.open(e); err != nil {
+				rp.close()
+				return nil, err
+			}
+		case "message":
+			rp.messages = append(rp.messages, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		rp.close()
+		return nil, err
+	}
+	if len(rp.tracks) == 0 {
+		return nil, newSignalingError(http.StatusUnprocessableEntity, "Recording has no media")
+	}
+	return rp, nil
+}
+
+// Open the media file of a "track" event
+func (rp *replay) open(e recordingEvent) error {
+	if e.File != filepath.Base(e.File) {
+		return fmt.Errorf("invalid file %q in recording %s", e.File, rp.id)
+	}
+	f, err := media.open(e.File)
+	if err != nil {
+		return err
+	}
+	rp.files = append(rp.files, f)
+
+	offset := time.Duration(e.OffsetMs * float64(time.Millisecond))
+	id, _, _ := strings.Cut(e.Track, ":")
+	switch filepath.Ext(e.File) {
+	case ".ivf":
+		source, err := newIVFSource(f)
+		if err != nil {
+			return err
+		}
+		rp.tracks = append(rp.tracks, &replayTrack{id: id, offset: offset, codec: replayCodec(webrtc.MimeTypeVP8), kind: webrtc.RTPCodecTypeVideo, source: source})
+	case ".ogg":
+		source, err := newOggSource(f)
+		if err != nil {
+			return err
+		}
+		rp.tracks = append(rp.tracks, &replayTrack{id: id, offset: offset, codec: replayCodec(webrtc.MimeTypeOpus), kind: webrtc.RTPCodecTypeAudio, source: source})
+	case ".webm":
+		tracks, err := webmTracks(f)
+		if err != nil {
+			return err
+		}
+		for _, t := range tracks {
+			t.offset = offset
+		}
+		rp.tracks = append(rp.tracks, tracks...)
+	case ".h264":
+		// Annex B streams carry no timing to replay them at
+		replayLog.debugf("Skipping %s, H264 recordings are not replayed.", e.File)
+	default:
+		return fmt.Errorf("cannot replay %s", e.File)
+	}
+	return nil
+}
+
+func (rp *replay) close() {
+	for _, f := range rp.files {
+		f.Close()
+	}
+}
+
+// Codec of replayed tracks, as the recorder only writes VP8 and Opus
+func replayCodec(mimeType string) webrtc.RTPCodecCapability {
+	if mimeType == webrtc.MimeTypeOpus {
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	}
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+}
+
+// Frames of an IVF file. The recorder counts frames rather than keeping
+// their capture time, so they are paced by the file's time base.
+type ivfSource struct {
+	reader   *ivfreader.IVFReader
+	timebase time.Duration
+}
+
+func newIVFSource(r io.Reader) (*ivfSource, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, errors.New("IVF file has no time base")
+	}
+	timebase := time.Duration(header.TimebaseNumerator) * time.Second / time.Duration(header.TimebaseDenominator)
+	return &ivfSource{reader: reader, timebase: timebase}, nil
+}
+
+func (s *ivfSource) next() (replayFrame, error) {
+	data, header, err := s.reader.ParseNextFrame()
+	if err != nil {
+		return replayFrame{}, err
+	}
+	return replayFrame{at: time.Duration(header.Timestamp) * s.timebase, data: data}, nil
+}
+
+// Packets of an Ogg Opus file, one per page as the recorder writes them,
+// placed by their granule position
+type oggSource struct {
+	reader *oggreader.OggReader
+}
+
+func newOggSource(r io.Reader) (*oggSource, error) {
+	reader, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	return &oggSource{reader: reader}, nil
+}
+
+func (s *oggSource) next() (replayFrame, error) {
+	for {
+		data, header, err := s.reader.ParseNextPage()
+		if err != nil {
+			return replayFrame{}, err
+		}
+		if bytes.HasPrefix(data, []byte("OpusTags")) {
+			continue
+		}
+		return replayFrame{at: time.Duration(header.GranulePosition) * time.Second / 48000, data: data}, nil
+	}
+}
+
+// Frames of one track of a WebM file, read into memory whole
+type webmSource struct {
+	frames []replayFrame
+}
+
+func (s *webmSource) next() (replayFrame, error) {
+	if len(s.frames) == 0 {
+		return replayFrame{}, io.EOF
+	}
+	frame := s.frames[0]
+	s.frames = s.frames[1:]
+	return frame, nil
+}
+
+// Tracks of a WebM file written by the recorder
+func webmTracks(r io.Reader) ([]*replayTrack, error) {
+	var file struct {
+		Header  webm.EBMLHeader `ebml:"EBML"`
+		Segment webm.Segment    `ebml:"Segment"`
+	}
+	if err := ebml.Unmarshal(r, &file); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	scale := time.Duration(file.Segment.Info.TimecodeScale)
+	if scale == 0 {
+		scale = time.Millisecond
+	}
+	sources := make(map[uint64]*webmSource)
+	var tracks []*replayTrack
+	for _, entry := range file.Segment.Tracks.TrackEntry {
+		t := &replayTrack{id: strings.ToLower(entry.Name)}
+		switch entry.CodecID {
+		case "V_VP8":
+			t.codec, t.kind = replayCodec(webrtc.MimeTypeVP8), webrtc.RTPCodecTypeVideo
+		case "A_OPUS":
+			t.codec, t.kind = replayCodec(webrtc.MimeTypeOpus), webrtc.RTPCodecTypeAudio
+		default:
+			continue
+		}
+		source := &webmSource{}
+		t.source = source
+		sources[entry.TrackNumber] = source
+		tracks = append(tracks, t)
+	}
+
+	for _, cluster := range file.Segment.Cluster {
+		for _, block := range cluster.SimpleBlock {
+			source, ok := sources[block.TrackNumber]
+			if !ok {
+				continue
+			}
+			at := time.Duration(int64(cluster.Timecode)+int64(block.Timecode)) * scale
+			for _, data := range block.Data {
+				source.frames = append(source.frames, replayFrame{at: at, data: data})
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// Play the recording on a stream as its publisher, with the original timing
+// of media and data channel messages. Ends when everything was played or
+// another publisher takes over.
+func (rp *replay) start(stream string, owner *account) (*Publisher, error) {
+	room := getOrCreateRoom(stream)
+	publisher := newLocalPublisher(stream, owner)
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	fanouts := make([]*trackFanout, len(rp.tracks))
+	for i, t := range rp.tracks {
+		fanouts[i] = publisher.addFanout(newTrackFanout(t.codec, t.id, "replay", "", t.kind), 0)
+	}
+
+	if room.getPublisher() != nil {
+		room.removeIfEmpty()
+		return nil, newSignalingError(http.StatusConflict, "Stream is live")
+	}
+	room.setPublisher(publisher)
+
+	start := time.Now()
+	done := make(chan struct{}, len(rp.tracks)+1)
+	for i, t := range rp.tracks {
+		go func() {
+			rp.playTrack(room, publisher, fanouts[i], t, start, r.Uint32(), r.Uint32())
+			done <- struct{}{}
+		}()
+	}
+	go func() {
+		rp.playMessages(room, publisher, start)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		for range len(rp.tracks) + 1 {
+			<-done
+		}
+		rp.close()
+		for _, t := range fanouts {
+			room.unpublishTrack(publisher, t)
+		}
+		publisher.endStream.Store(true)
+		room.closePublisher(publisher)
+		publisher.log(replayLog).infof("[publisher %s] Replay of %s ended after %v.", publisher.id, rp.id, time.Since(start).Round(time.Second))
+	}()
+
+	publisher.log(replayLog).infof("[publisher %s] Replaying %s, %d tracks and %d messages.", publisher.id, rp.id, len(rp.tracks), len(rp.messages))
+	return publisher, nil
+}
+
+// Wait until an offset of the replay's timeline, false when the publisher
+// was closed meanwhile
+func waitReplay(publisher *Publisher, start time.Time, offset time.Duration) bool {
+	timer := time.NewTimer(time.Until(start.Add(offset)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-publisher.done:
+		return false
+	}
+}
+
+func (rp *replay) playTrack(room *Room, publisher *Publisher, fanout *trackFanout, t *replayTrack, start time.Time, ssrc, timestamp uint32) {
+	var payloader rtp.Payloader = &codecs.OpusPayloader{}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	}
+	packetizer := rtp.NewPacketizer(localPublisherMTU, 0, ssrc, payloader, rtp.NewRandomSequencer(), t.codec.ClockRate)
+
+	for {
+		frame, err := t.source.next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				replayLog.withStream(room.name).errorf("Error reading track %s of %s: %v", t.id, rp.id, err)
+			}
+			return
+		}
+		if !waitReplay(publisher, start, t.offset+frame.at) {
+			return
+		}
+
+		ts := timestamp + uint32(frame.at.Seconds()*float64(t.codec.ClockRate))
+		for _, packet := range packetizer.Packetize(frame.data, 0) {
+			packet.Timestamp = ts
+			if err := room.publishRTP(publisher, fanout, packet); err != nil {
+				replayLog.withStream(room.name).errorf("Error writing track %s of %s: %v", t.id, rp.id, err)
+				return
+			}
+		}
+	}
+}
+
+// Send the recorded messages to the viewers' data channels of the same label
+func (rp *replay) playMessages(room *Room, publisher *Publisher, start time.Time) {
+	sort.SliceStable(rp.messages, func(i, j int) bool { return rp.messages[i].OffsetMs < rp.messages[j].OffsetMs })
+	for _, e := range rp.messages {
+		if !waitReplay(publisher, start, time.Duration(e.OffsetMs*float64(time.Millisecond))) {
+			return
+		}
+		msg := webrtc.DataChannelMessage{IsString: e.Binary == nil, Data: e.Binary}
+		if msg.IsString {
+			msg.Data = []byte(e.Text)
+		}
+		for _, v := range room.getViewers() {
+			v.sendData(e.Label, msg)
+		}
+	}
+}
+
+// Handler for POST /api/recordings/{id}/replay, playing a recording on the
+// stream named by {"stream":"name"}, "replay-<id>" by default. Needs the
+// right to manage the recorded stream and to publish to the new one, with
+// its publish token and stream key.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	match := recordingIDPattern.FindStringSubmatch(id)
+	if match == nil {
+		http.Error(w, "Invalid recording ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Stream string `json:"stream"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Stream == "" {
+		req.Stream = "replay-" + id
+	}
+	if !streamNamePattern.MatchString(req.Stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+
+	a := currentAccount(r)
+	if err := authorizeStream(a, match[1], actionManage); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	key, a, err := authorizePublisher(publishToken(r), streamKeyParam(r), req.Stream, a)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	rp, err := loadReplay(id)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	publisher, err := rp.start(req.Stream, a)
+	if err != nil {
+		rp.close()
+		writeSignalingError(w, err)
+		return
+	}
+	trackStreamKey(key, req.Stream, publisher)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        publisher.id,
+		"recording": rp.id,
+		"stream":    req.Stream,
+		"tracks":    len(rp.tracks),
+		"messages":  len(rp.messages),
+	})
+}
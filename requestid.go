@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+// Header carrying the correlation ID of a request, taken from the client or a
+// proxy when it sends one and set on every response
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// Give every request a correlation ID, logged as "request" by the module
+// loggers of its handlers and of the peers it sets up, so the lines of one
+// session can be picked out of interleaved output
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Correlation ID of a request, empty outside of withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
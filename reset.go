@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Files of recordings, storyboards and events included, named after the
+// recording's stream and start time
+var recordingFilePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}-[0-9]{8}-[0-9]{6}([-.]|$)`)
+
+var resetLog = newLogger("reset")
+
+// What POST /api/admin/reset tore down
+type resetResult struct {
+	Sockets    int `json:"sockets"`
+	Publishers int `json:"publishers"`
+	Viewers    int `json:"viewers"`
+	// Other sessions, like bandwidth and data channel tests
+	Sessions   int `json:"sessions"`
+	Egresses   int `json:"egresses"`
+	Recordings int `json:"recordingFilesRemoved"`
+}
+
+// Handler for POST /api/admin/reset, returning the instance to the state it
+// started in for automated test suites, without restarting it: signaling
+// sockets get {"type":"reset"} and are closed, every publisher, viewer and
+// other session is disconnected, outputs, ingests and prewarmed connections
+// are stopped, the files of finished recordings are removed unless
+// ?keepRecordings=true, and counters, stats histories and test results are
+// cleared. Accounts, stream keys, stream metadata and rules are kept.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if services.isStopping() {
+		writeSignalingError(w, errShuttingDown)
+		return
+	}
+	var res resetResult
+
+	// Outputs and ingests first, so nothing starts again as peers leave
+	egressesMu.Lock()
+	for _, list := range egresses {
+		res.Egresses += len(list)
+	}
+	egressesMu.Unlock()
+	stopEgresses()
+	stopRestreams()
+	stopExternalForwards()
+	stopHLSPipelines()
+	stopRTSPSources()
+	stopRTPIngests()
+	stopPrewarming()
+	stopLoadTests()
+	stopCertifications()
+	stopRecordings()
+
+	wsSessionsMu.Lock()
+	sockets := make([]*wsSession, 0, len(wsSessions))
+	for s := range wsSessions {
+		sockets = append(sockets, s)
+	}
+	wsSessionsMu.Unlock()
+	for _, s := range sockets {
+		s.send(signalMessage{Type: "reset"})
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Server reset"), time.Now().Add(time.Second))
+		s.conn.Close()
+	}
+	res.Sockets = len(sockets)
+
+	for _, room := range listRooms() {
+		for _, v := range room.getViewers() {
+			room.closeViewer(v)
+			res.Viewers++
+		}
+		for _, p := range room.getCohosts() {
+			room.closePublisher(p)
+			res.Publishers++
+		}
+		if p := room.getPublisher(); p != nil {
+			p.endStream.Store(true)
+			room.closePublisher(p)
+			res.Publishers++
+		}
+	}
+	peersMu.Lock()
+	rest := make([]*peer, 0, len(peers))
+	for _, p := range peers {
+		rest = append(rest, p)
+	}
+	peersMu.Unlock()
+	for _, p := range rest {
+		p.close(func() {})
+		res.Sessions++
+	}
+
+	if r.URL.Query().Get("keepRecordings") != "true" {
+		res.Recordings = removeRecordingFiles()
+	}
+	resetCounters()
+
+	resetLog.infof("Reset: %d sockets, %d publishers, %d viewers, %d other sessions and %d outputs closed, %d recording files removed.",
+		res.Sockets, res.Publishers, res.Viewers, res.Sessions, res.Egresses, res.Recordings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Remove the files of recordings from media storage, leaving anything else
+// there alone, and return how many were removed. Recordings still being
+// written, of a publisher that connected meanwhile, are kept.
+func removeRecordingFiles() int {
+	names, err := media.list()
+	if err != nil {
+		resetLog.warnf("Error listing recordings: %v", err)
+		return 0
+	}
+	active := activeRecordings()
+	removed := 0
+	for _, name := range names {
+		match := recordingFilePattern.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		if active[name[:match[2]]] {
+			resetLog.debugf("Kept %s, still being recorded.", name)
+			continue
+		}
+		if err := media.remove(name); err != nil {
+			resetLog.warnf("Error removing %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// Clear the metrics, stats histories and results kept by this instance
+func resetCounters() {
+	admissionsRejected.Store(0)
+	layerPrunes.Store(0)
+	prunedTracksMu.Lock()
+	prunedTracks = make(map[*viewerTrack]prunedTrack)
+	prunedTracksMu.Unlock()
+	summariesMu.Lock()
+	for _, s := range summaries {
+		s.reset()
+	}
+	summariesMu.Unlock()
+
+	pliStatsMu.Lock()
+	pliStats = make(map[string]*pliCounters)
+	pliStatsMu.Unlock()
+
+	latency.mu.Lock()
+	latency.viewers = make(map[string]*viewerLatency)
+	latency.regions = make(map[string][]float64)
+	latency.mu.Unlock()
+
+	audience.mu.Lock()
+	audience.streams = make(map[string]*streamAudience)
+	audience.mu.Unlock()
+
+	statsHistoriesMu.Lock()
+	statsHistories = make(map[string]*statsHistory)
+	statsHistoriesMu.Unlock()
+
+	dataTestsMu.Lock()
+	dataTests = make(map[string]*dataTest)
+	dataTestsMu.Unlock()
+
+	loadTestsMu.Lock()
+	loadTests = make(map[string]*loadTest)
+	loadTestsMu.Unlock()
+
+	transfersMu.Lock()
+	transfers = make(map[string]*viewerTransfer)
+	transfersMu.Unlock()
+
+	certificationsMu.Lock()
+	certifications = make(map[string]*certification)
+	certificationsMu.Unlock()
+
+	// Rooms kept by their outputs or ingests
+	for _, room := range listRooms() {
+		in := &room.interactions
+		in.mu.Lock()
+		in.reactions, in.hands, in.buckets, in.changed = nil, nil, nil, false
+		in.mu.Unlock()
+	}
+
+	streamUsagesMu.Lock()
+	streamUsages, streamUsageTime = nil, time.Time{}
+	streamUsagesMu.Unlock()
+}
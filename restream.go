@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How often a restream checks whether its stream went live or ended
+	restreamCheckInterval = 2 * time.Second
+
+	// Wait before starting ffmpeg again after it exited on its own
+	restreamRetryDelay = 10 * time.Second
+)
+
+var restreamLog = newLogger("restream")
+
+var (
+	restreams   = make(map[string]*restream)
+	restreamsMu sync.Mutex
+)
+
+// Container formats a stream can be pushed in
+const (
+	// FLV over RTMP, for YouTube, Twitch and the like
+	restreamFLV = "flv"
+	// MPEG-TS over UDP, TCP or SRT, for broadcast gear and media servers
+	restreamMPEGTS = "mpegts"
+)
+
+// Pushes a stream to an external endpoint such as YouTube or Twitch
+// whenever it is live, until stopped. Its tracks are forwarded as RTP to an
+// ffmpeg that muxes them as FLV or MPEG-TS.
+type restream struct {
+	stream  string
+	url     string
+	format  string
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu        sync.Mutex
+	running   bool
+	since     time.Time
+	lastError string
+}
+
+// State of a restream as returned by the API, with the stream key hidden
+type restreamStatus struct {
+	Stream    string     `json:"stream"`
+	Enabled   bool       `json:"enabled"`
+	URL       string     `json:"url,omitempty"`
+	Running   bool       `json:"running"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// The ffmpeg pushing one publishing session of the stream
+type restreamOutput struct {
+	room    *Room
+	forward *rtpForward
+	ffmpeg  *ffmpegProcess
+	sdpPath string
+}
+
+func startRestream(stream, target, format string) *restream {
+	s := &restream{stream: stream, url: target, format: format, done: make(chan struct{}), stopped: make(chan struct{})}
+	go s.run()
+	restreamLog.withStream(stream).infof("Restreaming to %s.", s.redactedURL())
+	return s
+}
+
+// Stop the restream and wait for its ffmpeg to exit
+func (s *restream) stop() {
+	close(s.done)
+	<-s.stopped
+	restreamLog.withStream(s.stream).infof("Restream to %s stopped.", s.redactedURL())
+}
+
+// Start ffmpeg while the stream is live and stop it once it ends, retrying
+// after a delay when ffmpeg exits on its own
+func (s *restream) run() {
+	defer close(s.stopped)
+	tick := time.NewTicker(restreamCheckInterval)
+	defer tick.Stop()
+
+	var out *restreamOutput
+	var retry time.Time
+	for {
+		if room := getRoom(s.stream); out != nil && (room != out.room || room.getPublisher() == nil) {
+			restreamLog.withStream(s.stream).infof("Stream ended, waiting for it to go live again.")
+			out.stop()
+			out = nil
+			s.setRunning(false, "")
+		}
+		if room := getRoom(s.stream); out == nil && room != nil && room.getPublisher() != nil && time.Now().After(retry) {
+			var err error
+			if out, err = startRestreamOutput(room, s.url, s.format); err != nil {
+				restreamLog.withStream(s.stream).errorf("Error starting restream: %v", err)
+				s.setRunning(false, err.Error())
+				retry = time.Now().Add(restreamRetryDelay)
+			} else {
+				restreamLog.withStream(s.stream).infof("Stream live, started ffmpeg.")
+				s.setRunning(true, "")
+			}
+		}
+
+		var exited <-chan struct{}
+		if out != nil {
+			exited = out.ffmpeg.exited()
+		}
+		select {
+		case <-tick.C:
+		case <-exited:
+			restreamLog.withStream(s.stream).warnf("ffmpeg exited, restarting in %v.", restreamRetryDelay)
+			out.stop()
+			out = nil
+			s.setRunning(false, "ffmpeg exited")
+			retry = time.Now().Add(restreamRetryDelay)
+		case <-s.done:
+			if out != nil {
+				out.stop()
+			}
+			return
+		}
+	}
+}
+
+// Stop all restreams, on shutdown
+func stopRestreams() {
+	restreamsMu.Lock()
+	defer restreamsMu.Unlock()
+	for stream, s := range restreams {
+		s.stop()
+		delete(restreams, stream)
+	}
+}
+
+func (s *restream) setRunning(running bool, lastError string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if running && !s.running {
+		s.since = time.Now()
+	}
+	s.running = running
+	if lastError != "" || running {
+		s.lastError = lastError
+	}
+}
+
+func (s *restream) status() restreamStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := restreamStatus{Stream: s.stream, Enabled: true, URL: s.redactedURL(), Running: s.running, LastError: s.lastError}
+	if s.running {
+		since := s.since
+		st.Since = &since
+	}
+	return st
+}
+
+func startRestreamOutput(room *Room, target, format string) (*restreamOutput, error) {
+	videoAddr, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	audioAddr, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	forward, err := newRTPForward(room, videoAddr, audioAddr)
+	if err != nil {
+		return nil, err
+	}
+	out := &restreamOutput{room: room, forward: forward}
+
+	f, err := os.CreateTemp("", "sfu-restream-*.sdp")
+	if err != nil {
+		forward.close()
+		return nil, err
+	}
+	out.sdpPath = f.Name()
+	_, err = f.WriteString(forward.sdp())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		forward.close()
+		os.Remove(out.sdpPath)
+		return nil, err
+	}
+
+	// FLV carries H264 and AAC, anything else is transcoded, and H264 too
+	// with the transcoding feature. MPEG-TS gets the same to play everywhere.
+	args := []string{"-protocol_whitelist", "file,udp,rtp", "-i", out.sdpPath}
+	switch video := forward.mimeType(webrtc.RTPCodecTypeVideo); {
+	case video == "":
+	case strings.EqualFold(video, webrtc.MimeTypeH264) && !featureEnabled(featureTranscoding):
+		args = append(args, "-c:v", "copy")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-g", "60")
+	}
+	if forward.mimeType(webrtc.RTPCodecTypeAudio) != "" {
+		args = append(args, "-c:a", "aac", "-ar", "44100", "-b:a", "128k")
+	}
+	args = append(args, "-f", format, target)
+
+	if out.ffmpeg, err = startFFmpeg(room.name, args...); err != nil {
+		forward.close()
+		os.Remove(out.sdpPath)
+		return nil, err
+	}
+	room.addSink(forward)
+
+	time.AfterFunc(ffmpegInputDelay, func() {
+		if publisher := room.getPublisher(); publisher != nil {
+			publisher.requestKeyframe()
+		}
+	})
+	return out, nil
+}
+
+func (o *restreamOutput) stop() {
+	o.room.removeSink(o.forward)
+	o.forward.close()
+	o.ffmpeg.stop()
+	os.Remove(o.sdpPath)
+}
+
+// Restream URLs end with the stream key, which is left out of logs and
+// responses
+func redactRestreamURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	dir := path.Dir(u.Path)
+	if dir == "." || dir == "/" {
+		dir = ""
+	}
+	return u.Scheme + "://" + u.Host + dir + "/***"
+}
+
+func (s *restream) redactedURL() string {
+	if s.format == restreamMPEGTS {
+		return redactMPEGTSURL(s.url)
+	}
+	return redactRestreamURL(s.url)
+}
+
+// SRT URLs carry their passphrase and stream ID in the query, which is left
+// out
+func redactMPEGTSURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	redacted := u.Scheme + "://" + u.Host + u.Path
+	if u.RawQuery != "" {
+		redacted += "?***"
+	}
+	return redacted
+}
+
+func validMPEGTSURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "udp" || u.Scheme == "tcp" || u.Scheme == "srt") && u.Host != "" && len(target) <= 2048
+}
+
+func validRestreamURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "rtmp" || u.Scheme == "rtmps") && u.Host != "" && len(target) <= 2048
+}
+
+// Handler for POST /api/streams/{stream}/restream, for the stream's owner:
+// {"action": "start", "url": "rtmp://a.rtmp.youtube.com/live2/KEY"} pushes
+// the stream to the URL whenever it is live, {"action": "stop"} ends that.
+func restreamHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	var req struct {
+		Action string `json:"action"`
+		URL    string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	restreamsMu.Lock()
+	defer restreamsMu.Unlock()
+
+	s := restreams[stream]
+	switch req.Action {
+	case "start":
+		if !validRestreamURL(req.URL) {
+			http.Error(w, "Invalid restream URL, expected rtmp:// or rtmps://", http.StatusBadRequest)
+			return
+		}
+		if s != nil && s.url != req.URL {
+			s.stop()
+			s = nil
+		}
+		if s == nil {
+			s = startRestream(stream, req.URL, restreamFLV)
+			restreams[stream] = s
+		}
+	case "stop":
+		if s == nil {
+			http.Error(w, "Stream is not restreamed", http.StatusNotFound)
+			return
+		}
+		s.stop()
+		delete(restreams, stream)
+		s = nil
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	status := restreamStatus{Stream: stream}
+	if s != nil {
+		status = s.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,88 @@
+package main
+
+import "time"
+
+// How long a stream whose publisher dropped stays live for a publisher to
+// continue it, from -publisher-grace
+var publisherGrace = 30 * time.Second
+
+// Stream whose publisher dropped, waiting for it or another publisher of the
+// stream to come back. Viewers keep their connections meanwhile and are fed
+// by the next publisher as on a takeover, the rewriter of each viewer track
+// continuing the sequence numbers and timestamps.
+type streamGrace struct {
+	publisher *Publisher
+	since     time.Time
+	timer     *time.Timer
+}
+
+// Keep the stream live after its publisher p left, unless it was kicked,
+// replaced by nobody on a reset or the server is stopping. Returns false when
+// the stream ends right away.
+func (r *Room) holdForPublisher(p *Publisher) bool {
+	if publisherGrace <= 0 || p.endStream.Load() || services.isStopping() {
+		return false
+	}
+	g := &streamGrace{publisher: p, since: time.Now()}
+	r.mu.Lock()
+	r.grace = g
+	g.timer = time.AfterFunc(publisherGrace, func() { r.graceEnded(g) })
+	r.mu.Unlock()
+
+	if !p.reconnecting.Swap(true) {
+		go r.events.notify(r, streamNotice{Type: "publisher-reconnecting", Publisher: p.displayID})
+	}
+	p.log(roomLog).infof("[publisher %s] Left, stream waits %v for it to publish again.", p.id, publisherGrace)
+	return true
+}
+
+// End the stream once nobody continued it in time
+func (r *Room) graceEnded(g *streamGrace) {
+	r.mu.Lock()
+	ended := r.grace == g
+	if ended {
+		r.grace = nil
+	}
+	r.mu.Unlock()
+	if !ended {
+		return
+	}
+	g.publisher.log(roomLog).infof("[publisher %s] Not back within %v, stream ended.", g.publisher.id, publisherGrace)
+	r.streamEnded(g.publisher)
+}
+
+// Whether p continues the stream of a publisher that dropped, rather than
+// starting it
+func (r *Room) resumeStream(p *Publisher) bool {
+	r.mu.Lock()
+	g := r.grace
+	r.grace = nil
+	if g != nil {
+		g.timer.Stop()
+	}
+	r.mu.Unlock()
+	if g == nil {
+		return false
+	}
+	p.log(roomLog).infof("[publisher %s] Resumed the stream of publisher %s after %v.", p.id, g.publisher.id, time.Since(g.since).Round(time.Millisecond))
+	return true
+}
+
+// Tell the rules' webhooks and the viewers that the stream of p ended
+func (r *Room) streamEnded(p *Publisher) {
+	go streamChanged(r.name, "stream.ended", p)
+	go func() {
+		r.events.notify(r, streamNotice{Type: "stream-ended", Publisher: p.displayID})
+		r.failover()
+		r.failoverDependents()
+	}()
+}
+
+// How long the recording of a publisher that left waits for the next one
+func recordingHold() time.Duration {
+	hold := publisherGrace
+	if inputSwitching && inputSwitchHold > hold {
+		hold = inputSwitchHold
+	}
+	return hold
+}
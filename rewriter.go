@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Maps the sequence numbers and timestamps of the packets forwarded to a
+// viewer onto one continuous sequence, whichever publisher they come from.
+// Whenever the source SSRC changes the offsets are recomputed so the next
+// packet follows the last one sent, advanced by the wall clock time passed.
+type rtpRewriter struct {
+	clockRate uint32
+
+	started    bool
+	sourceSSRC uint32
+	seqOffset  uint16
+	tsOffset   uint32
+
+	lastSeq  uint16
+	lastTS   uint32
+	lastSent time.Time
+}
+
+func (r *rtpRewriter) rewrite(h *rtp.Header) {
+	now := time.Now()
+	if !r.started {
+		r.started = true
+		r.sourceSSRC = h.SSRC
+	} else if h.SSRC != r.sourceSSRC {
+		r.sourceSSRC = h.SSRC
+		r.seqOffset = r.lastSeq + 1 - h.SequenceNumber
+
+		elapsed := uint32(now.Sub(r.lastSent).Seconds() * float64(r.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.tsOffset = r.lastTS + elapsed - h.Timestamp
+	}
+
+	h.SequenceNumber += r.seqOffset
+	h.Timestamp += r.tsOffset
+
+	// Only move forward, retransmitted or reordered packets keep their place
+	if r.lastSent.IsZero() || int16(h.SequenceNumber-r.lastSeq) > 0 {
+		r.lastSeq = h.SequenceNumber
+		r.lastTS = h.Timestamp
+		r.lastSent = now
+	}
+}
+
+// Leave out a packet of the current source, the next one takes its sequence
+// number so the viewer sees no loss. Packets of another source are left to
+// the offsets recomputed on its first forwarded packet.
+func (r *rtpRewriter) drop(h *rtp.Header) {
+	if !r.started || h.SSRC != r.sourceSSRC {
+		return
+	}
+	if int16(h.SequenceNumber+r.seqOffset-r.lastSeq) > 0 {
+		r.seqOffset--
+	}
+}
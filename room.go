@@ -0,0 +1,708 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Stream used by clients that don't name one
+const defaultStream = "default"
+
+// Header of the answer to an HTTP offer carrying the peer's secret
+const peerSecretHeader = "X-Peer-Secret"
+
+var roomLog = newLogger("room")
+
+var streamNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var (
+	// Rooms by stream name
+	rooms   = make(map[string]*Room)
+	roomsMu sync.Mutex
+
+	// Publishers and viewers by peer ID, for the signaling endpoints
+	peers   = make(map[string]*peer)
+	peersMu sync.Mutex
+)
+
+// State shared by publishers and viewers: the PeerConnection and the ICE
+// candidates exchanged with the client. Publishers fed by the
+// server itself, like replays, have no PeerConnection.
+type peer struct {
+	id      string
+	role    string
+	stream  string
+	pc      *webrtc.PeerConnection
+	done    chan struct{}
+	created time.Time
+	// Correlation ID of the signaling request that set the peer up
+	request string
+	// Shown for the peer to others, in chat and stream events, where the
+	// ID, which authorizes requests about the peer, must not be
+	displayID string
+	// Handed out with the ID to the client alone, which HTTP requests about
+	// the peer must present, see authorizedPeer
+	secret string
+
+	iceMutex      sync.Mutex
+	iceCandidates []webrtc.ICECandidateInit
+	// Whether gathering completed, and the /events streams following the
+	// peer, which get the candidates instead of the queue
+	gathered  bool
+	eventSubs map[chan peerEvent]struct{}
+
+	remoteCandidatesMtx     sync.Mutex
+	pendingRemoteCandidates []webrtc.ICECandidateInit // to store early remote candidates coming when remote description is not ready
+
+	// RTCP the PeerConnection sent and received, set once it is a peer
+	feedback atomic.Pointer[rtcpFeedback]
+
+	// Held while an offer or answer is applied, see renegotiatePeer
+	negotiationMu sync.Mutex
+	// Last time the watchdog found the PeerConnection connected, in Unix
+	// nanoseconds, 0 before it did
+	lastSeen atomic.Int64
+
+	closeOnce sync.Once
+}
+
+// Publisher of a room and the local tracks its media is forwarded to
+type Publisher struct {
+	*peer
+
+	// Logged in user publishing, nil when accounts are disabled
+	owner *account
+	// Where the publisher's media comes from
+	source ingest
+	// Whether the publisher sends no media, only data channels relayed to
+	// its viewers, see parseDataOnly
+	dataOnly bool
+	channels dataChannels
+	// Whether the publisher joined another's stream, see parseCohost
+	cohost bool
+	// Codecs the publisher asked to send with ?codec=, see peerOverrides
+	codecs []string
+	// Kinds of tracks muted by an admin, see muteHandler
+	mutedAudio, mutedVideo atomic.Bool
+	// Whether the publisher's connection is interrupted, and whether the
+	// stream ends once it leaves rather than waiting for it, see
+	// holdForPublisher
+	reconnecting, endStream atomic.Bool
+
+	// Local tracks by the ID of the publisher's track, e.g. camera, screen
+	// share and microphone, and by ID and RID for each simulcast layer
+	trackMutex sync.Mutex
+	tracks     map[string]*trackFanout
+	// SSRCs of the publisher's video tracks, for keyframe requests
+	videoSSRCs map[string]webrtc.SSRC
+	pli        pliThrottle
+
+	// Recording of the publisher's tracks, nil when not recording
+	recordingMu sync.Mutex
+	recording   *recording
+}
+
+// Viewer attached to a room's publisher
+type Viewer struct {
+	*peer
+
+	// Logged in user viewing, nil for anonymous viewers
+	account *account
+
+	// Outbound tracks, one per publisher track the viewer subscribed to,
+	// more are added as the publisher adds tracks
+	tracksMu sync.Mutex
+	tracks   []*viewerTrack
+	// Whether tracks were added while the last offer was out
+	offerPending atomic.Bool
+	// One in how many video frames the viewer gets, see frameDecimator
+	decimation atomic.Int32
+	// Lowest VP8 temporal layers the viewer gets, 0 for all
+	temporalLayers atomic.Int32
+	// Whether the viewer asked for no video, see peerOverrides
+	audioOnly bool
+
+	// Data channels the viewer opened, replays and data-only publishers send
+	// messages on them
+	channels dataChannels
+
+	startup *viewerStartup
+
+	identityMu sync.Mutex
+	ident      viewerIdentity
+	// Viewer whose session this one takes over once connected, see takeOver
+	transferredFrom atomic.Pointer[Viewer]
+}
+
+// Who a viewer counts as in analytics and the token it joined with, kept
+// when its session moves to another device
+type viewerIdentity struct {
+	analyticsID string
+	token       string
+}
+
+func (v *Viewer) getTracks() []*viewerTrack {
+	v.tracksMu.Lock()
+	defer v.tracksMu.Unlock()
+	return append([]*viewerTrack(nil), v.tracks...)
+}
+
+func (v *Viewer) identity() viewerIdentity {
+	v.identityMu.Lock()
+	defer v.identityMu.Unlock()
+	if v.ident.analyticsID == "" {
+		return viewerIdentity{analyticsID: v.id, token: v.ident.token}
+	}
+	return v.ident
+}
+
+func (v *Viewer) setIdentity(id viewerIdentity) {
+	v.identityMu.Lock()
+	v.ident = id
+	v.identityMu.Unlock()
+}
+
+// Room owns the publisher of a stream, its viewers and their lifecycle
+type Room struct {
+	name    string
+	created time.Time
+
+	mu        sync.Mutex
+	publisher *Publisher
+	cohosts   []*Publisher
+	viewers   map[string]*Viewer
+	// Set while the stream waits for its publisher to come back
+	grace *streamGrace
+
+	// Consumers of the publisher's packets other than viewers, kept across
+	// publisher takeovers
+	sinksMu sync.RWMutex
+	sinks   []packetSink
+
+	// Components following the publisher's tracks, see trackSubscriber
+	subscribersMu sync.Mutex
+	subscribers   []trackSubscriber
+
+	// RTP bytes received from the publishers and sent to the viewers
+	bytesIn, bytesOut atomic.Uint64
+
+	interactions roomInteractions
+	chat         roomChat
+	events       roomEvents
+	capture      captureRing
+}
+
+// Gets every packet of the room's current publisher. Sinks implementing
+// trackSubscriber are subscribed to the room's tracks while added.
+type packetSink interface {
+	writeRTP(t *trackFanout, packet *rtp.Packet)
+}
+
+// Stream name from the request, defaultStream when omitted
+func streamName(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("stream")
+	if name == "" {
+		return defaultStream, nil
+	}
+	if !streamNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid stream name %q", name)
+	}
+	return name, nil
+}
+
+// Random identifier for peers
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Secret of a peer, longer than its ID, as it is the one proving a request
+// comes from the peer's client
+func newPeerSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newPeer(role, stream, request string, pc *webrtc.PeerConnection) *peer {
+	p := &peer{id: newID(), displayID: newID(), secret: newPeerSecret(), role: role, stream: stream, request: request, pc: pc, done: make(chan struct{}), created: time.Now()}
+
+	peersMu.Lock()
+	peers[p.id] = p
+	peersMu.Unlock()
+	p.saveRecord()
+
+	collectStats(p)
+	return p
+}
+
+// Module logger bound to the peer, its stream and the request that set it up
+func (p *peer) log(l moduleLogger) moduleLogger {
+	return l.withStream(p.stream).withRequest(p.request).withPeer(p.id)
+}
+
+func lookupPeer(id string) *peer {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	return peers[id]
+}
+
+// The peer a plain HTTP request is about, nil unless the request presents
+// its secret in the X-Peer-Secret header, or the "secret" parameter for
+// EventSource, which cannot set headers. Clients get both the ID and the
+// secret with their answer, on /ws in the answer message.
+func authorizedPeer(r *http.Request, id string) *peer {
+	p := lookupPeer(id)
+	if p == nil {
+		return nil
+	}
+	secret := r.Header.Get(peerSecretHeader)
+	if secret == "" {
+		secret = r.URL.Query().Get("secret")
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(p.secret)) != 1 {
+		return nil
+	}
+	return p
+}
+
+// Store a gathered candidate until the client follows the peer's events, or
+// push it to the peer's event streams
+func (p *peer) queueCandidate(c *webrtc.ICECandidate) {
+	p.iceMutex.Lock()
+	defer p.iceMutex.Unlock()
+	if c == nil {
+		p.gathered = true
+		p.publishEventLocked(peerEvent{Type: "end-of-candidates"})
+		return
+	}
+	init := c.ToJSON()
+	if !p.publishEventLocked(peerEvent{Type: "candidate", Candidate: &init}) {
+		p.iceCandidates = append(p.iceCandidates, init)
+	}
+}
+
+// Add a remote candidate, or hold it back until the remote description is set
+func (p *peer) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	p.remoteCandidatesMtx.Lock()
+	defer p.remoteCandidatesMtx.Unlock()
+
+	if p.pc.RemoteDescription() == nil {
+		p.pendingRemoteCandidates = append(p.pendingRemoteCandidates, candidate)
+		return nil
+	}
+
+	return p.pc.AddICECandidate(candidate)
+}
+
+// Apply candidates that arrived before the remote description
+func (p *peer) flushPendingCandidates() {
+	p.remoteCandidatesMtx.Lock()
+	defer p.remoteCandidatesMtx.Unlock()
+
+	for _, candidate := range p.pendingRemoteCandidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			p.log(iceLog).errorf("[%s %s] Error adding pending ICE candidate: %v", p.role, p.id, err)
+		}
+	}
+	p.pendingRemoteCandidates = nil
+}
+
+// Close the PeerConnection and forget the peer, safe to call more than once
+func (p *peer) close(onClose func()) {
+	p.closeOnce.Do(func() {
+		peersMu.Lock()
+		delete(peers, p.id)
+		peersMu.Unlock()
+		// Local publishers were never registered
+		if p.pc != nil {
+			p.removeRecord()
+		}
+
+		if p.pc != nil {
+			if err := p.pc.Close(); err != nil {
+				p.log(roomLog).errorf("[%s %s] Error closing PeerConnection: %v", p.role, p.id, err)
+			}
+		}
+		close(p.done)
+		onClose()
+	})
+}
+
+// Largest RTP packet the frames of local publishers are split into
+const localPublisherMTU = 1200
+
+// Publisher whose media the server produces itself, without a
+// PeerConnection and not reachable over the signaling endpoints
+func newLocalPublisher(stream string, owner *account) *Publisher {
+	return &Publisher{peer: &peer{id: newID(), role: "publisher", stream: stream, done: make(chan struct{})}, owner: owner}
+}
+
+// Fanout forwarding a track of the publisher, created on first use. It
+// keeps the ID and stream of the publisher's track so viewers can tell
+// camera and screen share apart and play audio in sync with its video.
+// Each simulcast layer gets its own fanout under the same ID.
+func (p *Publisher) addTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) *trackFanout {
+	id := remote.ID()
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", remote.Kind(), remote.SSRC())
+	}
+	streamID := remote.StreamID()
+	if streamID == "" {
+		streamID = "sfu"
+	}
+	if p.cohost {
+		streamID = "cohost-" + p.id
+	}
+
+	t := newTrackFanout(remote.Codec().RTPCodecCapability, id, streamID, remote.RID(), remote.Kind())
+	t.dropExtensions = simulcastExtensionIDs(receiver)
+	return p.addFanout(t, remote.SSRC())
+}
+
+// Add a fanout unless the publisher has one under its key already. Video
+// tracks with an SSRC can be asked for keyframes.
+func (p *Publisher) addFanout(t *trackFanout, ssrc webrtc.SSRC) *trackFanout {
+	p.trackMutex.Lock()
+	defer p.trackMutex.Unlock()
+
+	if existing, ok := p.tracks[t.key()]; ok {
+		return existing
+	}
+	if p.tracks == nil {
+		p.tracks = make(map[string]*trackFanout)
+		p.videoSSRCs = make(map[string]webrtc.SSRC)
+	}
+	p.tracks[t.key()] = t
+	if t.Kind() == webrtc.RTPCodecTypeVideo && ssrc != 0 {
+		p.videoSSRCs[t.key()] = ssrc
+	}
+	return t
+}
+
+// Forget a fanout once the publisher's track has ended
+func (p *Publisher) removeTrack(t *trackFanout) {
+	p.trackMutex.Lock()
+	if p.tracks[t.key()] == t {
+		delete(p.tracks, t.key())
+		delete(p.videoSSRCs, t.key())
+	}
+	p.trackMutex.Unlock()
+	t.close()
+
+	// Viewers of an ended simulcast layer continue on another one
+	if next := p.bestLayer(t.ID()); next != nil {
+		if moved := t.moveViewers(next); moved > 0 {
+			p.log(roomLog).infof("[publisher %s] Layer %q of track %s ended, %d viewers moved to layer %q.", p.id, t.RID(), t.ID(), moved, next.RID())
+			p.requestKeyframe(next.key())
+		}
+	}
+}
+
+func (p *Publisher) hasTrack(t *trackFanout) bool {
+	p.trackMutex.Lock()
+	defer p.trackMutex.Unlock()
+	return p.tracks[t.key()] == t
+}
+
+// Simulcast layers of a track, highest first. Layers are ranked by the
+// bytes received so far, as RIDs carry no agreed meaning.
+func (p *Publisher) layers(id string) []*trackFanout {
+	p.trackMutex.Lock()
+	var list []*trackFanout
+	for _, t := range p.tracks {
+		if t.ID() == id {
+			list = append(list, t)
+		}
+	}
+	p.trackMutex.Unlock()
+
+	received := make(map[*trackFanout]uint64, len(list))
+	for _, t := range list {
+		received[t] = t.bytesReceived()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if received[list[i]] != received[list[j]] {
+			return received[list[i]] > received[list[j]]
+		}
+		return list[i].RID() < list[j].RID()
+	})
+	return list
+}
+
+// Highest simulcast layer of a track, or the track itself without simulcast
+func (p *Publisher) bestLayer(id string) *trackFanout {
+	if layers := p.layers(id); len(layers) > 0 {
+		return layers[0]
+	}
+	return nil
+}
+
+// Ask the publisher for a keyframe on the video tracks with the given keys,
+// or on all of them when none are given. Requests are coalesced to at most
+// one PLI per track and pliInterval.
+func (p *Publisher) requestKeyframe(ids ...string) {
+	p.trackMutex.Lock()
+	ssrcs := make([]webrtc.SSRC, 0, len(p.videoSSRCs))
+	for id, ssrc := range p.videoSSRCs {
+		if len(ids) > 0 && !slices.Contains(ids, id) {
+			continue
+		}
+		ssrcs = append(ssrcs, ssrc)
+	}
+	p.trackMutex.Unlock()
+
+	p.sendPLIs(ssrcs)
+}
+
+// Tracks viewers subscribe to, video first and then by ID. Simulcast
+// tracks are represented by their highest layer.
+func (p *Publisher) getTracks() []*trackFanout {
+	p.trackMutex.Lock()
+	ids := make(map[string]bool, len(p.tracks))
+	for _, t := range p.tracks {
+		ids[t.ID()] = true
+	}
+	p.trackMutex.Unlock()
+
+	list := make([]*trackFanout, 0, len(ids))
+	for id := range ids {
+		if t := p.bestLayer(id); t != nil {
+			list = append(list, t)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind() != list[j].Kind() {
+			return list[i].Kind() == webrtc.RTPCodecTypeVideo
+		}
+		return list[i].ID() < list[j].ID()
+	})
+	return list
+}
+
+func getRoom(name string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	return rooms[name]
+}
+
+func getOrCreateRoom(name string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	room, ok := rooms[name]
+	if !ok {
+		room = &Room{name: name, created: time.Now(), viewers: make(map[string]*Viewer)}
+		rooms[name] = room
+		roomLog.withStream(name).infof("Room created.")
+	}
+	return room
+}
+
+// Snapshot of all rooms sorted by name
+func listRooms() []*Room {
+	roomsMu.Lock()
+	list := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, room)
+	}
+	roomsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Drop the room from the registry once nobody uses it anymore
+func (r *Room) removeIfEmpty() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	r.mu.Lock()
+	empty := r.publisher == nil && len(r.cohosts) == 0 && len(r.viewers) == 0
+	r.mu.Unlock()
+	r.sinksMu.RLock()
+	empty = empty && len(r.sinks) == 0
+	r.sinksMu.RUnlock()
+	r.subscribersMu.Lock()
+	empty = empty && len(r.subscribers) == 0
+	r.subscribersMu.Unlock()
+
+	if empty && rooms[r.name] == r {
+		delete(rooms, r.name)
+		roomLog.withStream(r.name).infof("Room removed.")
+	}
+}
+
+func (r *Room) addSink(s packetSink) {
+	r.sinksMu.Lock()
+	r.sinks = append(r.sinks, s)
+	r.sinksMu.Unlock()
+	if sub, ok := s.(trackSubscriber); ok {
+		r.subscribeTracks(sub)
+	}
+}
+
+func (r *Room) removeSink(s packetSink) {
+	r.sinksMu.Lock()
+	if i := slices.Index(r.sinks, s); i >= 0 {
+		r.sinks = slices.Delete(r.sinks, i, i+1)
+	}
+	r.sinksMu.Unlock()
+	if sub, ok := s.(trackSubscriber); ok {
+		r.unsubscribeTracks(sub)
+	}
+	r.removeIfEmpty()
+}
+
+// Hand a packet of the publisher to the room's sinks
+func (r *Room) writeSinks(t *trackFanout, packet *rtp.Packet) {
+	r.sinksMu.RLock()
+	defer r.sinksMu.RUnlock()
+	for _, s := range r.sinks {
+		s.writeRTP(t, packet)
+	}
+}
+
+// Hand a packet of a track of the room's publisher to its recording, the
+// room's sinks and the track's viewers. Sinks only get the host's packets.
+func (r *Room) publishRTP(p *Publisher, t *trackFanout, packet *rtp.Packet) error {
+	r.bytesIn.Add(uint64(packet.MarshalSize()))
+	if p.isMuted(t.Kind()) {
+		return nil
+	}
+	p.record(t, packet)
+	if !p.cohost {
+		r.writeSinks(t, packet)
+		r.capture.add(p, t, packet)
+	}
+	r.bytesOut.Add(t.WriteRTP(packet))
+	return nil
+}
+
+// Make p the publisher of the room, returning the publisher it replaces.
+// The subscribers get the tracks p has already.
+func (r *Room) setPublisher(p *Publisher) *Publisher {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+
+	r.mu.Lock()
+	old := r.publisher
+	r.publisher = p
+	r.mu.Unlock()
+	r.switchTracks(old, p)
+	if old == nil && r.resumeStream(p) {
+		go r.events.notify(r, streamNotice{Type: "publisher-reconnected", Publisher: p.displayID})
+	} else {
+		go streamChanged(r.name, "stream.live", p)
+		go r.events.notify(r, streamNotice{Type: "stream-started", Publisher: p.displayID})
+	}
+	return old
+}
+
+func (r *Room) getPublisher() *Publisher {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.publisher
+}
+
+// Tracks of the current publisher, empty when there is none yet
+func (r *Room) tracks() []*trackFanout {
+	p := r.getPublisher()
+	if p == nil {
+		return nil
+	}
+	return p.getTracks()
+}
+
+// Add a viewer whose tracks are set up, it follows the room's tracks from
+// then on, including those of a publisher that took over meanwhile
+func (r *Room) addViewer(v *Viewer) {
+	r.mu.Lock()
+	r.viewers[v.id] = v
+	r.mu.Unlock()
+	r.subscribeTracks(v)
+	r.events.viewersChanged(r)
+}
+
+func (r *Room) getViewer(id string) *Viewer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.viewers[id]
+}
+
+func (r *Room) getViewers() []*Viewer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*Viewer, 0, len(r.viewers))
+	for _, v := range r.viewers {
+		list = append(list, v)
+	}
+	return list
+}
+
+// Close the publisher and remove it from the room if it is still the current one
+func (r *Room) closePublisher(p *Publisher) {
+	p.close(func() {
+		r.subscribersMu.Lock()
+		r.mu.Lock()
+		current := r.publisher == p
+		if current {
+			r.publisher = nil
+		}
+		r.mu.Unlock()
+		if current {
+			r.switchTracks(p, nil)
+			if !r.holdForPublisher(p) {
+				r.streamEnded(p)
+			}
+		}
+		r.subscribersMu.Unlock()
+		if r.removeCohost(p) {
+			notifyViewers(r, signalMessage{Type: "cohost-left", Stream: r.name, ID: p.id})
+		}
+		p.holdRecording()
+		r.chat.left(p.displayID)
+		p.log(roomLog).infof("[publisher %s] Left stream.", p.id)
+		r.removeIfEmpty()
+	})
+}
+
+// Send a message on the viewer's open data channels with the label
+func (v *Viewer) sendData(label string, msg webrtc.DataChannelMessage) {
+	if err := v.channels.send(label, msg); err != nil {
+		v.log(roomLog).warnf("[viewer %s] Error sending on data channel %q: %v", v.id, label, err)
+	}
+}
+
+func (r *Room) closeViewer(v *Viewer) {
+	v.close(func() {
+		r.unsubscribeTracks(v)
+		r.mu.Lock()
+		delete(r.viewers, v.id)
+		r.mu.Unlock()
+		r.interactions.viewerLeft(v.id)
+		r.chat.left(v.displayID)
+		r.events.viewersChanged(r)
+		v.log(roomLog).infof("[viewer %s] Left stream.", v.id)
+		r.removeIfEmpty()
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Shortest and longest time between RTCP reports that may be asked for
+	minRTCPInterval = 100 * time.Millisecond
+	maxRTCPInterval = 30 * time.Second
+
+	// Bandwidth a viewer's estimate starts from, in bits per second
+	viewerInitialBitrate = 1_000_000
+)
+
+// RTCP report settings of each role, from -publisher-rtcp-interval and the
+// like. Publishers and viewers may pick their own with ?rtcpInterval= and
+// ?rtcpFraction=.
+var (
+	publisherRTCP = rtcpSettings{Interval: time.Second}
+	viewerRTCP    = rtcpSettings{Interval: time.Second}
+)
+
+// How often a PeerConnection sends RTCP reports: receiver reports to
+// publishers, sender reports to viewers
+type rtcpSettings struct {
+	Interval time.Duration
+	// Largest share of the media bytes the connection carries that the RTCP
+	// it sends may take, as RFC 3550's RTCP bandwidth, 0 for no limit.
+	// Reports that would exceed it are skipped; NACKs, PLIs and congestion
+	// feedback are always sent but count against it.
+	Fraction float64
+}
+
+func (s rtcpSettings) String() string {
+	if s.Fraction == 0 {
+		return "every " + s.Interval.String()
+	}
+	return fmt.Sprintf("every %v, within %g%% of the media", s.Interval, s.Fraction*100)
+}
+
+func (s rtcpSettings) check() error {
+	if s.Interval < minRTCPInterval || s.Interval > maxRTCPInterval {
+		return fmt.Errorf("RTCP interval must be between %v and %v", minRTCPInterval, maxRTCPInterval)
+	}
+	if s.Fraction < 0 || s.Fraction > 1 {
+		return fmt.Errorf("RTCP fraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// RTCP settings of a publisher or viewer, the role's defaults with the
+// ?rtcpInterval= and ?rtcpFraction= of the request, e.g. to compare the
+// feedback of a stream at 200ms with that at 5s
+func parseRTCPSettings(r *http.Request, defaults rtcpSettings) (rtcpSettings, error) {
+	s := defaults
+	query := r.URL.Query()
+	if value := query.Get("rtcpInterval"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return s, newSignalingError(http.StatusBadRequest, "rtcpInterval must be a duration")
+		}
+		s.Interval = d
+	}
+	if value := query.Get("rtcpFraction"); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return s, newSignalingError(http.StatusBadRequest, "rtcpFraction must be a number")
+		}
+		s.Fraction = f
+	}
+	if err := s.check(); err != nil {
+		return s, newSignalingError(http.StatusBadRequest, err.Error())
+	}
+	return s, nil
+}
+
+// Register pion's default interceptors with the reports sent as the
+// settings ask, one counting the connection's RTCP into f, pion's stats
+// interceptor keeping the stats of its RTP streams in f and the chaos mode
+// one
+func registerInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry, s rtcpSettings, f *rtcpFeedback) error {
+	// First in the chain, so it sees the RTCP of every other interceptor
+	i.Add(&rtcpFeedbackFactory{feedback: f})
+	// Next to the network, behind the NACK responder
+	i.Add(chaosInterceptorFactory{})
+	streamStats, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+	streamStats.OnNewPeerConnection(func(_ string, g stats.Getter) { f.streams.Store(g) })
+	i.Add(streamStats)
+	if err := webrtc.ConfigureNack(m, i); err != nil {
+		return err
+	}
+	receiver, err := report.NewReceiverInterceptor(report.ReceiverInterval(s.Interval))
+	if err != nil {
+		return err
+	}
+	sender, err := report.NewSenderInterceptor(report.SenderInterval(s.Interval))
+	if err != nil {
+		return err
+	}
+	i.Add(receiver)
+	i.Add(sender)
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// RTCP a PeerConnection sent and received next to the media it carried,
+// collected with its stats as the rtcp-feedback report
+type rtcpFeedback struct {
+	settings rtcpSettings
+
+	packetsSent, bytesSent             atomic.Uint64
+	reportsSent, reportsSkipped        atomic.Uint64
+	packetsReceived, bytesReceived     atomic.Uint64
+	mediaBytesSent, mediaBytesReceived atomic.Uint64
+
+	// Stats of the RTP streams, a stats.Getter
+	streams atomic.Value
+	// Bandwidth estimate of a viewer connection from its transport-wide
+	// congestion control feedback, a cc.BandwidthEstimator, and whether the
+	// viewer sent any
+	estimator    atomic.Value
+	twccReceived atomic.Bool
+	// NACKs and keyframe requests, PLI or FIR, received
+	nacksReceived, keyframeRequestsReceived atomic.Uint64
+	// Latest reception report sent for each SSRC received, whose jitter
+	// pion's report interceptor measures
+	reportsMu   sync.Mutex
+	sentReports map[uint32]rtcp.ReceptionReport
+}
+
+func newRTCPFeedback(s rtcpSettings) *rtcpFeedback {
+	return &rtcpFeedback{settings: s, sentReports: make(map[uint32]rtcp.ReceptionReport)}
+}
+
+// Stats of the RTP stream with the SSRC, nil before it carried anything
+func (f *rtcpFeedback) streamStats(ssrc uint32) *stats.Stats {
+	g, _ := f.streams.Load().(stats.Getter)
+	if g == nil {
+		return nil
+	}
+	return g.Get(ssrc)
+}
+
+// Estimate a viewer's available bandwidth with Google congestion control
+// from the transport-wide sequence numbers stamped on the media sent to it
+// and the TWCC feedback it returns. The media is not paced to the estimate:
+// the SFU forwards what the publisher sends, the estimate is what the stats
+// API shows.
+func registerBandwidthEstimator(m *webrtc.MediaEngine, i *interceptor.Registry, f *rtcpFeedback) error {
+	estimator, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(viewerInitialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return err
+	}
+	estimator.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) { f.estimator.Store(e) })
+	i.Add(estimator)
+	// Added after the estimator, so packets are stamped before it sees them
+	return webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
+}
+
+// Bandwidth estimate of a viewer connection, nil for other connections
+func (f *rtcpFeedback) bandwidthEstimator() cc.BandwidthEstimator {
+	e, _ := f.estimator.Load().(cc.BandwidthEstimator)
+	return e
+}
+
+// Latest reception report sent for the SSRC
+func (f *rtcpFeedback) sentReport(ssrc uint32) (rtcp.ReceptionReport, bool) {
+	f.reportsMu.Lock()
+	defer f.reportsMu.Unlock()
+	r, ok := f.sentReports[ssrc]
+	return r, ok
+}
+
+// Attributes of the rtcp-feedback stats report
+func (f *rtcpFeedback) stats() map[string]interface{} {
+	media := f.mediaBytesSent.Load() + f.mediaBytesReceived.Load()
+	share := 0.0
+	if media > 0 {
+		share = float64(f.bytesSent.Load()) / float64(media)
+	}
+	return map[string]interface{}{
+		"reportInterval":     float64(f.settings.Interval.Milliseconds()),
+		"bandwidthFraction":  f.settings.Fraction,
+		"packetsSent":        float64(f.packetsSent.Load()),
+		"bytesSent":          float64(f.bytesSent.Load()),
+		"reportsSent":        float64(f.reportsSent.Load()),
+		"reportsSkipped":     float64(f.reportsSkipped.Load()),
+		"packetsReceived":    float64(f.packetsReceived.Load()),
+		"bytesReceived":      float64(f.bytesReceived.Load()),
+		"mediaBytesSent":     float64(f.mediaBytesSent.Load()),
+		"mediaBytesReceived": float64(f.mediaBytesReceived.Load()),
+		"rtcpShare":          share,
+	}
+}
+
+// Whether packets are only sender and receiver reports
+func onlyReports(packets []rtcp.Packet) bool {
+	for _, p := range packets {
+		switch p.(type) {
+		case *rtcp.SenderReport, *rtcp.ReceiverReport:
+		default:
+			return false
+		}
+	}
+	return len(packets) > 0
+}
+
+// Interceptor factory counting the RTCP and media of one PeerConnection
+type rtcpFeedbackFactory struct {
+	feedback *rtcpFeedback
+}
+
+func (f *rtcpFeedbackFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &rtcpFeedbackInterceptor{feedback: f.feedback}, nil
+}
+
+type rtcpFeedbackInterceptor struct {
+	interceptor.NoOp
+	feedback *rtcpFeedback
+}
+
+func (i *rtcpFeedbackInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	f := i.feedback
+	return interceptor.RTCPWriterFunc(func(packets []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		size := 0
+		for _, p := range packets {
+			size += p.MarshalSize()
+		}
+		reports := onlyReports(packets)
+		if reports && f.settings.Fraction > 0 {
+			budget := f.settings.Fraction * float64(f.mediaBytesSent.Load()+f.mediaBytesReceived.Load())
+			if float64(f.bytesSent.Load())+float64(size) > budget {
+				f.reportsSkipped.Add(1)
+				return 0, nil
+			}
+		}
+		n, err := writer.Write(packets, attributes)
+		if err == nil {
+			for _, p := range packets {
+				if rr, ok := p.(*rtcp.ReceiverReport); ok {
+					f.reportsMu.Lock()
+					for _, r := range rr.Reports {
+						f.sentReports[r.SSRC] = r
+					}
+					f.reportsMu.Unlock()
+				}
+			}
+			f.packetsSent.Add(uint64(len(packets)))
+			f.bytesSent.Add(uint64(size))
+			if reports {
+				f.reportsSent.Add(1)
+			}
+		}
+		return n, err
+	})
+}
+
+func (i *rtcpFeedbackInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	f := i.feedback
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		if packets, err := attr.GetRTCPPackets(b[:n]); err == nil {
+			f.packetsReceived.Add(uint64(len(packets)))
+			for _, p := range packets {
+				switch p.(type) {
+				case *rtcp.TransportLayerCC:
+					f.twccReceived.Store(true)
+				case *rtcp.TransportLayerNack:
+					f.nacksReceived.Add(1)
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					f.keyframeRequestsReceived.Add(1)
+				}
+			}
+		}
+		f.bytesReceived.Add(uint64(n))
+		return n, attr, nil
+	})
+}
+
+func (i *rtcpFeedbackInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	f := i.feedback
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err == nil {
+			f.mediaBytesSent.Add(uint64(n))
+		}
+		return n, err
+	})
+}
+
+func (i *rtcpFeedbackInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	f := i.feedback
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err == nil {
+			f.mediaBytesReceived.Add(uint64(n))
+		}
+		return n, attr, err
+	})
+}
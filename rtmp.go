@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// RTMP message types
+const (
+	rtmpSetChunkSize     = 1
+	rtmpAbort            = 2
+	rtmpAck              = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpSetPeerBandwidth = 6
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+)
+
+const (
+	rtmpHandshakeSize = 1536
+
+	// Chunk size until the peer sets another, and the one used for sending
+	rtmpDefaultChunkSize = 128
+	rtmpOutChunkSize     = 4096
+
+	// Largest message accepted, well above any video frame of a live encoder
+	rtmpMaxMessageSize = 16 << 20
+
+	// Window the peer acknowledges received bytes in
+	rtmpWindowSize = 2500000
+
+	// Longest time without any data from the peer
+	rtmpReadTimeout = 30 * time.Second
+)
+
+// A message reassembled from its chunks
+type rtmpMessage struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// Header state of one chunk stream, later chunks only carry what changed
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+// Server side of an RTMP connection: the handshake, the chunk stream in
+// both directions, and acknowledgements of what was received
+type rtmpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	inChunkSize uint32
+	streams     map[uint32]*rtmpChunkStream
+
+	// Acknowledgement window of the peer and bytes received so far
+	ackWindow uint32
+	received  uint32
+	acked     uint32
+}
+
+func newRTMPConn(conn net.Conn) *rtmpConn {
+	return &rtmpConn{
+		conn:        conn,
+		r:           bufio.NewReaderSize(conn, 64*1024),
+		w:           bufio.NewWriterSize(conn, 64*1024),
+		inChunkSize: rtmpDefaultChunkSize,
+		streams:     make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+// Simple handshake without digests, which encoders accept from servers
+func (c *rtmpConn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(rtmpReadTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	s0s1s2[0] = 3
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	rand.Read(s0s1s2[9 : 1+rtmpHandshakeSize])
+	copy(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := c.w.Write(s0s1s2); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(c.r, make([]byte, rtmpHandshakeSize))
+	return err
+}
+
+func (c *rtmpConn) read(b []byte) error {
+	c.conn.SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+	n, err := io.ReadFull(c.r, b)
+	c.received += uint32(n)
+	return err
+}
+
+func (c *rtmpConn) readUint(n int) (uint32, error) {
+	b := make([]byte, 4)
+	if err := c.read(b[4-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Read chunks until a message is complete. Protocol control messages are
+// handled here and not returned.
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.acknowledge(); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.typeID {
+		case rtmpSetChunkSize:
+			if len(msg.payload) < 4 {
+				return nil, errors.New("short set chunk size message")
+			}
+			size := binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+			if size == 0 || size > rtmpMaxMessageSize {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.inChunkSize = size
+		case rtmpWindowAckSize:
+			if len(msg.payload) >= 4 {
+				c.ackWindow = binary.BigEndian.Uint32(msg.payload)
+			}
+		case rtmpAbort:
+			if len(msg.payload) >= 4 {
+				if cs, ok := c.streams[binary.BigEndian.Uint32(msg.payload)]; ok {
+					cs.buf = nil
+				}
+			}
+		case rtmpAck, rtmpUserControl, rtmpSetPeerBandwidth:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// Read one chunk, returning the message it completes if any
+func (c *rtmpConn) readChunk() (*rtmpMessage, error) {
+	b0, err := c.readUint(1)
+	if err != nil {
+		return nil, err
+	}
+	format := b0 >> 6
+	csid := b0 & 0x3f
+	switch csid {
+	case 0:
+		b1, err := c.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + b1
+	case 1:
+		b, err := c.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + b>>8 + (b&0xff)*256
+	}
+
+	cs, ok := c.streams[csid]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts without a full header", csid)
+		}
+		cs = &rtmpChunkStream{}
+		c.streams[csid] = cs
+	}
+
+	var ts uint32
+	if format <= 2 {
+		if ts, err = c.readUint(3); err != nil {
+			return nil, err
+		}
+	}
+	if format <= 1 {
+		if cs.length, err = c.readUint(3); err != nil {
+			return nil, err
+		}
+		typeID, err := c.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+		cs.typeID = uint8(typeID)
+		if cs.length > rtmpMaxMessageSize {
+			return nil, fmt.Errorf("message of %d bytes too large", cs.length)
+		}
+	}
+	if format == 0 {
+		b := make([]byte, 4)
+		if err := c.read(b); err != nil {
+			return nil, err
+		}
+		cs.streamID = binary.LittleEndian.Uint32(b)
+	}
+	if format <= 2 {
+		cs.extended = ts == 0xffffff
+	}
+	if cs.extended {
+		if ts, err = c.readUint(4); err != nil {
+			return nil, err
+		}
+	}
+
+	// Timestamps are absolute in full headers and deltas otherwise. A
+	// chunk continuing a message repeats the extended timestamp only.
+	start := len(cs.buf) == 0
+	switch {
+	case format == 0:
+		cs.timestamp, cs.delta = ts, 0
+	case format <= 2:
+		cs.delta = ts
+		cs.timestamp += ts
+	case start:
+		if cs.extended {
+			cs.delta = ts
+		}
+		cs.timestamp += cs.delta
+	}
+
+	n := min(cs.length-uint32(len(cs.buf)), c.inChunkSize)
+	chunk := make([]byte, n)
+	if err := c.read(chunk); err != nil {
+		return nil, err
+	}
+	cs.buf = append(cs.buf, chunk...)
+	if uint32(len(cs.buf)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &rtmpMessage{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.buf}
+	cs.buf = nil
+	return msg, nil
+}
+
+// Acknowledge received bytes once a window of them arrived
+func (c *rtmpConn) acknowledge() error {
+	if c.ackWindow == 0 || c.received-c.acked < c.ackWindow {
+		return nil
+	}
+	c.acked = c.received
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, c.received)
+	return c.writeMessage(2, &rtmpMessage{typeID: rtmpAck, payload: b})
+}
+
+// Send a message on a chunk stream, split into chunks of rtmpOutChunkSize
+func (c *rtmpConn) writeMessage(csid uint8, msg *rtmpMessage) error {
+	header := make([]byte, 12)
+	header[0] = csid
+	putUint24(header[1:], min(msg.timestamp, 0xffffff))
+	putUint24(header[4:], uint32(len(msg.payload)))
+	header[7] = msg.typeID
+	binary.LittleEndian.PutUint32(header[8:], msg.streamID)
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	for payload := msg.payload; ; {
+		n := min(len(payload), rtmpOutChunkSize)
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		// Continuation chunk with no header fields
+		if err := c.w.WriteByte(0xc0 | csid); err != nil {
+			return err
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(rtmpReadTimeout))
+	return c.w.Flush()
+}
+
+// Send an AMF0 command on a message stream
+func (c *rtmpConn) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(3, &rtmpMessage{typeID: rtmpCommandAMF0, streamID: streamID, payload: amfEncode(values...)})
+}
+
+// Send a protocol control message carrying one value
+func (c *rtmpConn) writeControl(typeID uint8, value uint32, extra ...byte) error {
+	b := binary.BigEndian.AppendUint32(nil, value)
+	return c.writeMessage(2, &rtmpMessage{typeID: typeID, payload: append(b, extra...)})
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Address the RTMP ingest listens on, empty disables it
+var rtmpAddr = ":1935"
+
+// FLV codec IDs of RTMP audio and video messages
+const (
+	flvCodecAVC = 7
+	flvCodecAAC = 10
+)
+
+var rtmpLog = newLogger("rtmp")
+
+// Accept RTMP publishers, e.g. OBS with rtmp://host/live and the stream
+// name as stream key. With accounts enabled the key carries the login,
+// "name?user=alice&password=secret", or an API token with the publish
+// scope, "name?token=sfu_...". With publish JWTs configured the token goes
+// in "name?jwt=...". Streams with keys from /api/streamkeys take one of
+// them as the whole stream key, "sk_...", or in "name?key=sk_...", and it
+// stands in for the login. ready is called once listening. Once ctx is
+// done the connections are closed and their publishers have left when this
+// returns.
+func runRTMPIngest(ctx context.Context, addr string, ready func()) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	rtmpLog.infof("RTMP ingest listening on %s", addr)
+	ready()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = make(map[net.Conn]bool)
+	)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			conn.Close()
+		}
+		conns[conn] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveRTMP(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// An RTMP connection and, once it publishes, the publisher it feeds
+type rtmpSession struct {
+	*rtmpConn
+
+	stream  string
+	session *ingestSession
+
+	// H264 parameter sets of the sequence header, sent before keyframes
+	sps, pps   []byte
+	lengthSize int
+	video      *ingestTrack
+	warnedAAC  bool
+}
+
+func (s *rtmpSession) protocol() string { return "rtmp" }
+func (s *rtmpSession) remote() string   { return s.conn.RemoteAddr().String() }
+
+func serveRTMP(conn net.Conn) {
+	defer conn.Close()
+
+	s := &rtmpSession{rtmpConn: newRTMPConn(conn)}
+	if err := s.handshake(); err != nil {
+		rtmpLog.debugf("Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	err := s.serve()
+	if s.session != nil {
+		s.session.close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		rtmpLog.withStream(s.stream).warnf("Connection from %s ended: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *rtmpSession) serve() error {
+	for {
+		msg, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.typeID {
+		case rtmpCommandAMF0:
+			done, err := s.command(msg)
+			if err != nil || done {
+				return err
+			}
+		case rtmpVideo:
+			if s.session != nil {
+				if err := s.videoMessage(msg); err != nil {
+					return err
+				}
+			}
+		case rtmpAudio:
+			if s.session != nil && len(msg.payload) > 0 && msg.payload[0]>>4 == flvCodecAAC && !s.warnedAAC {
+				s.warnedAAC = true
+				s.session.publisher.log(rtmpLog).warnf("[publisher %s] AAC audio is not forwarded, WebRTC viewers cannot play it.", s.session.publisher.id)
+			}
+		}
+	}
+}
+
+// Handle a command, returning true once the publisher is done
+func (s *rtmpSession) command(msg *rtmpMessage) (bool, error) {
+	values, err := amfDecode(msg.payload)
+	if err != nil || len(values) < 2 {
+		return false, fmt.Errorf("invalid command: %v", err)
+	}
+	name, _ := values[0].(string)
+	txn, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if err := s.writeControl(rtmpWindowAckSize, rtmpWindowSize); err != nil {
+			return false, err
+		}
+		if err := s.writeControl(rtmpSetPeerBandwidth, rtmpWindowSize, 2); err != nil {
+			return false, err
+		}
+		if err := s.writeControl(rtmpSetChunkSize, rtmpOutChunkSize); err != nil {
+			return false, err
+		}
+		return false, s.writeCommand(0, "_result", txn,
+			amfMap{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			amfMap{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0})
+	case "createStream":
+		return false, s.writeCommand(0, "_result", txn, nil, 1)
+	case "releaseStream", "FCPublish":
+		return false, s.writeCommand(0, "_result", txn, nil)
+	case "publish":
+		if len(values) < 4 {
+			return false, errors.New("publish without a stream key")
+		}
+		key, _ := values[3].(string)
+		if err := s.publish(key); err != nil {
+			s.writeCommand(msg.streamID, "onStatus", 0, nil,
+				amfMap{"level": "error", "code": "NetStream.Publish.BadName", "description": err.Error()})
+			return true, err
+		}
+		return false, s.writeCommand(msg.streamID, "onStatus", 0, nil,
+			amfMap{"level": "status", "code": "NetStream.Publish.Start", "description": "Publishing " + s.stream + "."})
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return s.session != nil, nil
+	}
+	return false, nil
+}
+
+// Authorize the stream key and become the publisher of its stream
+func (s *rtmpSession) publish(key string) error {
+	if s.session != nil {
+		return errors.New("already publishing")
+	}
+	name, query, _ := strings.Cut(key, "?")
+	params, _ := url.ParseQuery(query)
+	// A bare stream key names its stream
+	if strings.HasPrefix(name, streamKeyPrefix) {
+		stream, ok := streamOfKey(name)
+		if !ok {
+			return errors.New("invalid stream key")
+		}
+		params.Set("key", name)
+		name = stream
+	}
+	if !streamNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid stream name %q", name)
+	}
+
+	if err := authorizePublishToken(params.Get("jwt"), name); err != nil {
+		return err
+	}
+	streamKey, owner, err := authorizeStreamKey(params.Get("key"), name, nil)
+	if err != nil {
+		return err
+	}
+	if accountsDB != nil && owner == nil {
+		if token := params.Get("token"); token != "" {
+			if owner = tokenAccount(token); owner == nil {
+				return errors.New("invalid token")
+			}
+		} else {
+			a, err := authenticate(params.Get("user"), params.Get("password"))
+			if err != nil {
+				return errors.New("invalid username or password")
+			}
+			owner = a
+		}
+	}
+	if err := authorizePublish(owner, name); err != nil {
+		return err
+	}
+
+	s.stream = name
+	s.session = newIngestSession(s, name, owner)
+	s.session.takeOver()
+	trackStreamKey(streamKey, name, s.session.publisher)
+
+	// End the connection when another publisher takes over
+	go func() {
+		<-s.session.done()
+		s.conn.Close()
+	}()
+	s.session.publisher.log(rtmpLog).infof("[publisher %s] Publishing from %s.", s.session.publisher.id, s.conn.RemoteAddr())
+	return nil
+}
+
+// Transmux an FLV video tag: H264 in AVCC format becomes RTP
+func (s *rtmpSession) videoMessage(msg *rtmpMessage) error {
+	p := msg.payload
+	if len(p) < 5 || p[0]&0x0f != flvCodecAVC {
+		return nil
+	}
+	keyframe := p[0]>>4 == 1
+	cts := int32(uint32(p[2])<<16|uint32(p[3])<<8|uint32(p[4])) << 8 >> 8
+
+	switch p[1] {
+	case 0:
+		return s.sequenceHeader(p[5:])
+	case 1:
+		if s.video == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var frame []byte
+	if keyframe {
+		frame = appendAnnexB(appendAnnexB(frame, s.sps), s.pps)
+	}
+	for data := p[5:]; len(data) > s.lengthSize; {
+		var n int
+		for _, b := range data[:s.lengthSize] {
+			n = n<<8 | int(b)
+		}
+		data = data[s.lengthSize:]
+		if n > len(data) {
+			return errors.New("truncated NAL unit")
+		}
+		frame = appendAnnexB(frame, data[:n])
+		data = data[n:]
+	}
+
+	s.video.writeFrame(frame, uint32((int64(msg.timestamp)+int64(cts))*90))
+	return nil
+}
+
+// Read the SPS and PPS of an AVCDecoderConfigurationRecord and create the
+// video track on the first one
+func (s *rtmpSession) sequenceHeader(p []byte) error {
+	if len(p) < 8 {
+		return errors.New("short AVC sequence header")
+	}
+	s.lengthSize = int(p[4]&0x03) + 1
+	numSPS := int(p[5] & 0x1f)
+	p = p[6:]
+	var sps, pps []byte
+	for i := 0; i < numSPS && len(p) >= 2; i++ {
+		n := int(binary.BigEndian.Uint16(p))
+		if len(p) < 2+n {
+			return errors.New("truncated SPS")
+		}
+		if sps == nil {
+			sps = p[2 : 2+n]
+		}
+		p = p[2+n:]
+	}
+	if len(p) >= 3 {
+		n := int(binary.BigEndian.Uint16(p[1:]))
+		if p[0] > 0 && len(p) >= 3+n {
+			pps = p[3 : 3+n]
+		}
+	}
+	if len(sps) < 4 || pps == nil {
+		return errors.New("AVC sequence header without SPS and PPS")
+	}
+	s.sps, s.pps = append([]byte(nil), sps...), append([]byte(nil), pps...)
+
+	if s.video == nil {
+		codec := h264Capability(sps)
+		var err error
+		if s.video, err = s.session.addTrack(codec, webrtc.RTPCodecTypeVideo, nil, nil); err != nil {
+			return err
+		}
+		s.session.publisher.log(rtmpLog).infof("[publisher %s] Publisher video track video initialized (%s).", s.session.publisher.id, codec.SDPFmtpLine)
+	}
+	return nil
+}
+
+// H264 codec of a track, with the profile of its SPS or the constrained
+// baseline profile all viewers decode when there is none
+func h264Capability(sps []byte) webrtc.RTPCodecCapability {
+	profile := "42e01f"
+	if len(sps) >= 4 {
+		profile = fmt.Sprintf("%02x%02x%02x", sps[1], sps[2], sps[3])
+	}
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+	}
+}
+
+func appendAnnexB(frame, nalu []byte) []byte {
+	return append(append(frame, 0, 0, 0, 1), nalu...)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The stream ends once the sender was silent for this long, the ports stay
+// open for it to go live again
+const rtpIngestTimeout = 5 * time.Second
+
+var rtpIngestLog = newLogger("rtpingest")
+
+var (
+	rtpIngests   = make(map[string]*rtpIngest)
+	rtpIngestsMu sync.Mutex
+)
+
+// UDP ports a stream is published on as plain RTP, e.g. by
+// ffmpeg -f rtp or a GStreamer udpsink. The first host sending is the
+// publisher until it goes silent, packets of other hosts are dropped.
+type rtpIngest struct {
+	stream  string
+	owner   *account
+	key     *streamKey
+	ports   []*rtpIngestPort
+	done    chan struct{}
+	stopped chan struct{}
+	readers sync.WaitGroup
+
+	mu         sync.Mutex
+	sender     net.IP
+	session    *ingestSession
+	lastPacket time.Time
+	state      string
+	since      time.Time
+	lastError  string
+}
+
+// Port receiving the RTP of one kind
+type rtpIngestPort struct {
+	kind  webrtc.RTPCodecType
+	name  string
+	codec webrtc.RTPCodecCapability
+	conn  *net.UDPConn
+	track *ingestTrack
+}
+
+// State of an RTP ingest as returned by the API
+type rtpIngestStatus struct {
+	Stream    string               `json:"stream"`
+	State     string               `json:"state"`
+	Since     *time.Time           `json:"since,omitempty"`
+	Sender    string               `json:"sender,omitempty"`
+	LastError string               `json:"lastError,omitempty"`
+	Video     *rtpIngestPortStatus `json:"video,omitempty"`
+	Audio     *rtpIngestPortStatus `json:"audio,omitempty"`
+}
+
+type rtpIngestPortStatus struct {
+	Codec string `json:"codec"`
+	Port  int    `json:"port"`
+}
+
+// Codec of RTP sent to an ingest port, by the names of ?codec=
+func rtpIngestCodec(name string) (webrtc.RTPCodecCapability, bool) {
+	mimeType, ok := codecNames[strings.ToLower(name)]
+	if !ok {
+		return webrtc.RTPCodecCapability{}, false
+	}
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		return h264Capability(nil), true
+	case webrtc.MimeTypeOpus:
+		return webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, true
+	case webrtc.MimeTypeG722, webrtc.MimeTypePCMU, webrtc.MimeTypePCMA:
+		return webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 8000}, true
+	default:
+		return webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}, true
+	}
+}
+
+// Host an RTP ingest publishes from
+type rtpSender struct {
+	ip net.IP
+}
+
+func (s rtpSender) protocol() string { return "rtp" }
+func (s rtpSender) remote() string   { return s.ip.String() }
+
+// Open a UDP port for each codec, video or audio may be empty
+func startRTPIngest(stream string, owner *account, key *streamKey, video, audio string) (*rtpIngest, error) {
+	i := &rtpIngest{stream: stream, owner: owner, key: key, done: make(chan struct{}), stopped: make(chan struct{})}
+	for _, p := range []*rtpIngestPort{{kind: webrtc.RTPCodecTypeVideo, name: video}, {kind: webrtc.RTPCodecTypeAudio, name: audio}} {
+		if p.name == "" {
+			continue
+		}
+		codec, ok := rtpIngestCodec(p.name)
+		if !ok || !strings.HasPrefix(codec.MimeType, p.kind.String()+"/") {
+			i.closePorts()
+			return nil, newSignalingError(http.StatusBadRequest, "Invalid "+p.kind.String()+" codec "+p.name)
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			i.closePorts()
+			return nil, err
+		}
+		p.name, p.codec, p.conn = strings.ToLower(p.name), codec, conn
+		i.ports = append(i.ports, p)
+	}
+	if len(i.ports) == 0 {
+		return nil, newSignalingError(http.StatusBadRequest, "Missing video or audio codec")
+	}
+
+	i.setState("waiting", "")
+	for _, p := range i.ports {
+		i.readers.Add(1)
+		go i.read(p)
+	}
+	go i.run()
+	rtpIngestLog.withStream(stream).infof("Receiving RTP on %s.", i.portList())
+	return i, nil
+}
+
+func (i *rtpIngest) portList() string {
+	var ports []string
+	for _, p := range i.ports {
+		ports = append(ports, p.kind.String()+" "+p.conn.LocalAddr().String())
+	}
+	return strings.Join(ports, ", ")
+}
+
+// Stop receiving and wait for the publisher to leave
+func (i *rtpIngest) stop() {
+	close(i.done)
+	<-i.stopped
+}
+
+// Stop all RTP ingests, on shutdown
+func stopRTPIngests() {
+	rtpIngestsMu.Lock()
+	defer rtpIngestsMu.Unlock()
+	for stream, i := range rtpIngests {
+		i.stop()
+		delete(rtpIngests, stream)
+	}
+}
+
+func (i *rtpIngest) closePorts() {
+	for _, p := range i.ports {
+		p.conn.Close()
+	}
+}
+
+// End the publishing session once the sender went silent, another
+// publisher took over or the ingest was stopped
+func (i *rtpIngest) run() {
+	defer close(i.stopped)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	slog := rtpIngestLog.withStream(i.stream)
+
+	for {
+		var takenOver <-chan struct{}
+		i.mu.Lock()
+		if i.session != nil {
+			takenOver = i.session.done()
+		}
+		i.mu.Unlock()
+
+		select {
+		case <-tick.C:
+			i.mu.Lock()
+			if i.session != nil && time.Since(i.lastPacket) > rtpIngestTimeout {
+				slog.infof("No RTP from %s for %v, stream ended.", i.sender, rtpIngestTimeout)
+				i.endSession()
+				i.setStateLocked("waiting", "")
+			}
+			i.mu.Unlock()
+		case <-takenOver:
+			if i.key.revoked() {
+				slog.infof("Stream key revoked, no longer receiving RTP.")
+			} else {
+				slog.infof("Stream taken over, no longer receiving RTP.")
+			}
+			i.closePorts()
+			i.readers.Wait()
+			i.mu.Lock()
+			i.endSession()
+			i.setStateLocked("stopped", errTakenOver.Error())
+			i.mu.Unlock()
+			return
+		case <-i.done:
+			i.closePorts()
+			i.readers.Wait()
+			i.mu.Lock()
+			i.endSession()
+			i.setStateLocked("stopped", "")
+			i.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (i *rtpIngest) read(p *rtpIngestPort) {
+	defer i.readers.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		i.write(p, addr, packet)
+	}
+}
+
+// Publish a packet of the sender, going live on the first one
+func (i *rtpIngest) write(p *rtpIngestPort, addr *net.UDPAddr, packet *rtp.Packet) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.sender != nil && !i.sender.Equal(addr.IP) {
+		return
+	}
+	if i.session == nil && i.key.revoked() {
+		return
+	}
+	if i.session == nil {
+		if err := i.startSession(addr.IP); err != nil {
+			rtpIngestLog.withStream(i.stream).errorf("Error publishing RTP from %s: %v", addr.IP, err)
+			return
+		}
+	}
+	i.lastPacket = time.Now()
+	p.track.writeRTP(packet)
+}
+
+func (i *rtpIngest) startSession(sender net.IP) error {
+	i.sender = sender
+	session := newIngestSession(rtpSender{ip: sender}, i.stream, i.owner)
+	for _, p := range i.ports {
+		t, err := session.addTrack(p.codec, p.kind, nil, nil)
+		if err != nil {
+			session.close()
+			i.sender = nil
+			return err
+		}
+		p.track = t
+	}
+	i.session = session
+	session.takeOver()
+	trackStreamKey(i.key, i.stream, session.publisher)
+	i.setStateLocked("live", "")
+	session.publisher.log(rtpIngestLog).infof("[publisher %s] Publishing RTP from %s.", session.publisher.id, sender)
+	return nil
+}
+
+func (i *rtpIngest) endSession() {
+	if i.session != nil {
+		i.session.close()
+		i.session = nil
+	}
+	i.sender = nil
+}
+
+func (i *rtpIngest) setState(state, lastError string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.setStateLocked(state, lastError)
+}
+
+func (i *rtpIngest) setStateLocked(state, lastError string) {
+	if state != i.state {
+		i.since = time.Now()
+	}
+	i.state = state
+	if lastError != "" || state == "live" {
+		i.lastError = lastError
+	}
+}
+
+func (i *rtpIngest) status() rtpIngestStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	since := i.since
+	st := rtpIngestStatus{Stream: i.stream, State: i.state, Since: &since, LastError: i.lastError}
+	if i.sender != nil {
+		st.Sender = i.sender.String()
+	}
+	for _, p := range i.ports {
+		ps := &rtpIngestPortStatus{Codec: p.name, Port: p.conn.LocalAddr().(*net.UDPAddr).Port}
+		if p.kind == webrtc.RTPCodecTypeVideo {
+			st.Video = ps
+		} else {
+			st.Audio = ps
+		}
+	}
+	return st
+}
+
+// Codec names of the ports, to tell whether a start changes them
+func (i *rtpIngest) codecs() (video, audio string) {
+	for _, p := range i.ports {
+		if p.kind == webrtc.RTPCodecTypeVideo {
+			video = p.name
+		} else {
+			audio = p.name
+		}
+	}
+	return video, audio
+}
+
+// Handler for POST /api/streams/{stream}/rtp, for the stream's owner:
+// {"action": "start", "video": "h264", "audio": "opus"} opens a UDP port
+// for each codec and publishes the RTP sent there, e.g. with
+// ffmpeg -c:v libx264 -f rtp rtp://server:port, {"action": "stop"} closes
+// them. Starting takes the publish token and stream key WebRTC publishers
+// need.
+func rtpIngestHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	var req struct {
+		Action string `json:"action"`
+		Video  string `json:"video"`
+		Audio  string `json:"audio"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	rtpIngestsMu.Lock()
+	defer rtpIngestsMu.Unlock()
+
+	i := rtpIngests[stream]
+	switch req.Action {
+	case "start":
+		key, owner, err := authorizePublisher(publishToken(r), streamKeyParam(r), stream, currentAccount(r))
+		if err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+		if i != nil {
+			video, audio := i.codecs()
+			if video != strings.ToLower(req.Video) || audio != strings.ToLower(req.Audio) || i.status().State == "stopped" {
+				i.stop()
+				delete(rtpIngests, stream)
+				i = nil
+			}
+		}
+		if i == nil {
+			var err error
+			if i, err = startRTPIngest(stream, owner, key, req.Video, req.Audio); err != nil {
+				writeSignalingError(w, err)
+				return
+			}
+			rtpIngests[stream] = i
+		}
+	case "stop":
+		if i == nil {
+			http.Error(w, "Stream has no RTP ingest", http.StatusNotFound)
+			return
+		}
+		i.stop()
+		delete(rtpIngests, stream)
+		rtpIngestLog.withStream(stream).infof("Stopped receiving RTP on %s.", i.portList())
+		i = nil
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	status := rtpIngestStatus{Stream: stream, State: "stopped"}
+	if i != nil {
+		status = i.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
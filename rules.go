@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// How often the rules are applied again to the live streams, picking up
+	// changes made on other instances sharing the session store
+	rulesCheckInterval = 15 * time.Second
+	// Longest a webhook may take to answer
+	webhookTimeout = 5 * time.Second
+)
+
+// Kind of the rules in the session store
+const storeRules = "rule"
+
+var rulesLog = newLogger("rules")
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Policy for every stream carrying all of its tags, instead of configuring
+// each stream: an output attached while such a stream is live on this
+// instance, e.g. recording all streams tagged "qa", or a webhook told when
+// one goes live and ends. Rules are kept in the session store, so instances
+// sharing it use the same.
+type streamRule struct {
+	ID      string         `json:"id"`
+	Tags    []string       `json:"tags"`
+	Egress  *egressRequest `json:"egress,omitempty"`
+	Webhook string         `json:"webhook,omitempty"`
+	// Key of the HMAC-SHA256 in the X-SFU-Signature header of webhook
+	// requests, not returned by the API
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Event sent to the webhooks of the rules matching a stream
+type streamEvent struct {
+	Event     string    `json:"event"`
+	Stream    string    `json:"stream"`
+	Tags      []string  `json:"tags"`
+	Publisher string    `json:"publisher"`
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+}
+
+// Whether a stream with the tags has every tag of the rule
+func (rule streamRule) matches(tags []string) bool {
+	for _, t := range rule.Tags {
+		if !slices.Contains(tags, t) {
+			return false
+		}
+	}
+	return len(rule.Tags) > 0
+}
+
+// Rules of the session store, oldest first
+func listRules() []streamRule {
+	values, err := sessions.list(storeRules)
+	if err != nil {
+		rulesLog.warnf("Error loading rules: %v", err)
+		return nil
+	}
+	rules := make([]streamRule, 0, len(values))
+	for _, data := range values {
+		var rule streamRule
+		if err := json.Unmarshal(data, &rule); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Created.Before(rules[j].Created) })
+	return rules
+}
+
+// An output attached by an egress rule
+type ruleEgress struct {
+	egress
+	rule string
+}
+
+func (e *ruleEgress) status() egressStatus {
+	st := e.egress.status()
+	st.Rule = e.rule
+	return st
+}
+
+// Attach the outputs of the egress rules matching a stream live on this
+// instance, and detach those of rules that no longer match its tags or are
+// gone. Outputs stay attached once the stream ends, as others do.
+func applyStreamRules(stream string, rules []streamRule) {
+	tags := getMetadata(stream).Tags
+	room := getRoom(stream)
+	live := room != nil && room.getPublisher() != nil && !services.isStopping()
+	elog := egressLog.withStream(stream)
+
+	egressesMu.Lock()
+	var stale []egress
+	attached := map[string]bool{}
+	kept := make([]egress, 0, len(egresses[stream]))
+	for _, e := range egresses[stream] {
+		if re, ok := e.(*ruleEgress); ok {
+			i := slices.IndexFunc(rules, func(rule streamRule) bool { return rule.ID == re.rule })
+			if i < 0 || !rules[i].matches(tags) {
+				stale = append(stale, e)
+				continue
+			}
+			attached[re.rule] = true
+		}
+		kept = append(kept, e)
+	}
+	if len(kept) > 0 {
+		egresses[stream] = kept
+	} else {
+		delete(egresses, stream)
+	}
+	for _, rule := range rules {
+		if !live || rule.Egress == nil || attached[rule.ID] || !rule.matches(tags) {
+			continue
+		}
+		e, err := startEgress(stream, *rule.Egress)
+		if err != nil {
+			elog.warnf("Error attaching %s output of rule %s: %v", rule.Egress.Type, rule.ID, err)
+			continue
+		}
+		egresses[stream] = append(egresses[stream], &ruleEgress{egress: e, rule: rule.ID})
+		elog.infof("Attached %s output %s for rule %s.", rule.Egress.Type, e.egressID(), rule.ID)
+	}
+	egressesMu.Unlock()
+
+	for _, e := range stale {
+		re := e.(*ruleEgress)
+		typ := re.status().Type
+		e.stop()
+		elog.infof("Detached %s output %s, rule %s no longer matches.", typ, e.egressID(), re.rule)
+	}
+}
+
+// Apply the rules to every stream live on this instance or with outputs
+// attached by rules
+func applyRules() {
+	rules := listRules()
+	streams := map[string]bool{}
+	for _, room := range listRooms() {
+		if room.getPublisher() != nil {
+			streams[room.name] = true
+		}
+	}
+	egressesMu.Lock()
+	for stream, list := range egresses {
+		for _, e := range list {
+			if _, ok := e.(*ruleEgress); ok {
+				streams[stream] = true
+			}
+		}
+	}
+	egressesMu.Unlock()
+	for stream := range streams {
+		applyStreamRules(stream, rules)
+	}
+}
+
+func runRules(ctx context.Context) error {
+	ticker := time.NewTicker(rulesCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			applyRules()
+		}
+	}
+}
+
+// A publisher went live on the stream or ended it: attach the outputs of
+// the matching rules once it is live and call their webhooks
+func streamChanged(stream, event string, p *Publisher) {
+	rules := listRules()
+	if event == "stream.live" {
+		applyStreamRules(stream, rules)
+	}
+	tags := getMetadata(stream).Tags
+	ev := streamEvent{Event: event, Stream: stream, Tags: tags, Publisher: p.id, Instance: settings.InstanceID, Time: time.Now()}
+	for _, rule := range rules {
+		if rule.Webhook != "" && rule.matches(tags) {
+			callWebhook(rule, ev)
+		}
+	}
+}
+
+func callWebhook(rule streamRule, ev streamEvent) {
+	wlog := rulesLog.withStream(ev.Stream)
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, rule.Webhook, bytes.NewReader(body))
+	if err != nil {
+		wlog.warnf("Error calling webhook of rule %s: %v", rule.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SFU-Event", ev.Event)
+	if rule.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(rule.Secret))
+		mac.Write(body)
+		req.Header.Set("X-SFU-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		wlog.warnf("Error calling webhook of rule %s: %v", rule.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		wlog.warnf("Webhook of rule %s answered %s to %s.", rule.ID, resp.Status, ev.Event)
+		return
+	}
+	wlog.debugf("Webhook of rule %s told of %s.", rule.ID, ev.Event)
+}
+
+// Handler for GET /api/admin/rules, the egress and webhook rules with their
+// secrets left out
+func listRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules := listRules()
+	for i := range rules {
+		rules[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// Handler for POST /api/admin/rules, adding a rule for the streams with
+// all of its tags, with an output to attach or a webhook to call:
+//
+//	{"tags": ["qa"], "egress": {"type": "record", "format": "webm"}}
+//	{"tags": ["event", "eu"], "egress": {"type": "rtmp", "url": "rtmp://..."}}
+//	{"tags": ["qa"], "webhook": "https://example.com/hook", "secret": "..."}
+//
+// Webhooks get a POST of {"event": "stream.live", "stream": ...} as a
+// publisher goes live and "stream.ended" as it leaves.
+func createRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule streamRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid rule", http.StatusBadRequest)
+		return
+	}
+	tags, err := parseTags(rule.Tags)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if len(tags) == 0 {
+		http.Error(w, "A rule needs tags", http.StatusBadRequest)
+		return
+	}
+	if (rule.Egress == nil) == (rule.Webhook == "") {
+		http.Error(w, "A rule has either an egress or a webhook", http.StatusBadRequest)
+		return
+	}
+	if rule.Egress != nil {
+		if err := rule.Egress.validate(); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+	}
+	if rule.Webhook != "" {
+		if u, err := url.Parse(rule.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "Invalid webhook URL, expected http:// or https://", http.StatusBadRequest)
+			return
+		}
+	}
+	rule.ID, rule.Tags, rule.Created = newID(), tags, time.Now()
+
+	data, err := json.Marshal(rule)
+	if err == nil {
+		err = sessions.put(storeRules, rule.ID, data, 0)
+	}
+	if err != nil {
+		rulesLog.errorf("Error saving rule: %v", err)
+		http.Error(w, "Could not save rule", http.StatusInternalServerError)
+		return
+	}
+	rulesLog.infof("Rule %s added for tags %v.", rule.ID, rule.Tags)
+	go applyRules()
+
+	rule.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// Handler for DELETE /api/admin/rules/{id}, removing a rule and detaching
+// the outputs it attached on this instance, those of other instances once
+// they apply the rules again
+func deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := sessions.get(storeRules, id); err == errNotStored {
+		http.Error(w, "No such rule", http.StatusNotFound)
+		return
+	}
+	if err := sessions.remove(storeRules, id); err != nil {
+		rulesLog.errorf("Error removing rule %s: %v", id, err)
+		http.Error(w, "Could not remove rule", http.StatusInternalServerError)
+		return
+	}
+	rulesLog.infof("Rule %s removed.", id)
+	applyRules()
+	w.WriteHeader(http.StatusNoContent)
+}
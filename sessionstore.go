@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long the record of a peer outlives its instance when that stops
+	// without removing it, and how often running instances renew them
+	peerRecordTTL     = 90 * time.Second
+	peerRecordRefresh = 30 * time.Second
+
+	// Longest a call to the session store may take
+	sessionStoreTimeout = 2 * time.Second
+)
+
+// Kinds of records in the session store
+const (
+	storePeers    = "peer"
+	storeMetadata = "metadata"
+)
+
+var errNotStored = errors.New("not in the session store")
+
+var storeLog = newLogger("store")
+
+// Keeps signaling state outside of the peers' PeerConnections: the record of
+// every peer and the metadata of streams. The memory store is lost with the
+// process, the Redis store keeps it across restarts and shares it between
+// instances behind a load balancer. PeerConnections themselves can't be
+// stored; a peer's record only says which instance holds it.
+type sessionStore interface {
+	// Save a value under its kind and key, dropped after ttl unless 0
+	put(kind, key string, value []byte, ttl time.Duration) error
+	// The value saved under kind and key, errNotStored if there's none
+	get(kind, key string) ([]byte, error)
+	remove(kind, key string) error
+	// Every value saved under kind, by key
+	list(kind string) (map[string][]byte, error)
+	// Whether the store answers, for /readyz
+	ping(ctx context.Context) error
+	close() error
+}
+
+// Session store of the server, memoryStore unless -session-store is given
+var sessions sessionStore = newMemoryStore()
+
+// Where a publisher or viewer is connected, as saved in the session store
+type peerRecord struct {
+	ID       string    `json:"id"`
+	Role     string    `json:"role"`
+	Stream   string    `json:"stream"`
+	Instance string    `json:"instance"`
+	Created  time.Time `json:"created"`
+	// Correlation ID the peer's messages are logged with
+	Request string `json:"request,omitempty"`
+}
+
+// Open the store of -session-store and forget the peers this instance left
+// in it when it last stopped without removing them
+func openSessionStore(url string) error {
+	if url == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	s := &redisStore{client: redis.NewClient(opts)}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.close()
+		return err
+	}
+	sessions = s
+	storeLog.infof("Keeping sessions in Redis at %s as instance %s.", opts.Addr, settings.InstanceID)
+
+	stale := 0
+	for _, rec := range listPeerRecords() {
+		if rec.Instance == settings.InstanceID {
+			sessions.remove(storePeers, rec.ID)
+			stale++
+		}
+	}
+	if stale > 0 {
+		storeLog.infof("Forgot %d sessions left from the previous run.", stale)
+	}
+	return nil
+}
+
+// Renew the records of the instance's peers until ctx is done, then close
+// the store. Added first so it stops after the peers left.
+func runSessionStore(ctx context.Context) error {
+	ticker := time.NewTicker(peerRecordRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			peersMu.Lock()
+			list := make([]*peer, 0, len(peers))
+			for _, p := range peers {
+				list = append(list, p)
+			}
+			peersMu.Unlock()
+			for _, p := range list {
+				p.saveRecord()
+			}
+		case <-ctx.Done():
+			return sessions.close()
+		}
+	}
+}
+
+// Save or renew the peer's record
+func (p *peer) saveRecord() {
+	rec := peerRecord{ID: p.id, Role: p.role, Stream: p.stream, Instance: settings.InstanceID, Created: p.created, Request: p.request}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = sessions.put(storePeers, p.id, data, peerRecordTTL)
+	}
+	if err != nil {
+		p.log(storeLog).warnf("[%s %s] Error saving session: %v", p.role, p.id, err)
+	}
+}
+
+func (p *peer) removeRecord() {
+	if err := sessions.remove(storePeers, p.id); err != nil {
+		p.log(storeLog).warnf("[%s %s] Error removing session: %v", p.role, p.id, err)
+	}
+}
+
+// Record of a peer, on this instance or another one
+func lookupPeerRecord(id string) (peerRecord, bool) {
+	var rec peerRecord
+	data, err := sessions.get(storePeers, id)
+	if err != nil {
+		if err != errNotStored {
+			storeLog.warnf("Error looking up session %s: %v", id, err)
+		}
+		return rec, false
+	}
+	return rec, json.Unmarshal(data, &rec) == nil
+}
+
+// Records of the peers of every instance, oldest first
+func listPeerRecords() []peerRecord {
+	values, err := sessions.list(storePeers)
+	if err != nil {
+		storeLog.warnf("Error listing sessions: %v", err)
+	}
+	list := make([]peerRecord, 0, len(values))
+	for _, data := range values {
+		var rec peerRecord
+		if json.Unmarshal(data, &rec) == nil {
+			list = append(list, rec)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Answer a request for a peer this instance doesn't have: 421 naming the
+// instance holding it, so a load balancer or client can retry there, or 404
+func unknownPeer(w http.ResponseWriter, id, role string) {
+	if rec, ok := lookupPeerRecord(id); ok && rec.Role == role && rec.Instance != settings.InstanceID {
+		w.Header().Set("X-SFU-Instance", rec.Instance)
+		http.Error(w, "Peer is connected to instance "+rec.Instance, http.StatusMisdirectedRequest)
+		return
+	}
+	http.Error(w, "Unknown peer", http.StatusNotFound)
+}
+
+// Session store of a single instance, lost when it stops
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (s *memoryStore) put(kind, key string, value []byte, ttl time.Duration) error {
+	e := memoryEntry{value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	s.entries[kind+":"+key] = e
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) get(kind, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[kind+":"+key]
+	if !ok || e.expired() {
+		return nil, errNotStored
+	}
+	return e.value, nil
+}
+
+func (s *memoryStore) remove(kind, key string) error {
+	s.mu.Lock()
+	delete(s.entries, kind+":"+key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) list(kind string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string][]byte)
+	for k, e := range s.entries {
+		if key, ok := strings.CutPrefix(k, kind+":"); ok {
+			if e.expired() {
+				delete(s.entries, k)
+				continue
+			}
+			values[key] = e.value
+		}
+	}
+	return values, nil
+}
+
+func (s *memoryStore) ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
+
+func (e memoryEntry) expired() bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+// Session store in Redis, with keys like sfu:peer:<id>
+type redisStore struct {
+	client *redis.Client
+}
+
+const redisKeyPrefix = "sfu:"
+
+func redisKey(kind, key string) string {
+	return redisKeyPrefix + kind + ":" + key
+}
+
+func (s *redisStore) put(kind, key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	return s.client.Set(ctx, redisKey(kind, key), value, ttl).Err()
+}
+
+func (s *redisStore) get(kind, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	value, err := s.client.Get(ctx, redisKey(kind, key)).Bytes()
+	if err == redis.Nil {
+		return nil, errNotStored
+	}
+	return value, err
+}
+
+func (s *redisStore) remove(kind, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	return s.client.Del(ctx, redisKey(kind, key)).Err()
+}
+
+func (s *redisStore) list(kind string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+
+	var keys []string
+	iter := s.client.Scan(ctx, 0, redisKey(kind, "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	// Keys expiring in between come back as nil
+	results, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range results {
+		if v, ok := v.(string); ok {
+			values[strings.TrimPrefix(keys[i], redisKey(kind, ""))] = []byte(v)
+		}
+	}
+	return values, nil
+}
+
+func (s *redisStore) ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Answer to signaling once the server started shutting down
+var errShuttingDown = newSignalingError(http.StatusServiceUnavailable, "Server is shutting down")
+
+var shutdownLog = newLogger("shutdown")
+
+var (
+	// Open signaling sockets, told when the server shuts down
+	wsSessions   = make(map[*wsSession]bool)
+	wsSessionsMu sync.Mutex
+)
+
+// Whether the server is shutting down and refuses new sessions
+func (l *lifecycle) isStopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+// Close every session on shutdown, before the HTTP server stops: signaling
+// sockets get a {"type":"shutdown"} message and are closed, then the
+// PeerConnections of viewers, WebRTC publishers and monitors are closed, so
+// browsers see the connection close right away instead of failing after a
+// timeout. Recordings of the publishers are finished as they leave.
+func drainPeers() {
+	wsSessionsMu.Lock()
+	sockets := make([]*wsSession, 0, len(wsSessions))
+	for s := range wsSessions {
+		sockets = append(sockets, s)
+	}
+	wsSessionsMu.Unlock()
+	for _, s := range sockets {
+		s.send(signalMessage{Type: "shutdown"})
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"), time.Now().Add(time.Second))
+		s.conn.Close()
+	}
+
+	closed := 0
+	for _, room := range listRooms() {
+		for _, v := range room.getViewers() {
+			room.closeViewer(v)
+			closed++
+		}
+		// Publishers of other protocols are stopped with their ingest
+		if p := room.getPublisher(); p != nil && p.pc != nil {
+			room.closePublisher(p)
+			closed++
+		}
+	}
+	peersMu.Lock()
+	rest := make([]*peer, 0, len(peers))
+	for _, p := range peers {
+		rest = append(rest, p)
+	}
+	peersMu.Unlock()
+	for _, p := range rest {
+		p.close(func() {})
+		closed++
+	}
+	shutdownLog.infof("Closed %d signaling sockets and %d sessions.", len(sockets), closed)
+}
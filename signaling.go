@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Error from negotiation, carrying the HTTP status to report it with
+type signalingError struct {
+	status  int
+	message string
+}
+
+func newSignalingError(status int, message string) *signalingError {
+	return &signalingError{status: status, message: message}
+}
+
+func (e *signalingError) Error() string {
+	return e.message
+}
+
+// Reply to a failed negotiation with the status carried by the error
+func writeSignalingError(w http.ResponseWriter, err error) {
+	if sigErr, ok := err.(*signalingError); ok {
+		http.Error(w, sigErr.message, sigErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of signed stream URLs, e.g.
+// /watch/demo?expires=1760000000&signature=...
+const (
+	signedURLExpires   = "expires"
+	signedURLSignature = "signature"
+	// Longest a signed URL made by /api/streams/{stream}/signed-url is valid
+	maxSignedURLValidity = 30 * 24 * time.Hour
+	// Validity of signed URLs made without an expiresIn
+	defaultSignedURLValidity = 24 * time.Hour
+)
+
+// Signature of the stream's URLs valid until expires, in Unix seconds: the
+// hex HMAC-SHA256 of "<stream>:<expires>" with -url-signing-secret. It
+// covers the stream rather than a path, so the same query string opens the
+// watch page, the HLS playlist and its segments, and viewer signaling. The
+// same stream and expiry always give the same URL, so CDNs can cache it.
+func streamSignature(stream string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(settings.URLSigningSecret))
+	mac.Write([]byte(stream + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of the request's URL for the stream. Whether it is
+// signed; an error when it carries a signature that is invalid or expired.
+func checkSignedURL(r *http.Request, stream string) (bool, error) {
+	q := r.URL.Query()
+	signature := q.Get(signedURLSignature)
+	if signature == "" {
+		return false, nil
+	}
+	if settings.URLSigningSecret == "" {
+		return false, newSignalingError(http.StatusForbidden, "Signed URLs are disabled")
+	}
+	expires, err := strconv.ParseInt(q.Get(signedURLExpires), 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(streamSignature(stream, expires))) {
+		return false, newSignalingError(http.StatusForbidden, "Invalid URL signature")
+	}
+	if time.Now().Unix() > expires {
+		return false, newSignalingError(http.StatusForbidden, "Signed URL expired")
+	}
+	return true, nil
+}
+
+// Query string granting access to a stream's media that the request came
+// with, its ?token= or signature, for the URLs of a page or playlist to
+// carry on. Empty when there's none.
+func viewQuery(r *http.Request) string {
+	q := r.URL.Query()
+	carried := url.Values{}
+	for _, name := range []string{"token", signedURLExpires, signedURLSignature} {
+		if v := q.Get(name); v != "" {
+			carried.Set(name, v)
+		}
+	}
+	return carried.Encode()
+}
+
+// Append the request's access query to the segment URIs of an HLS playlist,
+// players resolve them against the playlist URL without its query
+func signPlaylist(playlist []byte, query string) []byte {
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines[i] = line + "?" + query
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Handler for POST /api/streams/{stream}/signed-url, signed URLs of the
+// stream for sharing: {"expiresIn": "2h"}, 24h when omitted. Answers
+//
+//	{"expires": "...", "query": "expires=...&signature=...", "watch": "https://host/watch/demo?...", "hls": "..."}
+//
+// They open the stream until they expire, private streams included.
+func signedURLHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	if settings.URLSigningSecret == "" {
+		http.Error(w, "Signed URLs are disabled", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		ExpiresIn string `json:"expiresIn"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	validity := defaultSignedURLValidity
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxSignedURLValidity {
+			http.Error(w, "expiresIn must be a positive duration up to "+maxSignedURLValidity.String(), http.StatusBadRequest)
+			return
+		}
+		validity = d
+	}
+
+	expires := time.Now().Add(validity).Unix()
+	query := url.Values{}
+	query.Set(signedURLExpires, strconv.FormatInt(expires, 10))
+	query.Set(signedURLSignature, streamSignature(stream, expires))
+	encoded := query.Encode()
+	base := externalURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expires": time.Unix(expires, 0).UTC(),
+		"query":   encoded,
+		"watch":   base + "/watch/" + url.PathEscape(stream) + "?" + encoded,
+		"hls":     base + "/hls/" + url.PathEscape(stream) + "/" + hlsPlaylist + "?" + encoded,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/image/vp8"
+)
+
+// JPEG quality of stream thumbnails
+const thumbnailQuality = 75
+
+var (
+	thumbnails   = make(map[string]*thumbnail)
+	thumbnailsMu sync.Mutex
+)
+
+// Thumbnail of a stream and the keyframe it was decoded from
+type thumbnail struct {
+	fanout    *trackFanout
+	timestamp uint32
+	jpeg      []byte
+	created   time.Time
+}
+
+// Thumbnail of the stream's current video, decoded from the keyframe of its
+// GOP cache. Only VP8 can be decoded; a new one is made per keyframe.
+func streamThumbnail(stream string) (*thumbnail, error) {
+	room := getRoom(stream)
+	if room == nil {
+		return nil, newSignalingError(http.StatusNotFound, "Stream is not live")
+	}
+	var video *trackFanout
+	for _, t := range room.tracks() {
+		if t.Kind() == webrtc.RTPCodecTypeVideo && strings.EqualFold(t.Codec().MimeType, webrtc.MimeTypeVP8) {
+			video = t
+			break
+		}
+	}
+	if video == nil {
+		return nil, newSignalingError(http.StatusNotFound, "Stream has no VP8 video")
+	}
+	packets := video.keyframe()
+	if len(packets) == 0 {
+		return nil, newSignalingError(http.StatusServiceUnavailable, "No keyframe yet")
+	}
+
+	thumbnailsMu.Lock()
+	defer thumbnailsMu.Unlock()
+	if t, ok := thumbnails[stream]; ok && t.fanout == video && t.timestamp == packets[0].Timestamp {
+		return t, nil
+	}
+
+	data, err := decodeVP8Thumbnail(packets)
+	if err != nil {
+		return nil, err
+	}
+	t := &thumbnail{fanout: video, timestamp: packets[0].Timestamp, jpeg: data, created: time.Now()}
+	thumbnails[stream] = t
+
+	// Forget thumbnails of streams that ended
+	for name, other := range thumbnails {
+		if other.fanout.isClosed() {
+			delete(thumbnails, name)
+		}
+	}
+	return t, nil
+}
+
+// Reassemble a VP8 keyframe from its packets and encode it as JPEG
+func decodeVP8Thumbnail(packets []*rtp.Packet) ([]byte, error) {
+	packets = append([]*rtp.Packet(nil), packets...)
+	sort.Slice(packets, func(i, j int) bool {
+		return int16(packets[i].SequenceNumber-packets[j].SequenceNumber) < 0
+	})
+
+	var frame []byte
+	for i, p := range packets {
+		if i > 0 && p.SequenceNumber != packets[i-1].SequenceNumber+1 {
+			return nil, errors.New("keyframe is missing packets")
+		}
+		var depacketizer codecs.VP8Packet
+		payload, err := depacketizer.Unmarshal(p.Payload)
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, payload...)
+	}
+
+	img, err := decodeVP8Frame(frame)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decode a VP8 keyframe, the decoder can't do interframes
+func decodeVP8Frame(frame []byte) (image.Image, error) {
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(frame), len(frame))
+	header, err := d.DecodeFrameHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !header.KeyFrame {
+		return nil, errors.New("not a keyframe")
+	}
+	return d.DecodeFrame()
+}
+
+// Handler for GET /api/streams/{stream}/thumbnail.jpg
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	stream := r.PathValue("stream")
+	if !streamNamePattern.MatchString(stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeView(r, stream); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	t, err := streamThumbnail(stream)
+	if err != nil {
+		var sigErr *signalingError
+		if !errors.As(err, &sigErr) {
+			httpLog.withStream(stream).warnf("Error decoding thumbnail: %v", err)
+			err = newSignalingError(http.StatusServiceUnavailable, "Thumbnail not available")
+		}
+		writeSignalingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=10")
+	http.ServeContent(w, r, "thumbnail.jpg", t.created, bytes.NewReader(t.jpeg))
+}
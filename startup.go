@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+var startupLog = newLogger("startup")
+
+var (
+	startupConnectSeconds = newSummary("sfu_viewer_startup_connect_seconds",
+		"Time from the viewer answer being sent to the PeerConnection reaching connected.")
+	startupFirstRTPSeconds = newSummary("sfu_viewer_startup_first_rtp_seconds",
+		"Time from the viewer answer being sent to the first RTP packet forwarded to it.")
+	startupFirstKeyframeSeconds = newSummary("sfu_viewer_startup_first_keyframe_seconds",
+		"Time from the viewer answer being sent to the first video keyframe forwarded to it.")
+)
+
+// Join timeline of one viewer
+type viewerStartup struct {
+	mu            sync.Mutex
+	viewerID      string
+	stream        string
+	answerSent    time.Time
+	connected     time.Time
+	firstRTP      time.Time
+	firstKeyframe time.Time
+}
+
+func (s *viewerStartup) markAnswerSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answerSent = time.Now()
+}
+
+func (s *viewerStartup) markConnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.connected.IsZero() || s.answerSent.IsZero() {
+		return
+	}
+	s.connected = time.Now()
+	startupConnectSeconds.observe(s.connected.Sub(s.answerSent).Seconds())
+}
+
+// Called for every RTP packet written to the viewer
+func (s *viewerStartup) onRTP(mimeType string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.firstKeyframe.IsZero() || s.answerSent.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	if s.firstRTP.IsZero() {
+		s.firstRTP = now
+		startupFirstRTPSeconds.observe(now.Sub(s.answerSent).Seconds())
+	}
+
+	if strings.HasPrefix(strings.ToLower(mimeType), "video/") && isKeyframe(mimeType, payload) {
+		s.firstKeyframe = now
+		startupFirstKeyframeSeconds.observe(now.Sub(s.answerSent).Seconds())
+		startupLog.withStream(s.stream).withPeer(s.viewerID).infof("[viewer %s] Connected after %s, first RTP after %s, first keyframe after %s", s.viewerID,
+			since(s.answerSent, s.connected), since(s.answerSent, s.firstRTP), since(s.answerSent, s.firstKeyframe))
+	}
+}
+
+// Duration between two marks, zero when the second one has not happened
+func since(from, to time.Time) time.Duration {
+	if to.IsZero() {
+		return 0
+	}
+	return to.Sub(from).Round(time.Millisecond)
+}
+
+// Interceptor factory observing the RTP written to one viewer
+type startupInterceptorFactory struct {
+	startup *viewerStartup
+}
+
+func (f *startupInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &startupInterceptor{startup: f.startup}, nil
+}
+
+type startupInterceptor struct {
+	interceptor.NoOp
+	startup *viewerStartup
+}
+
+func (i *startupInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		i.startup.onRTP(info.MimeType, payload)
+		return writer.Write(header, payload, attributes)
+	})
+}
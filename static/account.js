@@ -0,0 +1,54 @@
+// Login and registration against /api/account, the session is kept in a cookie
+
+document.addEventListener("DOMContentLoaded", () => {
+    document.getElementById("loginButton").addEventListener("click", () => submitAccount("login"));
+    document.getElementById("registerButton").addEventListener("click", () => submitAccount("register"));
+    document.getElementById("logoutButton").addEventListener("click", logout);
+    refreshAccount();
+});
+
+// Show who is logged in, or hide the form when the server has no accounts
+async function refreshAccount() {
+    const response = await fetch("/api/account");
+    if (response.status === 404) {
+        document.getElementById("account").hidden = true;
+        return;
+    }
+    const user = response.ok ? await response.json() : null;
+    showAccount(user);
+}
+
+function showAccount(user) {
+    document.getElementById("accountStatus").textContent = user
+        ? `Logged in as ${user.username}${user.admin ? " (admin)" : ""}`
+        : "Not logged in, log in to publish.";
+    // Logging in with SSO returns to this page, with the query it was opened with
+    const sso = document.getElementById("ssoLogin");
+    if (sso) {
+        sso.href = "/api/account/oidc/login?next=" + encodeURIComponent(location.pathname + location.search);
+    }
+    document.getElementById("loginForm").hidden = !!user;
+    document.getElementById("logoutButton").hidden = !user;
+}
+
+async function submitAccount(action) {
+    const response = await fetch(`/api/account/${action}`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({
+            username: document.getElementById("username").value,
+            password: document.getElementById("password").value,
+        }),
+    });
+    if (!response.ok) {
+        alert(`Could not ${action}: ${(await response.text()).trim()}`);
+        return;
+    }
+    document.getElementById("password").value = "";
+    showAccount(await response.json());
+}
+
+async function logout() {
+    await fetch("/api/account/logout", { method: "POST" });
+    showAccount(null);
+}
@@ -0,0 +1,54 @@
+// Chat of the stream on the "chat" data channel the server opens on every
+// publisher and viewer connection, shown in the page's #chat panel
+function attachChat(pc) {
+    pc.addEventListener("datachannel", (event) => {
+        if (event.channel.label !== "chat") {
+            return;
+        }
+        const channel = event.channel;
+        const panel = document.getElementById("chat");
+        const messages = document.getElementById("chatMessages");
+        const input = document.getElementById("chatInput");
+        const error = document.getElementById("chatError");
+        // The catch-up of a reconnect skips messages already shown
+        let lastSeq = Number(messages.dataset.lastSeq || 0);
+
+        const send = () => {
+            const text = input.value.trim();
+            if (!text || channel.readyState !== "open") {
+                return;
+            }
+            channel.send(JSON.stringify({ text }));
+            input.value = "";
+        };
+        document.getElementById("chatSend").onclick = send;
+        input.onkeydown = (e) => {
+            if (e.key === "Enter") send();
+        };
+
+        channel.onopen = () => {
+            panel.hidden = false;
+        };
+        channel.onclose = () => {
+            error.textContent = "Chat disconnected.";
+        };
+        channel.onmessage = (e) => {
+            const msg = JSON.parse(e.data);
+            if (msg.type === "chat-error") {
+                error.textContent = msg.error;
+                return;
+            }
+            if (msg.type !== "chat" || msg.seq <= lastSeq) {
+                return;
+            }
+            lastSeq = msg.seq;
+            messages.dataset.lastSeq = lastSeq;
+            error.textContent = "";
+            const item = document.createElement("li");
+            const who = msg.from.user || `${msg.from.role} ${msg.from.id.slice(0, 6)}`;
+            item.textContent = `${new Date(msg.time).toLocaleTimeString()} ${who}: ${msg.text}`;
+            messages.appendChild(item);
+            messages.scrollTop = messages.scrollHeight;
+        };
+    });
+}
@@ -0,0 +1,163 @@
+// Endpoints used by each role, the offer ones as the server announces them
+const endpoints = {
+    publisher: { offer: document.body.dataset.publishPath || '/publish', validate: 'publish' },
+    viewer: { offer: document.body.dataset.viewPath || '/view', validate: 'view' },
+};
+
+// Add event listeners when the DOM content is fully loaded
+document.addEventListener("DOMContentLoaded", () => {
+    document.getElementById("validateButton").addEventListener("click", validateOffer);
+    document.getElementById("sendOfferButton").addEventListener("click", sendOffer);
+    document.getElementById("sendCandidateButton").addEventListener("click", sendCandidate);
+    document.getElementById("fetchCandidatesButton").addEventListener("click", fetchCandidates);
+    document.getElementById("followEventsButton").addEventListener("click", followEvents);
+});
+
+// Server-Sent Events of the peer while followed
+let events = null;
+
+// Currently selected role
+function currentEndpoints() {
+    return endpoints[document.getElementById("role").value];
+}
+
+// Append a line to the log panel
+function log(message) {
+    const line = `[${new Date().toLocaleTimeString()}] ${message}\n`;
+    document.getElementById("log").textContent += line;
+    console.log(message);
+}
+
+// Accept either a JSON session description or a raw SDP blob
+function readOffer() {
+    const text = document.getElementById("offer").value.trim();
+    if (text.startsWith("{")) {
+        return JSON.parse(text);
+    }
+    return { type: "offer", sdp: text.replace(/\r?\n/g, "\r\n") };
+}
+
+// POST a JSON body and return the status and raw response text
+async function postJSON(url, body, headers = {}) {
+    const response = await fetch(url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', ...headers },
+        body: JSON.stringify(body)
+    });
+    const text = await response.text();
+    log(`POST ${url} -> ${response.status}`);
+    return { status: response.status, text, peerId: response.headers.get("X-Peer-ID"), peerSecret: response.headers.get("X-Peer-Secret") };
+}
+
+// Pretty print JSON responses, leave anything else untouched
+function formatBody(text) {
+    try {
+        return JSON.stringify(JSON.parse(text), null, 2);
+    } catch (e) {
+        return text;
+    }
+}
+
+// Query string naming the stream
+function streamQuery() {
+    return "stream=" + encodeURIComponent(document.getElementById("stream").value);
+}
+
+async function validateOffer() {
+    try {
+        const url = `/api/validate-offer?role=${currentEndpoints().validate}&${streamQuery()}`;
+        const result = await postJSON(url, readOffer());
+        document.getElementById("answer").textContent = formatBody(result.text);
+    } catch (error) {
+        log(`Error validating offer: ${error}`);
+    }
+}
+
+async function sendOffer() {
+    try {
+        let url = `${currentEndpoints().offer}?${streamQuery()}`;
+        if (document.getElementById("streamed").checked) {
+            url += "&trickle=stream";
+        }
+        const result = await postJSON(url, readOffer());
+        if (result.peerId) {
+            document.getElementById("peerId").value = result.peerId;
+            document.getElementById("peerSecret").value = result.peerSecret;
+            log(`Peer ID ${result.peerId}`);
+        }
+        document.getElementById("answer").textContent = formatBody(result.text);
+    } catch (error) {
+        log(`Error sending offer: ${error}`);
+    }
+}
+
+// Events endpoint of the peer, which takes its candidates on POST
+function eventsURL() {
+    return `${document.body.dataset.eventsPath || "/events/"}${encodeURIComponent(document.getElementById("peerId").value)}`;
+}
+
+function peerSecret() {
+    return document.getElementById("peerSecret").value;
+}
+
+async function sendCandidate() {
+    try {
+        const candidate = JSON.parse(document.getElementById("candidate").value);
+        const result = await postJSON(eventsURL(), candidate, { "X-Peer-Secret": peerSecret() });
+        if (result.text) {
+            log(result.text.trim());
+        }
+    } catch (error) {
+        log(`Error posting candidate: ${error}`);
+    }
+}
+
+// Read the candidates the server gathered so far off the event stream,
+// which starts with them, and close it again
+function fetchCandidates() {
+    const url = `${eventsURL()}?secret=${encodeURIComponent(peerSecret())}`;
+    const stream = new EventSource(url);
+    const panel = document.getElementById("candidates");
+    let count = 0;
+    const done = () => {
+        stream.close();
+        log(`GET ${url} -> ${count} candidate(s)`);
+    };
+    stream.addEventListener("candidate", (event) => {
+        panel.textContent += JSON.stringify(JSON.parse(event.data).candidate) + "\n";
+        count++;
+    });
+    stream.addEventListener("end-of-candidates", done);
+    stream.onerror = done;
+    // Candidates still being gathered come after a moment at most
+    setTimeout(() => stream.readyState !== EventSource.CLOSED && done(), 2000);
+}
+
+function followEvents() {
+    if (events) {
+        events.close();
+    }
+    const url = `${eventsURL()}?secret=${encodeURIComponent(peerSecret())}`;
+    events = new EventSource(url);
+    log(`Following ${url}`);
+    const panel = document.getElementById("candidates");
+    events.addEventListener("candidate", (event) => {
+        panel.textContent += JSON.stringify(JSON.parse(event.data).candidate) + "\n";
+    });
+    events.addEventListener("end-of-candidates", () => log("End of candidates"));
+    for (const type of ["connection-state", "ice-state"]) {
+        events.addEventListener(type, (event) => {
+            const state = JSON.parse(event.data).state;
+            log(`${type}: ${state}`);
+            if (type === "connection-state" && state === "closed") {
+                events.close();
+                events = null;
+            }
+        });
+    }
+    events.onerror = () => {
+        log(`Event stream of ${url} ended`);
+        events.close();
+        events = null;
+    };
+}
@@ -0,0 +1,28 @@
+// Configuration for new peer connections with the server's STUN and TURN
+// servers for the role, "publisher" or "viewer", fetched for each
+// connection since TURN credentials expire
+async function fetchIceConfig(role = "publisher") {
+    try {
+        const response = await fetch(`/api/ice-config?role=${role}`);
+        if (response.ok) {
+            return await response.json();
+        }
+        console.error("Error fetching ICE config:", response.status);
+    } catch (error) {
+        console.error("Error fetching ICE config:", error);
+    }
+    return { iceServers: [{ urls: "stun:stun.l.google.com:19302" }] };
+}
+
+// Setting the server rendered into a data attribute of the page's body,
+// e.g. "signaling" or "socketPath"
+function serverSetting(name, fallback) {
+    return document.body.dataset[name] || fallback;
+}
+
+// URL of the signaling socket, with an optional query
+function signalingSocketURL(query) {
+    const protocol = location.protocol === "https:" ? "wss:" : "ws:";
+    const url = `${protocol}//${location.host}${serverSetting("socketPath", "/ws")}`;
+    return query ? `${url}?${query}` : url;
+}
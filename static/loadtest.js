@@ -0,0 +1,79 @@
+// Load test page: starts synthetic viewers of a stream on the server and
+// shows their aggregate stats every second until the test ends
+
+let currentTest = null;
+let pollTimer = null;
+
+document.addEventListener("DOMContentLoaded", () => {
+    if (!document.getElementById("loadTest")) {
+        return;
+    }
+    document.getElementById("startButton").addEventListener("click", startLoadTest);
+    document.getElementById("stopButton").addEventListener("click", stopLoadTest);
+});
+
+async function startLoadTest() {
+    document.getElementById("error").textContent = "";
+    const response = await fetch("/api/admin/loadtests", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({
+            stream: document.getElementById("stream").value,
+            viewers: Number(document.getElementById("viewers").value),
+            duration: document.getElementById("duration").value,
+        }),
+    });
+    if (!response.ok) {
+        document.getElementById("error").textContent = `Could not start: ${(await response.text()).trim()}`;
+        return;
+    }
+    const test = await response.json();
+    currentTest = test.id;
+    document.getElementById("startButton").disabled = true;
+    document.getElementById("stopButton").disabled = false;
+    showStatus(test);
+    pollTimer = setInterval(pollLoadTest, 1000);
+}
+
+async function stopLoadTest() {
+    if (currentTest) {
+        await fetch(`/api/admin/loadtests/${currentTest}`, { method: "DELETE" });
+    }
+}
+
+async function pollLoadTest() {
+    const response = await fetch(`/api/admin/loadtests/${currentTest}`);
+    if (!response.ok) {
+        finish();
+        return;
+    }
+    const test = await response.json();
+    showStatus(test);
+    if (!test.running) {
+        finish();
+    }
+}
+
+function finish() {
+    clearInterval(pollTimer);
+    currentTest = null;
+    document.getElementById("startButton").disabled = false;
+    document.getElementById("stopButton").disabled = true;
+}
+
+function showStatus(test) {
+    document.getElementById("stats").hidden = false;
+    const set = (id, value) => document.getElementById(id).textContent = value;
+    set("statStream", test.stream);
+    set("statState", test.running ? `running, ${test.viewers} viewers` : "done");
+    set("statConnecting", test.connecting);
+    set("statConnected", test.connected);
+    set("statDisconnected", test.disconnected);
+    set("statFailed", test.failed);
+    set("statConnectTime", `${Math.round(test.connectTime)} ms`);
+    set("statBitrate", `${(test.bitrate / 1e6).toFixed(2)} Mbit/s`);
+    set("statPackets", test.packetsReceived);
+    set("statLost", test.packetsLost);
+    set("statBytes", `${(test.bytesReceived / 1e6).toFixed(1)} MB`);
+    document.getElementById("error").textContent = test.error || "";
+}
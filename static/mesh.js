@@ -0,0 +1,205 @@
+// Mesh room client: connects directly to the other participants with the
+// server relaying signaling, and switches to publishing and viewing through
+// the SFU when the server tells the room to migrate
+
+document.addEventListener("DOMContentLoaded", () => {
+    document.getElementById("joinButton").addEventListener("click", joinMesh);
+});
+
+let localStream;
+let socket;
+let myId;
+let room;
+let migrated = false;
+// Configuration of all peer connections, fetched on joining
+let rtcConfig;
+// IDs of the other members
+const members = new Set();
+// Direct connections, then SFU viewer connections, by member ID
+const peers = new Map();
+
+function setStatus(text) {
+    document.getElementById("meshStatus").textContent = text;
+}
+
+async function joinMesh() {
+    rtcConfig = await fetchIceConfig();
+    localStream = await navigator.mediaDevices.getUserMedia({ video: true, audio: true });
+    showVideo("local", localStream, true);
+    room = document.getElementById("streamName").value;
+
+    socket = new WebSocket(signalingSocketURL());
+    socket.onmessage = (event) => handleMeshMessage(JSON.parse(event.data));
+    socket.onopen = () => socket.send(JSON.stringify({ type: "join-mesh", stream: room }));
+    document.getElementById("joinButton").disabled = true;
+}
+
+async function handleMeshMessage(msg) {
+    switch (msg.type) {
+        case "mesh-joined":
+            myId = msg.id;
+            (msg.peers || []).forEach(id => members.add(id));
+            if (msg.migrated) {
+                migrate();
+                break;
+            }
+            setStatus(`Joined as ${myId}, peer-to-peer`);
+            // The newcomer calls everybody already in the room
+            for (const id of msg.peers || []) {
+                const pc = directConnection(id);
+                const offer = await pc.createOffer();
+                await pc.setLocalDescription(offer);
+                socket.send(JSON.stringify({ type: "mesh-signal", to: id, sdp: offer }));
+            }
+            break;
+
+        case "mesh-peer-joined":
+            members.add(msg.id);
+            if (migrated) {
+                viewMember(msg.id);
+            }
+            break;
+
+        case "mesh-peer-left":
+            members.delete(msg.id);
+            closeMember(msg.id);
+            break;
+
+        case "mesh-signal":
+            await handleSignal(msg);
+            break;
+
+        case "mesh-migrate":
+            migrate();
+            break;
+
+        case "error":
+            console.error("Mesh error:", msg.error);
+            break;
+    }
+}
+
+// Peer connection to another member, created by whoever offers first
+function directConnection(id) {
+    const pc = new RTCPeerConnection(rtcConfig);
+    localStream.getTracks().forEach(track => pc.addTrack(track, localStream));
+    pc.onicecandidate = (event) => {
+        if (event.candidate) {
+            socket.send(JSON.stringify({ type: "mesh-signal", to: id, candidate: event.candidate }));
+        }
+    };
+    pc.ontrack = (event) => showVideo(id, event.streams[0], false);
+    peers.set(id, pc);
+    return pc;
+}
+
+async function handleSignal(msg) {
+    if (migrated) {
+        return;
+    }
+    let pc = peers.get(msg.from);
+    if (msg.sdp) {
+        if (!pc) {
+            pc = directConnection(msg.from);
+        }
+        await pc.setRemoteDescription(msg.sdp);
+        if (msg.sdp.type === "offer") {
+            const answer = await pc.createAnswer();
+            await pc.setLocalDescription(answer);
+            socket.send(JSON.stringify({ type: "mesh-signal", to: msg.from, sdp: answer }));
+        }
+    } else if (msg.candidate && pc) {
+        await pc.addIceCandidate(msg.candidate);
+    }
+}
+
+// Drop the direct connections, publish our media to <room>.<id> and view
+// the stream of every other member
+function migrate() {
+    if (migrated) {
+        return;
+    }
+    migrated = true;
+    setStatus(`Joined as ${myId}, through the SFU`);
+    for (const id of [...peers.keys()]) {
+        closeMember(id);
+    }
+
+    const pc = new RTCPeerConnection(rtcConfig);
+    localStream.getTracks().forEach(track => pc.addTrack(track, localStream));
+    sfuSignal(pc, "publisher", `${room}.${myId}`);
+
+    members.forEach(id => viewMember(id));
+}
+
+// View a member's SFU stream, retrying until it is live
+async function viewMember(id, attempt = 0) {
+    const pc = new RTCPeerConnection(rtcConfig);
+    pc.addTransceiver("video", { direction: "recvonly" });
+    pc.addTransceiver("audio", { direction: "recvonly" });
+    pc.ontrack = (event) => showVideo(id, event.streams[0], false);
+    peers.set(id, pc);
+
+    const ws = await sfuSignal(pc, "viewer", `${room}.${id}`);
+    ws.addEventListener("message", (event) => {
+        const msg = JSON.parse(event.data);
+        if (msg.type === "error" && attempt < 10 && members.has(id) && peers.get(id) === pc) {
+            pc.close();
+            ws.close();
+            setTimeout(() => viewMember(id, attempt + 1), 1000);
+        }
+    });
+}
+
+// Offer/answer and trickle ICE for one SFU connection over its own socket
+async function sfuSignal(pc, role, stream) {
+    const ws = new WebSocket(signalingSocketURL());
+    let answerApplied;
+    const answerSet = new Promise(resolve => answerApplied = resolve);
+    ws.addEventListener("message", async (event) => {
+        const msg = JSON.parse(event.data);
+        if (msg.type === "answer") {
+            await pc.setRemoteDescription(msg.sdp);
+            answerApplied();
+        } else if (msg.type === "candidate") {
+            await answerSet;
+            await pc.addIceCandidate(msg.candidate);
+        }
+    });
+    pc.onicecandidate = (event) => {
+        if (event.candidate) {
+            ws.send(JSON.stringify({ type: "candidate", candidate: event.candidate }));
+        }
+    };
+    await new Promise(resolve => ws.onopen = resolve);
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    ws.send(JSON.stringify({ type: "offer", role: role, stream: stream, sdp: offer }));
+    return ws;
+}
+
+function closeMember(id) {
+    const pc = peers.get(id);
+    if (pc) {
+        pc.close();
+        peers.delete(id);
+    }
+    const video = document.getElementById(`video-${id}`);
+    if (video) {
+        video.remove();
+    }
+}
+
+function showVideo(id, stream, muted) {
+    let video = document.getElementById(`video-${id}`);
+    if (!video) {
+        video = document.createElement("video");
+        video.id = `video-${id}`;
+        video.autoplay = true;
+        video.playsInline = true;
+        video.muted = muted;
+        video.style = "width: 30%; margin: 10px; border: 2px solid black;";
+        document.getElementById("videos").appendChild(video);
+    }
+    video.srcObject = stream;
+}
@@ -0,0 +1,78 @@
+// Operator audio monitor: receives the audio track of every live stream over
+// one connection and mixes them with a shared gain
+
+document.addEventListener("DOMContentLoaded", () => {
+    document.getElementById("listenButton").addEventListener("click", startMonitor);
+});
+
+async function startMonitor() {
+    const monitor = document.getElementById("monitor");
+    const tracks = Number(monitor.dataset.tracks);
+    if (tracks === 0) {
+        alert("No stream is sending audio.");
+        return;
+    }
+
+    const audioContext = new AudioContext();
+    const gain = audioContext.createGain();
+    gain.gain.value = Number(document.getElementById("volume").value);
+    gain.connect(audioContext.destination);
+    document.getElementById("volume").addEventListener("input", (event) => {
+        gain.gain.value = Number(event.target.value);
+    });
+
+    const pc = new RTCPeerConnection();
+    for (let i = 0; i < tracks; i++) {
+        pc.addTransceiver("audio", { direction: "recvonly" });
+    }
+
+    pc.ontrack = (event) => {
+        const [stream] = event.streams;
+        // Chrome only starts decoding remote audio that is attached to an element
+        const audio = new Audio();
+        audio.srcObject = stream;
+        audio.muted = true;
+        audio.play();
+        audioContext.createMediaStreamSource(stream).connect(gain);
+
+        const item = document.createElement("li");
+        item.textContent = stream.id;
+        document.getElementById("streams").appendChild(item);
+    };
+
+    const ws = new WebSocket(signalingSocketURL());
+    let answerApplied;
+    const answerSet = new Promise(resolve => answerApplied = resolve);
+
+    ws.onmessage = async (event) => {
+        const msg = JSON.parse(event.data);
+        switch (msg.type) {
+            case "answer":
+                await pc.setRemoteDescription(msg.sdp);
+                answerApplied();
+                break;
+            case "candidate":
+                await answerSet;
+                await pc.addIceCandidate(msg.candidate);
+                break;
+            case "error":
+                alert(`Monitor error: ${msg.error}`);
+                break;
+        }
+    };
+
+    pc.onicecandidate = (event) => {
+        if (event.candidate) {
+            ws.send(JSON.stringify({ type: "candidate", candidate: event.candidate }));
+        }
+    };
+
+    await new Promise((resolve, reject) => {
+        ws.onopen = resolve;
+        ws.onerror = () => reject(new Error("Could not open signaling socket"));
+    });
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    ws.send(JSON.stringify({ type: "offer", role: "monitor", sdp: offer }));
+    document.getElementById("listenButton").disabled = true;
+}
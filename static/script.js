@@ -1,16 +1,21 @@
 let peerConnection;
-const servers = {
-    iceServers: [
-        {
-            urls: "stun:stun.l.google.com:19302", // Google's public STUN server
-        },
-    ],
-};
+// Peer ID the server gave our viewer connection
+let viewerId;
 
 // Add event listeners when the DOM content is fully loaded
 document.addEventListener("DOMContentLoaded", () => {
     document.getElementById("startPublisherButton").addEventListener("click", startPublisher);
     document.getElementById("startViewerButton").addEventListener("click", startViewer);
+    document.getElementById("quality").addEventListener("change", setQuality);
+    document.getElementById("testBandwidthButton").addEventListener("click", testBandwidth);
+    document.getElementById("testDataChannelButton").addEventListener("click", testDataChannel);
+    document.getElementById("addScreenButton").addEventListener("click", addScreenShare);
+
+    // Links from /browse and private stream links name the stream in the query
+    const stream = new URLSearchParams(location.search).get("stream");
+    if (stream) {
+        document.getElementById("streamName").value = stream;
+    }
     checkMediaDevices(); // Check for available media devices
 });
 
@@ -36,90 +41,53 @@ async function startPublisher() {
     try {
         console.log("Requesting access to media devices...");
 
-        const constraints = { video: true, audio: false };  // Define media constraints for video and audio
+        const constraints = { video: true, audio: true };  // Define media constraints for video and audio
         const stream = await navigator.mediaDevices.getUserMedia(constraints); // Request media stream
         console.log("Publisher's media stream acquired:", stream);
 
         // Add the stream to a video element to show local preview
-        document.body.appendChild(createVideoElement(stream));
+        document.body.appendChild(createVideoElement(stream, true));
+
+        // A screen share is sent as a second video track in its own stream
+        let screen;
+        if (document.getElementById("shareScreen").checked) {
+            screen = await navigator.mediaDevices.getDisplayMedia({ video: true });
+            document.body.appendChild(createVideoElement(screen, true));
+        }
 
         // Create a new RTCPeerConnection
-        peerConnection = new RTCPeerConnection({
-            iceServers: [{
-              urls: 'stun:stun.l.google.com:19302'
-            }]
-        });
+        peerConnection = new RTCPeerConnection(await fetchIceConfig());
+        attachChat(peerConnection);
 
-        // Add the media stream's tracks to the peer connection
+        // Add the media stream's tracks to the peer connection, the camera
+        // in three layers when simulcast is on
+        const simulcast = document.getElementById("simulcast").checked;
         stream.getTracks().forEach((track) => {
             //console.log(`Track being added to peer connection - Kind: ${track.kind}, Label: ${track.label}`);
-            peerConnection.addTrack(track, stream);  // Add track to peer connection
-        });
-
-        // Log all senders
-        //logSenders();
-
-        // Handle ICE candidates
-        peerConnection.onicecandidate = event => {
-            if (event.candidate) {
-                console.log("Sending ICE candidate to the server.");
-                fetch('http://localhost:8080/ice-candidate-p', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify(event.candidate)
-                }).then(() => {
-                    console.log("ICE candidate sent successfully.");
-                }).catch(error => {
-                    console.error("Error sending ICE candidate:", error);
+            if (simulcast && track.kind === "video") {
+                peerConnection.addTransceiver(track, {
+                    direction: "sendonly",
+                    streams: [stream],
+                    sendEncodings: [
+                        { rid: "q", scaleResolutionDownBy: 4 },
+                        { rid: "h", scaleResolutionDownBy: 2 },
+                        { rid: "f" },
+                    ],
                 });
+                return;
             }
-        };
-
-        try {
-        
-            const offer = await peerConnection.createOffer();
-            await peerConnection.setLocalDescription(offer);
-            console.log("Offer created and set as local description.");
-    
-            const response = await fetch('http://localhost:8080/publish', {
-              method: 'POST',
-              headers: { 'Content-Type': 'application/json' },
-              body: JSON.stringify(offer)
-            });
-            const answer = await response.json();
-            console.log("Received answer from the server.");
-    
-            await peerConnection.setRemoteDescription(answer);
-            console.log("Answer set as remote description.");
-        } catch (error) {
-            console.error("Error during offer/answer exchange:", error);
+            peerConnection.addTrack(track, stream);  // Add track to peer connection
+        });
+        if (screen) {
+            screen.getVideoTracks().forEach(track => peerConnection.addTrack(track, screen));
         }
 
+        // Reactions and raised hands of the viewers, lowered with a click
+        const interactionChannel = peerConnection.createDataChannel("interactions");
+        interactionChannel.onmessage = (event) => showInteractions(JSON.parse(event.data), interactionChannel);
 
-
-        // Handle incoming ICE candidates from the server
-        const handleIncomingICECandidate = async (candidate) => {
-            try {
-                await peerConnection.addIceCandidate(candidate);
-                console.log("Added received ICE candidate.");
-            } catch (e) {
-                console.error('Error adding received ice candidate', e);
-            }
-        };
-
-        // Poll the server for ICE candidates
-        setInterval(async () => {
-            try {
-                const response = await fetch('http://localhost:8080/ice-candidates-p');
-                const candidates = await response.json();
-                if (candidates) {
-                    candidates.forEach(handleIncomingICECandidate);
-                    console.log("Polled and added ICE candidates from the server.");
-                }
-            } catch (error) {
-                console.error("Error polling ICE candidates:", error);
-            }
-        }, 1000);
+        // Log all senders
+        //logSenders();
 
         // Handle ICE connection state changes
         peerConnection.oniceconnectionstatechange = function() {
@@ -131,37 +99,14 @@ async function startPublisher() {
             console.log("Publisher connection state:", peerConnection.connectionState);
         };
 
-        // Handle negotiation needed event
-        /*
-        peerConnection.onnegotiationneeded = async () => {
-            try {
-                console.log("Negotiation needed");
-                const offer = await peerConnection.createOffer();
-                await peerConnection.setLocalDescription(offer);
-                console.log("Publisher SDP offer created:");
-
-                // Send offer to the SFU server and receive the SDP answer
-                const response = await fetch('http://localhost:8080/offer', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify(offer)
-                  });
-
-                const answer = await response.json();
-                console.log("Received SDP answer from SFU server:", answer);
-                //await peerConnection.setRemoteDescription(new RTCSessionDescription({ type: "answer", sdp: answer }));
-                //console.log("Publisher remote description set");
-                let a = JSON.parse(answer);
-                peerConnection.setRemoteDescription(answer.sdp)
-                    .catch(error => console.error('Error setting answer remote description:', error));
-
-                // Log the senders after negotiation
-                logSenders();
-            } catch (error) {
-                console.error("Error during negotiation:", error);
-            }
-        };
-        */
+        // Exchange the offer/answer and ICE candidates over the signaling socket
+        try {
+            await startSignaling("publisher", peerConnection);
+        } catch (error) {
+            console.error("Error during offer/answer exchange:", error);
+        }
+
+        document.getElementById("addScreenButton").disabled = false;
 
     } catch (error) {
         console.error("Error getting media stream:", error);
@@ -171,6 +116,34 @@ async function startPublisher() {
 
 
 
+// Share the screen while publishing, the new track renegotiates the
+// connection instead of restarting it
+async function addScreenShare() {
+    try {
+        const screen = await navigator.mediaDevices.getDisplayMedia({ video: true });
+        document.body.appendChild(createVideoElement(screen, true));
+        screen.getVideoTracks().forEach(track => peerConnection.addTrack(track, screen));
+        document.getElementById("addScreenButton").disabled = true;
+    } catch (error) {
+        console.error("Error sharing screen:", error);
+    }
+}
+
+// Show the viewers' latest reactions and raised hands to the publisher
+function showInteractions(update, channel) {
+    const reactions = Object.entries(update.reactions || {}).map(([r, n]) => `${r} ${n}`).join(" ");
+    if (reactions) {
+        document.getElementById("reactions").textContent = reactions;
+    }
+    const hands = document.getElementById("raisedHands");
+    hands.replaceChildren(...update.raisedHands.map((hand) => {
+        const button = document.createElement("button");
+        button.textContent = `Lower hand of ${hand.user || hand.viewer}`;
+        button.onclick = () => channel.send(JSON.stringify({ type: "lower-hand", viewer: hand.viewer }));
+        return button;
+    }));
+}
+
 // Function to start viewing (downloading) the video stream
 async function startViewer() {
     try {
@@ -182,41 +155,59 @@ async function startViewer() {
 
 
         // Create a new RTCPeerConnection
-        peerConnection = new RTCPeerConnection({
-            iceServers: [{
-              urls: 'stun:stun.l.google.com:19302'
-            }]
-        });
+        peerConnection = new RTCPeerConnection(await fetchIceConfig("viewer"));
+        attachChat(peerConnection);
 
         // Add the media stream's tracks to the peer connection
         stream.getTracks().forEach((track) => {
             peerConnection.addTrack(track, stream);  // Add track to peer connection
         });
 
+        // Receive the publisher's audio and a second video, e.g. its screen share
+        peerConnection.addTransceiver("audio", { direction: "recvonly" });
+        peerConnection.addTransceiver("video", { direction: "recvonly" });
+
+
 
+        // Echo the server's latency probes so it can measure our round trip time
+        const latencyChannel = peerConnection.createDataChannel("latency");
+        latencyChannel.onmessage = (event) => latencyChannel.send(event.data);
+
+        // Report the playback state of the first remote video for the
+        // concurrent-viewers analytics
+        const heartbeatChannel = peerConnection.createDataChannel("heartbeat");
+        let watchedVideo;
+        const sendHeartbeat = () => {
+            if (!watchedVideo || heartbeatChannel.readyState !== "open") {
+                return;
+            }
+            let state = "playing";
+            if (watchedVideo.paused) {
+                state = "paused";
+            } else if (watchedVideo.readyState < HTMLMediaElement.HAVE_FUTURE_DATA) {
+                state = "buffering";
+            }
+            heartbeatChannel.send(JSON.stringify({ state, position: watchedVideo.currentTime }));
+        };
+        setInterval(sendHeartbeat, 15000);
 
         // Handle incoming tracks from the publisher
+        // Audio and video arrive as separate tracks of the same stream, show each stream once
+        const displayedStreams = new Set();
         peerConnection.ontrack = (event) => {
             console.log("Received track from publisher:", event.track);
             const [remoteStream] = event.streams;
-            document.body.appendChild(createVideoElement(remoteStream)); // Show remote video
-            console.log("Viewer displaying remote stream:", remoteStream);
-        };
-
-        // Handle ICE candidates
-        peerConnection.onicecandidate = event => {
-            if (event.candidate) {
-                console.log("Sending ICE candidate to the server.");
-                fetch('http://localhost:8080/ice-candidate-v', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify(event.candidate)
-                }).then(() => {
-                    console.log("ICE candidate sent successfully.");
-                }).catch(error => {
-                    console.error("Error sending ICE candidate:", error);
-                });
+            if (displayedStreams.has(remoteStream.id)) {
+                return;
+            }
+            displayedStreams.add(remoteStream.id);
+            const video = createVideoElement(remoteStream, false);
+            document.body.appendChild(video); // Show remote video
+            if (!watchedVideo) {
+                watchedVideo = video;
+                ["playing", "pause", "waiting"].forEach((type) => video.addEventListener(type, sendHeartbeat));
             }
+            console.log("Viewer displaying remote stream:", remoteStream);
         };
 
         // Handle ICE connection state changes
@@ -229,54 +220,337 @@ async function startViewer() {
             console.log("Viewer connection state:", peerConnection.connectionState);
         };
 
+        // Exchange the offer/answer and ICE candidates over the signaling socket
         try {
-        
-            const offer = await peerConnection.createOffer();
-            await peerConnection.setLocalDescription(offer);
-            console.log("Offer created and set as local description.");
-    
-            const response = await fetch('http://localhost:8080/view', {
-              method: 'POST',
-              headers: { 'Content-Type': 'application/json' },
-              body: JSON.stringify(offer)
-            });
-            const answer = await response.json();
-            console.log("Received answer from the server.");
-    
-            await peerConnection.setRemoteDescription(answer);
-            console.log("Answer set as remote description.");
+            await startSignaling("viewer", peerConnection);
         } catch (error) {
             console.error("Error during offer/answer exchange:", error);
         }
 
-        // Handle incoming ICE candidates from the server
-        const handleIncomingICECandidate = async (candidate) => {
-            try {
-                await peerConnection.addIceCandidate(candidate);
-                console.log("Added received ICE candidate.");
-            } catch (e) {
-                console.error('Error adding received ice candidate', e);
+    } catch (error) {
+        console.error("Error starting viewer:", error);
+        alert(`Error starting viewer: ${error.name} - ${error.message}`);
+    }
+}
+
+// Open the /ws signaling socket, send the offer for the given role and stream
+// and trickle ICE candidates in both directions. With -signaling http the
+// publisher and viewer signal over plain HTTP instead.
+async function startSignaling(role, pc) {
+    if (serverSetting("signaling") === "http" && (role === "publisher" || role === "viewer")) {
+        return startHTTPSignaling(role, pc);
+    }
+    const ws = new WebSocket(signalingSocketURL());
+    await new Promise((resolve, reject) => {
+        ws.onopen = resolve;
+        ws.onerror = () => reject(new Error("Could not open signaling socket"));
+    });
+    console.log("Signaling socket opened.");
+
+    // Remote candidates can only be added once the answer is applied
+    let answerApplied;
+    const answerSet = new Promise(resolve => answerApplied = resolve);
+
+    ws.onmessage = async (event) => {
+        const msg = JSON.parse(event.data);
+        try {
+            switch (msg.type) {
+                case "answer":
+                    await pc.setRemoteDescription(msg.sdp);
+                    console.log(`Answer set as remote description (peer ${msg.id}, stream ${msg.stream}).`);
+                    if (role === "viewer") {
+                        viewerId = msg.id;
+                        document.getElementById("quality").disabled = false;
+                    }
+                    // Tracks added from now on are offered on the socket
+                    pc.onnegotiationneeded = async () => {
+                        await pc.setLocalDescription(await pc.createOffer());
+                        ws.send(JSON.stringify({ type: "offer", sdp: pc.localDescription }));
+                    };
+                    answerApplied();
+                    break;
+                case "offer":
+                    // The server adds tracks published after we connected
+                    await pc.setRemoteDescription(msg.sdp);
+                    await pc.setLocalDescription(await pc.createAnswer());
+                    ws.send(JSON.stringify({ type: "answer", sdp: pc.localDescription }));
+                    console.log("Renegotiated for new tracks.");
+                    break;
+                case "candidate":
+                    await answerSet;
+                    await pc.addIceCandidate(msg.candidate);
+                    console.log("Added received ICE candidate.");
+                    break;
+                case "end-of-candidates":
+                    console.log("Server finished gathering ICE candidates.");
+                    break;
+                case "error":
+                    console.error("Signaling error:", msg.error);
+                    break;
+                case "shutdown":
+                    console.log("Server is shutting down.");
+                    break;
+                case "reset":
+                    console.log("Server was reset.");
+                    break;
+                case "kicked":
+                    console.warn("Disconnected by an admin.", msg.reason || "");
+                    break;
+                case "publisher-kicked":
+                    console.warn("The publisher was disconnected by an admin.", msg.reason || "");
+                    break;
+                case "transferred":
+                    console.log("Playback moved to another device.");
+                    break;
+                case "cohost-joined":
+                    console.log(`Co-host ${msg.id} joined, reconnect to receive their tracks.`);
+                    break;
+                case "cohost-left":
+                    console.log(`Co-host ${msg.id} left.`);
+                    break;
+                case "muted":
+                case "unmuted":
+                    console.warn(`Your ${msg.kind} was ${msg.type} by an admin.`);
+                    break;
+                case "data-test-result":
+                    showDataTestResult(msg.dataResult);
+                    pc.close();
+                    ws.close();
+                    break;
+                case "bandwidth-result":
+                    showBandwidthResult(msg.result);
+                    pc.close();
+                    ws.close();
+                    break;
             }
-        };
+        } catch (error) {
+            console.error(`Error handling ${msg.type} message:`, error);
+        }
+    };
+
+    ws.onclose = () => {
+        console.log("Signaling socket closed.");
+    };
+
+    // Send our candidates as they are gathered
+    pc.onicecandidate = event => {
+        if (event.candidate) {
+            ws.send(JSON.stringify({ type: "candidate", candidate: event.candidate }));
+        } else {
+            ws.send(JSON.stringify({ type: "end-of-candidates" }));
+        }
+    };
+
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    console.log("Offer created and set as local description.");
+    const stream = document.getElementById("streamName").value;
+    const params = new URLSearchParams(location.search);
+    const token = params.get("token") || undefined;
+    const key = params.get("key") || undefined;
+    ws.send(JSON.stringify({ type: "offer", role: role, stream: stream, token: token, key: key, sdp: offer }));
+
+    return ws;
+}
 
-        // Poll the server for ICE candidates
-        setInterval(async () => {
-            try {
-                const response = await fetch('http://localhost:8080/ice-candidates-v');
-                const candidates = await response.json();
-                if (candidates) {
-                    candidates.forEach(handleIncomingICECandidate);
-                    console.log("Polled and added ICE candidates from the server.");
-                }
-            } catch (error) {
-                console.error("Error polling ICE candidates:", error);
+// POST the offer to /publish or /view, then trickle our candidates to the
+// peer's /events endpoint and take the server's from its event stream
+async function startHTTPSignaling(role, pc) {
+    // Candidates gathered before the answer names the peer wait for it
+    let candidateURL, secret;
+    const pending = [];
+    const sendCandidate = (candidate) => fetch(candidateURL, {
+        method: "POST",
+        headers: { "Content-Type": "application/json", "X-Peer-Secret": secret },
+        body: JSON.stringify(candidate),
+    }).catch(error => console.error("Error sending ICE candidate:", error));
+    pc.onicecandidate = event => {
+        if (!event.candidate) {
+            return;
+        }
+        if (candidateURL) {
+            sendCandidate(event.candidate);
+        } else {
+            pending.push(event.candidate);
+        }
+    };
+
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    console.log("Offer created and set as local description.");
+    const query = new URLSearchParams({ stream: document.getElementById("streamName").value });
+    const params = new URLSearchParams(location.search);
+    for (const name of ["token", "key"]) {
+        if (params.has(name)) query.set(name, params.get(name));
+    }
+    const path = role === "publisher" ? serverSetting("publishPath", "/publish") : serverSetting("viewPath", "/view");
+    const response = await fetch(`${path}?${query}`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(offer),
+    });
+    if (!response.ok) {
+        throw new Error(`Signaling failed: ${response.status} ${(await response.text()).trim()}`);
+    }
+    const id = response.headers.get("X-Peer-ID");
+    // Requests about the peer prove they come from us with its secret
+    secret = response.headers.get("X-Peer-Secret");
+    await pc.setRemoteDescription(await response.json());
+    console.log(`Answer set as remote description (peer ${id}).`);
+    if (role === "viewer") {
+        viewerId = id;
+        document.getElementById("quality").disabled = false;
+    }
+
+    const eventsURL = serverSetting("eventsPath", "/events/") + encodeURIComponent(id);
+    candidateURL = eventsURL;
+    pending.splice(0).forEach(sendCandidate);
+
+    // New offers of either side go through /renegotiate
+    const renegotiateURL = `/renegotiate?id=${encodeURIComponent(id)}`;
+    const postDescription = (desc) => fetch(renegotiateURL, {
+        method: "POST",
+        headers: { "Content-Type": "application/json", "X-Peer-Secret": secret },
+        body: JSON.stringify(desc),
+    });
+    pc.onnegotiationneeded = async () => {
+        try {
+            await pc.setLocalDescription(await pc.createOffer());
+            const response = await postDescription(pc.localDescription);
+            if (!response.ok) {
+                throw new Error(`${response.status} ${(await response.text()).trim()}`);
             }
-        }, 1000);
+            await pc.setRemoteDescription(await response.json());
+        } catch (error) {
+            console.error("Error renegotiating:", error);
+        }
+    };
 
+    const events = new EventSource(`${eventsURL}?secret=${encodeURIComponent(secret)}`);
+    events.addEventListener("candidate", async (event) => {
+        try {
+            await pc.addIceCandidate(JSON.parse(event.data).candidate);
+            console.log("Added received ICE candidate.");
+        } catch (error) {
+            console.error("Error adding ICE candidate:", error);
+        }
+    });
+    events.addEventListener("end-of-candidates", () => console.log("Server finished gathering ICE candidates."));
+    events.addEventListener("offer", async (event) => {
+        try {
+            await pc.setRemoteDescription(JSON.parse(event.data).sdp);
+            await pc.setLocalDescription(await pc.createAnswer());
+            await postDescription(pc.localDescription);
+            console.log("Renegotiated for new tracks.");
+        } catch (error) {
+            console.error("Error renegotiating:", error);
+        }
+    });
+    events.addEventListener("connection-state", (event) => {
+        if (JSON.parse(event.data).state === "closed") {
+            events.close();
+            console.log("Event stream closed.");
+        }
+    });
+    return events;
+}
+
+// Send a few seconds of camera and microphone media to a throwaway
+// connection, the server answers with the bitrate it got through and the
+// resolution to publish at
+async function testBandwidth() {
+    const result = document.getElementById("bandwidthResult");
+    try {
+        const stream = await navigator.mediaDevices.getUserMedia({ video: { width: 1920, height: 1080 }, audio: true });
+        const pc = new RTCPeerConnection(await fetchIceConfig());
+        stream.getTracks().forEach(track => pc.addTrack(track, stream));
+        pc.onconnectionstatechange = () => {
+            if (pc.connectionState === "closed" || pc.connectionState === "failed") {
+                stream.getTracks().forEach(track => track.stop());
+            }
+        };
+        result.textContent = "Testing bandwidth...";
+        const ws = await startSignaling("bandwidth-test", pc);
+        ws.addEventListener("close", () => stream.getTracks().forEach(track => track.stop()));
+        // Let the encoder go as high as the connection allows
+        pc.getSenders().filter(s => s.track && s.track.kind === "video").forEach(async sender => {
+            const params = sender.getParameters();
+            if (params.encodings && params.encodings.length > 0) {
+                params.encodings[0].maxBitrate = 8000000;
+                await sender.setParameters(params).catch(error => console.warn("Could not raise bitrate cap:", error));
+            }
+        });
     } catch (error) {
-        console.error("Error starting viewer:", error);
-        alert(`Error starting viewer: ${error.name} - ${error.message}`);
+        console.error("Error testing bandwidth:", error);
+        result.textContent = `Bandwidth test failed: ${error.message}`;
+    }
+}
+
+function showBandwidthResult(res) {
+    const result = document.getElementById("bandwidthResult");
+    if (res.error) {
+        result.textContent = `Bandwidth test failed: ${res.error}`;
+        return;
+    }
+    const r = res.recommendation;
+    result.textContent = `Upload: ${Math.round(res.sustainedBitrate / 1000)} kbit/s sustained, ` +
+        `${(res.loss * 100).toFixed(1)}% loss. Recommended: ${r.width}x${r.height} at ${r.framerate} fps, ` +
+        `up to ${Math.round(r.maxBitrate / 1000)} kbit/s.`;
+}
+
+// Send as much as the path carries on a reliable channel the server echoes
+// and an unreliable one it sinks, until the server answers with the rates
+async function testDataChannel() {
+    const result = document.getElementById("bandwidthResult");
+    try {
+        const pc = new RTCPeerConnection(await fetchIceConfig());
+        const chunk = new Uint8Array(16 * 1024);
+        const channels = [
+            pc.createDataChannel("echo"),
+            pc.createDataChannel("sink", { ordered: false, maxRetransmits: 0 }),
+        ];
+        channels.forEach(dc => {
+            dc.bufferedAmountLowThreshold = 1024 * 1024;
+            const fill = () => {
+                while (dc.readyState === "open" && dc.bufferedAmount < 4 * 1024 * 1024) {
+                    dc.send(chunk);
+                }
+            };
+            dc.onopen = fill;
+            dc.onbufferedamountlow = fill;
+        });
+        result.textContent = "Testing data channels...";
+        await startSignaling("data-test", pc);
+    } catch (error) {
+        console.error("Error testing data channels:", error);
+        result.textContent = `Data channel test failed: ${error.message}`;
+    }
+}
+
+function showDataTestResult(res) {
+    const result = document.getElementById("bandwidthResult");
+    if (res.error) {
+        result.textContent = `Data channel test failed: ${res.error}`;
+        return;
+    }
+    result.textContent = res.channels.map(c =>
+        `${c.label}: ${Math.round(c.bitrate / 1000)} kbit/s, ${c.messages} messages` +
+        (c.echo ? `, ${c.echoedMessages} echoed` : "")).join("; ");
+}
+
+// Ask the server for another simulcast layer of the stream we view
+async function setQuality() {
+    const quality = document.getElementById("quality").value;
+    const response = await fetch("/view/quality", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ id: viewerId, quality: quality }),
+    });
+    if (!response.ok) {
+        console.error("Error setting quality:", await response.text());
+        return;
     }
+    console.log("Quality set:", await response.json());
 }
 
 // Function to log the senders and their associated tracks
@@ -298,11 +572,11 @@ function logSenders() {
 }
 
 // Utility function to create a video element and attach a stream
-function createVideoElement(stream) {
+function createVideoElement(stream, muted) {
     const video = document.createElement("video");
     video.srcObject = stream;
     video.autoplay = true;
-    video.muted = true; // Mute local video element to avoid echo during publishing
+    video.muted = muted; // Mute local video element to avoid echo during publishing
     video.style = "width: 50%; margin: 10px; border: 2px solid black;";
     return video;
 }
@@ -0,0 +1,263 @@
+// Stream page: watches the stream named by the page through the SFU and
+// reports playback heartbeats like the main viewer
+
+document.addEventListener("DOMContentLoaded", () => watchStream());
+
+function setWatchStatus(text) {
+    document.getElementById("watchStatus").textContent = text;
+}
+
+// A transfer code given takes over the session of another device, or of
+// this page's previous connection when it reconnects to get the tracks of a
+// co-host that joined
+async function watchStream(transfer) {
+    const stream = document.body.dataset.stream;
+    const video = document.getElementById("video");
+    let replaced = false;
+
+    // Links may relay the connection through TURN, ?iceTransportPolicy=relay,
+    // or leave out video, ?audioOnly=true
+    const query = new URLSearchParams(location.search);
+    const audioOnly = query.get("audioOnly") === "true";
+    const rtcConfig = await fetchIceConfig("viewer");
+    if (query.get("iceTransportPolicy") === "relay") {
+        rtcConfig.iceTransportPolicy = "relay";
+    }
+    const pc = new RTCPeerConnection(rtcConfig);
+    attachChat(pc);
+    attachStreamEvents(pc);
+    if (!audioOnly) {
+        pc.addTransceiver("video", { direction: "recvonly" });
+    }
+    pc.addTransceiver("audio", { direction: "recvonly" });
+
+    const heartbeatChannel = pc.createDataChannel("heartbeat");
+    const sendHeartbeat = () => {
+        if (heartbeatChannel.readyState !== "open") {
+            return;
+        }
+        let state = "playing";
+        if (video.paused) {
+            state = "paused";
+        } else if (video.readyState < HTMLMediaElement.HAVE_FUTURE_DATA) {
+            state = "buffering";
+        }
+        heartbeatChannel.send(JSON.stringify({ state, position: video.currentTime }));
+    };
+    setInterval(sendHeartbeat, 15000);
+    ["playing", "pause", "waiting"].forEach((type) => video.addEventListener(type, sendHeartbeat));
+
+    // Reactions and a raised hand go to the publisher and other viewers
+    const interactionChannel = pc.createDataChannel("interactions");
+    interactionChannel.onopen = () => enableInteractions(interactionChannel);
+    interactionChannel.onmessage = (event) => showInteractions(JSON.parse(event.data), viewerId);
+
+    // Each co-host's tracks come on a stream of their own
+    pc.ontrack = (event) => {
+        const mediaStream = event.streams[0];
+        if (mediaStream.id.startsWith("cohost-")) {
+            cohostVideo(mediaStream.id).srcObject = mediaStream;
+        } else if (video.srcObject !== mediaStream) {
+            video.srcObject = mediaStream;
+        }
+    };
+    pc.onconnectionstatechange = () => {
+        if (pc.connectionState === "connected") {
+            setWatchStatus("");
+        } else if (pc.connectionState === "failed" || pc.connectionState === "closed") {
+            setWatchStatus("Disconnected.");
+        }
+    };
+
+    // Joining right as the stream starts waits for its tracks, and a signed
+    // link's expiry and signature go along for the viewer's offer, as does
+    // the decimation and temporal layer cap of thumbnails, monitoring walls
+    // and slow links, and the link's connection overrides
+    const params = new URLSearchParams({ wait: "10s" });
+    for (const name of ["expires", "signature", "decimate", "temporalLayer", "iceTransportPolicy", "audioOnly", "codec"]) {
+        if (query.has(name)) params.set(name, query.get(name));
+    }
+    const ws = new WebSocket(signalingSocketURL(params));
+
+    // Remote candidates can only be added once the answer is applied
+    let viewerId, viewerSecret;
+    let answerApplied;
+    const answerSet = new Promise(resolve => answerApplied = resolve);
+
+    ws.onmessage = async (event) => {
+        const msg = JSON.parse(event.data);
+        switch (msg.type) {
+            case "answer":
+                await pc.setRemoteDescription(msg.sdp);
+                answerApplied();
+                enableTransfer(msg.id, msg.secret);
+                viewerId = msg.id;
+                viewerSecret = msg.secret;
+                break;
+            case "offer":
+                // Tracks the publisher added after we joined
+                await pc.setRemoteDescription(msg.sdp);
+                await pc.setLocalDescription(await pc.createAnswer());
+                ws.send(JSON.stringify({ type: "answer", sdp: pc.localDescription }));
+                break;
+            case "candidate":
+                await answerSet;
+                await pc.addIceCandidate(msg.candidate);
+                break;
+            case "error":
+                setWatchStatus(msg.error);
+                break;
+            case "shutdown":
+                setWatchStatus("The server is shutting down.");
+                break;
+            case "reset":
+                setWatchStatus("The server was reset.");
+                break;
+            case "kicked":
+            case "publisher-kicked":
+                setWatchStatus(msg.reason ? `The stream was stopped: ${msg.reason}` : "The stream was stopped.");
+                break;
+            case "transferred":
+                if (replaced) {
+                    ws.close();
+                    pc.close();
+                    break;
+                }
+                setWatchStatus("Playback moved to another device.");
+                document.getElementById("transfer").hidden = true;
+                break;
+            case "cohost-joined":
+                // Tracks of a co-host need a new connection, which takes
+                // over this one once connected
+                if (!replaced && viewerId) {
+                    const response = await fetch(`/api/viewers/${viewerId}/transfer`, { method: "POST", headers: { "X-Peer-Secret": viewerSecret } });
+                    if (response.ok) {
+                        replaced = true;
+                        watchStream((await response.json()).code);
+                    }
+                }
+                break;
+            case "cohost-left":
+                document.getElementById(`cohost-${msg.id}`)?.remove();
+                break;
+        }
+    };
+    await new Promise((resolve, reject) => {
+        ws.onopen = resolve;
+        ws.onerror = () => reject(new Error("Could not open signaling socket"));
+    });
+
+    pc.onicecandidate = (event) => {
+        if (event.candidate) {
+            ws.send(JSON.stringify({ type: "candidate", candidate: event.candidate }));
+        } else {
+            ws.send(JSON.stringify({ type: "end-of-candidates" }));
+        }
+    };
+
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    // A transfer code takes over the session of another device
+    const token = query.get("token") || undefined;
+    transfer = transfer || query.get("transfer") || undefined;
+    ws.send(JSON.stringify({ type: "offer", role: "viewer", stream, token, transfer, sdp: offer }));
+}
+
+// Events of the stream on the "stream-events" data channel the server opens
+// on the connection: it going live or ending, its publisher reconnecting and
+// the number of viewers
+function attachStreamEvents(pc) {
+    pc.addEventListener("datachannel", (event) => {
+        if (event.channel.label !== "stream-events") {
+            return;
+        }
+        // Only the status set for an interruption is cleared once it is over
+        let interrupted = false;
+        const interrupt = (text) => {
+            interrupted = true;
+            setWatchStatus(text);
+        };
+        event.channel.onmessage = (e) => {
+            const msg = JSON.parse(e.data);
+            switch (msg.type) {
+                case "stream-started":
+                case "publisher-reconnected":
+                    if (interrupted) {
+                        interrupted = false;
+                        setWatchStatus("");
+                    }
+                    break;
+                case "stream-ended":
+                    interrupt("The stream ended, waiting for it to go live again...");
+                    break;
+                case "publisher-reconnecting":
+                    interrupt("The publisher is reconnecting...");
+                    break;
+                case "failover":
+                    interrupt(msg.failover === "offline-slate"
+                        ? "The stream is offline, waiting for it to go live again..."
+                        : `The stream is offline, showing ${msg.failover} meanwhile...`);
+                    break;
+                case "viewer-count":
+                    document.getElementById("viewerCount").textContent =
+                        msg.viewers === 1 ? "1 viewer" : `${msg.viewers} viewers`;
+                    break;
+            }
+        };
+    });
+}
+
+function enableInteractions(channel) {
+    document.getElementById("interactions").hidden = false;
+    document.querySelectorAll(".reaction").forEach((button) => {
+        button.onclick = () => channel.send(JSON.stringify({ type: "reaction", reaction: button.textContent }));
+    });
+    const hand = document.getElementById("raiseHand");
+    hand.onclick = () => {
+        const raised = hand.dataset.raised === "true";
+        channel.send(JSON.stringify({ type: raised ? "lower-hand" : "raise-hand" }));
+    };
+}
+
+function showInteractions(update, viewerId) {
+    const reactions = Object.entries(update.reactions || {}).map(([r, n]) => `${r} ${n}`).join(" ");
+    if (reactions) {
+        document.getElementById("reactionCounts").textContent = reactions;
+    }
+    const raised = update.raisedHands.some((hand) => hand.viewer === viewerId);
+    const hand = document.getElementById("raiseHand");
+    hand.dataset.raised = raised;
+    hand.textContent = raised ? "Lower hand" : "Raise hand";
+    document.getElementById("handCount").textContent = update.raisedHands.length ? `${update.raisedHands.length} hands raised` : "";
+}
+
+// Video element of a co-host's stream, added next to the host's
+function cohostVideo(id) {
+    let video = document.getElementById(id);
+    if (!video) {
+        video = document.createElement("video");
+        video.id = id;
+        video.autoplay = video.playsInline = video.controls = video.muted = true;
+        document.getElementById("cohosts").append(video);
+    }
+    return video;
+}
+
+// Let the viewer get a code to continue watching on another device
+function enableTransfer(viewerId, secret) {
+    const button = document.getElementById("transferButton");
+    document.getElementById("transfer").hidden = false;
+    button.onclick = async () => {
+        const response = await fetch(`/api/viewers/${viewerId}/transfer`, { method: "POST", headers: { "X-Peer-Secret": secret } });
+        if (!response.ok) {
+            document.getElementById("transferCode").textContent = `Could not get a code: ${(await response.text()).trim()}`;
+            return;
+        }
+        const transfer = await response.json();
+        const link = document.createElement("a");
+        link.href = transfer.url;
+        link.textContent = transfer.url;
+        document.getElementById("transferCode").replaceChildren(
+            `Code ${transfer.code}, valid for 2 minutes: `, link);
+    };
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Values kept per stat, the oldest are dropped beyond that
+	statsHistoryLength = 600
+	// How long the history of a closed session remains available
+	statsRetention = 15 * time.Minute
+)
+
+// How often the stats of each PeerConnection are collected, 0 disables
+var statsInterval = time.Second
+
+var (
+	// Stats histories of sessions by peer ID, closed ones until they expire
+	statsHistories   = make(map[string]*statsHistory)
+	statsHistoriesMu sync.Mutex
+)
+
+// The getStats() reports of a PeerConnection over time, as
+// chrome://webrtc-internals collects them
+type statsHistory struct {
+	id      string
+	role    string
+	stream  string
+	started time.Time
+
+	mu      sync.Mutex
+	ended   time.Time
+	series  map[string]*statsSeries
+	updates []statsUpdate
+	states  [2]string
+}
+
+// Values of one attribute of one stats report, e.g. bytesReceived of an
+// inbound-rtp report
+type statsSeries struct {
+	statsType string
+	times     []time.Time
+	values    []interface{}
+}
+
+// Event of a session's update log
+type statsUpdate struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Value string    `json:"value"`
+}
+
+// Collect the stats of the peer's PeerConnection until it closes
+func collectStats(p *peer) {
+	if p.pc == nil || statsInterval <= 0 {
+		return
+	}
+	h := &statsHistory{id: p.id, role: p.role, stream: p.stream, started: time.Now(), series: make(map[string]*statsSeries)}
+	statsHistoriesMu.Lock()
+	for id, old := range statsHistories {
+		if old.expired() {
+			delete(statsHistories, id)
+		}
+	}
+	statsHistories[p.id] = h
+	statsHistoriesMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				h.mu.Lock()
+				h.ended = time.Now()
+				h.mu.Unlock()
+				return
+			case <-ticker.C:
+				h.sample(p)
+			}
+		}
+	}()
+}
+
+func (h *statsHistory) expired() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.ended.IsZero() && time.Since(h.ended) > statsRetention
+}
+
+func (h *statsHistory) sample(p *peer) {
+	now := time.Now()
+	pc := p.pc
+	report := pc.GetStats()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Signaling is not observed directly, the descriptions and state
+	// changes are logged as the samples see them
+	if len(h.updates) == 0 {
+		if d := pc.RemoteDescription(); d != nil {
+			h.updates = append(h.updates, statsUpdate{Time: now, Type: "setRemoteDescription", Value: "type: " + d.Type.String() + ", sdp: " + d.SDP})
+		}
+		if d := pc.LocalDescription(); d != nil {
+			h.updates = append(h.updates, statsUpdate{Time: now, Type: "setLocalDescription", Value: "type: " + d.Type.String() + ", sdp: " + d.SDP})
+		}
+	}
+	if state := pc.ICEConnectionState().String(); state != h.states[0] {
+		h.states[0] = state
+		h.updates = append(h.updates, statsUpdate{Time: now, Type: "iceconnectionstatechange", Value: state})
+	}
+	if state := pc.ConnectionState().String(); state != h.states[1] {
+		h.states[1] = state
+		h.updates = append(h.updates, statsUpdate{Time: now, Type: "connectionstatechange", Value: state})
+	}
+
+	for id, stats := range report {
+		// The JSON names of pion's stats are those of the spec
+		data, err := json.Marshal(stats)
+		if err != nil {
+			continue
+		}
+		var attributes map[string]interface{}
+		if err := json.Unmarshal(data, &attributes); err != nil {
+			continue
+		}
+		statsType, _ := attributes["type"].(string)
+		h.record(now, id, statsType, attributes)
+	}
+	// Not a report of the spec, the RTCP of the connection against its
+	// media to see what its report settings cost
+	if f := p.feedback.Load(); f != nil {
+		h.record(now, "RTCPFeedback", "rtcp-feedback", f.stats())
+	}
+}
+
+// Append the attributes of a stats report to their series, with h.mu held
+func (h *statsHistory) record(now time.Time, id, statsType string, attributes map[string]interface{}) {
+	for name, value := range attributes {
+		if name == "id" || name == "type" || name == "timestamp" {
+			continue
+		}
+		switch value.(type) {
+		case float64, string, bool:
+		default:
+			data, _ := json.Marshal(value)
+			value = string(data)
+		}
+		key := id + "-" + name
+		s, ok := h.series[key]
+		if !ok {
+			s = &statsSeries{statsType: statsType}
+			h.series[key] = s
+		}
+		s.times = append(s.times, now)
+		s.values = append(s.values, value)
+		if len(s.values) > statsHistoryLength {
+			s.times = s.times[1:]
+			s.values = s.values[1:]
+		}
+	}
+}
+
+// Dump of the session in the format of chrome://webrtc-internals, which
+// its importers and visualizers read
+func (h *statsHistory) dump() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := make(map[string]interface{}, len(h.series))
+	for key, s := range h.series {
+		values, _ := json.Marshal(s.values)
+		stats[key] = map[string]interface{}{
+			"statsType": s.statsType,
+			"startTime": s.times[0].UTC().Format(time.RFC3339Nano),
+			"endTime":   s.times[len(s.times)-1].UTC().Format(time.RFC3339Nano),
+			"values":    string(values),
+		}
+	}
+	updates := make([]map[string]interface{}, len(h.updates))
+	for i, u := range h.updates {
+		updates[i] = map[string]interface{}{"time": u.Time.UTC().Format(time.RFC3339Nano), "type": u.Type, "value": u.Value}
+	}
+
+	return map[string]interface{}{
+		"getUserMedia": []interface{}{},
+		"PeerConnections": map[string]interface{}{
+			h.id: map[string]interface{}{
+				"pid":              0,
+				"rtcConfiguration": fmt.Sprintf("{ role: %s, stream: %s }", h.role, h.stream),
+				"constraints":      "",
+				"url":              fmt.Sprintf("%s %s of stream %s", h.role, h.id, h.stream),
+				"updateLog":        updates,
+				"stats":            stats,
+			},
+		},
+		"UserAgent": "webrtc-sfu",
+	}
+}
+
+// Session with collected stats as listed by GET /api/admin/sessions
+type statsSession struct {
+	ID      string     `json:"id"`
+	Role    string     `json:"role"`
+	Stream  string     `json:"stream"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+}
+
+// Handler for GET /api/admin/sessions, the sessions whose stats can be
+// exported, newest first
+func statsSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	statsHistoriesMu.Lock()
+	list := make([]statsSession, 0, len(statsHistories))
+	for _, h := range statsHistories {
+		if h.expired() {
+			continue
+		}
+		s := statsSession{ID: h.id, Role: h.role, Stream: h.stream, Started: h.started}
+		h.mu.Lock()
+		if !h.ended.IsZero() {
+			ended := h.ended
+			s.Ended = &ended
+		}
+		h.mu.Unlock()
+		list = append(list, s)
+	}
+	statsHistoriesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Handler for GET /api/admin/sessions/{id}/stats, the stats history of a
+// publisher or viewer session as a webrtc-internals dump
+func statsDumpHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	statsHistoriesMu.Lock()
+	h, ok := statsHistories[id]
+	statsHistoriesMu.Unlock()
+	if !ok || h.expired() {
+		http.Error(w, "No stats for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"webrtc-stats-%s.json\"", id))
+	json.NewEncoder(w).Encode(h.dump())
+}
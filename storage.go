@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where recordings, their sidecars and storyboards go, from -media-storage:
+// empty for -recordings-dir on local disk, nfs:/path for a directory
+// shared with other hosts, or s3://bucket/prefix for an S3-compatible
+// object store at -s3-endpoint. HLS segments are copied to shared storage
+// as ffmpeg writes them.
+var mediaStorageURL string
+
+// Settings of s3:// media storage. The keys default to AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY.
+var (
+	s3Endpoint  string
+	s3Region    = "us-east-1"
+	s3AccessKey string
+	s3SecretKey string
+)
+
+// Media storage of this instance, opened from -media-storage on startup
+var media mediaStorage
+
+var storageLog = newLogger("storage")
+
+// Destination of the media files the SFU writes, by name relative to the
+// storage's root, e.g. "name-20240101-120000-video.ivf" or
+// "hls/name/seg00001.ts"
+type mediaStorage interface {
+	// Create a file, which others see under the name once it is closed
+	create(name string) (storageFile, error)
+	// Open a file for reading, an fs.ErrNotExist error when there is none
+	open(name string) (io.ReadCloser, error)
+	exists(name string) bool
+	remove(name string) error
+	// Names of the files at the root
+	list() ([]string, error)
+	// Whether other hosts read the storage, so HLS segments are copied there
+	shared() bool
+	String() string
+}
+
+// File being written to media storage. The muxers seek back to fill in
+// their headers before closing it.
+type storageFile interface {
+	io.WriteSeeker
+	io.Closer
+}
+
+// Write a file to media storage in one go, so readers hardly ever catch it
+// partly written even where files show up before they are closed
+func writeMediaFile(name string, write func(io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	f, err := media.create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func openMediaStorage(rawURL string) (mediaStorage, error) {
+	if rawURL == "" {
+		return localStorage{dir: recordingsDir}, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("-media-storage: %w", err)
+	}
+	switch u.Scheme {
+	case "nfs":
+		if u.Path == "" {
+			return nil, fmt.Errorf("-media-storage nfs: needs a path, e.g. nfs:/mnt/media")
+		}
+		return nfsStorage{localStorage{dir: u.Path}}, nil
+	case "s3":
+		return newS3Storage(u)
+	}
+	return nil, fmt.Errorf("-media-storage must be empty, nfs:/path or s3://bucket/prefix")
+}
+
+// Media files in a local directory
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s localStorage) create(name string) (storageFile, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (s localStorage) open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s localStorage) exists(name string) bool {
+	_, err := os.Stat(s.path(name))
+	return err == nil
+}
+
+func (s localStorage) remove(name string) error {
+	return os.RemoveAll(s.path(name))
+}
+
+func (s localStorage) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+func (s localStorage) shared() bool   { return false }
+func (s localStorage) String() string { return s.dir }
+
+// Media files on an NFS mount shared with other hosts. Files are written
+// under a temporary name and renamed once complete, since other clients
+// of the mount don't see a local writer's progress consistently.
+type nfsStorage struct {
+	localStorage
+}
+
+func (s nfsStorage) create(name string) (storageFile, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &nfsFile{File: f, path: p}, nil
+}
+
+func (s nfsStorage) shared() bool   { return true }
+func (s nfsStorage) String() string { return "nfs:" + s.dir }
+
+type nfsFile struct {
+	*os.File
+	path string
+}
+
+func (f *nfsFile) Close() error {
+	err := f.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+// Media files in a bucket of an S3-compatible object store, addressed by
+// path so any endpoint works, e.g. MinIO or Ceph. Files are written to a
+// local temporary file and uploaded once closed.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	s := &s3Storage{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), region: s3Region, accessKey: s3AccessKey, secretKey: s3SecretKey, client: &http.Client{Timeout: 5 * time.Minute}}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("-media-storage s3: needs a bucket, e.g. s3://bucket/prefix")
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.accessKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.secretKey == "" {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("-media-storage s3: needs -s3-access-key and -s3-secret-key")
+	}
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("-s3-endpoint must be a URL like https://s3.example.com")
+	}
+	return s, nil
+}
+
+// Send a request for the object, or the bucket when key is empty, signed
+// with AWS signature version 4
+func (s *s3Storage) do(method, key string, query url.Values, body io.ReadSeeker) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, s.bucket, key)
+	if key == "" {
+		u.Path += "/"
+	}
+	u.RawQuery = s3Escape(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash := sha256.New()
+	if body != nil {
+		n, err := io.Copy(payloadHash, body)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.Body, req.ContentLength = io.NopCloser(body), n
+	}
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash.Sum(nil)))
+	s.sign(req, time.Now())
+	return s.client.Do(req)
+}
+
+// Add the Authorization header of AWS signature version 4, covering the
+// host and every header set on the request
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3Escape(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// Query string in the canonical form of signature version 4, sorted and
+// with everything but unreserved characters escaped
+func s3Escape(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3EscapeString(k)+"="+s3EscapeString(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3EscapeString(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3EscapeString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Error of a response other than the expected status, fs.ErrNotExist for
+// missing objects
+func s3Error(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	return fmt.Errorf("s3 %s %s: %s %s %s", op, name, resp.Status, e.Code, e.Message)
+}
+
+func (s *s3Storage) create(name string) (storageFile, error) {
+	f, err := os.CreateTemp("", "sfu-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{File: f, storage: s, name: name}, nil
+}
+
+func (s *s3Storage) open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("open", name, resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) exists(name string) bool {
+	resp, err := s.do(http.MethodHead, s.prefix+name, nil, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (s *s3Storage) remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("remove", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) list() ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}, "delimiter": {"/"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3Error("list", s.prefix, resp)
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", s.prefix, err)
+		}
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) shared() bool   { return true }
+func (s *s3Storage) String() string { return "s3://" + s.bucket + "/" + s.prefix }
+
+// Local temporary file uploaded as an object once closed
+type s3Upload struct {
+	*os.File
+	storage *s3Storage
+	name    string
+}
+
+func (u *s3Upload) Close() error {
+	defer os.Remove(u.Name())
+	defer u.File.Close()
+	if _, err := u.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := u.storage.do(http.MethodPut, u.storage.prefix+u.name, nil, u.File)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("upload", u.name, resp)
+	}
+	resp.Body.Close()
+	storageLog.debugf("Uploaded %s to %s.", u.name, u.storage)
+	return nil
+}
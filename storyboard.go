@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// Width of each thumbnail of a storyboard, the height keeps the aspect
+	storyboardWidth = 160
+	// Thumbnails per row of the sprite
+	storyboardColumns = 10
+	// Most thumbnails of a storyboard, longer recordings get them further
+	// apart than the interval
+	maxStoryboardThumbnails = 300
+)
+
+// Time between the thumbnails of recording storyboards, 0 disables them
+var storyboardInterval = 10 * time.Second
+
+var storyboardLog = newLogger("storyboard")
+
+// Storyboards being generated, by recording ID
+var storyboards singleflight.Group
+
+// Thumbnail of a storyboard and when it is shown on the recording's
+// video timeline
+type storyboardThumbnail struct {
+	at  time.Duration
+	img image.Image
+}
+
+// Sprite and WebVTT files of a recording's storyboard in media storage
+func storyboardFiles(id string) (sprite, vtt string) {
+	base := id + "-storyboard"
+	return base + ".jpg", base + ".vtt"
+}
+
+// Generate the storyboard of the recording unless it has one already
+func recordingStoryboard(id string) error {
+	if storyboardInterval <= 0 {
+		return newSignalingError(http.StatusNotFound, "Storyboards are disabled")
+	}
+	if recordingInProgress(id) {
+		return newSignalingError(http.StatusConflict, "Recording is still in progress")
+	}
+	// The sprite is written first, so it is complete once the track exists
+	sprite, vtt := storyboardFiles(id)
+	if media.exists(vtt) && media.exists(sprite) {
+		return nil
+	}
+	_, err, _ := storyboards.Do(id, func() (interface{}, error) {
+		return nil, buildStoryboard(id)
+	})
+	return err
+}
+
+// Decode a keyframe of the recording's video about every interval into a
+// sprite of thumbnails, and write the WebVTT track pointing into it. The
+// decoder only reads keyframes, so thumbnails are as far apart as those at
+// least; -max-keyframe-interval makes publishers send them often enough.
+func buildStoryboard(id string) error {
+	rp, err := loadReplay(id)
+	if err != nil {
+		return err
+	}
+	defer rp.close()
+
+	var video *replayTrack
+	for _, t := range rp.tracks {
+		if t.kind == webrtc.RTPCodecTypeVideo {
+			video = t
+			break
+		}
+	}
+	if video == nil {
+		return newSignalingError(http.StatusUnprocessableEntity, "Recording has no video")
+	}
+
+	started := time.Now()
+	interval := storyboardInterval
+	var thumbnails []storyboardThumbnail
+	var next, end time.Duration
+	height := 0
+	for {
+		frame, err := video.source.next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		end = frame.at
+		if frame.at < next || len(frame.data) == 0 || frame.data[0]&1 != 0 {
+			continue
+		}
+		img, err := decodeVP8Frame(frame.data)
+		if err != nil {
+			storyboardLog.withStream(rp.stream).debugf("Skipping frame at %v of recording %s: %v", frame.at, id, err)
+			continue
+		}
+		if height == 0 {
+			b := img.Bounds()
+			height = max(2, storyboardWidth*b.Dy()/b.Dx()&^1)
+		}
+		thumb := image.NewRGBA(image.Rect(0, 0, storyboardWidth, height))
+		draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, img.Bounds(), draw.Src, nil)
+		thumbnails = append(thumbnails, storyboardThumbnail{at: frame.at, img: thumb})
+		next = frame.at + interval
+
+		// Keep every other thumbnail once there are too many
+		if len(thumbnails) == maxStoryboardThumbnails {
+			kept := thumbnails[:0]
+			for i := 0; i < len(thumbnails); i += 2 {
+				kept = append(kept, thumbnails[i])
+			}
+			thumbnails = kept
+			interval *= 2
+			next = thumbnails[len(thumbnails)-1].at + interval
+		}
+	}
+	if len(thumbnails) == 0 {
+		return newSignalingError(http.StatusUnprocessableEntity, "Recording has no decodable VP8 keyframe")
+	}
+	// Shown from the start of the video, the last one until its end
+	thumbnails[0].at = 0
+	end = max(end, thumbnails[len(thumbnails)-1].at+time.Second)
+
+	columns := min(len(thumbnails), storyboardColumns)
+	rows := (len(thumbnails) + columns - 1) / columns
+	sprite := image.NewRGBA(image.Rect(0, 0, columns*storyboardWidth, rows*height))
+	for i, t := range thumbnails {
+		at := image.Pt(i%columns*storyboardWidth, i/columns*height)
+		draw.Draw(sprite, t.img.Bounds().Add(at), t.img, image.Point{}, draw.Src)
+	}
+
+	spriteName, vttName := storyboardFiles(id)
+	err = writeMediaFile(spriteName, func(w io.Writer) error {
+		return jpeg.Encode(w, sprite, &jpeg.Options{Quality: thumbnailQuality})
+	})
+	if err != nil {
+		return err
+	}
+	// Cues link the sprite relative to the track, both are served side by side
+	err = writeMediaFile(vttName, func(w io.Writer) error {
+		b := bufio.NewWriter(w)
+		fmt.Fprint(b, "WEBVTT\n")
+		for i, t := range thumbnails {
+			cueEnd := end
+			if i+1 < len(thumbnails) {
+				cueEnd = thumbnails[i+1].at
+			}
+			fmt.Fprintf(b, "\n%s --> %s\nstoryboard.jpg#xywh=%d,%d,%d,%d\n", vttTimestamp(t.at), vttTimestamp(cueEnd),
+				i%columns*storyboardWidth, i/columns*height, storyboardWidth, height)
+		}
+		return b.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	storyboardLog.withStream(rp.stream).infof("Storyboard of recording %s: %d thumbnails in %v.", id, len(thumbnails), time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// Whether a publisher is still writing the recording, or it waits for the
+// stream's next input
+func recordingInProgress(id string) bool {
+	if recordingHeld(id) {
+		return true
+	}
+	for _, room := range listRooms() {
+		if p := room.getPublisher(); p != nil {
+			if rec := p.currentRecording(); rec != nil && rec.fileName("") == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HH:MM:SS.mmm of a WebVTT cue
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// Generate the storyboard of a recording that just stopped, so the first
+// player asking for it doesn't wait
+func prepareStoryboard(id string) {
+	if storyboardInterval <= 0 || services.isStopping() {
+		return
+	}
+	go func() {
+		if err := recordingStoryboard(id); err != nil {
+			var sigErr *signalingError
+			if !errors.As(err, &sigErr) {
+				storyboardLog.warnf("Error generating storyboard of recording %s: %v", id, err)
+			}
+		}
+	}()
+}
+
+// Handler for GET /api/recordings/{id}/storyboard.vtt, a WebVTT thumbnail
+// track for the seek bar of a player, and the sprite its cues point into,
+// storyboard.jpg. Both are generated on first use and need the right to
+// view the recorded stream.
+func storyboardHandler(file string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		match := recordingIDPattern.FindStringSubmatch(id)
+		if match == nil {
+			http.Error(w, "Invalid recording ID", http.StatusBadRequest)
+			return
+		}
+		if err := authorizeView(r, match[1]); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+
+		if err := recordingStoryboard(id); err != nil {
+			var sigErr *signalingError
+			if !errors.As(err, &sigErr) {
+				storyboardLog.withStream(match[1]).errorf("Error generating storyboard of recording %s: %v", id, err)
+				err = newSignalingError(http.StatusInternalServerError, "Could not generate storyboard")
+			}
+			writeSignalingError(w, err)
+			return
+		}
+
+		sprite, vtt := storyboardFiles(id)
+		name, contentType := sprite, "image/jpeg"
+		if file == "storyboard.vtt" {
+			name, contentType = vtt, "text/vtt; charset=utf-8"
+		}
+		f, err := media.open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			storyboardLog.withStream(match[1]).errorf("Error reading %s: %v", name, err)
+			http.Error(w, "Could not read storyboard", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(data))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Label of the data channel the server opens on every viewer connection
+	// for the events of its stream
+	streamEventsChannelLabel = "stream-events"
+	// Viewers joining and leaving are announced at most this often
+	viewerCountInterval = time.Second
+)
+
+var streamEventsLog = newLogger("streamevents")
+
+// Event of a stream pushed to its viewers, so players can react without
+// polling: "stream-started" when a publisher goes live or takes over,
+// "stream-ended", "publisher-reconnecting" while the publisher's connection
+// is interrupted, "publisher-reconnected" once it is back, "failover" when
+// viewers are shown the stream's failover stream or the offline slate,
+// "layers-pruned" when the server stops forwarding the highest simulcast
+// layer under load and "layers-restored" once it forwards it again, and
+// "viewer-count" as viewers join and leave. Events about a publisher carry
+// its display ID, never the peer ID that authorizes requests about it.
+//
+//	{"type": "viewer-count", "stream": "demo", "viewers": 12, "time": "..."}
+type streamNotice struct {
+	Type      string `json:"type"`
+	Stream    string `json:"stream"`
+	Publisher string `json:"publisher,omitempty"`
+	Viewers   *int   `json:"viewers,omitempty"`
+	// Stream shown instead, or "offline-slate"
+	Failover string    `json:"failover,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Events channel state of a room
+type roomEvents struct {
+	mu sync.Mutex
+	// Whether a viewer count update is scheduled
+	countPending bool
+}
+
+// Open the events channel on a viewer's connection, once its offer is set
+func openStreamEvents(room *Room, v *Viewer) {
+	if desc := v.pc.RemoteDescription(); desc == nil || !strings.Contains(desc.SDP, "m=application") {
+		return
+	}
+	dc, err := v.pc.CreateDataChannel(streamEventsChannelLabel, nil)
+	if err != nil {
+		v.log(streamEventsLog).warnf("[viewer %s] Error opening stream events channel: %v", v.id, err)
+		return
+	}
+	dc.OnOpen(func() {
+		room.events.join(room, dc, &v.channels)
+	})
+}
+
+// Tell a viewer's new channel the state of the stream, and send it the
+// next events too, none missed or out of order in between
+func (e *roomEvents) join(room *Room, dc *webrtc.DataChannel, channels *dataChannels) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if p := room.getPublisher(); p != nil {
+		sendStreamNotice(dc, streamNotice{Type: "stream-started", Stream: room.name, Publisher: p.displayID, Time: time.Now()})
+	}
+	viewers := len(room.getViewers())
+	sendStreamNotice(dc, streamNotice{Type: "viewer-count", Stream: room.name, Viewers: &viewers, Time: time.Now()})
+	channels.add(dc)
+}
+
+// Send an event to every viewer of the room
+func (e *roomEvents) notify(room *Room, n streamNotice) {
+	n.Stream, n.Time = room.name, time.Now()
+	data, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+	msg := webrtc.DataChannelMessage{IsString: true, Data: data}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, v := range room.getViewers() {
+		v.sendData(streamEventsChannelLabel, msg)
+	}
+	streamEventsLog.withStream(room.name).debugf("Event %s sent to the viewers.", n.Type)
+}
+
+// Announce the number of viewers shortly, coalescing the joins and leaves
+// of a burst into one update
+func (e *roomEvents) viewersChanged(room *Room) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.countPending {
+		return
+	}
+	e.countPending = true
+	time.AfterFunc(viewerCountInterval, func() {
+		e.mu.Lock()
+		e.countPending = false
+		e.mu.Unlock()
+		viewers := len(room.getViewers())
+		e.notify(room, streamNotice{Type: "viewer-count", Viewers: &viewers})
+	})
+}
+
+func sendStreamNotice(dc *webrtc.DataChannel, n streamNotice) {
+	if data, err := json.Marshal(n); err == nil {
+		dc.SendText(string(data))
+	}
+}
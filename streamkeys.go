@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of stream keys, so they are told apart from stream names
+	streamKeyPrefix         = "sk_"
+	maxStreamKeyLabelLength = 100
+)
+
+// File stream keys are kept in, empty keeps them in memory only
+var streamKeysPath = "stream-keys.json"
+
+var streamKeyLog = newLogger("streamkeys")
+
+// Streams a stream key or publish token may grant: a stream name or a
+// pattern of them in path.Match syntax, e.g. ci-* for the streams of CI
+// pipelines
+var streamGrantPattern = regexp.MustCompile(`^[A-Za-z0-9._*?-]{1,64}$`)
+
+// Revocable key for publishing to one stream, or to all streams matching a
+// pattern, as listed by /api/streamkeys without the key itself
+type streamKey struct {
+	ID       string     `json:"id"`
+	Stream   string     `json:"stream"`
+	Label    string     `json:"label,omitempty"`
+	User     string     `json:"user,omitempty"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// Set once, when the key is created
+	Key string `json:"key,omitempty"`
+
+	// Account of the user who created the key, 0 while accounts are disabled
+	userID int64
+	hash   string
+}
+
+// Stream key as saved to the file
+type storedStreamKey struct {
+	streamKey
+	UserID int64  `json:"userId,omitempty"`
+	Hash   string `json:"hash"`
+}
+
+var (
+	streamKeysMu sync.Mutex
+	streamKeys   = make(map[string]*streamKey)
+	// Publishers live with a stream key, so revoking it ends them
+	streamKeyPublishers = make(map[*Publisher]liveStreamKey)
+)
+
+// Key a publisher went live with and the stream it publishes, which a
+// pattern doesn't name
+type liveStreamKey struct {
+	id, stream string
+}
+
+// Whether the stream a key or publish token grants, a name or a pattern,
+// covers the stream
+func grantsStream(grant, stream string) bool {
+	ok, err := path.Match(grant, stream)
+	return err == nil && ok
+}
+
+// Whether a granted stream is a pattern rather than a stream name
+func isStreamPattern(grant string) bool {
+	return strings.ContainsAny(grant, "*?")
+}
+
+// Check that the user may create or revoke keys of the stream. Patterns
+// cover streams of other users, so only admins manage their keys.
+func authorizeStreamGrant(a *account, grant string, action streamAction) error {
+	if !isStreamPattern(grant) {
+		return authorizeStream(a, grant, action)
+	}
+	switch {
+	case accountsDB == nil:
+		return nil
+	case a == nil:
+		return newSignalingError(http.StatusUnauthorized, "Login required")
+	case !a.Admin:
+		return newSignalingError(http.StatusForbidden, "Only admins manage keys of stream patterns")
+	}
+	return nil
+}
+
+// Load the keys of -stream-keys, a missing file has none yet
+func loadStreamKeys() error {
+	if streamKeysPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(streamKeysPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var stored []storedStreamKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	streamKeysMu.Lock()
+	defer streamKeysMu.Unlock()
+	for _, s := range stored {
+		k := s.streamKey
+		k.userID, k.hash = s.UserID, s.Hash
+		streamKeys[k.ID] = &k
+	}
+	streamKeyLog.infof("Loaded %d stream keys from %s.", len(stored), streamKeysPath)
+	return nil
+}
+
+// Write every key to -stream-keys, with streamKeysMu held
+func saveStreamKeys() error {
+	if streamKeysPath == "" {
+		return nil
+	}
+	stored := make([]storedStreamKey, 0, len(streamKeys))
+	for _, k := range sortedStreamKeys() {
+		stored = append(stored, storedStreamKey{streamKey: *k, UserID: k.userID, Hash: k.hash})
+	}
+	return writeFileAtomic(streamKeysPath, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stored)
+	})
+}
+
+// Write a file through a temporary one, so readers never see it partly
+// written
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Every key oldest first, with streamKeysMu held
+func sortedStreamKeys() []*streamKey {
+	list := make([]*streamKey, 0, len(streamKeys))
+	for _, k := range streamKeys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// New random stream key and the hash it is stored under, like API tokens
+func newStreamKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = streamKeyPrefix + hex.EncodeToString(b)
+	return key, hashAPIToken(key), nil
+}
+
+// Check the stream key of a publisher of the stream. Streams no key covers,
+// by name or pattern, need none, publishers of the others one of them. A
+// valid key stands in for
+// the user who created it when the publisher isn't logged in, with the
+// publish scope; the key is returned so revoking it ends the publisher.
+func authorizeStreamKey(key, stream string, a *account) (*streamKey, *account, error) {
+	streamKeysMu.Lock()
+	defer streamKeysMu.Unlock()
+
+	var found *streamKey
+	required := false
+	hash := hashAPIToken(key)
+	for _, k := range streamKeys {
+		if !grantsStream(k.Stream, stream) {
+			continue
+		}
+		required = true
+		if key != "" && subtle.ConstantTimeCompare([]byte(k.hash), []byte(hash)) == 1 {
+			found = k
+		}
+	}
+	switch {
+	case !required:
+		return nil, a, nil
+	case key == "":
+		return nil, nil, newSignalingError(http.StatusUnauthorized, "Stream key required")
+	case found == nil:
+		publishLog.withStream(stream).warnf("Rejected invalid stream key.")
+		return nil, nil, newSignalingError(http.StatusUnauthorized, "Invalid stream key")
+	}
+
+	now := time.Now()
+	if found.LastUsed == nil || now.Sub(*found.LastUsed) >= tokenLastUsedPrecision {
+		found.LastUsed = &now
+		if err := saveStreamKeys(); err != nil {
+			streamKeyLog.withStream(stream).warnf("Error recording use of stream key %s: %v", found.ID, err)
+		}
+	}
+	if a == nil && accountsDB != nil && found.userID != 0 {
+		owner := &account{scopes: []string{scopePublish}}
+		err := accountsDB.QueryRow(`SELECT id, username, admin FROM users WHERE id = ?`, found.userID).Scan(&owner.ID, &owner.Username, &owner.Admin)
+		if err == nil {
+			owner.Admin = false
+			a = owner
+		}
+	}
+	return found, a, nil
+}
+
+// Stream whose key a bare stream key is, for RTMP encoders that only take a
+// key, e.g. OBS with rtmp://host/live and the key sk_... Keys of patterns
+// name no stream, encoders pass them with the stream instead.
+func streamOfKey(key string) (string, bool) {
+	hash := hashAPIToken(key)
+	streamKeysMu.Lock()
+	defer streamKeysMu.Unlock()
+	for _, k := range streamKeys {
+		if !isStreamPattern(k.Stream) && subtle.ConstantTimeCompare([]byte(k.hash), []byte(hash)) == 1 {
+			return k.Stream, true
+		}
+	}
+	return "", false
+}
+
+// Stream key of a request, from an X-Stream-Key header or the ?key= of the
+// URL
+func streamKeyParam(r *http.Request) string {
+	if key := r.Header.Get("X-Stream-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// Whether the key was revoked since it was checked, false for nil, so that
+// sources publishing again on their own, like RTSP cameras, stop with it
+func (k *streamKey) revoked() bool {
+	if k == nil {
+		return false
+	}
+	streamKeysMu.Lock()
+	defer streamKeysMu.Unlock()
+	return streamKeys[k.ID] != k
+}
+
+// Remember the publisher went live on the stream with the key until it ends
+func trackStreamKey(k *streamKey, stream string, p *Publisher) {
+	if k == nil {
+		return
+	}
+	streamKeysMu.Lock()
+	streamKeyPublishers[p] = liveStreamKey{id: k.ID, stream: stream}
+	streamKeysMu.Unlock()
+	go func() {
+		<-p.done
+		streamKeysMu.Lock()
+		delete(streamKeyPublishers, p)
+		streamKeysMu.Unlock()
+	}()
+}
+
+// Handler for GET /api/streamkeys, the keys of the streams the user
+// manages without the keys themselves, ?stream= limiting them to the keys
+// covering one
+func listStreamKeysHandler(w http.ResponseWriter, r *http.Request) {
+	stream := r.URL.Query().Get("stream")
+	if stream != "" && !streamNamePattern.MatchString(stream) {
+		http.Error(w, "Invalid stream name", http.StatusBadRequest)
+		return
+	}
+	streamKeysMu.Lock()
+	all := sortedStreamKeys()
+	list := make([]streamKey, 0, len(all))
+	for _, k := range all {
+		list = append(list, *k)
+	}
+	streamKeysMu.Unlock()
+
+	a := currentAccount(r)
+	visible := []streamKey{}
+	for _, k := range list {
+		if (stream == "" || grantsStream(k.Stream, stream)) && authorizeStreamGrant(a, k.Stream, actionManage) == nil {
+			visible = append(visible, k)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// Handler for POST /api/streamkeys, creating a key for publishing to a
+// stream the user may publish to:
+//
+//	{"stream": "demo", "label": "studio encoder"}
+//
+// or, by admins, for all streams matching a pattern such as "ci-*". Once a
+// stream has a key, publishers need one of its keys. The key is only
+// returned in this response.
+func createStreamKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Stream string `json:"stream"`
+		Label  string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !streamGrantPattern.MatchString(req.Stream) {
+		http.Error(w, "Invalid stream name or pattern", http.StatusBadRequest)
+		return
+	}
+	if len(req.Label) > maxStreamKeyLabelLength {
+		http.Error(w, "Label is at most 100 bytes", http.StatusBadRequest)
+		return
+	}
+	a := currentAccount(r)
+	if err := authorizeStreamGrant(a, req.Stream, actionPublish); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	key, hash, err := newStreamKey()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	k := &streamKey{ID: newID(), Stream: req.Stream, Label: req.Label, Created: time.Now().Truncate(time.Second), hash: hash}
+	if a != nil {
+		k.User, k.userID = a.Username, a.ID
+	}
+	streamKeysMu.Lock()
+	streamKeys[k.ID] = k
+	err = saveStreamKeys()
+	if err != nil {
+		delete(streamKeys, k.ID)
+	}
+	created := *k
+	streamKeysMu.Unlock()
+	if err != nil {
+		streamKeyLog.withStream(req.Stream).errorf("Error saving stream keys: %v", err)
+		http.Error(w, "Could not save stream key", http.StatusInternalServerError)
+		return
+	}
+
+	created.Key = key
+	streamKeyLog.withStream(req.Stream).infof("Stream key %s created.", k.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// Handler for DELETE /api/streamkeys/{id}, revoking the key at once and
+// ending the publishers live with it
+func deleteStreamKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	streamKeysMu.Lock()
+	k, ok := streamKeys[id]
+	streamKeysMu.Unlock()
+	if !ok {
+		http.Error(w, "No such stream key", http.StatusNotFound)
+		return
+	}
+	if err := authorizeStreamGrant(currentAccount(r), k.Stream, actionManage); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	streamKeysMu.Lock()
+	if _, ok := streamKeys[id]; !ok {
+		streamKeysMu.Unlock()
+		http.Error(w, "No such stream key", http.StatusNotFound)
+		return
+	}
+	delete(streamKeys, id)
+	err := saveStreamKeys()
+	if err != nil {
+		streamKeys[id] = k
+	}
+	live := make(map[*Publisher]string)
+	for p, used := range streamKeyPublishers {
+		if used.id == id && err == nil {
+			live[p] = used.stream
+		}
+	}
+	streamKeysMu.Unlock()
+	if err != nil {
+		streamKeyLog.withStream(k.Stream).errorf("Error saving stream keys: %v", err)
+		http.Error(w, "Could not save stream keys", http.StatusInternalServerError)
+		return
+	}
+
+	for p, stream := range live {
+		p.log(streamKeyLog).infof("[publisher %s] Ending, its stream key was revoked.", p.id)
+		p.endStream.Store(true)
+		if room := getRoom(stream); room != nil {
+			room.closePublisher(p)
+		} else {
+			p.close(func() {})
+		}
+	}
+	streamKeyLog.withStream(k.Stream).infof("Stream key %s revoked.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
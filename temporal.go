@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// VP8 temporal layers a stream can have, of the 2 bits of the TID
+const maxTemporalLayers = 4
+
+// Temporal layer of a VP8 payload, false when it carries none
+func vp8TemporalLayer(mimeType string, payload []byte) (uint8, bool) {
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return 0, false
+	}
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(payload); err != nil || vp8.T != 1 {
+		return 0, false
+	}
+	return vp8.TID, true
+}
+
+// Picture ID of a VP8 payload, false when it carries none
+func vp8PictureID(payload []byte) (uint16, bool) {
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(payload); err != nil || vp8.I != 1 {
+		return 0, false
+	}
+	return vp8.PictureID, true
+}
+
+// Copy of a VP8 payload with its picture ID moved back by gap, so the
+// frames left out leave no hole decoders wait on. The payload is returned
+// as is without a picture ID.
+func shiftVP8PictureID(payload []byte, gap uint16) []byte {
+	if gap == 0 || len(payload) < 3 || payload[0]&0x80 == 0 || payload[1]&0x80 == 0 {
+		return payload
+	}
+	shifted := append([]byte(nil), payload...)
+	if shifted[2]&0x80 == 0 {
+		// 7 bit picture ID
+		shifted[2] = (shifted[2] - byte(gap)) & 0x7f
+		return shifted
+	}
+	if len(shifted) < 4 {
+		return payload
+	}
+	id := (uint16(shifted[2]&0x7f)<<8 | uint16(shifted[3])) - gap
+	shifted[2] = 0x80 | byte(id>>8)&0x7f
+	shifted[3] = byte(id)
+	return shifted
+}
+
+// Highest temporal layer a viewer's VP8 video keeps by the ?temporalLayer=
+// of the request, e.g. temporalLayer=1 for the 15fps tier of a 30fps stream
+// sent with three layers. -1 when not given.
+func parseTemporalLayer(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("temporalLayer")
+	if value == "" {
+		return -1, nil
+	}
+	return validTemporalLayer(value)
+}
+
+func validTemporalLayer(value string) (int, error) {
+	layer, err := strconv.Atoi(value)
+	if err != nil || layer < 0 || layer >= maxTemporalLayers {
+		return 0, newSignalingError(http.StatusBadRequest, "temporalLayer must be a number from 0 to "+strconv.Itoa(maxTemporalLayers-1))
+	}
+	return layer, nil
+}
+
+// Forward the VP8 temporal layers up to layer of the viewer's video, the
+// current tracks and those added later. Video without temporal layers is
+// forwarded whole.
+func (v *Viewer) setTemporalLayer(layer int) {
+	v.temporalLayers.Store(int32(layer + 1))
+	for _, t := range v.getTracks() {
+		t.setTemporalLayers(layer + 1)
+	}
+	v.log(viewLog).infof("[viewer %s] Temporal layers up to %d forwarded.", v.id, layer)
+}
+
+// Keep as many of the lowest temporal layers of the track's VP8 video as
+// layers, 0 keeps them all
+func (t *viewerTrack) setTemporalLayers(layers int) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.mu.Lock()
+	t.decimator.layers = layers
+	t.mu.Unlock()
+}
+
+// Handler for POST /view/temporal-layer {"id":"<viewer ID>","layer":1}
+// capping the VP8 temporal layers a viewer receives
+func viewTemporalLayerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID    string `json:"id"`
+		Layer *int   `json:"layer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Layer == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	layer, err := validTemporalLayer(strconv.Itoa(*req.Layer))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	p := lookupPeer(req.ID)
+	if p == nil || p.role != "viewer" {
+		http.Error(w, "Unknown peer", http.StatusNotFound)
+		return
+	}
+	var viewer *Viewer
+	if room := getRoom(p.stream); room != nil {
+		viewer = room.getViewer(p.id)
+	}
+	if viewer == nil {
+		http.Error(w, "Unknown peer", http.StatusNotFound)
+		return
+	}
+	viewer.setTemporalLayer(layer)
+
+	// Layers of the viewer's video as seen so far, 0 without any
+	var tracks []trackTemporalLayers
+	for _, t := range viewer.getTracks() {
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			tracks = append(tracks, trackTemporalLayers{Track: t.ID(), Layers: t.currentFanout().temporalLayerCount(), Layer: layer})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracks)
+}
+
+// Temporal layers of a viewer's video track and the highest one it gets
+type trackTemporalLayers struct {
+	Track  string `json:"track"`
+	Layers int    `json:"layers"`
+	Layer  int    `json:"layer"`
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsLog = newLogger("tls")
+
+// ACME manager when certificates come from Let's Encrypt, it also answers
+// the http-01 challenges of the redirect server
+var acmeManager *autocert.Manager
+
+// TLS config of the HTTP server from the settings, nil for plain HTTP
+func serverTLSConfig() (*tls.Config, error) {
+	switch {
+	case len(settings.ACMEDomains) > 0:
+		if err := os.MkdirAll(settings.ACMECacheDir, 0o700); err != nil {
+			return nil, err
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(settings.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(settings.ACMEDomains...),
+			Email:      settings.ACMEEmail,
+		}
+		// Also answers tls-alpn-01 challenges, when listening on :443
+		return acmeManager.TLSConfig(), nil
+	case settings.TLSCert != "":
+		c := &certificateFiles{cert: settings.TLSCert, key: settings.TLSKey}
+		if _, err := c.getCertificate(nil); err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: c.getCertificate, NextProtos: []string{"h2", "http/1.1"}}, nil
+	}
+	return nil, nil
+}
+
+// A certificate and key file, loaded again once either changes so a renewal
+// by certbot or similar needs no restart
+type certificateFiles struct {
+	cert, key string
+
+	mu       sync.Mutex
+	loaded   *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func (c *certificateFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.cert, c.key} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded != nil && modTimes == c.modTimes {
+		return c.loaded, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		if c.loaded != nil {
+			tlsLog.warnf("Error reloading %s, still serving the previous certificate: %v", c.cert, err)
+			return c.loaded, nil
+		}
+		return nil, err
+	}
+	if c.loaded != nil {
+		tlsLog.infof("Reloaded certificate %s.", c.cert)
+	}
+	c.loaded, c.modTimes = &cert, modTimes
+	return c.loaded, nil
+}
+
+// Serve redirects from plain HTTP to the HTTPS server on addr, and ACME
+// challenges, until ctx is done, calling ready once listening
+func runHTTPRedirect(ctx context.Context, addr string, ready func()) error {
+	if addr == "" {
+		return nil
+	}
+	_, httpsPort, err := net.SplitHostPort(settings.Listen)
+	if err != nil {
+		return err
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if acmeManager != nil {
+		handler = acmeManager.HTTPHandler(handler)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ready()
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(ln)
+	}()
+	tlsLog.infof("Redirecting HTTP on %s to HTTPS.", addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), subsystemStopTimeout/2)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API token scopes
+const (
+	// Publish to and manage the user's streams
+	scopePublish = "publish"
+	// Watch private streams the user manages
+	scopeView = "view"
+	// Act as the admin the token belongs to
+	scopeAdmin = "admin"
+	// Read /metrics
+	scopeMetrics = "metrics"
+)
+
+var apiTokenScopes = []string{scopePublish, scopeView, scopeAdmin, scopeMetrics}
+
+const (
+	// Prefix of API tokens, so they are recognizable in configs and logs
+	apiTokenPrefix = "sfu_"
+	// Longest an old token keeps working after a rotation
+	maxTokenRotationGrace = 7 * 24 * time.Hour
+	// Last use is written at most this often per token
+	tokenLastUsedPrecision = time.Minute
+	maxTokenNameLength     = 100
+)
+
+// API token as listed by /api/admin/tokens, without the token itself
+type apiToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	User     string     `json:"user"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	// Set once, when the token is created or rotated
+	Token string `json:"token,omitempty"`
+}
+
+// Whether the account may act within scope: sessions of a user may do
+// whatever the user may, API tokens only what their scopes allow
+func (a *account) hasScope(scope string) bool {
+	return a.scopes == nil || slices.Contains(a.scopes, scope)
+}
+
+// Whether the request may read /metrics: admins, and tokens with the
+// metrics scope. Open while accounts are disabled.
+func canReadMetrics(r *http.Request) bool {
+	if accountsDB == nil {
+		return true
+	}
+	a := currentAccount(r)
+	return a != nil && (a.scopes == nil && a.Admin || a.scopes != nil && a.hasScope(scopeMetrics))
+}
+
+// New random token and the hash it is stored under. Tokens are random
+// enough that a fast hash keeps them safe at rest.
+func newAPIToken() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = apiTokenPrefix + hex.EncodeToString(b)
+	return token, hashAPIToken(token), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Token of the request's Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// User an API token acts as, with the token's scopes, nil when it is not
+// valid. Admin rights need the admin scope.
+func tokenAccount(token string) *account {
+	hash := hashAPIToken(token)
+	now := time.Now()
+	a := &account{}
+	var id, scopes string
+	var lastUsed sql.NullInt64
+	err := accountsDB.QueryRow(`SELECT t.id, t.scopes, t.last_used, u.id, u.username, u.admin FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE (t.hash = ? OR (t.previous_hash = ? AND t.previous_expires > ?)) AND (t.expires IS NULL OR t.expires > ?)`,
+		hash, hash, now.Unix(), now.Unix()).Scan(&id, &scopes, &lastUsed, &a.ID, &a.Username, &a.Admin)
+	if err != nil {
+		return nil
+	}
+	a.scopes = strings.Split(scopes, ",")
+	a.Admin = a.Admin && a.hasScope(scopeAdmin)
+
+	if !lastUsed.Valid || now.Sub(time.Unix(lastUsed.Int64, 0)) >= tokenLastUsedPrecision {
+		if _, err := accountsDB.Exec(`UPDATE api_tokens SET last_used = ? WHERE id = ?`, now.Unix(), id); err != nil {
+			accountLog.warnf("Error recording use of token %s: %v", id, err)
+		}
+	}
+	return a
+}
+
+// Scopes of a request, deduplicated, in the order of apiTokenScopes
+func parseScopes(list []string) ([]string, error) {
+	if len(list) == 0 {
+		return nil, newSignalingError(http.StatusBadRequest, "At least one scope is required")
+	}
+	var scopes []string
+	for _, s := range apiTokenScopes {
+		if slices.Contains(list, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	for _, s := range list {
+		if !slices.Contains(apiTokenScopes, s) {
+			return nil, newSignalingError(http.StatusBadRequest, "Unknown scope "+s+", expected publish, view, admin or metrics")
+		}
+	}
+	return scopes, nil
+}
+
+func getAPIToken(id string) (*apiToken, error) {
+	t := &apiToken{}
+	var scopes string
+	var created int64
+	var lastUsed, expires sql.NullInt64
+	err := accountsDB.QueryRow(`SELECT t.id, t.name, u.username, t.scopes, t.created, t.last_used, t.expires FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.id = ?`, id).Scan(&t.ID, &t.Name, &t.User, &scopes, &created, &lastUsed, &expires)
+	if err == sql.ErrNoRows {
+		return nil, newSignalingError(http.StatusNotFound, "No such token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	t.Created = time.Unix(created, 0)
+	if lastUsed.Valid {
+		used := time.Unix(lastUsed.Int64, 0)
+		t.LastUsed = &used
+	}
+	if expires.Valid {
+		e := time.Unix(expires.Int64, 0)
+		t.Expires = &e
+	}
+	return t, nil
+}
+
+func listAPITokens() ([]*apiToken, error) {
+	rows, err := accountsDB.Query(`SELECT id FROM api_tokens ORDER BY created, id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	list := []*apiToken{}
+	for _, id := range ids {
+		t, err := getAPIToken(id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// Wrap a token handler so it answers 404 while accounts are disabled, there
+// are no users to issue tokens for
+func requireAccountsDB(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if accountsDB == nil {
+			http.Error(w, "Accounts are disabled", http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Handler for GET /api/admin/tokens, every API token without its secret
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := listAPITokens()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Handler for GET /api/admin/tokens/{id}
+func getTokenHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := getAPIToken(r.PathValue("id"))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Handler for POST /api/admin/tokens, issuing a token for a machine
+// integration:
+//
+//	{"name": "obs-studio", "scopes": ["publish"], "user": "alice", "expiresIn": "720h"}
+//
+// The token acts as user, the admin creating it when omitted. It is only
+// returned in this response.
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		User      string   `json:"user"`
+		ExpiresIn string   `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Name) > maxTokenNameLength {
+		http.Error(w, "Name is required and at most 100 bytes", http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(req.Scopes)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	var expires sql.NullInt64
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expiresIn must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		expires = sql.NullInt64{Int64: time.Now().Add(d).Unix(), Valid: true}
+	}
+	user := req.User
+	if user == "" {
+		if a := currentAccount(r); a != nil {
+			user = a.Username
+		}
+	}
+	var userID int64
+	if err := accountsDB.QueryRow(`SELECT id FROM users WHERE username = ?`, user).Scan(&userID); err != nil {
+		http.Error(w, "No such user", http.StatusBadRequest)
+		return
+	}
+
+	token, hash, err := newAPIToken()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	id := newID()
+	if _, err := accountsDB.Exec(`INSERT INTO api_tokens (id, user_id, name, hash, scopes, created, expires) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, userID, req.Name, hash, strings.Join(scopes, ","), time.Now().Unix(), expires); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	t, err := getAPIToken(id)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	t.Token = token
+	accountLog.infof("API token %s (%s) issued for %s with scopes %s.", id, req.Name, user, strings.Join(scopes, ","))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// Handler for PUT /api/admin/tokens/{id}, changing the name or scopes of a
+// token: {"name": "...", "scopes": [...]}, omitted fields are kept
+func updateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   *string  `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	t, err := getAPIToken(r.PathValue("id"))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if req.Name != nil {
+		if *req.Name == "" || len(*req.Name) > maxTokenNameLength {
+			http.Error(w, "Name is required and at most 100 bytes", http.StatusBadRequest)
+			return
+		}
+		t.Name = *req.Name
+	}
+	if req.Scopes != nil {
+		if t.Scopes, err = parseScopes(req.Scopes); err != nil {
+			writeSignalingError(w, err)
+			return
+		}
+	}
+	if _, err := accountsDB.Exec(`UPDATE api_tokens SET name = ?, scopes = ? WHERE id = ?`, t.Name, strings.Join(t.Scopes, ","), t.ID); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Handler for POST /api/admin/tokens/{id}/rotate, replacing the token's
+// secret. {"grace": "1h"} keeps the old one working for that long so
+// integrations can be updated without downtime.
+func rotateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Grace string `json:"grace"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	var grace time.Duration
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 || grace > maxTokenRotationGrace {
+			http.Error(w, "grace must be a duration up to "+maxTokenRotationGrace.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := getAPIToken(r.PathValue("id"))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	token, hash, err := newAPIToken()
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if _, err := accountsDB.Exec(`UPDATE api_tokens SET previous_hash = hash, previous_expires = ?, hash = ? WHERE id = ?`,
+		time.Now().Add(grace).Unix(), hash, t.ID); err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	t.Token = token
+	accountLog.infof("API token %s (%s) rotated, the old one works for %v.", t.ID, t.Name, grace)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Handler for DELETE /api/admin/tokens/{id}, revoking the token at once
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	res, err := accountsDB.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "No such token", http.StatusNotFound)
+		return
+	}
+	accountLog.infof("API token %s revoked.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// Longest a viewer can ask to wait for the publisher's tracks
+	maxTrackWait = 30 * time.Second
+	// Once the first track arrived, how long to wait for the others a
+	// publisher sends along with it, e.g. audio after video
+	trackWaitSettle = 200 * time.Millisecond
+)
+
+// How long a viewer waits for the tracks of a stream whose publisher has
+// none yet, by the ?wait= of the request, e.g. wait=10s. 0 when not given.
+func parseTrackWait(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 || wait > maxTrackWait {
+		return 0, newSignalingError(http.StatusBadRequest, "wait must be a duration up to "+maxTrackWait.String())
+	}
+	return wait, nil
+}
+
+// Wakes a viewer waiting for a stream's tracks
+type trackWaiter chan struct{}
+
+func (w trackWaiter) trackAdded(*Publisher, *trackFanout) {
+	select {
+	case w <- struct{}{}:
+	default:
+	}
+}
+
+func (w trackWaiter) trackRemoved(*Publisher, *trackFanout) {}
+
+// Hold a joining viewer until the stream has tracks to subscribe to, for at
+// most wait. Returns right away when it has some already or there is no such
+// stream; negotiateViewer reports those.
+func waitForTracks(ctx context.Context, stream string, wait time.Duration) {
+	room := getRoom(stream)
+	if wait <= 0 || room == nil || len(room.tracks()) > 0 {
+		return
+	}
+	vlog := viewLog.withStream(stream)
+	vlog.debugf("Viewer waiting up to %v for the publisher's tracks.", wait)
+
+	waiter := make(trackWaiter, 1)
+	room.subscribeTracks(waiter)
+	defer func() {
+		room.unsubscribeTracks(waiter)
+		room.removeIfEmpty()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-waiter:
+	case <-timer.C:
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	settle := time.NewTimer(trackWaitSettle)
+	defer settle.Stop()
+	select {
+	case <-settle.C:
+	case <-ctx.Done():
+	}
+}
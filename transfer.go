@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Long enough to type on another device, short enough to guess
+	transferCodeLength = 8
+	// How long a transfer code can be redeemed
+	transferCodeTTL = 2 * time.Minute
+)
+
+// Letters and digits of transfer codes, without those easily mistaken for
+// one another
+const transferAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var transferLog = newLogger("transfer")
+
+// A code another device redeems to take over a viewer's session
+type viewerTransfer struct {
+	viewer  *Viewer
+	expires time.Time
+}
+
+// Transfer codes of this instance's viewers, by code
+var (
+	transfersMu sync.Mutex
+	transfers   = make(map[string]*viewerTransfer)
+)
+
+func newTransferCode() string {
+	b := make([]byte, transferCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = transferAlphabet[int(b[i])%len(transferAlphabet)]
+	}
+	return string(b)
+}
+
+// Handler for POST /api/viewers/{id}/transfer, a code for moving a viewer's
+// session to another device, e.g. from a phone to a desktop mid-watch. The
+// device redeeming it on /view?transfer= or the "transfer" of its offer
+// views under the same account, token and analytics identity, and the old
+// connection is closed once the new one connects. As the code stands in for
+// the viewer's token, it needs the peer ID and secret the viewer got with its
+// answer, see authorizedPeer.
+//
+//	{"code": "K7PM2XQA", "expires": "...", "url": "https://.../watch/name?transfer=K7PM2XQA"}
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var viewer *Viewer
+	if p := authorizedPeer(r, id); p != nil && p.role == "viewer" {
+		if room := getRoom(p.stream); room != nil {
+			viewer = room.getViewer(id)
+		}
+	}
+	if viewer == nil {
+		http.Error(w, "No such viewer", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	code := newTransferCode()
+	expires := now.Add(transferCodeTTL)
+	transfersMu.Lock()
+	for c, t := range transfers {
+		if now.After(t.expires) || t.viewer == viewer {
+			delete(transfers, c)
+		}
+	}
+	transfers[code] = &viewerTransfer{viewer: viewer, expires: expires}
+	transfersMu.Unlock()
+	viewer.log(transferLog).infof("[viewer %s] Transfer code issued.", viewer.id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Code    string    `json:"code"`
+		Expires time.Time `json:"expires"`
+		URL     string    `json:"url"`
+	}{code, expires, externalURL(r) + "/watch/" + url.PathEscape(viewer.stream) + "?transfer=" + code})
+}
+
+// The viewer of the stream a transfer code moves, if it is still valid
+func pendingTransfer(code, stream string) *Viewer {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	return pendingTransferLocked(strings.ToUpper(code), stream)
+}
+
+func pendingTransferLocked(code, stream string) *Viewer {
+	t, ok := transfers[code]
+	if !ok || time.Now().After(t.expires) || t.viewer.stream != stream {
+		return nil
+	}
+	return t.viewer
+}
+
+// Use up a transfer code of the stream, authorizing the device redeeming it
+// in place of the viewer's token, and return the viewer it moves
+func redeemTransfer(code, stream string) (*Viewer, error) {
+	// Looked up and deleted at once, so of two devices redeeming the same
+	// code only one gets the viewer
+	code = strings.ToUpper(code)
+	transfersMu.Lock()
+	old := pendingTransferLocked(code, stream)
+	if old != nil {
+		delete(transfers, code)
+	}
+	transfersMu.Unlock()
+	if old == nil {
+		return nil, newSignalingError(http.StatusForbidden, "Invalid or expired transfer code")
+	}
+
+	if s := old.pc.ConnectionState(); s == webrtc.PeerConnectionStateClosed || s == webrtc.PeerConnectionStateFailed {
+		return nil, newSignalingError(http.StatusGone, "The session to transfer has ended")
+	}
+	// The token the viewer joined with may have expired since
+	if _, err := checkViewToken(old.identity().token, stream); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Carry the account, token and analytics identity of the viewer over to its
+// replacement, closing it once the replacement connects
+func (v *Viewer) takeOver(old *Viewer) {
+	v.setIdentity(old.identity())
+	v.transferredFrom.Store(old)
+	if v.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		v.completeTransfer()
+	}
+}
+
+func (v *Viewer) completeTransfer() {
+	old := v.transferredFrom.Swap(nil)
+	if old == nil {
+		return
+	}
+	room := getRoom(v.stream)
+	if room == nil {
+		return
+	}
+	notifySockets(signalMessage{Type: "transferred", Stream: v.stream, ID: old.id}, old.peer)
+	room.closeViewer(old)
+	v.log(transferLog).infof("[viewer %s] Took over the session of viewer %s.", v.id, old.id)
+}
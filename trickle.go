@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long a streamed answer waits for ICE gathering to complete
+const streamedGatherTimeout = 10 * time.Second
+
+// One line of a streamed signaling response
+type trickleMessage struct {
+	Type      string                     `json:"type"`
+	ID        string                     `json:"id,omitempty"`
+	Answer    *webrtc.SessionDescription `json:"answer,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+// Clients opt into streamed answers with ?trickle=stream or an ndjson Accept header
+func wantsStreamedAnswer(r *http.Request) bool {
+	if r.URL.Query().Get("trickle") == "stream" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// Forward gathered candidates to ch until the request goes away. A nil candidate
+// marks the end of gathering, same as in OnICECandidate.
+func streamCandidates(ctx context.Context, ch chan<- *webrtc.ICECandidate) func(*webrtc.ICECandidate) {
+	return func(c *webrtc.ICECandidate) {
+		select {
+		case ch <- c:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Write the answer, then each gathered candidate, then end-of-candidates, as JSON lines
+func writeStreamedAnswer(w http.ResponseWriter, r *http.Request, prefix, id string, answer webrtc.SessionDescription, candidates <-chan *webrtc.ICECandidate) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	tlog := signalingLog.forRequest(r).withPeer(id)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	write := func(msg trickleMessage) bool {
+		if err := enc.Encode(msg); err != nil {
+			tlog.errorf("%s: Error streaming answer: %v", prefix, err)
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	if !write(trickleMessage{Type: "answer", ID: id, Answer: &answer}) {
+		return
+	}
+
+	timeout := time.NewTimer(streamedGatherTimeout)
+	defer timeout.Stop()
+
+	count := 0
+	for {
+		select {
+		case c := <-candidates:
+			if c == nil {
+				write(trickleMessage{Type: "end-of-candidates"})
+				tlog.debugf("%s: Streamed %d ICE candidates.", prefix, count)
+				return
+			}
+			init := c.ToJSON()
+			if !write(trickleMessage{Type: "candidate", Candidate: &init}) {
+				return
+			}
+			count++
+		case <-timeout.C:
+			tlog.warnf("%s: ICE gathering timed out after %d candidates.", prefix, count)
+			write(trickleMessage{Type: "end-of-candidates"})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the resource usage of streams is sampled
+const usageSampleInterval = 5 * time.Second
+
+// Clock ticks per second of the CPU times in /proc, USER_HZ is 100 on all
+// common Linux platforms
+const procClockTicks = 100
+
+var usageLog = newLogger("usage")
+
+// Latest usage sample of every stream
+var (
+	streamUsages    []streamUsage
+	streamUsageTime time.Time
+	streamUsagesMu  sync.Mutex
+)
+
+// Resources a stream used over the last sample interval
+type streamUsage struct {
+	Stream  string `json:"stream"`
+	Viewers int    `json:"viewers"`
+
+	// Bits per second received from the publisher and sent to viewers
+	IngressBitrate float64 `json:"ingressBitrate"`
+	EgressBitrate  float64 `json:"egressBitrate"`
+
+	// Bytes held in the GOP caches of the stream's tracks
+	BufferBytes int `json:"bufferBytes"`
+
+	// CPU cores used by the stream's ffmpeg processes, e.g. 0.5 for half a
+	// core spent transcoding for HLS or restreaming
+	TranscodeCPU float64 `json:"transcodeCPU"`
+	Transcoders  int     `json:"transcoders"`
+}
+
+// Counters of the previous sample, rates are taken over the difference
+type usageSampler struct {
+	at    time.Time
+	bytes map[*Room][2]uint64
+	cpu   map[*ffmpegProcess]time.Duration
+}
+
+// Sample the usage of all streams until ctx is done
+func runUsageSampler(ctx context.Context) error {
+	sampler := &usageSampler{}
+	sampler.sample()
+
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			sampler.sample()
+		}
+	}
+}
+
+func (s *usageSampler) sample() {
+	now := time.Now()
+	var elapsed float64
+	if !s.at.IsZero() {
+		elapsed = now.Sub(s.at).Seconds()
+	}
+	usages := make(map[string]*streamUsage)
+
+	bytes := make(map[*Room][2]uint64)
+	for _, room := range listRooms() {
+		u := &streamUsage{Stream: room.name, Viewers: len(room.getViewers())}
+		usages[room.name] = u
+
+		counters := [2]uint64{room.bytesIn.Load(), room.bytesOut.Load()}
+		bytes[room] = counters
+		if last, ok := s.bytes[room]; ok && elapsed > 0 {
+			u.IngressBitrate = float64(counters[0]-last[0]) * 8 / elapsed
+			u.EgressBitrate = float64(counters[1]-last[1]) * 8 / elapsed
+		}
+		for _, t := range room.tracks() {
+			u.BufferBytes += t.cachedBytes()
+		}
+	}
+
+	ffmpegProcessesMu.Lock()
+	processes := make([]*ffmpegProcess, 0, len(ffmpegProcesses))
+	for p := range ffmpegProcesses {
+		processes = append(processes, p)
+	}
+	ffmpegProcessesMu.Unlock()
+
+	cpu := make(map[*ffmpegProcess]time.Duration)
+	for _, p := range processes {
+		used, err := procCPUTime(p.cmd.Process.Pid)
+		if err != nil {
+			usageLog.withStream(p.stream).debugf("Error reading CPU time of ffmpeg: %v", err)
+			continue
+		}
+		cpu[p] = used
+		u, ok := usages[p.stream]
+		if !ok {
+			u = &streamUsage{Stream: p.stream}
+			usages[p.stream] = u
+		}
+		u.Transcoders++
+		if elapsed > 0 {
+			u.TranscodeCPU += (used - s.cpu[p]).Seconds() / elapsed
+		}
+	}
+	s.at, s.bytes, s.cpu = now, bytes, cpu
+
+	list := make([]streamUsage, 0, len(usages))
+	for _, u := range usages {
+		list = append(list, *u)
+	}
+	streamUsagesMu.Lock()
+	streamUsages, streamUsageTime = list, now
+	streamUsagesMu.Unlock()
+}
+
+// User and system CPU time a process used so far, from /proc/<pid>/stat
+func procCPUTime(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name in parentheses may contain spaces
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(utime+stime) * time.Second / procClockTicks, nil
+}
+
+// Handler for GET /api/admin/usage?sort=bandwidth&limit=10, the streams
+// using the most bandwidth, buffer memory or transcode CPU, for admins
+// deciding which stream to shed
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	streamUsagesMu.Lock()
+	list := append([]streamUsage(nil), streamUsages...)
+	sampled := streamUsageTime
+	streamUsagesMu.Unlock()
+
+	by := r.URL.Query().Get("sort")
+	var key func(u streamUsage) float64
+	switch by {
+	case "", "bandwidth":
+		by = "bandwidth"
+		key = func(u streamUsage) float64 { return u.IngressBitrate + u.EgressBitrate }
+	case "memory":
+		key = func(u streamUsage) float64 { return float64(u.BufferBytes) }
+	case "cpu":
+		key = func(u streamUsage) float64 { return u.TranscodeCPU }
+	case "viewers":
+		key = func(u streamUsage) float64 { return float64(u.Viewers) }
+	default:
+		http.Error(w, "Invalid sort, expected bandwidth, memory, cpu or viewers", http.StatusBadRequest)
+		return
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if ki, kj := key(list[i]), key(list[j]); ki != kj {
+			return ki > kj
+		}
+		return list[i].Stream < list[j].Stream
+	})
+
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < len(list) {
+			list = list[:n]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sampled":         sampled,
+		"intervalSeconds": usageSampleInterval.Seconds(),
+		"sort":            by,
+		"streams":         list,
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Codecs registered by webrtc.MediaEngine.RegisterDefaultCodecs
+var supportedCodecs = map[string]bool{
+	webrtc.MimeTypeOpus: true,
+	webrtc.MimeTypeG722: true,
+	webrtc.MimeTypePCMU: true,
+	webrtc.MimeTypePCMA: true,
+	webrtc.MimeTypeVP8:  true,
+	webrtc.MimeTypeVP9:  true,
+	webrtc.MimeTypeH264: true,
+	webrtc.MimeTypeAV1:  true,
+}
+
+// Codecs that carry no media of their own (retransmission, FEC)
+var auxiliaryCodecs = map[string]bool{
+	"rtx":    true,
+	"ulpfec": true,
+	"red":    true,
+}
+
+type offerReport struct {
+	Valid    bool          `json:"valid"`
+	Role     string        `json:"role"`
+	Type     string        `json:"type,omitempty"`
+	Errors   []string      `json:"errors"`
+	Warnings []string      `json:"warnings"`
+	Media    []mediaReport `json:"media"`
+}
+
+type mediaReport struct {
+	Mid       string        `json:"mid,omitempty"`
+	Kind      string        `json:"kind"`
+	Direction string        `json:"direction"`
+	Codecs    []codecReport `json:"codecs"`
+}
+
+type codecReport struct {
+	PayloadType uint8  `json:"payloadType"`
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    string `json:"channels,omitempty"`
+	Fmtp        string `json:"fmtp,omitempty"`
+	Supported   bool   `json:"supported"`
+}
+
+func (r *offerReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *offerReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Handler for dry-run offer validation, no peer connection is created
+func validateOfferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = "publish"
+	}
+
+	report := &offerReport{Role: role, Errors: []string{}, Warnings: []string{}, Media: []mediaReport{}}
+	if role != "publish" && role != "view" {
+		report.errorf("unknown role %q, expected publish or view", role)
+	}
+
+	stream, err := streamName(r)
+	if err != nil {
+		report.errorf("%v", err)
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		report.errorf("request body is not a JSON session description: %v", err)
+	} else {
+		validateOffer(report, stream, offer)
+	}
+
+	report.Valid = len(report.Errors) == 0
+	signalingLog.withStream(stream).debugf("Validated %s offer: valid=%t errors=%d warnings=%d", role, report.Valid, len(report.Errors), len(report.Warnings))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Run the same checks the signaling handlers depend on against a parsed offer
+func validateOffer(report *offerReport, stream string, offer webrtc.SessionDescription) {
+	report.Type = offer.Type.String()
+	if offer.Type != webrtc.SDPTypeOffer {
+		report.errorf("type must be \"offer\", got %q", offer.Type.String())
+	}
+
+	if strings.TrimSpace(offer.SDP) == "" {
+		report.errorf("sdp is empty")
+		return
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		report.errorf("sdp could not be parsed: %v", err)
+		return
+	}
+
+	if len(parsed.MediaDescriptions) == 0 {
+		report.errorf("sdp has no media sections")
+		return
+	}
+
+	_, sessionUfrag := parsed.Attribute("ice-ufrag")
+	_, sessionPwd := parsed.Attribute("ice-pwd")
+	_, sessionFingerprint := parsed.Attribute("fingerprint")
+
+	var videoSend, videoRecv bool
+	var videoCodecs []string
+	for i, media := range parsed.MediaDescriptions {
+		m := mediaReport{
+			Kind:      media.MediaName.Media,
+			Direction: mediaDirection(media),
+			Codecs:    []codecReport{},
+		}
+		m.Mid, _ = media.Attribute("mid")
+
+		label := fmt.Sprintf("media section %d (%s)", i, m.Kind)
+		if m.Mid == "" {
+			report.warnf("%s has no mid attribute", label)
+		}
+		if _, ok := media.Attribute("ice-ufrag"); !ok && !sessionUfrag {
+			report.errorf("%s has no ice-ufrag", label)
+		}
+		if _, ok := media.Attribute("ice-pwd"); !ok && !sessionPwd {
+			report.errorf("%s has no ice-pwd", label)
+		}
+		if _, ok := media.Attribute("fingerprint"); !ok && !sessionFingerprint {
+			report.errorf("%s has no DTLS fingerprint", label)
+		}
+
+		if m.Kind == "audio" || m.Kind == "video" {
+			m.Codecs = mediaCodecs(report, parsed, media, label)
+		}
+
+		if m.Kind == "video" && m.Direction != "inactive" {
+			if m.Direction == "sendrecv" || m.Direction == "sendonly" {
+				videoSend = true
+			}
+			if m.Direction == "sendrecv" || m.Direction == "recvonly" {
+				videoRecv = true
+			}
+			for _, c := range m.Codecs {
+				if c.Supported {
+					videoCodecs = append(videoCodecs, c.MimeType)
+				}
+			}
+		}
+
+		report.Media = append(report.Media, m)
+	}
+
+	switch report.Role {
+	case "publish":
+		if !videoSend {
+			report.errorf("publisher offer has no video section that sends media")
+		}
+	case "view":
+		if !videoRecv {
+			report.errorf("viewer offer has no video section that receives media")
+		}
+		validateViewerCodecs(report, stream, videoCodecs)
+	}
+
+	if len(videoCodecs) == 0 {
+		report.errorf("no offered video codec is supported by the server")
+	}
+}
+
+// Collect the codecs of one media section and flag the ones the server can't use
+func mediaCodecs(report *offerReport, parsed *sdp.SessionDescription, media *sdp.MediaDescription, label string) []codecReport {
+	codecs := []codecReport{}
+	usable := false
+	for _, format := range media.MediaName.Formats {
+		var pt uint8
+		if _, err := fmt.Sscanf(format, "%d", &pt); err != nil {
+			report.errorf("%s has invalid payload type %q", label, format)
+			continue
+		}
+
+		codec, err := parsed.GetCodecForPayloadType(pt)
+		if err != nil {
+			report.warnf("%s payload type %d has no rtpmap", label, pt)
+			continue
+		}
+
+		mimeType := media.MediaName.Media + "/" + codec.Name
+		c := codecReport{
+			PayloadType: pt,
+			MimeType:    mimeType,
+			ClockRate:   codec.ClockRate,
+			Channels:    codec.EncodingParameters,
+			Fmtp:        codec.Fmtp,
+		}
+		for supported := range supportedCodecs {
+			if strings.EqualFold(supported, mimeType) {
+				c.MimeType = supported
+				c.Supported = true
+				usable = true
+			}
+		}
+		if !c.Supported && auxiliaryCodecs[strings.ToLower(codec.Name)] {
+			c.Supported = true
+		}
+		codecs = append(codecs, c)
+	}
+
+	if !usable && media.MediaName.Port.Value != 0 {
+		report.warnf("%s offers no codec supported by the server", label)
+	}
+	return codecs
+}
+
+// A viewer can only connect when it accepts the codecs of the current publisher's video tracks
+func validateViewerCodecs(report *offerReport, stream string, videoCodecs []string) {
+	room := getRoom(stream)
+	if room == nil {
+		report.warnf("stream %q does not exist, /view would be rejected", stream)
+		return
+	}
+
+	tracks := room.tracks()
+	if len(tracks) == 0 {
+		report.warnf("stream %q has no publisher available, /view would be rejected", stream)
+		return
+	}
+
+	for _, t := range tracks {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		mimeType := t.Codec().MimeType
+		accepted := false
+		for _, c := range videoCodecs {
+			if strings.EqualFold(c, mimeType) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			report.errorf("viewer offer does not accept the publisher codec %s of track %s", mimeType, t.ID())
+		}
+	}
+}
+
+// Direction attribute of a media section, sendrecv when omitted
+func mediaDirection(media *sdp.MediaDescription) string {
+	for _, dir := range []string{"sendrecv", "sendonly", "recvonly", "inactive"} {
+		if _, ok := media.Attribute(dir); ok {
+			return dir
+		}
+	}
+	return "sendrecv"
+}
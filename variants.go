@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Transcode a stream's video for viewers whose offer lacks its codec, from
+// -codec-variants
+var codecVariantsEnabled bool
+
+const (
+	// Variants nobody watched for this long are stopped
+	variantIdleTimeout = 30 * time.Second
+	// Keyframe interval of the transcoded video, viewers joining a running
+	// variant start on the cached GOP
+	variantKeyframeInterval = "2"
+)
+
+var variantLog = newLogger("variants")
+
+var (
+	codecVariants   = make(map[string]*codecVariant)
+	codecVariantsMu sync.Mutex
+)
+
+// Video of a stream transcoded by ffmpeg to another codec, so viewers that
+// can't decode the published one, e.g. Safari without VP8 or Firefox without
+// H264, still get a track. Started by the first viewer needing the codec and
+// stopped once nobody watches it. Like HLS it follows the stream's first
+// video track across publishers sending the same codec.
+type codecVariant struct {
+	key     string
+	room    *Room
+	codec   webrtc.RTPCodecCapability
+	fanout  *trackFanout
+	forward *rtpForward
+	ffmpeg  *ffmpegProcess
+	conn    *net.UDPConn
+	sdpPath string
+
+	mu       sync.Mutex
+	lastUsed time.Time
+}
+
+// Codecs video is transcoded to, those all browsers decode one of
+func variantCodecs() []webrtc.RTPCodecCapability {
+	return []webrtc.RTPCodecCapability{
+		{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		h264Capability(nil),
+	}
+}
+
+// Replace the stream's first video track with a variant of a codec the
+// viewer takes when it doesn't take the published one. offered are the
+// video codecs of the viewer's offer and prefer those of its ?codec=, in
+// order of preference.
+func withCodecVariants(room *Room, tracks []*trackFanout, offered, prefer []string) []*trackFanout {
+	var videoPrefer []string
+	for _, mimeType := range prefer {
+		if strings.HasPrefix(mimeType, "video/") {
+			videoPrefer = append(videoPrefer, mimeType)
+		}
+	}
+	takes := func(mimeType string) bool {
+		return containsFold(offered, mimeType) && (len(videoPrefer) == 0 || containsFold(videoPrefer, mimeType))
+	}
+	wanted := offered
+	if len(videoPrefer) > 0 {
+		wanted = videoPrefer
+	}
+
+	list := make([]*trackFanout, len(tracks))
+	copy(list, tracks)
+	for i, t := range list {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if takes(t.Codec().MimeType) {
+			return list
+		}
+		for _, mimeType := range wanted {
+			for _, codec := range variantCodecs() {
+				if !strings.EqualFold(codec.MimeType, mimeType) || !takes(mimeType) {
+					continue
+				}
+				f, err := getCodecVariant(room, codec)
+				if err != nil {
+					variantLog.withStream(room.name).warnf("Error transcoding video to %s: %v", codec.MimeType, err)
+					return list
+				}
+				list[i] = f
+				return list
+			}
+		}
+		// Only the first video track is forwarded to ffmpeg
+		return list
+	}
+	return list
+}
+
+// Mime types of the offer's codecs of a kind
+func offerCodecs(offer webrtc.SessionDescription, kind webrtc.RTPCodecType) []string {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return nil
+	}
+	var mimeTypes []string
+	for _, media := range parsed.MediaDescriptions {
+		if !strings.EqualFold(media.MediaName.Media, kind.String()) {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			var pt uint8
+			if _, err := fmt.Sscanf(format, "%d", &pt); err != nil {
+				continue
+			}
+			if codec, err := parsed.GetCodecForPayloadType(pt); err == nil {
+				mimeTypes = append(mimeTypes, kind.String()+"/"+codec.Name)
+			}
+		}
+	}
+	return mimeTypes
+}
+
+// Fanout of the stream's video in a codec, transcoding it when nobody
+// watches that variant yet
+func getCodecVariant(room *Room, codec webrtc.RTPCodecCapability) (*trackFanout, error) {
+	codecVariantsMu.Lock()
+	defer codecVariantsMu.Unlock()
+
+	key := room.name + " " + codec.MimeType
+	if v, ok := codecVariants[key]; ok {
+		v.touch()
+		return v.fanout, nil
+	}
+	v, err := startCodecVariant(room, codec)
+	if err != nil {
+		return nil, err
+	}
+	v.key = key
+	codecVariants[key] = v
+	return v.fanout, nil
+}
+
+func startCodecVariant(room *Room, codec webrtc.RTPCodecCapability) (*codecVariant, error) {
+	videoAddr, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	forward, err := newRTPForward(room, videoAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		forward.close()
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimPrefix(codec.MimeType, "video/"))
+	fanout := newTrackFanout(codec, "video-"+name, "transcoded", "", webrtc.RTPCodecTypeVideo)
+	fanout.transcoded = true
+	v := &codecVariant{room: room, codec: codec, fanout: fanout, forward: forward, conn: conn, lastUsed: time.Now()}
+
+	if err := v.start(name); err != nil {
+		forward.close()
+		conn.Close()
+		if v.sdpPath != "" {
+			os.Remove(v.sdpPath)
+		}
+		return nil, err
+	}
+	room.addSink(forward)
+	variantLog.withStream(room.name).infof("Transcoding %s video to %s.", forward.mimeType(webrtc.RTPCodecTypeVideo), codec.MimeType)
+
+	go v.read()
+	go v.run()
+	return v, nil
+}
+
+// Write the SDP of the forward and start ffmpeg on it, sending the
+// transcoded video back as RTP
+func (v *codecVariant) start(name string) error {
+	f, err := os.CreateTemp("", "sfu-variant-*.sdp")
+	if err != nil {
+		return err
+	}
+	v.sdpPath = f.Name()
+	_, err = f.WriteString(v.forward.sdp())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-protocol_whitelist", "file,udp,rtp", "-i", v.sdpPath}, rtpEncoderArgs(name, v.conn)...)
+	v.ffmpeg, err = startFFmpeg(v.room.name, args...)
+	return err
+}
+
+// ffmpeg output arguments encoding video to the codec of name, vp8 or h264,
+// and sending it as RTP to conn
+func rtpEncoderArgs(name string, conn *net.UDPConn) []string {
+	args := []string{"-an"}
+	switch name {
+	case "vp8":
+		args = append(args, "-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8", "-b:v", "1500k")
+	case "h264":
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-profile:v", "baseline", "-pix_fmt", "yuv420p")
+	}
+	return append(args,
+		"-force_key_frames", "expr:gte(t,n_forced*"+variantKeyframeInterval+")",
+		"-payload_type", fmt.Sprint(forwardVideoPayloadType),
+		"-f", "rtp", fmt.Sprintf("rtp://%s?pkt_size=%d", conn.LocalAddr(), localPublisherMTU),
+	)
+}
+
+// Forward ffmpeg's packets to the viewers of the variant
+func (v *codecVariant) read() {
+	readRTP(v.conn, func(packet *rtp.Packet) {
+		v.room.bytesOut.Add(v.fanout.WriteRTP(packet))
+	})
+}
+
+// Hand the RTP packets arriving on conn to handle until it is closed
+func readRTP(conn *net.UDPConn, handle func(*rtp.Packet)) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			continue
+		}
+		handle(packet)
+	}
+}
+
+// Ask for a keyframe once ffmpeg listens, then stop the variant when
+// nobody watches it or ffmpeg exits
+func (v *codecVariant) run() {
+	keyframe := time.NewTimer(ffmpegInputDelay)
+	defer keyframe.Stop()
+	idle := time.NewTicker(variantIdleTimeout / 4)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-keyframe.C:
+			if publisher := v.room.getPublisher(); publisher != nil {
+				publisher.requestKeyframe()
+			}
+		case <-idle.C:
+			if v.stopIfIdle() {
+				variantLog.withStream(v.room.name).infof("No viewers of the %s video left, transcoding stopped.", v.codec.MimeType)
+				return
+			}
+		case <-v.ffmpeg.exited():
+			variantLog.withStream(v.room.name).warnf("ffmpeg exited, %s video stopped.", v.codec.MimeType)
+			v.stop()
+			return
+		}
+	}
+}
+
+func (v *codecVariant) touch() {
+	v.mu.Lock()
+	v.lastUsed = time.Now()
+	v.mu.Unlock()
+}
+
+// Stop the variant if it had no viewers for variantIdleTimeout. Checked
+// with the variants' lock held, so no viewer gets it in between.
+func (v *codecVariant) stopIfIdle() bool {
+	codecVariantsMu.Lock()
+	if v.fanout.viewerCount() > 0 {
+		v.touch()
+	}
+	v.mu.Lock()
+	idle := time.Since(v.lastUsed) > variantIdleTimeout
+	v.mu.Unlock()
+	if idle && codecVariants[v.key] == v {
+		delete(codecVariants, v.key)
+	}
+	codecVariantsMu.Unlock()
+
+	if idle {
+		v.stop()
+	}
+	return idle
+}
+
+func (v *codecVariant) stop() {
+	codecVariantsMu.Lock()
+	if codecVariants[v.key] == v {
+		delete(codecVariants, v.key)
+	}
+	codecVariantsMu.Unlock()
+
+	v.room.removeSink(v.forward)
+	v.forward.close()
+	v.ffmpeg.stop()
+	v.conn.Close()
+	v.fanout.close()
+	os.Remove(v.sdpPath)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Validity of view tokens made without an expiresIn, and the longest
+	defaultViewTokenValidity = time.Hour
+	maxViewTokenValidity     = 30 * 24 * time.Hour
+)
+
+var viewTokenMethods = []string{"HS256", "HS384", "HS512"}
+
+// Check the view token of a viewer of the stream, a JWT signed with
+// -view-token-secret for the view audience naming the stream. Whether the token is one; an error
+// when it is a JWT that is invalid, expired or for another stream. Private
+// streams' access tokens aren't JWTs and are left to the caller.
+func checkViewToken(token, stream string) (bool, error) {
+	if settings.ViewTokenSecret == "" || strings.Count(token, ".") != 2 {
+		return false, nil
+	}
+	var claims streamClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) { return []byte(settings.ViewTokenSecret), nil },
+		jwt.WithValidMethods(viewTokenMethods), jwt.WithExpirationRequired(), jwt.WithLeeway(publishTokenLeeway))
+	if err == nil {
+		err = checkTokenAudience(&claims, viewTokenAudience, viewLog.withStream(stream))
+	}
+	if err != nil {
+		viewLog.withStream(stream).warnf("Rejected view token: %v", err)
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return false, newSignalingError(http.StatusUnauthorized, "View token expired")
+		case errors.Is(err, errAudienceRequired):
+			return false, newSignalingError(http.StatusUnauthorized, "View token needs the \"view\" audience")
+		}
+		return false, newSignalingError(http.StatusUnauthorized, "Invalid view token")
+	}
+	if claims.Stream != stream {
+		return false, newSignalingError(http.StatusForbidden, "View token is for another stream")
+	}
+	return true, nil
+}
+
+// Handler for POST /api/streams/{stream}/view-token, a token for watching
+// the stream with /view?token=... or /watch/{stream}?token=... until it
+// expires: {"expiresIn": "2h"}, an hour when omitted. Answers
+// {"token": "...", "expires": "..."}.
+func viewTokenHandler(w http.ResponseWriter, r *http.Request, stream string) {
+	if settings.ViewTokenSecret == "" {
+		http.Error(w, "View tokens are disabled", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		ExpiresIn string `json:"expiresIn"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	validity := defaultViewTokenValidity
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxViewTokenValidity {
+			http.Error(w, "expiresIn must be a positive duration up to "+maxViewTokenValidity.String(), http.StatusBadRequest)
+			return
+		}
+		validity = d
+	}
+
+	expires := time.Now().Add(validity).Truncate(time.Second)
+	claims := streamClaims{Stream: stream, RegisteredClaims: jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{viewTokenAudience},
+		ExpiresAt: jwt.NewNumericDate(expires),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(settings.ViewTokenSecret))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires": expires.UTC()})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Who can find and watch a stream
+const (
+	// Listed in /browse and /api/streams
+	visibilityPublic = "public"
+	// Watchable by anyone with the link, not listed
+	visibilityUnlisted = "unlisted"
+	// Watchable only with the stream's access token
+	visibilityPrivate = "private"
+)
+
+func validVisibility(v string) bool {
+	return v == visibilityPublic || v == visibilityUnlisted || v == visibilityPrivate
+}
+
+// Check that the request may watch the stream. Every endpoint handing out a
+// stream's media or details goes through here; private streams, and every
+// stream with -viewing token, need their ?token=, a view token, a signed
+// URL or a user who manages the stream.
+func authorizeView(r *http.Request, stream string) error {
+	return authorizeViewToken(r, stream, r.URL.Query().Get("token"))
+}
+
+func authorizeViewToken(r *http.Request, stream, token string) error {
+	signed, err := checkSignedURL(r, stream)
+	if err != nil {
+		return err
+	}
+	viewToken, err := checkViewToken(token, stream)
+	if err != nil {
+		return err
+	}
+	if signed || viewToken {
+		return nil
+	}
+	m := getMetadata(stream)
+	if m.Visibility == visibilityPrivate {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.AccessToken)) == 1 {
+			return nil
+		}
+	} else if settings.Viewing != "token" {
+		return nil
+	}
+	if accountsDB != nil && authorizeStream(currentAccount(r), stream, actionView) == nil {
+		return nil
+	}
+	if m.Visibility == visibilityPrivate {
+		return newSignalingError(http.StatusForbidden, "Stream is private")
+	}
+	return newSignalingError(http.StatusUnauthorized, "View token required")
+}
+
+// Entry of the live stream directory
+type streamListing struct {
+	Stream      string    `json:"stream"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
+	Viewers     int       `json:"viewers"`
+	Since       time.Time `json:"since"`
+	// Protocol the stream is published over, e.g. webrtc or rtmp
+	Protocol string `json:"protocol"`
+	// Seconds the current host has been publishing
+	Uptime float64           `json:"uptimeSeconds"`
+	Tracks []streamTrackInfo `json:"tracks"`
+}
+
+// Track of a listed stream's host. The frame size of VP8 video is that of
+// its last keyframe, a hint of the resolution viewers get.
+type streamTrackInfo struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Codec  string `json:"codec"`
+	RID    string `json:"rid,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// VP8 temporal layers, viewers can cap them with ?temporalLayer=
+	TemporalLayers int `json:"temporalLayers,omitempty"`
+}
+
+// Codec and frame size of the track as the directory page shows it
+func (t streamTrackInfo) String() string {
+	_, codec, _ := strings.Cut(t.Codec, "/")
+	if t.Width > 0 && t.Height > 0 {
+		return fmt.Sprintf("%s %dx%d", codec, t.Width, t.Height)
+	}
+	return codec
+}
+
+// Uptime as the directory page shows it
+func (l streamListing) Live() string {
+	return (time.Duration(l.Uptime) * time.Second).String()
+}
+
+// Streams with a publisher, only public ones unless the request comes from an admin
+func liveStreams(r *http.Request) []streamListing {
+	a := currentAccount(r)
+	all := a != nil && a.Admin
+
+	list := []streamListing{}
+	for _, room := range listRooms() {
+		p := room.getPublisher()
+		if p == nil {
+			continue
+		}
+		m := getMetadata(room.name)
+		if m.Visibility != visibilityPublic && !all {
+			continue
+		}
+		l := streamListing{
+			Stream:      room.name,
+			Title:       m.Title,
+			Description: m.Description,
+			Visibility:  m.Visibility,
+			Viewers:     len(room.getViewers()),
+			Since:       room.created,
+			Protocol:    p.protocol(),
+			Uptime:      time.Since(p.created).Seconds(),
+			Tracks:      []streamTrackInfo{},
+		}
+		for _, t := range p.getTracks() {
+			info := streamTrackInfo{ID: t.ID(), Kind: t.Kind().String(), Codec: t.Codec().MimeType, RID: t.RID()}
+			info.Width, info.Height = t.frameSize()
+			info.TemporalLayers = t.temporalLayerCount()
+			l.Tracks = append(l.Tracks, info)
+		}
+		sort.Slice(l.Tracks, func(i, j int) bool {
+			if l.Tracks[i].ID != l.Tracks[j].ID {
+				return l.Tracks[i].ID < l.Tracks[j].ID
+			}
+			return l.Tracks[i].RID < l.Tracks[j].RID
+		})
+		list = append(list, l)
+	}
+	return list
+}
+
+// Handler listing live streams as JSON
+func streamsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(liveStreams(r))
+}
+
+// Reply to a viewer asking for a stream that doesn't exist with those it
+// may pick from instead
+func streamNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(struct {
+		Error   string          `json:"error"`
+		Streams []streamListing `json:"streams"`
+	}{"No such stream", liveStreams(r)})
+}
+
+// Data of the live stream directory
+type browsePage struct {
+	pageData
+	Streams []streamListing
+}
+
+// Handler rendering the live stream directory
+func browseHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, tmpl, "browse.html", browsePage{newPageData(), liveStreams(r)})
+	}
+}
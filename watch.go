@@ -0,0 +1,65 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// Data of the stream page and its Open Graph and Twitter card tags
+type watchPage struct {
+	pageData
+	Stream      string
+	Title       string
+	Description string
+	URL         string
+	Image       string
+	Live        bool
+}
+
+// Base URL the request reached the server under, for the absolute links
+// link previews need
+func externalURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Handler for GET /watch/{stream}, the page of a stream that links shared
+// in chat apps preview with its title, description and thumbnail
+func watchHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := r.PathValue("stream")
+		if !streamNamePattern.MatchString(stream) {
+			http.Error(w, "Invalid stream name", http.StatusBadRequest)
+			return
+		}
+		// The page of a transfer code redeems it with the viewer's offer
+		if code := r.URL.Query().Get("transfer"); code == "" || pendingTransfer(code, stream) == nil {
+			if err := authorizeView(r, stream); err != nil {
+				writeSignalingError(w, err)
+				return
+			}
+		}
+
+		m := getMetadata(stream)
+		page := watchPage{pageData: newPageData(), Stream: stream, Title: m.Title, Description: m.Description, URL: externalURL(r) + r.URL.RequestURI()}
+		if page.Title == "" {
+			page.Title = stream
+		}
+		if room := getRoom(stream); room != nil && room.getPublisher() != nil {
+			page.Live = true
+		}
+		if _, err := streamThumbnail(stream); err == nil {
+			image := externalURL(r) + "/api/streams/" + url.PathEscape(stream) + "/thumbnail.jpg"
+			if query := viewQuery(r); query != "" {
+				image += "?" + query
+			}
+			page.Image = image
+		}
+
+		renderPage(w, r, tmpl, "watch.html", page)
+	}
+}
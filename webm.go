@@ -0,0 +1,153 @@
+package main
+
+import (
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Packets a sample builder waits for a late packet before giving up on it
+const webmMaxLate = 128
+
+// Muxes a VP8 and an Opus track of a publisher into one WebM file. The file
+// is created on the first video keyframe, which carries the frame size, and
+// audio before it is dropped so both tracks start together.
+type webmWriter struct {
+	// Name of the file in media storage
+	name     string
+	videoKey string
+	audioKey string
+
+	videoBuilder *samplebuilder.SampleBuilder
+	audioBuilder *samplebuilder.SampleBuilder
+	video        webm.BlockWriteCloser
+	audio        webm.BlockWriteCloser
+	videoTS      time.Duration
+	audioTS      time.Duration
+	started      bool
+}
+
+// Writer for the tracks with the given keys, either may be empty
+func newWebMWriter(name, videoKey, audioKey string) *webmWriter {
+	w := &webmWriter{name: name, videoKey: videoKey, audioKey: audioKey}
+	if videoKey != "" {
+		w.videoBuilder = samplebuilder.New(webmMaxLate, &codecs.VP8Packet{}, 90000)
+	}
+	if audioKey != "" {
+		w.audioBuilder = samplebuilder.New(webmMaxLate, &codecs.OpusPacket{}, 48000)
+	}
+	return w
+}
+
+// Create the file with its track entries
+func (w *webmWriter) init(width, height int) error {
+	f, err := media.create(w.name)
+	if err != nil {
+		return err
+	}
+
+	var tracks []webm.TrackEntry
+	if w.audioKey != "" {
+		tracks = append(tracks, webm.TrackEntry{
+			Name: "Audio", TrackNumber: uint64(len(tracks) + 1), TrackUID: uint64(len(tracks) + 1),
+			CodecID: "A_OPUS", TrackType: 2, DefaultDuration: 20000000,
+			Audio: &webm.Audio{SamplingFrequency: 48000, Channels: 2},
+		})
+	}
+	if w.videoKey != "" {
+		tracks = append(tracks, webm.TrackEntry{
+			Name: "Video", TrackNumber: uint64(len(tracks) + 1), TrackUID: uint64(len(tracks) + 1),
+			CodecID: "V_VP8", TrackType: 1, DefaultDuration: 33333333,
+			Video: &webm.Video{PixelWidth: uint64(width), PixelHeight: uint64(height)},
+		})
+	}
+
+	writers, err := webm.NewSimpleBlockWriter(f, tracks)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if w.audioKey != "" {
+		w.audio, writers = writers[0], writers[1:]
+	}
+	if w.videoKey != "" {
+		w.video = writers[0]
+	}
+	w.started = true
+	return nil
+}
+
+// Add a packet of one of the muxed tracks, packets of other tracks are
+// ignored
+func (w *webmWriter) writeRTP(key string, packet *rtp.Packet) error {
+	switch key {
+	case w.videoKey:
+		return w.writeVideo(packet)
+	case w.audioKey:
+		return w.writeAudio(packet)
+	}
+	return nil
+}
+
+func (w *webmWriter) writeVideo(packet *rtp.Packet) error {
+	w.videoBuilder.Push(packet)
+	for sample := w.videoBuilder.Pop(); sample != nil; sample = w.videoBuilder.Pop() {
+		if len(sample.Data) == 0 {
+			continue
+		}
+		// Inverse key frame flag of the VP8 frame tag, keyframes have the
+		// frame size after the start code
+		keyframe := sample.Data[0]&0x01 == 0
+		if keyframe && !w.started && len(sample.Data) >= 10 {
+			raw := uint(sample.Data[6]) | uint(sample.Data[7])<<8 | uint(sample.Data[8])<<16 | uint(sample.Data[9])<<24
+			if err := w.init(int(raw&0x3FFF), int((raw>>16)&0x3FFF)); err != nil {
+				return err
+			}
+		}
+		if !w.started {
+			continue
+		}
+		if _, err := w.video.Write(keyframe, int64(w.videoTS/time.Millisecond), sample.Data); err != nil {
+			return err
+		}
+		w.videoTS += sample.Duration
+	}
+	return nil
+}
+
+func (w *webmWriter) writeAudio(packet *rtp.Packet) error {
+	// Without video there is no frame size to wait for
+	if w.videoKey == "" && !w.started {
+		if err := w.init(0, 0); err != nil {
+			return err
+		}
+	}
+
+	w.audioBuilder.Push(packet)
+	for sample := w.audioBuilder.Pop(); sample != nil; sample = w.audioBuilder.Pop() {
+		if !w.started {
+			continue
+		}
+		if _, err := w.audio.Write(true, int64(w.audioTS/time.Millisecond), sample.Data); err != nil {
+			return err
+		}
+		w.audioTS += sample.Duration
+	}
+	return nil
+}
+
+func (w *webmWriter) Close() error {
+	var err error
+	for _, bw := range []webm.BlockWriteCloser{w.audio, w.video} {
+		if bw == nil {
+			continue
+		}
+		if closeErr := bw.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+var upgrader = websocket.Upgrader{}
+
+var wsLog = newLogger("ws")
+
+// Message exchanged over the /ws signaling socket
+type signalMessage struct {
+	Type       string                     `json:"type"`
+	Role       string                     `json:"role,omitempty"`
+	Stream     string                     `json:"stream,omitempty"`
+	ID         string                     `json:"id,omitempty"`
+	Token      string                     `json:"token,omitempty"`
+	Kind       string                     `json:"kind,omitempty"`
+	Transfer   string                     `json:"transfer,omitempty"`
+	Secret     string                     `json:"secret,omitempty"`
+	Key        string                     `json:"key,omitempty"`
+	To         string                     `json:"to,omitempty"`
+	From       string                     `json:"from,omitempty"`
+	Peers      []string                   `json:"peers,omitempty"`
+	Migrated   bool                       `json:"migrated,omitempty"`
+	SDP        *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate  *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+	Reason     string                     `json:"reason,omitempty"`
+	Result     *bandwidthResult           `json:"result,omitempty"`
+	DataResult *dataTestResult            `json:"dataResult,omitempty"`
+}
+
+// Signaling socket for one publisher or viewer. The client sends
+// {"type":"offer","role":"publisher|viewer|bandwidth-test|data-test","stream":"name","sdp":{...}} and
+// gets the answer with its peer ID and secret back, then both sides trickle {"type":"candidate"} messages until
+// {"type":"end-of-candidates"}. Publishers and viewers may send another offer later, e.g. to add a
+// screen share, and viewers get one when the publisher adds a track, answered with {"type":"answer"}.
+type wsSession struct {
+	conn    *websocket.Conn
+	request *http.Request
+	account *account
+	role    string
+	peer    *peer
+	// Logs of the socket, with the correlation ID of its upgrade request
+	log moduleLogger
+
+	// Mesh room the socket joined instead of sending an offer
+	mesh   *meshRoom
+	meshID string
+
+	// Candidates gathered before the answer went out are held back so the
+	// client never sees a candidate before its remote description
+	writeMu  sync.Mutex
+	answered bool
+	held     []signalMessage
+}
+
+// Handler for WebSocket signaling
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if services.isStopping() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		wsLog.forRequest(r).errorf("Error upgrading connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	s := &wsSession{conn: conn, request: r, account: currentAccount(r), log: wsLog.forRequest(r)}
+	s.log.debugf("Signaling socket opened from %v", r.RemoteAddr)
+
+	wsSessionsMu.Lock()
+	wsSessions[s] = true
+	wsSessionsMu.Unlock()
+	defer func() {
+		wsSessionsMu.Lock()
+		delete(wsSessions, s)
+		wsSessionsMu.Unlock()
+	}()
+	for {
+		var msg signalMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.log.errorf("Error reading message: %v", err)
+			}
+			break
+		}
+		s.handle(msg)
+	}
+	s.leaveMesh()
+
+	s.log.debugf("Signaling socket closed (role %q).", s.role)
+}
+
+func (s *wsSession) send(msg signalMessage) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.write(msg)
+}
+
+// Must be called with writeMu held
+func (s *wsSession) write(msg signalMessage) {
+	if err := s.conn.WriteJSON(msg); err != nil {
+		s.log.errorf("Error writing message: %v", err)
+	}
+}
+
+// Peer the socket negotiated, nil until its answer went out
+func (s *wsSession) currentPeer() *peer {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.answered {
+		return nil
+	}
+	return s.peer
+}
+
+func (s *wsSession) sendError(message string) {
+	s.send(signalMessage{Type: "error", Error: message})
+}
+
+// Forward locally gathered candidates to the client
+func (s *wsSession) onCandidate(c *webrtc.ICECandidate) {
+	msg := signalMessage{Type: "end-of-candidates"}
+	if c != nil {
+		init := c.ToJSON()
+		msg = signalMessage{Type: "candidate", Candidate: &init}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if !s.answered {
+		s.held = append(s.held, msg)
+		return
+	}
+	s.write(msg)
+}
+
+func (s *wsSession) handle(msg signalMessage) {
+	switch msg.Type {
+	case "offer":
+		if p := s.currentPeer(); p != nil && (s.role == "publisher" || s.role == "viewer") {
+			s.renegotiate(p, msg)
+			return
+		}
+		s.handleOffer(msg)
+
+	case "answer":
+		p := s.currentPeer()
+		if p == nil || msg.SDP == nil {
+			s.sendError("Answer received before offer")
+			return
+		}
+		s.renegotiate(p, msg)
+
+	case "candidate":
+		if msg.Candidate == nil {
+			s.sendError("Invalid ICE candidate")
+			return
+		}
+
+		if s.peer == nil {
+			s.sendError("Candidate received before offer")
+			return
+		}
+
+		err := s.peer.addRemoteCandidate(*msg.Candidate)
+		if err != nil {
+			s.log.withStream(s.peer.stream).withPeer(s.peer.id).errorf("Error adding ICE candidate: %v", err)
+			s.sendError("Failed to add ICE candidate")
+		}
+
+	case "end-of-candidates":
+		// Nothing to do, pion does not need an explicit end marker
+
+	case "join-mesh":
+		stream := msg.Stream
+		if stream == "" {
+			stream = defaultStream
+		}
+		if !streamNamePattern.MatchString(stream) {
+			s.sendError("Invalid stream name")
+			return
+		}
+		s.joinMesh(stream)
+
+	case "mesh-signal":
+		s.relayMesh(msg)
+
+	default:
+		s.sendError("Unknown message type " + msg.Type)
+	}
+}
+
+// Check the socket's account, publish token and stream key for publishing
+// to the stream. The token and key of the offer take precedence over those
+// of the socket's URL. Returns the key and the account publishing, which is
+// the key's user when the socket isn't logged in.
+func (s *wsSession) authorizePublish(stream, token, key string) (*streamKey, *account, error) {
+	if token == "" {
+		token = publishToken(s.request)
+	}
+	if key == "" {
+		key = streamKeyParam(s.request)
+	}
+	return authorizePublisher(token, key, stream, s.account)
+}
+
+// Answer a new offer of the socket's publisher or viewer, or apply its
+// answer to the server's offer
+func (s *wsSession) renegotiate(p *peer, msg signalMessage) {
+	if msg.SDP == nil {
+		s.sendError("Invalid offer")
+		return
+	}
+	answer, err := renegotiatePeer(p, *msg.SDP)
+	if err != nil {
+		s.sendError(err.Error())
+		return
+	}
+	if answer != nil {
+		s.send(signalMessage{Type: "answer", ID: p.id, Stream: p.stream, SDP: answer})
+	}
+}
+
+func (s *wsSession) handleOffer(msg signalMessage) {
+	if s.role != "" || s.mesh != nil {
+		s.sendError("Offer already received on this socket")
+		return
+	}
+	if msg.SDP == nil {
+		s.sendError("Invalid offer")
+		return
+	}
+
+	stream := msg.Stream
+	if stream == "" {
+		stream = defaultStream
+	}
+	if !streamNamePattern.MatchString(stream) {
+		s.sendError("Invalid stream name")
+		return
+	}
+
+	var answer *webrtc.SessionDescription
+	var err error
+	switch msg.Role {
+	case "publisher":
+		s.log.withStream(stream).infof("Publisher connection initiated.")
+		var key *streamKey
+		var owner *account
+		if key, owner, err = s.authorizePublish(stream, msg.Token, msg.Key); err != nil {
+			break
+		}
+		var dataOnly, cohost bool
+		if dataOnly, err = parseDataOnly(s.request); err != nil {
+			break
+		}
+		if cohost, err = parseCohost(s.request); err != nil {
+			break
+		}
+		var rtcp rtcpSettings
+		if rtcp, err = parseRTCPSettings(s.request, publisherRTCP); err != nil {
+			break
+		}
+		var overrides peerOverrides
+		if overrides, err = parsePeerOverrides(s.request, "publisher"); err != nil {
+			break
+		}
+		var publisher *Publisher
+		publisher, answer, err = negotiatePublisher(requestID(s.request), stream, owner, *msg.SDP, dataOnly, cohost, rtcp, overrides, s.onCandidate)
+		if err == nil {
+			s.peer = publisher.peer
+			trackStreamKey(key, stream, publisher)
+		}
+	case "viewer":
+		s.log.withStream(stream).infof("Viewer connection initiated.")
+		var transferred *Viewer
+		a := s.account
+		if msg.Transfer != "" {
+			if transferred, err = redeemTransfer(msg.Transfer, stream); err != nil {
+				break
+			}
+			a = transferred.account
+		} else if err = authorizeViewToken(s.request, stream, msg.Token); err != nil {
+			break
+		}
+		var overrides peerOverrides
+		if overrides, err = parsePeerOverrides(s.request, "viewer"); err != nil {
+			break
+		}
+		var trackWait time.Duration
+		if trackWait, err = parseTrackWait(s.request); err != nil {
+			break
+		}
+		var rtcp rtcpSettings
+		if rtcp, err = parseRTCPSettings(s.request, viewerRTCP); err != nil {
+			break
+		}
+		var decimation int
+		if decimation, err = parseDecimation(s.request); err != nil {
+			break
+		}
+		var temporalLayer int
+		if temporalLayer, err = parseTemporalLayer(s.request); err != nil {
+			break
+		}
+		if err = admitViewer(s.request.Context(), stream); err != nil {
+			break
+		}
+		waitForTracks(s.request.Context(), stream, trackWait)
+		var viewer *Viewer
+		viewer, answer, err = negotiateViewer(requestID(s.request), stream, a, *msg.SDP, overrides, rtcp, s.onCandidate)
+		if err == nil {
+			s.peer = viewer.peer
+			if transferred != nil {
+				viewer.takeOver(transferred)
+			} else {
+				viewer.setIdentity(viewerIdentity{token: msg.Token})
+			}
+			if decimation > 1 {
+				viewer.setDecimation(decimation)
+			}
+			if temporalLayer >= 0 {
+				viewer.setTemporalLayer(temporalLayer)
+			}
+		}
+	case "bandwidth-test":
+		if _, _, err = s.authorizePublish(stream, msg.Token, msg.Key); err != nil {
+			break
+		}
+		var duration time.Duration
+		if duration, err = parseBandwidthTestDuration(s.request); err != nil {
+			break
+		}
+		onResult := func(res bandwidthResult) {
+			s.send(signalMessage{Type: "bandwidth-result", Stream: stream, Result: &res})
+		}
+		s.peer, answer, err = negotiateBandwidthTest(requestID(s.request), stream, *msg.SDP, duration, s.onCandidate, onResult)
+	case "data-test":
+		var duration time.Duration
+		if duration, err = parseDataTestDuration(s.request); err != nil {
+			break
+		}
+		onResult := func(res dataTestResult) {
+			s.send(signalMessage{Type: "data-test-result", DataResult: &res})
+		}
+		s.peer, answer, err = negotiateDataTest(requestID(s.request), *msg.SDP, duration, s.onCandidate, onResult)
+	case "monitor":
+		if !isAdmin(s.account) {
+			err = newSignalingError(http.StatusForbidden, "Admin access required")
+			break
+		}
+		s.peer, answer, err = negotiateMonitor(requestID(s.request), *msg.SDP, s.onCandidate)
+	default:
+		s.sendError("Unknown role " + msg.Role)
+		return
+	}
+	if err != nil {
+		s.sendError(err.Error())
+		return
+	}
+
+	s.role = msg.Role
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.write(signalMessage{Type: "answer", ID: s.peer.id, Secret: s.peer.secret, Stream: stream, SDP: answer})
+	for _, held := range s.held {
+		s.write(held)
+	}
+	s.held = nil
+	s.answered = true
+}